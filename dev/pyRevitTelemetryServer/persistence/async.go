@@ -0,0 +1,255 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"../cli"
+	"github.com/pkg/errors"
+)
+
+// behavior of writes when the async queue is full
+// OverflowBlock waits for room until the write context is done
+// OverflowDropOldest discards the longest queued records to make room
+// OverflowDropNewest rejects the records that do not fit
+// OverflowDrop is the older name of OverflowDropNewest
+const (
+	OverflowBlock      = "block"
+	OverflowDropOldest = "drop-oldest"
+	OverflowDropNewest = "drop-newest"
+	OverflowDrop       = "drop"
+)
+
+func isAsyncOverflow(overflow string) bool {
+	switch overflow {
+	case OverflowBlock, OverflowDropOldest, OverflowDropNewest, OverflowDrop:
+		return true
+	}
+	return false
+}
+
+const (
+	DefaultAsyncBatchSize     = 100
+	DefaultAsyncFlushInterval = time.Second
+)
+
+var ErrQueueFull = errors.New("write queue is full")
+
+// records are queued with the logger of the request that sent them
+type queuedRecord struct {
+	logrec TelemetryRecord
+	logger *cli.Logger
+}
+
+// queues writes and flushes them in batches from a background goroutine
+type AsyncConnection struct {
+	Connection
+	QueueSize     int
+	BatchSize     int
+	FlushInterval time.Duration
+	Overflow      string
+
+	config *Config
+	queue  chan queuedRecord
+	done   chan struct{}
+
+	// guards closing the queue against concurrent writes
+	mutex  sync.RWMutex
+	closed bool
+}
+
+func NewAsyncConnection(conn Connection, dbcfg *Config) (*AsyncConnection, error) {
+	overflow := dbcfg.AsyncOverflow
+	if overflow == "" {
+		overflow = OverflowBlock
+	}
+	if !isAsyncOverflow(overflow) {
+		return nil, errors.Errorf("unknown async overflow %q", overflow)
+	}
+	if overflow == OverflowDrop {
+		overflow = OverflowDropNewest
+	}
+
+	batchSize := dbcfg.AsyncBatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultAsyncBatchSize
+	}
+	flushInterval := dbcfg.AsyncFlushInterval
+	if flushInterval <= 0 {
+		flushInterval = DefaultAsyncFlushInterval
+	}
+
+	w := &AsyncConnection{
+		Connection:    conn,
+		QueueSize:     dbcfg.AsyncQueueSize,
+		BatchSize:     batchSize,
+		FlushInterval: flushInterval,
+		Overflow:      overflow,
+		config:        dbcfg,
+		queue:         make(chan queuedRecord, dbcfg.AsyncQueueSize),
+		done:          make(chan struct{}),
+	}
+	go w.flushLoop()
+	return w, nil
+}
+
+func (w *AsyncConnection) Write(ctx context.Context, logrec TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.WriteBatch(ctx, []TelemetryRecord{logrec}, logger)
+}
+
+// records are accepted into the queue and written on the next flush,
+// Dropped counts the records discarded under the overflow policy
+func (w *AsyncConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	if w.closed {
+		return nil, ErrClosed
+	}
+
+	if len(logrecs) == 0 {
+		return &Result{
+			ResultCode: ResultNoData,
+			Message:    "no data to write",
+		}, nil
+	}
+
+	queued := 0
+	dropped := 0
+	for _, logrec := range logrecs {
+		item := queuedRecord{logrec, logger}
+		switch w.Overflow {
+		case OverflowDropOldest:
+			dropped += w.enqueueDroppingOldest(item)
+			queued++
+			continue
+
+		case OverflowDropNewest:
+			select {
+			case w.queue <- item:
+				queued++
+				continue
+			default:
+			}
+			return &Result{
+				ResultCode: ResultQueueFull,
+				Queued:     queued,
+				Dropped:    len(logrecs) - queued,
+				Message:    fmt.Sprintf("queue is full, dropped %d of %d usage records", len(logrecs)-queued, len(logrecs)),
+			}, ErrQueueFull
+		}
+
+		// blocking writes wait for room no longer than the context allows
+		select {
+		case w.queue <- item:
+			queued++
+		case <-ctx.Done():
+			return &Result{
+				ResultCode: ResultQueueBusy,
+				Queued:     queued,
+				Message:    fmt.Sprintf("queue is busy, queued %d of %d usage records", queued, len(logrecs)),
+			}, wrapContextError(ctx, ctx.Err())
+		}
+	}
+
+	if dropped > 0 {
+		connectionLogger(w.Connection, logger).Debug("queue is full, dropped older usage records", "dropped", dropped)
+		return &Result{
+			Queued:  queued,
+			Dropped: dropped,
+			Message: fmt.Sprintf("queued %d usage records, dropped %d older", queued, dropped),
+		}, nil
+	}
+	return &Result{
+		Queued:  queued,
+		Message: fmt.Sprintf("queued %d usage records", queued),
+	}, nil
+}
+
+// makes room by taking the oldest records off the queue, the flush loop
+// may take them first. returns the number of records discarded
+func (w *AsyncConnection) enqueueDroppingOldest(item queuedRecord) int {
+	dropped := 0
+	for {
+		select {
+		case w.queue <- item:
+			return dropped
+		default:
+		}
+		select {
+		case <-w.queue:
+			dropped++
+		default:
+		}
+	}
+}
+
+// stops accepting writes, flushes the queue and closes the connection
+func (w *AsyncConnection) Close() error {
+	w.mutex.Lock()
+	if w.closed {
+		w.mutex.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.queue)
+	w.mutex.Unlock()
+
+	<-w.done
+	return w.Connection.Close()
+}
+
+func (w *AsyncConnection) flushLoop() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]queuedRecord, 0, w.BatchSize)
+	for {
+		select {
+		case item, ok := <-w.queue:
+			if !ok {
+				w.flush(batch)
+				return
+			}
+			batch = append(batch, item)
+			if len(batch) >= w.BatchSize {
+				w.flush(batch)
+				batch = make([]queuedRecord, 0, w.BatchSize)
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				w.flush(batch)
+				batch = make([]queuedRecord, 0, w.BatchSize)
+			}
+		}
+	}
+}
+
+// failed writes are logged with the logger of the first queued record
+func (w *AsyncConnection) flush(batch []queuedRecord) {
+	if len(batch) == 0 {
+		return
+	}
+
+	logrecs := make([]TelemetryRecord, 0, len(batch))
+	for _, item := range batch {
+		logrecs = append(logrecs, item.logrec)
+	}
+	logger := batch[0].logger
+
+	ctx, cancel := w.config.NewRequestContext(context.Background())
+	defer cancel()
+
+	result, err := w.Connection.WriteBatch(ctx, logrecs, logger)
+	if err != nil {
+		written := 0
+		if result != nil {
+			written = result.Written
+		}
+		connectionLogger(w.Connection, logger).Print(
+			"async write failed", "written", written, "records", len(logrecs), "error", err)
+	}
+}
@@ -0,0 +1,371 @@
+package persistence
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"../cli"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// memory backend whose writes wait until released, to fill the queue of
+// an async connection. records stay readable after Close
+type blockingConnection struct {
+	*MemoryConnection
+	started chan struct{}
+	release chan struct{}
+
+	// records of all write calls, repeated ones included
+	mutex   sync.Mutex
+	flushed int
+}
+
+func newBlockingConnection(t *testing.T) *blockingConnection {
+	memory := NewMemoryConnection(&Config{ScriptTarget: "scripts"})
+	t.Cleanup(func() { memory.Close() })
+	return &blockingConnection{
+		MemoryConnection: memory,
+		started:          make(chan struct{}, 64),
+		release:          make(chan struct{}),
+	}
+}
+
+func (w *blockingConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	w.started <- struct{}{}
+	<-w.release
+	w.mutex.Lock()
+	w.flushed += len(logrecs)
+	w.mutex.Unlock()
+	return w.MemoryConnection.WriteBatch(ctx, logrecs, logger)
+}
+
+func (w *blockingConnection) flushedCount() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.flushed
+}
+
+func (w *blockingConnection) Close() error {
+	return nil
+}
+
+// queue of one record with the flush loop stuck writing another
+func newSaturatedAsyncConnection(t *testing.T, overflow string) (*AsyncConnection, *blockingConnection) {
+	t.Helper()
+	inner := newBlockingConnection(t)
+	conn, err := NewAsyncConnection(inner, &Config{AsyncQueueSize: 1, AsyncBatchSize: 1, AsyncOverflow: overflow})
+	if err != nil {
+		t.Fatalf("creating async connection: %v", err)
+	}
+	t.Cleanup(func() {
+		select {
+		case <-inner.release:
+		default:
+			close(inner.release)
+		}
+		conn.Close()
+	})
+
+	writeTestRecords(t, conn, newTestScriptRecord("jane", "jane", "2021-06-01T10:00:00Z"))
+	<-inner.started
+	writeTestRecords(t, conn, newTestScriptRecord("jane", "jane", "2021-06-01T11:00:00Z"))
+	return conn, inner
+}
+
+func TestAsyncReportsQueuedRecords(t *testing.T) {
+	inner := newBlockingConnection(t)
+	close(inner.release)
+	conn, err := NewAsyncConnection(inner, &Config{AsyncQueueSize: 10, AsyncFlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("creating async connection: %v", err)
+	}
+
+	res, wErr := conn.WriteBatch(context.Background(), []TelemetryRecord{
+		newTestScriptRecord("jane", "jane", "2021-06-01T10:00:00Z"),
+		newTestScriptRecord("jane", "jane", "2021-06-01T11:00:00Z"),
+	}, testLogger)
+	if wErr != nil {
+		t.Fatalf("writing: %v", wErr)
+	}
+	if res.Queued != 2 || res.Written != 0 {
+		t.Errorf("queued %d and wrote %d records, want 2 queued and none written", res.Queued, res.Written)
+	}
+	if records := readTestRecords(t, inner.MemoryConnection, nil); len(records) != 0 {
+		t.Errorf("wrote %d records before the flush, want none", len(records))
+	}
+
+	// shutting down drains the queue
+	if cErr := conn.Close(); cErr != nil {
+		t.Fatalf("closing: %v", cErr)
+	}
+	if records := readTestRecords(t, inner.MemoryConnection, nil); len(records) != 2 {
+		t.Errorf("wrote %d records after closing, want 2", len(records))
+	}
+	if _, aErr := conn.Write(context.Background(), newTestScriptRecord("jane", "jane", "2021-06-01T12:00:00Z"), testLogger); aErr != ErrClosed {
+		t.Errorf("writing after closing returned %v, want ErrClosed", aErr)
+	}
+}
+
+func TestAsyncFlushesFullBatches(t *testing.T) {
+	inner := newBlockingConnection(t)
+	close(inner.release)
+	conn, err := NewAsyncConnection(inner, &Config{AsyncQueueSize: 10, AsyncBatchSize: 2, AsyncFlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("creating async connection: %v", err)
+	}
+	defer conn.Close()
+
+	writeTestRecords(t, conn,
+		newTestScriptRecord("jane", "jane", "2021-06-01T10:00:00Z"),
+		newTestScriptRecord("jane", "jane", "2021-06-01T11:00:00Z"))
+	select {
+	case <-inner.started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("full batch was not flushed")
+	}
+}
+
+func TestAsyncFlushesOnInterval(t *testing.T) {
+	inner := newBlockingConnection(t)
+	close(inner.release)
+	conn, err := NewAsyncConnection(inner, &Config{AsyncQueueSize: 10, AsyncBatchSize: 100, AsyncFlushInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("creating async connection: %v", err)
+	}
+	defer conn.Close()
+
+	writeTestRecords(t, conn, newTestScriptRecord("jane", "jane", "2021-06-01T10:00:00Z"))
+	select {
+	case <-inner.started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("partial batch was not flushed")
+	}
+}
+
+// records trickling in below the batch size are each flushed by the
+// ticker, within a few intervals of being queued
+func TestAsyncFlushesTrickle(t *testing.T) {
+	inner := newBlockingConnection(t)
+	close(inner.release)
+	interval := 20 * time.Millisecond
+	conn, err := NewAsyncConnection(inner, &Config{AsyncQueueSize: 10, AsyncBatchSize: 100, AsyncFlushInterval: interval})
+	if err != nil {
+		t.Fatalf("creating async connection: %v", err)
+	}
+	defer conn.Close()
+
+	for idx, ts := range []string{"2021-06-01T10:00:00Z", "2021-06-01T11:00:00Z", "2021-06-01T12:00:00Z"} {
+		writeTestRecords(t, conn, newTestScriptRecord("jane", "jane", ts))
+		queued := time.Now()
+		for inner.flushedCount() < idx+1 {
+			if time.Since(queued) > 10*interval {
+				t.Fatalf("record %d was not flushed within %s", idx, 10*interval)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if records := readTestRecords(t, inner.MemoryConnection, nil); len(records) != 3 {
+		t.Errorf("wrote %d records, want 3", len(records))
+	}
+}
+
+// a batch flushed by size is not flushed again by the ticker
+func TestAsyncFlushesEachRecordOnce(t *testing.T) {
+	inner := newBlockingConnection(t)
+	close(inner.release)
+	conn, err := NewAsyncConnection(inner, &Config{AsyncQueueSize: 100, AsyncBatchSize: 3, AsyncFlushInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("creating async connection: %v", err)
+	}
+
+	for idx := 0; idx < 20; idx++ {
+		ts := time.Date(2021, 6, 1, 10, idx, 0, 0, time.UTC).Format(time.RFC3339)
+		writeTestRecords(t, conn, newTestScriptRecord("jane", "jane", ts))
+		time.Sleep(time.Duration(idx%3) * time.Millisecond)
+	}
+	conn.Close()
+	if flushed := inner.flushedCount(); flushed != 20 {
+		t.Errorf("flushed %d records, want each of the 20 once", flushed)
+	}
+}
+
+// closing flushes the queue right away instead of waiting for the ticker
+func TestAsyncCloseFlushesImmediately(t *testing.T) {
+	inner := newBlockingConnection(t)
+	close(inner.release)
+	conn, err := NewAsyncConnection(inner, &Config{AsyncQueueSize: 10, AsyncBatchSize: 100, AsyncFlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("creating async connection: %v", err)
+	}
+	writeTestRecords(t, conn,
+		newTestScriptRecord("jane", "jane", "2021-06-01T10:00:00Z"),
+		newTestScriptRecord("jane", "jane", "2021-06-01T11:00:00Z"))
+
+	closed := make(chan error)
+	go func() { closed <- conn.Close() }()
+	select {
+	case cErr := <-closed:
+		if cErr != nil {
+			t.Fatalf("closing: %v", cErr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("closing waited for the flush interval")
+	}
+	if flushed := inner.flushedCount(); flushed != 2 {
+		t.Errorf("flushed %d records on close, want 2", flushed)
+	}
+}
+
+func TestAsyncBlockWaitsForTheContext(t *testing.T) {
+	conn, _ := newSaturatedAsyncConnection(t, OverflowBlock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	res, err := conn.Write(ctx, newTestScriptRecord("jane", "jane", "2021-06-01T12:00:00Z"), testLogger)
+	if err == nil || res.ResultCode != ResultQueueBusy {
+		t.Errorf("blocked write returned %v, want a busy result and an error", err)
+	}
+	if res.Queued != 0 {
+		t.Errorf("queued %d records, want none", res.Queued)
+	}
+}
+
+func TestAsyncBlockWaitsForRoom(t *testing.T) {
+	conn, inner := newSaturatedAsyncConnection(t, OverflowBlock)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(inner.release)
+	}()
+	res, err := conn.Write(context.Background(), newTestScriptRecord("jane", "jane", "2021-06-01T12:00:00Z"), testLogger)
+	if err != nil || res.Queued != 1 {
+		t.Errorf("blocked write returned %v and queued %d records, want 1 queued", err, res.Queued)
+	}
+}
+
+func TestAsyncDropRejectsRecordsThatDoNotFit(t *testing.T) {
+	conn, inner := newSaturatedAsyncConnection(t, OverflowDrop)
+
+	res, err := conn.WriteBatch(context.Background(), []TelemetryRecord{
+		newTestScriptRecord("jane", "jane", "2021-06-01T12:00:00Z"),
+		newTestScriptRecord("jane", "jane", "2021-06-01T13:00:00Z"),
+	}, testLogger)
+	if err != ErrQueueFull || res.ResultCode != ResultQueueFull {
+		t.Fatalf("overflowing write returned %v, want ErrQueueFull", err)
+	}
+	if res.Dropped != 2 || res.Queued != 0 {
+		t.Errorf("dropped %d and queued %d records, want 2 dropped", res.Dropped, res.Queued)
+	}
+
+	close(inner.release)
+	conn.Close()
+	if records := readTestRecords(t, inner.MemoryConnection, nil); len(records) != 2 {
+		t.Errorf("wrote %d records, want the 2 accepted", len(records))
+	}
+}
+
+func TestAsyncDropOldestMakesRoom(t *testing.T) {
+	conn, inner := newSaturatedAsyncConnection(t, OverflowDropOldest)
+
+	res, err := conn.WriteBatch(context.Background(), []TelemetryRecord{
+		newTestScriptRecord("jane", "jane", "2021-06-01T12:00:00Z"),
+		newTestScriptRecord("jane", "jane", "2021-06-01T13:00:00Z"),
+	}, testLogger)
+	if err != nil || res.ResultCode != ResultOK {
+		t.Fatalf("overflowing write returned %v with code %d, want no error", err, res.ResultCode)
+	}
+	if res.Dropped != 2 || res.Queued != 2 {
+		t.Errorf("dropped %d and queued %d records, want 2 of each", res.Dropped, res.Queued)
+	}
+
+	// the record being written and the newest one are left
+	close(inner.release)
+	conn.Close()
+	records := readTestRecords(t, inner.MemoryConnection, nil)
+	if len(records) != 2 {
+		t.Fatalf("wrote %d records, want 2", len(records))
+	}
+	for idx, want := range []string{"2021-06-01T10:00:00Z", "2021-06-01T13:00:00Z"} {
+		if ts := records[idx].GetTimeStamp().Format(time.RFC3339); ts != want {
+			t.Errorf("record %d is from %s, want %s", idx, ts, want)
+		}
+	}
+}
+
+func TestAsyncOverflowPolicies(t *testing.T) {
+	tests := []struct {
+		overflow string
+		want     string
+	}{
+		{"", OverflowBlock},
+		{OverflowBlock, OverflowBlock},
+		{OverflowDropOldest, OverflowDropOldest},
+		{OverflowDropNewest, OverflowDropNewest},
+		{OverflowDrop, OverflowDropNewest},
+	}
+	for _, test := range tests {
+		conn, err := NewAsyncConnection(NewMemoryConnection(&Config{}), &Config{AsyncOverflow: test.overflow})
+		if err != nil {
+			t.Fatalf("creating async connection with %q overflow: %v", test.overflow, err)
+		}
+		if conn.Overflow != test.want {
+			t.Errorf("overflow %q is %s, want %s", test.overflow, conn.Overflow, test.want)
+		}
+		conn.Close()
+	}
+
+	if _, err := NewAsyncConnection(NewMemoryConnection(&Config{}), &Config{AsyncOverflow: "wait"}); err == nil {
+		t.Error("unknown overflow passed")
+	}
+}
+
+// records dropped by either policy are counted by the metrics wrapper
+func TestAsyncDropsAreCounted(t *testing.T) {
+	for _, overflow := range []string{OverflowDropOldest, OverflowDropNewest} {
+		t.Run(overflow, func(t *testing.T) {
+			async, _ := newSaturatedAsyncConnection(t, overflow)
+			registry := prometheus.NewRegistry()
+			conn, err := NewMetricsConnection(async, registry)
+			if err != nil {
+				t.Fatalf("wrapping: %v", err)
+			}
+
+			conn.WriteBatch(context.Background(), []TelemetryRecord{
+				newTestScriptRecord("jane", "jane", "2021-06-01T12:00:00Z"),
+				newTestScriptRecord("jane", "jane", "2021-06-01T13:00:00Z"),
+			}, testLogger)
+			checkTestMetric(t, scrapeTestMetrics(t, registry), `pyrevit_telemetry_dropped_records_total{backend="memory"}`, "2")
+		})
+	}
+}
+
+func TestIdempotentDoesNotRememberQueuedWrites(t *testing.T) {
+	inner := newBlockingConnection(t)
+	close(inner.release)
+	async, err := NewAsyncConnection(inner, &Config{AsyncQueueSize: 10, AsyncFlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("creating async connection: %v", err)
+	}
+	conn := NewIdempotentConnection(async, &Config{IdempotencyTTL: time.Hour})
+	defer conn.Close()
+
+	ctx := WithIdempotencyKey(context.Background(), "request-1")
+	logrec := newTestScriptRecord("jane", "jane", "2021-06-01T10:00:00Z")
+	for attempt := 0; attempt < 2; attempt++ {
+		res, wErr := conn.Write(ctx, logrec, testLogger)
+		if wErr != nil {
+			t.Fatalf("writing: %v", wErr)
+		}
+		if res.Queued != 1 {
+			t.Errorf("attempt %d queued %d records, want 1", attempt, res.Queued)
+		}
+	}
+
+	// both attempts are queued, the record id keeps it from being written twice
+	conn.Close()
+	if records := readTestRecords(t, inner.MemoryConnection, nil); len(records) != 1 {
+		t.Errorf("wrote %d records, want 1", len(records))
+	}
+}
@@ -0,0 +1,294 @@
+package persistence
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"../cli"
+	"cloud.google.com/go/bigquery"
+	"github.com/pkg/errors"
+	"google.golang.org/api/option"
+)
+
+type bigqueryScriptRowV2 struct {
+	TimeStamp         time.Time `bigquery:"timestamp"`
+	UserName          string    `bigquery:"username"`
+	HostUserName      string    `bigquery:"host_user"`
+	RevitVersion      string    `bigquery:"revit"`
+	RevitBuild        string    `bigquery:"revitbuild"`
+	SessionId         string    `bigquery:"sessionid"`
+	PyRevitVersion    string    `bigquery:"pyrevit"`
+	Clone             string    `bigquery:"clone"`
+	IsDebugMode       bool      `bigquery:"debug"`
+	IsConfigMode      bool      `bigquery:"config"`
+	IsExecFromGUI     bool      `bigquery:"from_gui"`
+	ExecId            string    `bigquery:"exec_id"`
+	ExecTimeStamp     string    `bigquery:"exec_timestamp"`
+	CommandName       string    `bigquery:"commandname"`
+	CommandUniqueName string    `bigquery:"commanduniquename"`
+	BundleName        string    `bigquery:"commandbundle"`
+	ExtensionName     string    `bigquery:"commandextension"`
+	DocumentName      string    `bigquery:"docname"`
+	DocumentPath      string    `bigquery:"docpath"`
+	ResultCode        int       `bigquery:"resultcode"`
+	CommandResults    string    `bigquery:"commandresults"`
+	ScriptPath        string    `bigquery:"scriptpath"`
+	EngineType        string    `bigquery:"engine_type"`
+	EngineVersion     string    `bigquery:"engine_version"`
+	EngineSysPaths    []string  `bigquery:"engine_syspath"`
+	EngineConfigs     string    `bigquery:"engine_configs"`
+	TraceMessage      string    `bigquery:"trace_message"`
+}
+
+type bigqueryEventRowV2 struct {
+	TimeStamp        time.Time `bigquery:"timestamp"`
+	HandlerId        string    `bigquery:"handler_id"`
+	EventType        string    `bigquery:"type"`
+	EventArgs        string    `bigquery:"args"`
+	UserName         string    `bigquery:"username"`
+	HostUserName     string    `bigquery:"host_user"`
+	RevitVersion     string    `bigquery:"revit"`
+	RevitBuild       string    `bigquery:"revitbuild"`
+	Cancellable      bool      `bigquery:"cancellable"`
+	Cancelled        bool      `bigquery:"cancelled"`
+	DocumentId       int       `bigquery:"docid"`
+	DocumentType     string    `bigquery:"doctype"`
+	DocumentTemplate string    `bigquery:"doctemplate"`
+	DocumentName     string    `bigquery:"docname"`
+	DocumentPath     string    `bigquery:"docpath"`
+	ProjectNumber    string    `bigquery:"projectnum"`
+	ProjectName      string    `bigquery:"projectname"`
+}
+
+type BigQueryConnection struct {
+	DatabaseConnection
+	client  *bigquery.Client
+	dataset *bigquery.Dataset
+}
+
+func newBigQueryConnection(w DatabaseConnection) (*BigQueryConnection, error) {
+	// bigquery:project/dataset
+	parts := strings.Split(strings.Replace(w.Config.ConnString, string(BigQuery)+":", "", 1), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, errors.New("bigquery backend requires project/dataset")
+	}
+
+	// falls back to GOOGLE_APPLICATION_CREDENTIALS when not set
+	opts := make([]option.ClientOption, 0)
+	if w.Config.BigQueryCredentials != "" {
+		opts = append(opts, option.WithCredentialsFile(w.Config.BigQueryCredentials))
+	}
+
+	client, err := bigquery.NewClient(context.Background(), parts[0], opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &BigQueryConnection{
+		DatabaseConnection: w,
+		client:             client,
+		dataset:            client.Dataset(parts[1]),
+	}, nil
+}
+
+func (w *BigQueryConnection) GetType() DBBackend {
+	return w.Config.Backend
+}
+
+func (w *BigQueryConnection) GetVersion(logger *cli.Logger) string {
+	return "bigquery"
+}
+
+func (w *BigQueryConnection) GetStatus(logger *cli.Logger) ConnectionStatus {
+	return newConnectionStatus(w.Ping(context.Background()), w.GetVersion(logger))
+}
+
+func (w *BigQueryConnection) Ping(ctx context.Context) error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+	defer w.end()
+
+	pingCtx, cancel := w.Config.newPingContext(ctx)
+	defer cancel()
+
+	_, err := w.dataset.Metadata(pingCtx)
+	return wrapContextError(pingCtx, err)
+}
+
+func (w *BigQueryConnection) Write(ctx context.Context, logrec TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.WriteBatch(ctx, []TelemetryRecord{logrec}, logger)
+}
+
+func (w *BigQueryConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	log := w.Config.structured(logger)
+
+	if len(logrecs) == 0 {
+		return &Result{
+			ResultCode: ResultNoData,
+			Message:    "no data to write",
+		}, nil
+	}
+
+	// group rows by target table, keeping order
+	log.Debug("grouping records by target table")
+	tables := make([]string, 0)
+	rows := make(map[string][]*bigquery.StructSaver)
+	for _, logrec := range logrecs {
+		row, rErr := generateBigQueryRow(logrec, log)
+		if rErr != nil {
+			return nil, rErr
+		}
+
+		table := w.Config.targetFor(logrec)
+		if _, exists := rows[table]; !exists {
+			tables = append(tables, table)
+		}
+		rows[table] = append(rows[table], row)
+	}
+
+	written := 0
+	for _, table := range tables {
+		log.Debug("streaming rows", "table", table)
+		pErr := w.dataset.Table(table).Inserter().Put(ctx, rows[table])
+		if pErr == nil {
+			written += len(rows[table])
+			continue
+		}
+
+		// rows not listed in the multi error were inserted
+		if multiErr, ok := pErr.(bigquery.PutMultiError); ok {
+			written += len(rows[table]) - len(multiErr)
+			return &Result{
+				Written: written,
+				Message: fmt.Sprintf(
+					"inserted %d of %d usage records: %s",
+					written, len(logrecs), formatPutMultiError(multiErr)),
+			}, pErr
+		}
+		return &Result{
+			Written: written,
+			Message: fmt.Sprintf("inserted %d of %d usage records", written, len(logrecs)),
+		}, wrapContextError(ctx, pErr)
+	}
+
+	log.Debug("preparing report")
+	return &Result{
+		Written: written,
+		Message: fmt.Sprintf("successfully inserted %d usage records", written),
+	}, nil
+}
+
+func (w *BigQueryConnection) Close() error {
+	if !w.drain() {
+		return nil
+	}
+	return w.client.Close()
+}
+
+// insert ids let bigquery drop rows duplicated by retried requests
+func generateBigQueryRow(logrec TelemetryRecord, log *structuredLogger) (*bigquery.StructSaver, error) {
+	insertId, idErr := newRecordId(logrec)
+	if idErr != nil {
+		return nil, idErr
+	}
+
+	switch rec := logrec.(type) {
+	case *ScriptTelemetryRecordV2:
+		// marshal json data
+		engineCfgs, merr := json.Marshal(rec.TraceInfo.EngineInfo.Configs)
+		if merr != nil {
+			log.Debug("error logging engine configs")
+		}
+		cresults, merr := json.Marshal(rec.CommandResults)
+		if merr != nil {
+			log.Debug("error logging command results")
+		}
+
+		return &bigquery.StructSaver{
+			InsertID: insertId,
+			Struct: &bigqueryScriptRowV2{
+				TimeStamp:         rec.GetTimeStamp(),
+				UserName:          rec.UserName,
+				HostUserName:      rec.HostUserName,
+				RevitVersion:      rec.RevitVersion,
+				RevitBuild:        rec.RevitBuild,
+				SessionId:         rec.SessionId,
+				PyRevitVersion:    rec.PyRevitVersion,
+				Clone:             rec.Clone,
+				IsDebugMode:       rec.IsDebugMode,
+				IsConfigMode:      rec.IsConfigMode,
+				IsExecFromGUI:     rec.IsExecFromGUI,
+				ExecId:            rec.ExecId,
+				ExecTimeStamp:     rec.ExecTimeStamp,
+				CommandName:       rec.CommandName,
+				CommandUniqueName: rec.CommandUniqueName,
+				BundleName:        rec.BundleName,
+				ExtensionName:     rec.ExtensionName,
+				DocumentName:      rec.DocumentName,
+				DocumentPath:      rec.DocumentPath,
+				ResultCode:        rec.ResultCode,
+				CommandResults:    string(cresults),
+				ScriptPath:        rec.ScriptPath,
+				EngineType:        rec.TraceInfo.EngineInfo.Type,
+				EngineVersion:     rec.TraceInfo.EngineInfo.Version,
+				EngineSysPaths:    rec.TraceInfo.EngineInfo.SysPaths,
+				EngineConfigs:     string(engineCfgs),
+				TraceMessage:      rec.TraceInfo.Message,
+			},
+		}, nil
+
+	case *EventTelemetryRecordV2:
+		// marshal json data
+		eventArgs, merr := json.Marshal(rec.EventArgs)
+		if merr != nil {
+			log.Debug("error logging event args")
+		}
+
+		return &bigquery.StructSaver{
+			InsertID: insertId,
+			Struct: &bigqueryEventRowV2{
+				TimeStamp:        rec.GetTimeStamp(),
+				HandlerId:        rec.HandlerId,
+				EventType:        rec.EventType,
+				EventArgs:        string(eventArgs),
+				UserName:         rec.UserName,
+				HostUserName:     rec.HostUserName,
+				RevitVersion:     rec.RevitVersion,
+				RevitBuild:       rec.RevitBuild,
+				Cancellable:      rec.Cancellable,
+				Cancelled:        rec.Cancelled,
+				DocumentId:       rec.DocumentId,
+				DocumentType:     rec.DocumentType,
+				DocumentTemplate: rec.DocumentTemplate,
+				DocumentName:     rec.DocumentName,
+				DocumentPath:     rec.DocumentPath,
+				ProjectNumber:    rec.ProjectNumber,
+				ProjectName:      rec.ProjectName,
+			},
+		}, nil
+
+	default:
+		return nil, errors.New("only schema v2 records are supported by bigquery backend")
+	}
+}
+
+// lists failed row indexes with their first reason
+func formatPutMultiError(multiErr bigquery.PutMultiError) string {
+	failures := make([]string, 0, len(multiErr))
+	for _, rowErr := range multiErr {
+		reason := "unknown error"
+		if len(rowErr.Errors) > 0 {
+			reason = rowErr.Errors[0].Error()
+		}
+		failures = append(failures, fmt.Sprintf("row %d: %s", rowErr.RowIndex, reason))
+	}
+	return strings.Join(failures, "; ")
+}
@@ -0,0 +1,312 @@
+package persistence
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"../cli"
+	"github.com/gocql/gocql"
+	"github.com/pkg/errors"
+)
+
+const DefaultCassandraConsistency = "QUORUM"
+
+// upper bound of concurrent partition writes per batch
+const cassandraMaxConcurrency = 16
+
+const cassandraTable = `CREATE TABLE IF NOT EXISTS %s (
+	host text,
+	day text,
+	timestamp timestamp,
+	id timeuuid,
+	username text,
+	revit text,
+	record text,
+	PRIMARY KEY ((host, day), timestamp, id)
+) WITH CLUSTERING ORDER BY (timestamp DESC, id DESC)`
+
+const cassandraInsert = `INSERT INTO %s (host, day, timestamp, id, username, revit, record) VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+type CassandraConnection struct {
+	DatabaseConnection
+	session *gocql.Session
+
+	// tables are created on first write, retried until it succeeds
+	migrateMutex sync.Mutex
+	migrated     bool
+}
+
+// records sharing a partition are written together
+type cassandraPartition struct {
+	table string
+	host  string
+	day   string
+	rows  [][]interface{}
+}
+
+func newCassandraConnection(w DatabaseConnection) (*CassandraConnection, error) {
+	if err := w.Config.validateTargets(sqlTargetPattern); err != nil {
+		return nil, err
+	}
+
+	cluster, err := generateCassandraCluster(w.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	session, sErr := cluster.CreateSession()
+	if sErr != nil {
+		return nil, sErr
+	}
+	return &CassandraConnection{DatabaseConnection: w, session: session}, nil
+}
+
+// cassandra://host1,host2:9042/keyspace
+func generateCassandraCluster(dbcfg *Config) (*gocql.ClusterConfig, error) {
+	cassUrl, err := url.Parse(dbcfg.ConnString)
+	if err != nil {
+		return nil, err
+	}
+	keyspace := strings.Trim(cassUrl.Path, "/")
+	if cassUrl.Host == "" || keyspace == "" {
+		return nil, errors.New("cassandra backend requires hosts and keyspace")
+	}
+
+	consistency, cErr := parseCassandraConsistency(dbcfg.CassandraConsistency)
+	if cErr != nil {
+		return nil, cErr
+	}
+
+	cluster := gocql.NewCluster(strings.Split(cassUrl.Host, ",")...)
+	cluster.Keyspace = keyspace
+	cluster.Consistency = consistency
+	if password, exists := cassUrl.User.Password(); exists {
+		cluster.Authenticator = gocql.PasswordAuthenticator{
+			Username: cassUrl.User.Username(),
+			Password: password,
+		}
+	}
+	return cluster, nil
+}
+
+// consistency of every query of the session, QUORUM when empty.
+// ONE answers as soon as a single replica stores the write and is the
+// fastest, QUORUM waits for most replicas and ALL for every replica, so
+// a single slow or down replica stalls or fails ALL writes
+func parseCassandraConsistency(name string) (gocql.Consistency, error) {
+	if name == "" {
+		name = DefaultCassandraConsistency
+	}
+	consistency, err := gocql.ParseConsistencyWrapper(name)
+	if err != nil {
+		return consistency, errors.Errorf("unknown cassandra consistency %q", name)
+	}
+	return consistency, nil
+}
+
+func (w *CassandraConnection) GetType() DBBackend {
+	return w.Config.Backend
+}
+
+func (w *CassandraConnection) GetVersion(logger *cli.Logger) string {
+	if err := w.begin(); err != nil {
+		return ""
+	}
+	defer w.end()
+
+	w.Config.structured(logger).Debug("getting cassandra version")
+	var version string
+	if err := w.session.Query("SELECT release_version FROM system.local").Scan(&version); err != nil {
+		return ""
+	}
+	return version
+}
+
+func (w *CassandraConnection) GetStatus(logger *cli.Logger) ConnectionStatus {
+	if err := w.Ping(context.Background()); err != nil {
+		return newConnectionStatus(err, "")
+	}
+	return newConnectionStatus(nil, w.GetVersion(logger))
+}
+
+func (w *CassandraConnection) Ping(ctx context.Context) error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+	defer w.end()
+
+	pingCtx, cancel := w.Config.newPingContext(ctx)
+	defer cancel()
+
+	err := w.session.Query("SELECT now() FROM system.local").WithContext(pingCtx).Exec()
+	return wrapContextError(pingCtx, err)
+}
+
+func (w *CassandraConnection) Write(ctx context.Context, logrec TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.WriteBatch(ctx, []TelemetryRecord{logrec}, logger)
+}
+
+func (w *CassandraConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	log := w.Config.structured(logger)
+
+	if len(logrecs) == 0 {
+		return &Result{
+			ResultCode: ResultNoData,
+			Message:    "no data to write",
+		}, nil
+	}
+
+	if mErr := w.migrate(ctx, logger); mErr != nil {
+		return nil, wrapContextError(ctx, mErr)
+	}
+
+	log.Debug("grouping records by partition")
+	partitions, gErr := w.groupByPartition(logrecs)
+	if gErr != nil {
+		return nil, gErr
+	}
+
+	// partitions are written concurrently, each one in a single
+	// logged batch when it holds more than one record
+	log.Debug("writing partitions", "partitions", len(partitions))
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var lastErr error
+	written := 0
+	slots := make(chan struct{}, cassandraMaxConcurrency)
+	for _, partition := range partitions {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(partition *cassandraPartition) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			err := w.writePartition(ctx, partition)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				lastErr = err
+				return
+			}
+			written += len(partition.rows)
+		}(partition)
+	}
+	wg.Wait()
+
+	if lastErr != nil {
+		return &Result{
+			Written: written,
+			Message: fmt.Sprintf("inserted %d of %d usage records", written, len(logrecs)),
+		}, wrapContextError(ctx, lastErr)
+	}
+
+	log.Debug("preparing report")
+	return &Result{
+		Written: written,
+		Message: fmt.Sprintf("successfully inserted %d usage records", written),
+	}, nil
+}
+
+func (w *CassandraConnection) Close() error {
+	if !w.drain() {
+		return nil
+	}
+	w.session.Close()
+	return nil
+}
+
+// creates the script and event tables if they do not exist
+func (w *CassandraConnection) migrate(ctx context.Context, logger *cli.Logger) error {
+	w.migrateMutex.Lock()
+	defer w.migrateMutex.Unlock()
+	if w.migrated {
+		return nil
+	}
+
+	w.Config.structured(logger).Debug("ensuring cassandra tables exist")
+	for _, table := range []string{w.Config.ScriptTarget, w.Config.EventTarget} {
+		if err := w.session.Query(fmt.Sprintf(cassandraTable, table)).WithContext(ctx).Exec(); err != nil {
+			return err
+		}
+	}
+
+	w.migrated = true
+	return nil
+}
+
+func (w *CassandraConnection) groupByPartition(logrecs []TelemetryRecord) ([]*cassandraPartition, error) {
+	partitions := make([]*cassandraPartition, 0)
+	index := make(map[string]*cassandraPartition)
+	for _, logrec := range logrecs {
+		data, mErr := json.Marshal(logrec)
+		if mErr != nil {
+			return nil, mErr
+		}
+
+		timestamp := logrec.GetTimeStamp()
+		if timestamp.IsZero() {
+			timestamp = time.Now()
+		}
+		timestamp = timestamp.UTC()
+
+		host, user, revit := cassandraIdentity(logrec)
+		table := w.Config.targetFor(logrec)
+		day := timestamp.Format("2006-01-02")
+
+		key := strings.Join([]string{table, host, day}, "|")
+		partition, exists := index[key]
+		if !exists {
+			partition = &cassandraPartition{table: table, host: host, day: day}
+			index[key] = partition
+			partitions = append(partitions, partition)
+		}
+		partition.rows = append(partition.rows, []interface{}{
+			host,
+			day,
+			timestamp,
+			gocql.UUIDFromTime(timestamp),
+			user,
+			revit,
+			string(data),
+		})
+	}
+	return partitions, nil
+}
+
+func (w *CassandraConnection) writePartition(ctx context.Context, partition *cassandraPartition) error {
+	insert := fmt.Sprintf(cassandraInsert, partition.table)
+	if len(partition.rows) == 1 {
+		return w.session.Query(insert, partition.rows[0]...).WithContext(ctx).Exec()
+	}
+
+	batch := w.session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	for _, row := range partition.rows {
+		batch.Query(insert, row...)
+	}
+	return w.session.ExecuteBatch(batch)
+}
+
+// host is the partition key, v1 records only carry the user name
+func cassandraIdentity(logrec TelemetryRecord) (string, string, string) {
+	switch rec := logrec.(type) {
+	case *ScriptTelemetryRecordV1:
+		return rec.UserName, rec.UserName, rec.RevitVersion
+	case *ScriptTelemetryRecordV2:
+		return rec.HostUserName, rec.UserName, rec.RevitVersion
+	case *EventTelemetryRecordV2:
+		return rec.HostUserName, rec.UserName, rec.RevitVersion
+	default:
+		return "", "", ""
+	}
+}
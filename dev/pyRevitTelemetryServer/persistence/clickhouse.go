@@ -0,0 +1,325 @@
+package persistence
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"../cli"
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/pkg/errors"
+)
+
+const clickhouseScriptTableV2 = `CREATE TABLE IF NOT EXISTS %s (
+	id UUID,
+	timestamp DateTime64(3, 'UTC'),
+	username String,
+	host_user String,
+	revit LowCardinality(String),
+	revitbuild LowCardinality(String),
+	sessionid String,
+	pyrevit LowCardinality(String),
+	clone String,
+	debug Bool,
+	config Bool,
+	from_gui Bool,
+	exec_id String,
+	exec_timestamp String,
+	commandname String,
+	commandbundle String,
+	commandextension String,
+	commanduniquename String,
+	docname String,
+	docpath String,
+	resultcode Int32,
+	commandresults String,
+	scriptpath String,
+	engine_type LowCardinality(String),
+	engine_version LowCardinality(String),
+	engine_syspath Array(String),
+	engine_configs String,
+	trace_message String
+) ENGINE = MergeTree
+PARTITION BY toYYYYMM(timestamp)
+ORDER BY (timestamp, host_user)`
+
+const clickhouseEventTableV2 = `CREATE TABLE IF NOT EXISTS %s (
+	id UUID,
+	timestamp DateTime64(3, 'UTC'),
+	handler_id String,
+	type LowCardinality(String),
+	args String,
+	username String,
+	host_user String,
+	revit LowCardinality(String),
+	revitbuild LowCardinality(String),
+	cancellable Bool,
+	cancelled Bool,
+	docid Int64,
+	doctype LowCardinality(String),
+	doctemplate String,
+	docname String,
+	docpath String,
+	projectnum String,
+	projectname String
+) ENGINE = MergeTree
+PARTITION BY toYYYYMM(timestamp)
+ORDER BY (timestamp, type)`
+
+type ClickHouseConnection struct {
+	DatabaseConnection
+	conn driver.Conn
+
+	// tables are created on first write, retried until it succeeds
+	migrateMutex sync.Mutex
+	migrated     bool
+}
+
+func newClickHouseConnection(w DatabaseConnection) (*ClickHouseConnection, error) {
+	if err := w.Config.validateTargets(sqlTargetPattern); err != nil {
+		return nil, err
+	}
+
+	opts, err := clickhouse.ParseDSN(w.Config.ConnString)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, cErr := clickhouse.Open(opts)
+	if cErr != nil {
+		return nil, cErr
+	}
+	return &ClickHouseConnection{DatabaseConnection: w, conn: conn}, nil
+}
+
+func (w *ClickHouseConnection) GetType() DBBackend {
+	return w.Config.Backend
+}
+
+func (w *ClickHouseConnection) GetVersion(logger *cli.Logger) string {
+	if err := w.begin(); err != nil {
+		return ""
+	}
+	defer w.end()
+
+	w.Config.structured(logger).Debug("getting clickhouse version")
+	version, err := w.conn.ServerVersion()
+	if err != nil {
+		return ""
+	}
+	return version.Version.String()
+}
+
+func (w *ClickHouseConnection) GetStatus(logger *cli.Logger) ConnectionStatus {
+	if err := w.Ping(context.Background()); err != nil {
+		return newConnectionStatus(err, "")
+	}
+	return newConnectionStatus(nil, w.GetVersion(logger))
+}
+
+func (w *ClickHouseConnection) Ping(ctx context.Context) error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+	defer w.end()
+
+	pingCtx, cancel := w.Config.newPingContext(ctx)
+	defer cancel()
+
+	return wrapContextError(pingCtx, w.conn.Ping(pingCtx))
+}
+
+func (w *ClickHouseConnection) Write(ctx context.Context, logrec TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.WriteBatch(ctx, []TelemetryRecord{logrec}, logger)
+}
+
+func (w *ClickHouseConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	log := w.Config.structured(logger)
+
+	if len(logrecs) == 0 {
+		return &Result{
+			ResultCode: ResultNoData,
+			Message:    "no data to write",
+		}, nil
+	}
+
+	if mErr := w.migrate(ctx, logger); mErr != nil {
+		return nil, wrapContextError(ctx, mErr)
+	}
+
+	// group rows by target table, keeping order
+	log.Debug("grouping records by target table")
+	tables := make([]string, 0)
+	rows := make(map[string][][]interface{})
+	for _, logrec := range logrecs {
+		values, vErr := generateClickHouseValues(logrec, log)
+		if vErr != nil {
+			return nil, vErr
+		}
+
+		table := w.Config.targetFor(logrec)
+		if _, exists := rows[table]; !exists {
+			tables = append(tables, table)
+		}
+		rows[table] = append(rows[table], values)
+	}
+
+	// let the server buffer and merge small inserts
+	asyncCtx := clickhouse.Context(ctx, clickhouse.WithSettings(clickhouse.Settings{
+		"async_insert":          1,
+		"wait_for_async_insert": 1,
+	}))
+
+	written := 0
+	for _, table := range tables {
+		log.Debug("preparing insert batch")
+		batch, bErr := w.conn.PrepareBatch(asyncCtx, fmt.Sprintf("INSERT INTO %s", table))
+		if bErr != nil {
+			return &Result{Written: written}, wrapContextError(ctx, bErr)
+		}
+
+		for _, values := range rows[table] {
+			if aErr := batch.Append(values...); aErr != nil {
+				batch.Abort()
+				return &Result{Written: written}, aErr
+			}
+		}
+
+		log.Debug("sending insert batch")
+		if sErr := batch.Send(); sErr != nil {
+			return &Result{
+				Written: written,
+				Message: fmt.Sprintf("inserted %d of %d usage records", written, len(logrecs)),
+			}, wrapContextError(ctx, sErr)
+		}
+		written += len(rows[table])
+	}
+
+	log.Debug("preparing report")
+	return &Result{
+		Written: written,
+		Message: fmt.Sprintf("successfully inserted %d usage records", written),
+	}, nil
+}
+
+func (w *ClickHouseConnection) Close() error {
+	if !w.drain() {
+		return nil
+	}
+	return w.conn.Close()
+}
+
+// creates the script and event tables if they do not exist
+func (w *ClickHouseConnection) migrate(ctx context.Context, logger *cli.Logger) error {
+	w.migrateMutex.Lock()
+	defer w.migrateMutex.Unlock()
+	if w.migrated {
+		return nil
+	}
+
+	w.Config.structured(logger).Debug("ensuring clickhouse tables exist")
+	if err := w.conn.Exec(ctx, fmt.Sprintf(clickhouseScriptTableV2, w.Config.ScriptTarget)); err != nil {
+		return err
+	}
+	if err := w.conn.Exec(ctx, fmt.Sprintf(clickhouseEventTableV2, w.Config.EventTarget)); err != nil {
+		return err
+	}
+
+	w.migrated = true
+	return nil
+}
+
+func generateClickHouseValues(logrec TelemetryRecord, log *structuredLogger) ([]interface{}, error) {
+	// client provided or generated record id
+	recordId, idErr := newRecordId(logrec)
+	if idErr != nil {
+		return nil, idErr
+	}
+
+	switch rec := logrec.(type) {
+	case *ScriptTelemetryRecordV2:
+		// marshal json data
+		engineCfgs, merr := json.Marshal(rec.TraceInfo.EngineInfo.Configs)
+		if merr != nil {
+			log.Debug("error logging engine configs")
+		}
+		cresults, merr := json.Marshal(rec.CommandResults)
+		if merr != nil {
+			log.Debug("error logging command results")
+		}
+
+		sysPaths := rec.TraceInfo.EngineInfo.SysPaths
+		if sysPaths == nil {
+			sysPaths = []string{}
+		}
+
+		return []interface{}{
+			recordId,
+			rec.GetTimeStamp(),
+			rec.UserName,
+			rec.HostUserName,
+			rec.RevitVersion,
+			rec.RevitBuild,
+			rec.SessionId,
+			rec.PyRevitVersion,
+			rec.Clone,
+			rec.IsDebugMode,
+			rec.IsConfigMode,
+			rec.IsExecFromGUI,
+			rec.ExecId,
+			rec.ExecTimeStamp,
+			rec.CommandName,
+			rec.BundleName,
+			rec.ExtensionName,
+			rec.CommandUniqueName,
+			rec.DocumentName,
+			rec.DocumentPath,
+			int32(rec.ResultCode),
+			string(cresults),
+			rec.ScriptPath,
+			rec.TraceInfo.EngineInfo.Type,
+			rec.TraceInfo.EngineInfo.Version,
+			sysPaths,
+			string(engineCfgs),
+			rec.TraceInfo.Message,
+		}, nil
+
+	case *EventTelemetryRecordV2:
+		// marshal json data
+		eventArgs, merr := json.Marshal(rec.EventArgs)
+		if merr != nil {
+			log.Debug("error logging event args")
+		}
+
+		return []interface{}{
+			recordId,
+			rec.GetTimeStamp(),
+			rec.HandlerId,
+			rec.EventType,
+			string(eventArgs),
+			rec.UserName,
+			rec.HostUserName,
+			rec.RevitVersion,
+			rec.RevitBuild,
+			rec.Cancellable,
+			rec.Cancelled,
+			int64(rec.DocumentId),
+			rec.DocumentType,
+			rec.DocumentTemplate,
+			rec.DocumentName,
+			rec.DocumentPath,
+			rec.ProjectNumber,
+			rec.ProjectName,
+		}, nil
+
+	default:
+		return nil, errors.New("only schema v2 records are supported by clickhouse backend")
+	}
+}
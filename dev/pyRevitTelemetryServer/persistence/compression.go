@@ -0,0 +1,71 @@
+package persistence
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// output compression modes, empty uses the backend default
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+// resolves the configured compression against the backend default
+func (cfg *Config) compressionOr(fallback string) (string, error) {
+	switch cfg.Compression {
+	case "":
+		return fallback, nil
+	case CompressionNone, CompressionGzip:
+		return cfg.Compression, nil
+	default:
+		return "", errors.Errorf("unknown compression %q", cfg.Compression)
+	}
+}
+
+// compresses data into a complete gzip member, members appended to the
+// same file read back as one stream
+func gzipBytes(data []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if _, err := gz.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// opens a file for reading, decompressing .gz files transparently
+func openMaybeGzip(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return file, nil
+	}
+
+	gz, gErr := gzip.NewReader(file)
+	if gErr != nil {
+		file.Close()
+		return nil, gErr
+	}
+	return &gzipFile{gz, file}, nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (f *gzipFile) Close() error {
+	f.Reader.Close()
+	return f.file.Close()
+}
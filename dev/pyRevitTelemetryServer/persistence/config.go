@@ -1,7 +1,12 @@
 package persistence
 
 import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
 
 	"../cli"
 	"github.com/pkg/errors"
@@ -15,13 +20,184 @@ const (
 	MySql    DBBackend = "mysql"
 	MSSql    DBBackend = "sqlserver"
 	Sqlite   DBBackend = "sqlite3"
+
+	Elasticsearch DBBackend = "elasticsearch"
+	ClickHouse    DBBackend = "clickhouse"
+	InfluxDB      DBBackend = "influxdb"
+	Redis         DBBackend = "redis"
+	File          DBBackend = "file"
+	S3            DBBackend = "s3"
+	BigQuery      DBBackend = "bigquery"
+	Cassandra     DBBackend = "cassandra"
+	DynamoDB      DBBackend = "dynamodb"
+
+	// stores nothing, for load testing
+	Discard DBBackend = "discard"
+	// keeps records in memory, for tests
+	Memory DBBackend = "memory"
+	// prints records, for debugging clients
+	Stdout DBBackend = "stdout"
+)
+
+const (
+	DefaultRequestTimeout  = 30 * time.Second
+	DefaultPingTimeout     = 5 * time.Second
+	DefaultWriteTimeout    = 10 * time.Second
+	DefaultMaxOpenConns    = 10
+	DefaultMaxIdleConns    = 5
+	DefaultConnMaxLifetime = 30 * time.Minute
+	DefaultConnMaxIdleTime = 5 * time.Minute
+	DefaultRetryBackoff    = 100 * time.Millisecond
+	DefaultMaxBackoff      = 10 * time.Second
 )
 
 type Config struct {
-	Backend      DBBackend `json:"backend"`
-	ConnString   string    `json:"connection_string"`
-	ScriptTarget string    `json:"script_target"`
-	EventTarget  string    `json:"event_target"`
+	Backend        DBBackend     `json:"backend" yaml:"backend"`
+	ConnString     string        `json:"connection_string" yaml:"connection_string"`
+	ScriptTarget   string        `json:"script_target" yaml:"script_target"`
+	EventTarget    string        `json:"event_target" yaml:"event_target"`
+	RequestTimeout time.Duration `json:"request_timeout" yaml:"request_timeout"`
+	PingTimeout    time.Duration `json:"ping_timeout" yaml:"ping_timeout"`
+	WriteTimeout   time.Duration `json:"write_timeout" yaml:"write_timeout"`
+
+	// sql replica serving Read queries, the primary is used when empty
+	ReadConnString string `json:"read_connection_string" yaml:"read_connection_string"`
+
+	// override the script target for sql tables and mongodb collections,
+	// so one server can host several telemetry namespaces
+	TableName      string `json:"table_name" yaml:"table_name"`
+	CollectionName string `json:"collection_name" yaml:"collection_name"`
+
+	// mongodb indexes as lists of fields, - prefix for descending order
+	// nil uses the default indexes, an empty list disables them
+	MongoIndexes [][]string `json:"mongo_indexes" yaml:"mongo_indexes"`
+
+	// json names of fields records must carry, dotted for nested fields
+	// nil uses the defaults of each record type, an empty list disables them
+	RequiredFields []string `json:"required_fields" yaml:"required_fields"`
+
+	// json schema raw payloads are checked against by PayloadValidator,
+	// skipped when empty
+	RecordSchemaPath string `json:"record_schema_path" yaml:"record_schema_path"`
+
+	// tls for sql and mongodb backends, failing to load the certificates
+	// fails the connection instead of falling back to plaintext
+	TLSEnabled     bool   `json:"tls_enabled" yaml:"tls_enabled"`
+	CACertPath     string `json:"ca_cert_path" yaml:"ca_cert_path"`
+	ClientCertPath string `json:"client_cert_path" yaml:"client_cert_path"`
+	ClientKeyPath  string `json:"client_key_path" yaml:"client_key_path"`
+
+	// connect over a unix socket instead of the host of the connection
+	// string. the directory of the socket for postgres, the socket file
+	// for mysql
+	SocketPath string `json:"socket_path" yaml:"socket_path"`
+
+	// sql connection pool, zero values use the defaults above
+	// MaxOpenConns -> sql.DB.SetMaxOpenConns
+	// MaxIdleConns -> sql.DB.SetMaxIdleConns
+	// ConnMaxLifetime -> sql.DB.SetConnMaxLifetime
+	// ConnMaxIdleTime -> sql.DB.SetConnMaxIdleTime, and the mongodb pool
+	// max idle time when set
+	MaxOpenConns    int           `json:"max_open_conns" yaml:"max_open_conns"`
+	MaxIdleConns    int           `json:"max_idle_conns" yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `json:"conn_max_lifetime" yaml:"conn_max_lifetime"`
+	ConnMaxIdleTime time.Duration `json:"conn_max_idle_time" yaml:"conn_max_idle_time"`
+
+	// sqlite writers wait this long on a locked database before failing
+	SqliteBusyTimeout time.Duration `json:"sqlite_busy_timeout" yaml:"sqlite_busy_timeout"`
+
+	// postgres and sqlserver batches at least this large use COPY or bulk
+	// copy, negative disables it
+	CopyThreshold int `json:"copy_threshold" yaml:"copy_threshold"`
+
+	// postgres tables partitioned by month of the record timestamp.
+	// existing tables are converted with MigrateToPartitioned
+	Partitioning bool `json:"partitioning" yaml:"partitioning"`
+
+	// records of writes failing after retries are appended here as
+	// ndjson for ReplayDeadLetter, disabled when empty
+	DeadLetterPath string `json:"dead_letter_path" yaml:"dead_letter_path"`
+
+	// queue writes and flush them in the background, disabled when
+	// AsyncQueueSize is zero. AsyncOverflow is block, drop-oldest or
+	// drop-newest
+	AsyncQueueSize     int           `json:"async_queue_size" yaml:"async_queue_size"`
+	AsyncBatchSize     int           `json:"async_batch_size" yaml:"async_batch_size"`
+	AsyncFlushInterval time.Duration `json:"async_flush_interval" yaml:"async_flush_interval"`
+	AsyncOverflow      string        `json:"async_overflow" yaml:"async_overflow"`
+
+	// records each client may write per minute, disabled when zero.
+	// RateLimitMaxClients bounds the number of clients tracked at once
+	MaxRecordsPerMinute int `json:"max_records_per_minute" yaml:"max_records_per_minute"`
+	RateLimitMaxClients int `json:"rate_limit_max_clients" yaml:"rate_limit_max_clients"`
+
+	// records older than RetentionDays are purged by NewRetentionJob every
+	// RetentionInterval, disabled when zero. MongoTTLIndex leaves expiring
+	// mongodb documents to a ttl index instead
+	RetentionDays     int           `json:"retention_days" yaml:"retention_days"`
+	RetentionInterval time.Duration `json:"retention_interval" yaml:"retention_interval"`
+	MongoTTLIndex     bool          `json:"mongo_ttl_index" yaml:"mongo_ttl_index"`
+
+	// mongodb write concern, see parseMongoWriteConcern. the connection
+	// string or server default applies when empty
+	MongoWriteConcern string `json:"mongo_write_concern" yaml:"mongo_write_concern"`
+
+	// a fan-out connection stays healthy while this backend is down,
+	// as long as another one is up
+	Optional bool `json:"optional" yaml:"optional"`
+
+	// stdout backend prints one record per line instead of indented
+	StdoutCompact bool `json:"stdout_compact" yaml:"stdout_compact"`
+
+	// log lines of the package are plain text, or json lines with level,
+	// message, backend and error fields when json
+	LogFormat string `json:"log_format" yaml:"log_format"`
+
+	// repeated writes with the same idempotency key within the ttl get
+	// the result of the first write, disabled when zero
+	IdempotencyTTL time.Duration `json:"idempotency_ttl" yaml:"idempotency_ttl"`
+
+	// retry transient write failures, disabled when MaxRetries is zero
+	MaxRetries int           `json:"max_retries" yaml:"max_retries"`
+	MaxBackoff time.Duration `json:"max_backoff" yaml:"max_backoff"`
+
+	// secret keying the pseudonyms of anonymized users, the names are
+	// removed instead when empty
+	AnonymizationKey string `json:"anonymization_key" yaml:"anonymization_key"`
+
+	// influxdb
+	InfluxOrg    string `json:"influx_org" yaml:"influx_org"`
+	InfluxBucket string `json:"influx_bucket" yaml:"influx_bucket"`
+	InfluxToken  string `json:"influx_token" yaml:"influx_token"`
+
+	// redis streams, entries are trimmed to about RedisMaxLen when set
+	RedisStream string `json:"redis_stream" yaml:"redis_stream"`
+	RedisMaxLen int64  `json:"redis_maxlen" yaml:"redis_maxlen"`
+
+	// ndjson files, rotated daily and/or when exceeding FileMaxSize bytes
+	FileRotation string `json:"file_rotation" yaml:"file_rotation"`
+	FileMaxSize  int64  `json:"file_max_size" yaml:"file_max_size"`
+
+	// file and s3 output compression, none or gzip. files default to
+	// none and s3 objects to gzip
+	Compression string `json:"compression" yaml:"compression"`
+
+	// s3 archival, buffers are flushed at S3FlushSize bytes or every
+	// S3FlushInterval, S3Endpoint points to s3-compatible stores
+	S3Region        string        `json:"s3_region" yaml:"s3_region"`
+	S3Endpoint      string        `json:"s3_endpoint" yaml:"s3_endpoint"`
+	S3FlushSize     int           `json:"s3_flush_size" yaml:"s3_flush_size"`
+	S3FlushInterval time.Duration `json:"s3_flush_interval" yaml:"s3_flush_interval"`
+
+	// bigquery service account key, GOOGLE_APPLICATION_CREDENTIALS when empty
+	BigQueryCredentials string `json:"bigquery_credentials" yaml:"bigquery_credentials"`
+
+	// cassandra write consistency level, QUORUM when empty. see
+	// parseCassandraConsistency
+	CassandraConsistency string `json:"cassandra_consistency" yaml:"cassandra_consistency"`
+
+	// dynamodb local or compatible endpoint
+	DynamoDBEndpoint string `json:"dynamodb_endpoint" yaml:"dynamodb_endpoint"`
 }
 
 func NewConfig(options *cli.Options) (*Config, error) {
@@ -38,10 +214,76 @@ func NewConfig(options *cli.Options) (*Config, error) {
 	}, nil
 }
 
+// table and collection names can not be bound as parameters
+var (
+	sqlTargetPattern   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+	mongoTargetPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.\-]*$`)
+)
+
+// copy of the config writing scripts to the given target, when set
+func (cfg *Config) withScriptTarget(target string) *Config {
+	if target == "" {
+		return cfg
+	}
+	targetCfg := *cfg
+	targetCfg.ScriptTarget = target
+	return &targetCfg
+}
+
+// checks target names against the allowlist pattern
+func (cfg *Config) validateTargets(pattern *regexp.Regexp) error {
+	for _, target := range []string{cfg.ScriptTarget, cfg.EventTarget} {
+		if target != "" && !pattern.MatchString(target) {
+			return errors.Errorf("invalid target name %q", target)
+		}
+	}
+	return nil
+}
+
+// context for handling a single request, bound by the configured timeout
+func (cfg *Config) NewRequestContext(parent context.Context) (context.Context, context.CancelFunc) {
+	timeout := cfg.RequestTimeout
+	if timeout <= 0 {
+		timeout = DefaultRequestTimeout
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// context for a single backend write, bound by the configured write timeout
+func (cfg *Config) newWriteContext(parent context.Context) (context.Context, context.CancelFunc) {
+	timeout := cfg.WriteTimeout
+	if timeout <= 0 {
+		timeout = DefaultWriteTimeout
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// context for a connectivity check, bound by the configured ping timeout
+func (cfg *Config) newPingContext(parent context.Context) (context.Context, context.CancelFunc) {
+	timeout := cfg.PingTimeout
+	if timeout <= 0 {
+		timeout = DefaultPingTimeout
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// connections to open on server start, the idle ones the pool keeps
+func (cfg *Config) WarmupSize() int {
+	if cfg.MaxIdleConns <= 0 {
+		return DefaultMaxIdleConns
+	}
+	return cfg.MaxIdleConns
+}
+
+// file extensions of sqlite databases given as plain paths
+var sqliteFileExtensions = []string{".db", ".sqlite", ".sqlite3"}
+
+// backend named by the connection string scheme, plain paths to sqlite
+// database files are sqlite
 func parseUri(connString string) (DBBackend, error) {
-	if strings.HasPrefix(connString, "postgres:") {
+	if strings.HasPrefix(connString, "postgres:") || strings.HasPrefix(connString, "postgresql:") {
 		return Postgres, nil
-	} else if strings.HasPrefix(connString, "mongodb:") {
+	} else if strings.HasPrefix(connString, "mongodb:") || strings.HasPrefix(connString, "mongodb+srv:") {
 		return MongoDB, nil
 	} else if strings.HasPrefix(connString, "mysql:") {
 		return MySql, nil
@@ -49,7 +291,214 @@ func parseUri(connString string) (DBBackend, error) {
 		return MSSql, nil
 	} else if strings.HasPrefix(connString, "sqlite3:") {
 		return Sqlite, nil
+	} else if strings.HasPrefix(connString, "elasticsearch:") {
+		return Elasticsearch, nil
+	} else if strings.HasPrefix(connString, "clickhouse:") {
+		return ClickHouse, nil
+	} else if strings.HasPrefix(connString, "influxdb:") {
+		return InfluxDB, nil
+	} else if strings.HasPrefix(connString, "redis:") || strings.HasPrefix(connString, "rediss:") {
+		return Redis, nil
+	} else if strings.HasPrefix(connString, "file:") {
+		return File, nil
+	} else if strings.HasPrefix(connString, "s3:") {
+		return S3, nil
+	} else if strings.HasPrefix(connString, "bigquery:") {
+		return BigQuery, nil
+	} else if strings.HasPrefix(connString, "cassandra:") {
+		return Cassandra, nil
+	} else if strings.HasPrefix(connString, "dynamodb:") {
+		return DynamoDB, nil
+	} else if strings.HasPrefix(connString, "discard:") {
+		return Discard, nil
+	} else if strings.HasPrefix(connString, "memory:") {
+		return Memory, nil
+	} else if strings.HasPrefix(connString, "stdout:") {
+		return Stdout, nil
+	} else if isSqlitePath(connString) {
+		return Sqlite, nil
+	} else if scheme := connStringScheme(connString); scheme != "" {
+		return "", errors.Errorf("unsupported connection string scheme %q", scheme)
 	} else {
-		return "", errors.New("db is not yet supported")
+		return "", errors.New("connection string has no scheme to infer the backend from")
+	}
+}
+
+// keyword style dsns can name .db files too, paths have no spaces or =
+func isSqlitePath(connString string) bool {
+	if connString == "" || strings.ContainsAny(connString, " =") {
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(connString))
+	for _, sqliteExt := range sqliteFileExtensions {
+		if ext == sqliteExt {
+			return true
+		}
+	}
+	return false
+}
+
+// the scheme of url style connection strings only, the rest of the
+// connection string may hold secrets
+func connStringScheme(connString string) string {
+	idx := strings.Index(connString, "://")
+	if idx <= 0 {
+		return ""
+	}
+	scheme := connString[:idx]
+	if strings.ContainsAny(scheme, "/@ =;") {
+		return ""
+	}
+	return scheme
+}
+
+func (cfg *Config) targetFor(logrec TelemetryRecord) string {
+	return cfg.targetOf(logrec.GetRecordType())
+}
+
+// table or collection records of the type are stored in
+func (cfg *Config) targetOf(recordType RecordType) string {
+	if recordType == EventRecord {
+		return cfg.EventTarget
+	}
+	return cfg.ScriptTarget
+}
+
+// all backends NewConnection can open
+var knownBackends = []DBBackend{
+	Postgres, MongoDB, MySql, MSSql, Sqlite,
+	Elasticsearch, ClickHouse, InfluxDB, Redis, File,
+	S3, BigQuery, Cassandra, DynamoDB, Discard, Memory, Stdout,
+}
+
+// checks the config before anything connects, reporting every problem
+// found instead of the first one
+func (cfg *Config) Validate() error {
+	problems := make([]string, 0)
+	addProblem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	known := false
+	for _, backend := range knownBackends {
+		known = known || cfg.Backend == backend
+	}
+	if cfg.Backend == "" {
+		addProblem("backend is required")
+	} else if !known {
+		addProblem("unsupported backend %q", cfg.Backend)
+	}
+
+	if cfg.ConnString == "" {
+		addProblem("connection string is required")
+	} else if backend, err := parseUri(cfg.ConnString); err != nil {
+		addProblem("%v", err)
+	} else if known && backend != cfg.Backend {
+		addProblem("connection string is for %s, not %s backend", backend, cfg.Backend)
+	}
+
+	// fields the backends can not default
+	if cfg.Backend == InfluxDB && (cfg.InfluxOrg == "" || cfg.InfluxBucket == "") {
+		addProblem("influxdb backend requires org and bucket")
+	}
+	if cfg.Partitioning && cfg.Backend != Postgres {
+		addProblem("partitioning is not supported by %s backend", cfg.Backend)
+	}
+	if cfg.MongoTTLIndex && (cfg.Backend != MongoDB || cfg.RetentionDays <= 0) {
+		addProblem("mongodb ttl index requires mongodb backend and retention days")
+	}
+	if !isLogFormat(cfg.LogFormat) {
+		addProblem("unknown log format %q", cfg.LogFormat)
+	}
+	if cfg.MongoWriteConcern != "" {
+		if cfg.Backend != MongoDB {
+			addProblem("write concern is not supported by %s backend", cfg.Backend)
+		} else if _, err := parseMongoWriteConcern(cfg.MongoWriteConcern); err != nil {
+			addProblem("%v", err)
+		}
+	}
+	if cfg.SocketPath != "" && cfg.Backend != Postgres && cfg.Backend != MySql {
+		addProblem("unix sockets are not supported by %s backend", cfg.Backend)
+	}
+	if cfg.StdoutCompact && cfg.Backend != Stdout {
+		addProblem("compact output is not supported by %s backend", cfg.Backend)
+	}
+	if cfg.CassandraConsistency != "" {
+		if cfg.Backend != Cassandra {
+			addProblem("consistency is not supported by %s backend", cfg.Backend)
+		} else if _, err := parseCassandraConsistency(cfg.CassandraConsistency); err != nil {
+			addProblem("%v", err)
+		}
+	}
+	if cfg.ReadConnString != "" {
+		if backend, err := parseUri(cfg.ReadConnString); err != nil || backend != cfg.Backend {
+			addProblem("read replica must be a %s database", cfg.Backend)
+		}
+	}
+
+	if (cfg.ClientCertPath == "") != (cfg.ClientKeyPath == "") {
+		addProblem("client certificate and key must be set together")
+	}
+	if !cfg.TLSEnabled && (cfg.CACertPath != "" || cfg.ClientCertPath != "") {
+		addProblem("certificates are set but tls is not enabled")
+	}
+
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"request timeout", cfg.RequestTimeout},
+		{"ping timeout", cfg.PingTimeout},
+		{"write timeout", cfg.WriteTimeout},
+		{"connection max lifetime", cfg.ConnMaxLifetime},
+		{"connection max idle time", cfg.ConnMaxIdleTime},
+		{"max backoff", cfg.MaxBackoff},
+		{"async flush interval", cfg.AsyncFlushInterval},
+		{"s3 flush interval", cfg.S3FlushInterval},
+		{"sqlite busy timeout", cfg.SqliteBusyTimeout},
+		{"retention interval", cfg.RetentionInterval},
+		{"idempotency ttl", cfg.IdempotencyTTL},
+	}
+	for _, duration := range durations {
+		if duration.value < 0 {
+			addProblem("%s can not be negative", duration.name)
+		}
+	}
+
+	counts := []struct {
+		name  string
+		value int64
+	}{
+		{"max open connections", int64(cfg.MaxOpenConns)},
+		{"max idle connections", int64(cfg.MaxIdleConns)},
+		{"max retries", int64(cfg.MaxRetries)},
+		{"async queue size", int64(cfg.AsyncQueueSize)},
+		{"async batch size", int64(cfg.AsyncBatchSize)},
+		{"s3 flush size", int64(cfg.S3FlushSize)},
+		{"file max size", cfg.FileMaxSize},
+		{"redis max length", cfg.RedisMaxLen},
+		{"max records per minute", int64(cfg.MaxRecordsPerMinute)},
+		{"rate limit max clients", int64(cfg.RateLimitMaxClients)},
+		{"retention days", int64(cfg.RetentionDays)},
+	}
+	for _, count := range counts {
+		if count.value < 0 {
+			addProblem("%s can not be negative", count.name)
+		}
+	}
+
+	if cfg.AsyncOverflow != "" && !isAsyncOverflow(cfg.AsyncOverflow) {
+		addProblem("unknown async overflow %q", cfg.AsyncOverflow)
+	}
+	if cfg.Compression != "" && cfg.Compression != CompressionNone && cfg.Compression != CompressionGzip {
+		addProblem("unknown compression %q", cfg.Compression)
+	}
+	if cfg.FileRotation != RotateNever && cfg.FileRotation != RotateDaily {
+		addProblem("unknown file rotation %q", cfg.FileRotation)
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("invalid config: %s", strings.Join(problems, "; "))
 	}
+	return nil
 }
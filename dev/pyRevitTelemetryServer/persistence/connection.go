@@ -1,55 +1,391 @@
 package persistence
 
 import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
 	"../cli"
+	"github.com/pkg/errors"
 )
 
 type ConnectionStatus struct {
-	Status  string `json:"status"`
-	Version string `json:"version"`
-	Output  string `json:"output"`
+	Status   string          `json:"status"`
+	Version  string          `json:"version"`
+	Output   string          `json:"output"`
+	Backends []BackendStatus `json:"backends,omitempty"`
+}
+
+// status of each backend of a fan-out connection
+type BackendStatus struct {
+	Backend  string `json:"backend"`
+	Required bool   `json:"required"`
+	Status   string `json:"status"`
+	Output   string `json:"output,omitempty"`
 }
 
-// ErroCodes
-// 0: All OK
-// 1: No data to write
-// 2: data is available but did not get pushed under dry run
-// 3: headers are required
+// Result.ResultCode values, part of the wire format and never renumbered
+const (
+	// all ok
+	ResultOK = 0
+	// no data to write, or no matching records to read
+	ResultNoData = 1
+	// data is available but did not get pushed under dry run
+	ResultDryRunSkipped = 2
+	// headers are required
+	ResultHeadersRequired = 3
+	// backend throttled the write
+	ResultThrottled = 4
+	// record failed validation and was not written
+	ResultValidationFailed = 5
+	// all records already exist, nothing was written
+	ResultAllDuplicates = 6
+	// write queue is full, records were dropped
+	ResultQueueFull = 7
+	// write timed out
+	ResultTimeout = 8
+	// client exceeded its rate limit, nothing was written
+	ResultRateLimited = 9
+	// write queue stayed full until the write deadline
+	ResultQueueBusy = 10
+)
+
+// ResultCode is one of the Result constants above.
+// Written is the number of records actually persisted. On partial batch
+// failures it is returned alongside the error. Duplicates counts records
+// skipped because a record with the same id already exists. Affected
+// counts records deleted or updated in place. Dropped counts records
+// discarded by a full write queue. Queued counts records accepted by the
+// write queue, they are not written yet and not counted in Written.
+// NextPage is the page token of the page after a paged read, empty on the
+// last page. Records has the outcome of every record of a partially failed
+// batch, for backends able to tell which records failed.
 type Result struct {
 	ResultCode int
 	Message    string
+	Written    int
+	Duplicates int
+	Affected   int
+	Dropped    int
+	Queued     int
+	NextPage   string
+	Records    []RecordResult
+}
+
+// outcome of a single record of a batch, Index is its position in the
+// batch. Err is nil for records written or skipped as duplicates
+type RecordResult struct {
+	Index int
+	Err   error
+}
+
+func newRecordResults(count int) []RecordResult {
+	records := make([]RecordResult, count)
+	for idx := range records {
+		records[idx].Index = idx
+	}
+	return records
+}
+
+func countFailedRecords(records []RecordResult) int {
+	failed := 0
+	for _, record := range records {
+		if record.Err != nil {
+			failed++
+		}
+	}
+	return failed
 }
 
 type DatabaseConnection struct {
 	Config *Config `json:"db_configs"`
+	state  *connectionState
+}
+
+// tracks in-flight operations so Close can drain them
+type connectionState struct {
+	mutex    sync.RWMutex
+	closed   bool
+	inflight sync.WaitGroup
+}
+
+// defaults for backends that can not read records back
+func (w DatabaseConnection) Read(ctx context.Context, filter *RecordFilter, logger *cli.Logger) ([]TelemetryRecord, *Result, error) {
+	return nil, nil, errors.Errorf("reading records is not supported by %s backend", w.Config.Backend)
+}
+
+func (w DatabaseConnection) ReadStream(ctx context.Context, filter *RecordFilter, logger *cli.Logger) (<-chan TelemetryRecord, <-chan error) {
+	return failedRecordStream(errors.Errorf("streaming records is not supported by %s backend", w.Config.Backend))
+}
+
+func (w DatabaseConnection) AggregateCommandCounts(ctx context.Context, from time.Time, to time.Time) (map[string]int, error) {
+	return nil, errors.Errorf("aggregating records is not supported by %s backend", w.Config.Backend)
+}
+
+func (w DatabaseConnection) RecentByUser(ctx context.Context, username string, n int) ([]TelemetryRecord, error) {
+	return nil, errors.Errorf("reading recent records is not supported by %s backend", w.Config.Backend)
+}
+
+func (w DatabaseConnection) DeleteByUser(ctx context.Context, username string) (*Result, error) {
+	return nil, errors.Errorf("deleting records is not supported by %s backend", w.Config.Backend)
+}
+
+func (w DatabaseConnection) AnonymizeUser(ctx context.Context, username string) (*Result, error) {
+	return nil, errors.Errorf("anonymizing records is not supported by %s backend", w.Config.Backend)
+}
+
+func (w DatabaseConnection) PurgeOlderThan(ctx context.Context, cutoff time.Time) (*Result, error) {
+	return nil, errors.Errorf("purging records is not supported by %s backend", w.Config.Backend)
+}
+
+// backends without a connection pool have nothing to warm up
+func (w DatabaseConnection) Warmup(ctx context.Context, n int) error {
+	return nil
+}
+
+// registers an in-flight operation, fails if connection is closed
+func (w DatabaseConnection) begin() error {
+	w.state.mutex.RLock()
+	defer w.state.mutex.RUnlock()
+	if w.state.closed {
+		return ErrClosed
+	}
+	w.state.inflight.Add(1)
+	return nil
+}
+
+func (w DatabaseConnection) end() {
+	w.state.inflight.Done()
+}
+
+// marks connection as closed and waits for in-flight operations to finish
+// returns false if connection was already closed
+func (w DatabaseConnection) drain() bool {
+	w.state.mutex.Lock()
+	if w.state.closed {
+		w.state.mutex.Unlock()
+		return false
+	}
+	w.state.closed = true
+	w.state.mutex.Unlock()
+
+	w.state.inflight.Wait()
+	return true
 }
 
 type Connection interface {
 	GetType() DBBackend
 	GetVersion(*cli.Logger) string
 	GetStatus(*cli.Logger) ConnectionStatus
+	Write(context.Context, TelemetryRecord, *cli.Logger) (*Result, error)
+	WriteBatch(context.Context, []TelemetryRecord, *cli.Logger) (*Result, error)
+	// Deprecated: use Write
 	WriteScriptTelemetryV1(*ScriptTelemetryRecordV1, *cli.Logger) (*Result, error)
+	// Deprecated: use Write
 	WriteScriptTelemetryV2(*ScriptTelemetryRecordV2, *cli.Logger) (*Result, error)
+	// Deprecated: use Write
 	WriteEventTelemetryV2(*EventTelemetryRecordV2, *cli.Logger) (*Result, error)
-	// Read([]ScriptTelemetryRecord, *cli.Logger) (*Result, error)
+	Read(context.Context, *RecordFilter, *cli.Logger) ([]TelemetryRecord, *Result, error)
+	// reads the matching records without holding them all in memory,
+	// see newRecordStream for how the channels are consumed
+	ReadStream(ctx context.Context, filter *RecordFilter, logger *cli.Logger) (<-chan TelemetryRecord, <-chan error)
+	// number of script runs per command name between from and to,
+	// zero times leave the range open
+	AggregateCommandCounts(ctx context.Context, from time.Time, to time.Time) (map[string]int, error)
+	// latest n script records of a user, matched by user name or host
+	// user name, newest first
+	RecentByUser(ctx context.Context, username string, n int) ([]TelemetryRecord, error)
+	// remove or pseudonymize the script and event records of a user,
+	// matched by user name or host user name
+	DeleteByUser(ctx context.Context, username string) (*Result, error)
+	AnonymizeUser(ctx context.Context, username string) (*Result, error)
+	// deletes the script and event records timestamped before the cutoff
+	PurgeOlderThan(ctx context.Context, cutoff time.Time) (*Result, error)
+	Ping(context.Context) error
+	// opens up to n pooled connections ahead of the first requests,
+	// see Config.WarmupSize for the count used on server start
+	Warmup(ctx context.Context, n int) error
+	Close() error
+}
+
+func newConnectionStatus(pingErr error, version string) ConnectionStatus {
+	if pingErr != nil {
+		return ConnectionStatus{
+			Status: "fail",
+			Output: pingErr.Error(),
+		}
+	}
+	return ConnectionStatus{
+		Status:  "pass",
+		Version: version,
+	}
+}
+
+func newReadResult(records []TelemetryRecord, filter *RecordFilter) *Result {
+	if len(records) == 0 {
+		return &Result{
+			ResultCode: ResultNoData,
+			Message:    "no matching records",
+		}
+	}
+	return &Result{
+		Message:  fmt.Sprintf("found %d matching records", len(records)),
+		NextPage: filter.nextPageToken(records),
+	}
+}
+
+func validateRecentCount(n int) error {
+	if n <= 0 {
+		return errors.Errorf("record count must be positive, got %d", n)
+	}
+	return nil
+}
+
+// reports written records, noting records skipped as duplicates
+func newWriteResult(written int, duplicates int, verb string) *Result {
+	if written == 0 && duplicates > 0 {
+		return &Result{
+			ResultCode: ResultAllDuplicates,
+			Duplicates: duplicates,
+			Message:    fmt.Sprintf("all %d usage records already exist", duplicates),
+		}
+	}
+
+	message := fmt.Sprintf("successfully %s %d usage records", verb, written)
+	if duplicates > 0 {
+		message = fmt.Sprintf("%s, skipped %d existing", message, duplicates)
+	}
+	return &Result{
+		Written:    written,
+		Duplicates: duplicates,
+		Message:    message,
+	}
+}
+
+func newAffectedResult(affected int, verb string) *Result {
+	if affected == 0 {
+		return &Result{
+			ResultCode: ResultNoData,
+			Message:    "no matching records",
+		}
+	}
+	return &Result{
+		Affected: affected,
+		Message:  fmt.Sprintf("successfully %s %d usage records", verb, affected),
+	}
+}
+
+// wraps the context error when ctx is done so cancellations and deadlines
+// can be told apart from backend failures, other errors are classified
+func wrapContextError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return classifyError(errors.Wrapf(ctxErr, "operation interrupted: %v", err))
+	}
+	return classifyError(err)
 }
 
 func NewConnection(dbcfg *Config) (Connection, error) {
+	// the backend defaults to the one named by the connection string,
+	// Validate reports connection strings naming none
+	if dbcfg.Backend == "" {
+		if backend, err := parseUri(dbcfg.ConnString); err == nil {
+			inferred := *dbcfg
+			inferred.Backend = backend
+			dbcfg = &inferred
+		}
+	}
+
+	// fail on misconfiguration before anything connects
+	if vErr := dbcfg.Validate(); vErr != nil {
+		return nil, vErr
+	}
+
+	conn, err := newBackendConnection(dbcfg)
+	if err != nil {
+		return nil, redactError(err, dbcfg.ConnString)
+	}
+
+	// each attempt gets its own deadline
+	conn = NewTimeoutConnection(conn, dbcfg)
+
+	if dbcfg.MaxRetries > 0 {
+		conn = NewRetryConnection(conn, dbcfg)
+	}
+
+	if dbcfg.DeadLetterPath != "" {
+		conn = NewDeadLetterConnection(conn, dbcfg)
+	}
+
+	if dbcfg.AsyncQueueSize > 0 {
+		asyncConn, aErr := NewAsyncConnection(conn, dbcfg)
+		if aErr != nil {
+			conn.Close()
+			return nil, aErr
+		}
+		conn = asyncConn
+	}
+
+	// limit before queueing so rejected clients get an answer right away
+	if dbcfg.MaxRecordsPerMinute > 0 {
+		conn = NewRateLimitedConnection(conn, dbcfg)
+	}
+
+	// repeated writes are answered before they use up rate limits
+	if dbcfg.IdempotencyTTL > 0 {
+		conn = NewIdempotentConnection(conn, dbcfg)
+	}
+
+	// validate outside of retries and the queue, invalid records never
+	// succeed and are reported to the caller right away
+	conn = NewValidatingConnection(conn, dbcfg)
+	return conn, nil
+}
+
+func newBackendConnection(dbcfg *Config) (Connection, error) {
 	w := DatabaseConnection{
 		Config: dbcfg,
+		state:  &connectionState{},
 	}
 	if dbcfg.Backend == Postgres {
-		return GenericSQLConnection{w}, nil
+		return newGenericSQLConnection(w)
 	} else if dbcfg.Backend == MongoDB {
-		return MongoDBConnection{w}, nil
+		return newMongoDBConnection(w)
 	} else if dbcfg.Backend == MySql {
-		return GenericSQLConnection{w}, nil
+		return newGenericSQLConnection(w)
 	} else if dbcfg.Backend == MSSql {
-		return GenericSQLConnection{w}, nil
+		return newGenericSQLConnection(w)
 	} else if dbcfg.Backend == Sqlite {
-		return GenericSQLConnection{w}, nil
+		return newGenericSQLConnection(w)
+	} else if dbcfg.Backend == Elasticsearch {
+		return newElasticsearchConnection(w)
+	} else if dbcfg.Backend == ClickHouse {
+		return newClickHouseConnection(w)
+	} else if dbcfg.Backend == InfluxDB {
+		return newInfluxDBConnection(w)
+	} else if dbcfg.Backend == Redis {
+		return newRedisConnection(w)
+	} else if dbcfg.Backend == File {
+		return newFileConnection(w)
+	} else if dbcfg.Backend == S3 {
+		return newS3Connection(w)
+	} else if dbcfg.Backend == BigQuery {
+		return newBigQueryConnection(w)
+	} else if dbcfg.Backend == Cassandra {
+		return newCassandraConnection(w)
+	} else if dbcfg.Backend == DynamoDB {
+		return newDynamoDBConnection(w)
+	} else if dbcfg.Backend == Discard {
+		return newDiscardConnection(w)
+	} else if dbcfg.Backend == Memory {
+		return newMemoryConnection(w)
+	} else if dbcfg.Backend == Stdout {
+		return newStdoutConnection(w)
 	}
 	// ... other writers
 
-	panic("should not get here")
+	return nil, errors.Errorf("unsupported backend: %v", dbcfg.Backend)
 }
@@ -0,0 +1,169 @@
+package persistence
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestWriteAfterClose(t *testing.T) {
+	for name, connect := range map[string]func(*testing.T, Config) Connection{
+		"sqlite": newTestSqliteConnection,
+		"memory": newTestMemoryConnection,
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn := connect(t, Config{})
+			writeTestRecords(t, conn, newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"))
+			if err := conn.Close(); err != nil {
+				t.Fatalf("closing: %v", err)
+			}
+
+			for idx := 0; idx < 2; idx++ {
+				_, err := conn.Write(context.Background(), newTestScriptRecord("jane", "jane.doe", "2021-06-01T11:00:00Z"), testLogger)
+				if !errors.Is(err, ErrClosed) {
+					t.Errorf("write %d after closing returned %v, want ErrClosed", idx+1, err)
+				}
+			}
+			if err := conn.Close(); err != nil {
+				t.Errorf("closing again: %v", err)
+			}
+		})
+	}
+}
+
+// Close waits for the operations begun before it, later ones fail
+func TestCloseDrainsInflight(t *testing.T) {
+	w := DatabaseConnection{Config: &Config{}, state: &connectionState{}}
+	if err := w.begin(); err != nil {
+		t.Fatalf("beginning: %v", err)
+	}
+
+	drained := make(chan bool)
+	go func() { drained <- w.drain() }()
+	select {
+	case <-drained:
+		t.Fatal("drained with an operation in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	w.end()
+	if first := <-drained; !first {
+		t.Error("first drain reported the connection closed already")
+	}
+	if err := w.begin(); err != ErrClosed {
+		t.Errorf("beginning after closing returned %v, want ErrClosed", err)
+	}
+	if w.drain() {
+		t.Error("second drain closed the connection again")
+	}
+}
+
+// result codes are part of the wire format
+func TestResultCodeValues(t *testing.T) {
+	codes := []int{
+		ResultOK,
+		ResultNoData,
+		ResultDryRunSkipped,
+		ResultHeadersRequired,
+		ResultThrottled,
+		ResultValidationFailed,
+		ResultAllDuplicates,
+		ResultQueueFull,
+		ResultTimeout,
+		ResultRateLimited,
+		ResultQueueBusy,
+	}
+	for value, code := range codes {
+		if code != value {
+			t.Errorf("result code %d is renumbered to %d", value, code)
+		}
+	}
+}
+
+func TestResultCodes(t *testing.T) {
+	for name, connect := range map[string]func(*testing.T, Config) Connection{
+		"sqlite": newTestSqliteConnection,
+		"memory": newTestMemoryConnection,
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn := connect(t, Config{})
+			if res, err := conn.WriteBatch(context.Background(), nil, testLogger); err != nil || res.ResultCode != ResultNoData {
+				t.Errorf("empty batch result is %+v with %v, want no data", res, err)
+			}
+			if _, res, err := conn.Read(context.Background(), nil, testLogger); err != nil || res.ResultCode != ResultNoData {
+				t.Errorf("empty read result is %+v with %v, want no data", res, err)
+			}
+
+			logrec := newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z")
+			if res, err := conn.Write(context.Background(), logrec, testLogger); err != nil || res.ResultCode != ResultOK {
+				t.Errorf("write result is %+v with %v, want ok", res, err)
+			}
+			if _, res, err := conn.Read(context.Background(), nil, testLogger); err != nil || res.ResultCode != ResultOK {
+				t.Errorf("read result is %+v with %v, want ok", res, err)
+			}
+		})
+	}
+}
+
+func TestTimeoutResultCode(t *testing.T) {
+	failing := newFailingConnection(t, context.DeadlineExceeded)
+	conn := NewTimeoutConnection(failing, &Config{})
+	res, err := conn.Write(context.Background(), newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"), testLogger)
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("timed out write returned %v, want ErrTimeout", err)
+	}
+	if res == nil || res.ResultCode != ResultTimeout {
+		t.Errorf("result is %+v, want timeout", res)
+	}
+}
+
+// records stored before the timeout are not dead-lettered
+func TestTimeoutKeepsPartialResult(t *testing.T) {
+	failing := newFailingConnection(t, context.DeadlineExceeded)
+	failing.fails = func(logrec TelemetryRecord) bool {
+		return logrec.(*ScriptTelemetryRecordV2).HostUserName == "john.doe"
+	}
+	conn := NewDeadLetterConnection(NewTimeoutConnection(failing, &Config{}), &Config{DeadLetterPath: filepath.Join(t.TempDir(), "deadletter.json")})
+	res, err := conn.WriteBatch(context.Background(), []TelemetryRecord{
+		newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"),
+		newTestScriptRecord("john", "john.doe", "2021-06-01T10:00:00Z"),
+	}, testLogger)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("timed out write returned %v, want ErrTimeout", err)
+	}
+	if res.ResultCode != ResultTimeout || res.Written != 1 || countFailedRecords(res.Records) != 1 {
+		t.Errorf("result is %+v, want a timeout with one record written and one failed", res)
+	}
+
+	entries := readTestDeadLetters(t, conn.Path)
+	if len(entries) != 1 || !strings.Contains(string(entries[0].Record), "john.doe") {
+		t.Errorf("dead-lettered %v, want the record of john.doe only", entries)
+	}
+}
+
+// unknown backends fail the connection instead of panicking
+func TestNewConnectionUnknownBackend(t *testing.T) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			t.Fatalf("connecting panicked: %v", recovered)
+		}
+	}()
+
+	dbcfg := &Config{Backend: "oracle", ConnString: "oracle://db.local", ScriptTarget: "scripts"}
+	conn, err := NewConnection(dbcfg)
+	if err == nil || conn != nil {
+		t.Fatalf("connecting to an unknown backend returned %v", conn)
+	}
+	if !strings.Contains(err.Error(), `unsupported backend "oracle"`) {
+		t.Errorf("error is %v, want the backend reported as unsupported", err)
+	}
+
+	// past the config validation
+	if _, bErr := newBackendConnection(dbcfg); bErr == nil || bErr.Error() != "unsupported backend: oracle" {
+		t.Errorf("backend selection failed with %v", bErr)
+	}
+}
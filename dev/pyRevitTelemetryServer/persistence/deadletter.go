@@ -0,0 +1,255 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"../cli"
+	"github.com/gofrs/flock"
+	"github.com/pkg/errors"
+)
+
+// one failed record per line, kind tells which record type to decode
+type deadLetterEntry struct {
+	Kind     string          `json:"kind"`
+	FailedAt string          `json:"failed_at"`
+	Error    string          `json:"error"`
+	Record   json.RawMessage `json:"record"`
+}
+
+type deadLetterReplayKey struct{}
+
+// appends records of failed writes to a local ndjson file for replay
+type DeadLetterConnection struct {
+	Connection
+	Path string
+}
+
+func NewDeadLetterConnection(conn Connection, dbcfg *Config) *DeadLetterConnection {
+	return &DeadLetterConnection{
+		Connection: conn,
+		Path:       dbcfg.DeadLetterPath,
+	}
+}
+
+func (w *DeadLetterConnection) Write(ctx context.Context, logrec TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.WriteBatch(ctx, []TelemetryRecord{logrec}, logger)
+}
+
+// only the failed records are dead-lettered when the backend reports
+// which records failed, otherwise the whole batch is. replaying records
+// with a record id skips the ones already stored
+func (w *DeadLetterConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	log := connectionLogger(w.Connection, logger)
+
+	result, err := w.Connection.WriteBatch(ctx, logrecs, logger)
+	if err == nil || ctx.Value(deadLetterReplayKey{}) != nil {
+		return result, err
+	}
+
+	failed := logrecs
+	errs := make([]error, len(logrecs))
+	for idx := range errs {
+		errs[idx] = err
+	}
+	if result != nil && len(result.Records) == len(logrecs) {
+		failed = make([]TelemetryRecord, 0)
+		errs = make([]error, 0)
+		for _, record := range result.Records {
+			if record.Err != nil {
+				failed = append(failed, logrecs[record.Index])
+				errs = append(errs, record.Err)
+			}
+		}
+	}
+
+	log.Debug("dead-lettering usage records", "records", len(failed))
+	if dErr := appendDeadLetters(w.Path, failed, errs); dErr != nil {
+		log.Print("error dead-lettering usage records", "error", dErr)
+	}
+	return result, err
+}
+
+// errs holds the write error of each record
+func appendDeadLetters(path string, logrecs []TelemetryRecord, errs []error) error {
+	failedAt := time.Now().UTC().Format(time.RFC3339)
+	var lines bytes.Buffer
+	for idx, logrec := range logrecs {
+		data, mErr := json.Marshal(logrec)
+		if mErr != nil {
+			return mErr
+		}
+		line, mErr := json.Marshal(deadLetterEntry{
+			Kind:     recordKind(logrec),
+			FailedAt: failedAt,
+			Error:    errs[idx].Error(),
+			Record:   data,
+		})
+		if mErr != nil {
+			return mErr
+		}
+		lines.Write(line)
+		lines.WriteByte('\n')
+	}
+
+	fileLock := flock.New(path + ".lock")
+	if err := fileLock.Lock(); err != nil {
+		return err
+	}
+	defer fileLock.Unlock()
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, wErr := file.Write(lines.Bytes()); wErr != nil {
+		file.Close()
+		return wErr
+	}
+	return file.Close()
+}
+
+// re-attempts the writes in the dead-letter file, entries that still
+// fail are kept in the file. Written counts the replayed records
+func ReplayDeadLetter(ctx context.Context, conn Connection, path string, logger *cli.Logger) (*Result, error) {
+	log := connectionLogger(conn, logger)
+
+	fileLock := flock.New(path + ".lock")
+	if err := fileLock.Lock(); err != nil {
+		return nil, err
+	}
+	defer fileLock.Unlock()
+
+	log.Debug("reading dead-letter file")
+	entries, err := readDeadLetters(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return &Result{
+			ResultCode: ResultNoData,
+			Message:    "no data to write",
+		}, nil
+	}
+
+	// failures are kept here instead of being dead-lettered again
+	replayCtx := context.WithValue(ctx, deadLetterReplayKey{}, true)
+
+	log.Debug("replaying usage records", "records", len(entries))
+	remaining := make([]deadLetterEntry, 0)
+	written := 0
+	for idx, entry := range entries {
+		if ctx.Err() != nil {
+			remaining = append(remaining, entries[idx:]...)
+			break
+		}
+
+		logrec, dErr := decodeDeadLetter(entry)
+		if dErr != nil {
+			log.Debug("skipping undecodable entry", "error", dErr)
+			remaining = append(remaining, entry)
+			continue
+		}
+
+		if _, wErr := conn.Write(replayCtx, logrec, logger); wErr != nil {
+			entry.Error = wErr.Error()
+			remaining = append(remaining, entry)
+			continue
+		}
+		written++
+	}
+
+	log.Debug("rewriting dead-letter file")
+	if rErr := rewriteDeadLetters(path, remaining); rErr != nil {
+		return &Result{Written: written}, rErr
+	}
+
+	if ctx.Err() != nil {
+		return &Result{
+			Written: written,
+			Message: fmt.Sprintf("replayed %d of %d usage records", written, len(entries)),
+		}, wrapContextError(ctx, ctx.Err())
+	}
+
+	log.Debug("preparing report")
+	return &Result{
+		Written: written,
+		Message: fmt.Sprintf("replayed %d of %d usage records", written, len(entries)),
+	}, nil
+}
+
+func readDeadLetters(path string) ([]deadLetterEntry, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make([]deadLetterEntry, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var entry deadLetterEntry
+		if uErr := json.Unmarshal(line, &entry); uErr != nil {
+			return nil, errors.Wrapf(uErr, "invalid entry in %s", path)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// replaces the file atomically, removing it when nothing is left
+func rewriteDeadLetters(path string, entries []deadLetterEntry) error {
+	if len(entries) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	var lines bytes.Buffer
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		lines.Write(line)
+		lines.WriteByte('\n')
+	}
+
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, lines.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func decodeDeadLetter(entry deadLetterEntry) (TelemetryRecord, error) {
+	var logrec TelemetryRecord
+	switch entry.Kind {
+	case "script_v1":
+		logrec = &ScriptTelemetryRecordV1{}
+	case "script_v2":
+		logrec = &ScriptTelemetryRecordV2{}
+	case "event_v2":
+		logrec = &EventTelemetryRecordV2{}
+	default:
+		return nil, errors.Errorf("unknown record kind %q", entry.Kind)
+	}
+	if err := json.Unmarshal(entry.Record, logrec); err != nil {
+		return nil, err
+	}
+	return logrec, nil
+}
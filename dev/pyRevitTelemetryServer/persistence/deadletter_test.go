@@ -0,0 +1,148 @@
+package persistence
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+var errTestWrite = errors.New("backend is down")
+
+func newTestDeadLetterConnection(t *testing.T) (*DeadLetterConnection, *failingConnection) {
+	t.Helper()
+	inner := newFailingConnection(t, errTestWrite)
+	return NewDeadLetterConnection(inner, &Config{DeadLetterPath: filepath.Join(t.TempDir(), "deadletter.json")}), inner
+}
+
+func readTestDeadLetters(t *testing.T, path string) []deadLetterEntry {
+	t.Helper()
+	entries, err := readDeadLetters(path)
+	if err != nil {
+		t.Fatalf("reading dead letters: %v", err)
+	}
+	return entries
+}
+
+func TestDeadLetterFailedWrite(t *testing.T) {
+	conn, inner := newTestDeadLetterConnection(t)
+	_, err := conn.WriteBatch(context.Background(), []TelemetryRecord{
+		newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"),
+		newTestEventRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"),
+	}, testLogger)
+	if err != errTestWrite {
+		t.Fatalf("writing returned %v, want the backend error", err)
+	}
+
+	entries := readTestDeadLetters(t, conn.Path)
+	if len(entries) != 2 {
+		t.Fatalf("dead-lettered %d records, want 2", len(entries))
+	}
+	if entries[0].Kind != "script_v2" || entries[1].Kind != "event_v2" {
+		t.Errorf("dead-lettered kinds %q and %q", entries[0].Kind, entries[1].Kind)
+	}
+	for _, entry := range entries {
+		if entry.Error != errTestWrite.Error() || entry.FailedAt == "" {
+			t.Errorf("entry has error %q at %q", entry.Error, entry.FailedAt)
+		}
+	}
+
+	inner.setErr(nil)
+	res, rErr := ReplayDeadLetter(context.Background(), conn, conn.Path, testLogger)
+	if rErr != nil {
+		t.Fatalf("replaying: %v", rErr)
+	}
+	if res.Written != 2 {
+		t.Errorf("replayed %d records, want 2", res.Written)
+	}
+	if _, sErr := os.Stat(conn.Path); !os.IsNotExist(sErr) {
+		t.Errorf("dead-letter file is left after replaying all entries: %v", sErr)
+	}
+	if records := readTestRecords(t, inner, nil); len(records) != 1 {
+		t.Errorf("found %d script records after replaying, want 1", len(records))
+	}
+	if events := readTestRecords(t, inner, &RecordFilter{RecordType: EventRecord}); len(events) != 1 {
+		t.Errorf("found %d events after replaying, want 1", len(events))
+	}
+}
+
+// backends reporting the failed records of a batch dead-letter only those
+func TestDeadLetterFailedRecords(t *testing.T) {
+	conn, inner := newTestDeadLetterConnection(t)
+	inner.fails = func(logrec TelemetryRecord) bool {
+		return logrec.(*ScriptTelemetryRecordV2).HostUserName == "john.doe"
+	}
+	res, err := conn.WriteBatch(context.Background(), []TelemetryRecord{
+		newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"),
+		newTestScriptRecord("john", "john.doe", "2021-06-01T10:00:00Z"),
+	}, testLogger)
+	if err == nil || res.Written != 1 {
+		t.Fatalf("writing returned %+v, %v, want one record written", res, err)
+	}
+
+	entries := readTestDeadLetters(t, conn.Path)
+	if len(entries) != 1 || !strings.Contains(string(entries[0].Record), "john.doe") {
+		t.Errorf("dead-lettered %v, want the record of john.doe only", entries)
+	}
+}
+
+// entries failing again stay in the file once, with the new error
+func TestReplayDeadLetterKeepsFailures(t *testing.T) {
+	conn, inner := newTestDeadLetterConnection(t)
+	conn.WriteBatch(context.Background(), []TelemetryRecord{
+		newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"),
+		newTestScriptRecord("john", "john.doe", "2021-06-01T10:00:00Z"),
+	}, testLogger)
+
+	replayErr := errors.New("record is rejected")
+	inner.setErr(replayErr)
+	inner.fails = func(logrec TelemetryRecord) bool {
+		return logrec.(*ScriptTelemetryRecordV2).HostUserName == "john.doe"
+	}
+	res, err := ReplayDeadLetter(context.Background(), conn, conn.Path, testLogger)
+	if err != nil {
+		t.Fatalf("replaying: %v", err)
+	}
+	if res.Written != 1 {
+		t.Errorf("replayed %d records, want 1", res.Written)
+	}
+
+	entries := readTestDeadLetters(t, conn.Path)
+	if len(entries) != 1 {
+		t.Fatalf("kept %d entries, want 1", len(entries))
+	}
+	if !strings.Contains(string(entries[0].Record), "john.doe") || entries[0].Error != replayErr.Error() {
+		t.Errorf("kept %s with error %q, want the record of john.doe with the replay error", entries[0].Record, entries[0].Error)
+	}
+}
+
+func TestReplayDeadLetterWithoutFile(t *testing.T) {
+	conn, _ := newTestDeadLetterConnection(t)
+	res, err := ReplayDeadLetter(context.Background(), conn, conn.Path, testLogger)
+	if err != nil {
+		t.Fatalf("replaying: %v", err)
+	}
+	if res.ResultCode != ResultNoData {
+		t.Errorf("result code is %d, want %d", res.ResultCode, ResultNoData)
+	}
+}
+
+// only the record the database rejects is dead-lettered
+func TestDeadLetterSqlPartialFailure(t *testing.T) {
+	conn := NewDeadLetterConnection(newTestRejectingSqliteConnection(t), &Config{DeadLetterPath: filepath.Join(t.TempDir(), "deadletter.json")})
+	if _, err := conn.WriteBatch(context.Background(), []TelemetryRecord{
+		newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"),
+		newTestScriptRecord("john", "john.doe", "2021-06-01T11:00:00Z"),
+		newTestScriptRecord("jane", "jane.doe", "2021-06-01T12:00:00Z"),
+	}, testLogger); err == nil {
+		t.Fatal("writing a rejected record succeeded")
+	}
+
+	entries := readTestDeadLetters(t, conn.Path)
+	if len(entries) != 1 || !strings.Contains(string(entries[0].Record), "john.doe") {
+		t.Errorf("dead-lettered %v, want the record of john.doe only", entries)
+	}
+}
@@ -0,0 +1,110 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"../cli"
+)
+
+// accepts every record without storing it, for load testing the server
+// and running it without a database. connection string is discard:
+type DiscardConnection struct {
+	DatabaseConnection
+}
+
+func newDiscardConnection(w DatabaseConnection) (*DiscardConnection, error) {
+	return &DiscardConnection{DatabaseConnection: w}, nil
+}
+
+func (w *DiscardConnection) GetType() DBBackend {
+	return w.Config.Backend
+}
+
+func (w *DiscardConnection) GetVersion(logger *cli.Logger) string {
+	return "discard"
+}
+
+func (w *DiscardConnection) GetStatus(logger *cli.Logger) ConnectionStatus {
+	return newConnectionStatus(w.Ping(context.Background()), w.GetVersion(logger))
+}
+
+func (w *DiscardConnection) Ping(ctx context.Context) error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+	w.end()
+	return nil
+}
+
+func (w *DiscardConnection) Write(ctx context.Context, logrec TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.WriteBatch(ctx, []TelemetryRecord{logrec}, logger)
+}
+
+// records count as written so callers see the same results as with a
+// real backend
+func (w *DiscardConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	if len(logrecs) == 0 {
+		return &Result{
+			ResultCode: ResultNoData,
+			Message:    "no data to write",
+		}, nil
+	}
+	w.Config.structured(logger).Debug("discarding records", "records", len(logrecs))
+	return &Result{
+		ResultCode: ResultOK,
+		Written:    len(logrecs),
+		Message:    fmt.Sprintf("successfully discarded %d usage records", len(logrecs)),
+	}, nil
+}
+
+// nothing is ever stored so nothing matches
+func (w *DiscardConnection) Read(ctx context.Context, filter *RecordFilter, logger *cli.Logger) ([]TelemetryRecord, *Result, error) {
+	if err := w.begin(); err != nil {
+		return nil, nil, err
+	}
+	defer w.end()
+
+	records := make([]TelemetryRecord, 0)
+	return records, newReadResult(records, filter), nil
+}
+
+func (w *DiscardConnection) ReadStream(ctx context.Context, filter *RecordFilter, logger *cli.Logger) (<-chan TelemetryRecord, <-chan error) {
+	return newRecordStream(ctx, func(send func(TelemetryRecord) bool) error {
+		return nil
+	})
+}
+
+func (w *DiscardConnection) AggregateCommandCounts(ctx context.Context, from time.Time, to time.Time) (map[string]int, error) {
+	return make(map[string]int), nil
+}
+
+func (w *DiscardConnection) RecentByUser(ctx context.Context, username string, n int) ([]TelemetryRecord, error) {
+	if err := validateRecentCount(n); err != nil {
+		return nil, err
+	}
+	return make([]TelemetryRecord, 0), nil
+}
+
+func (w *DiscardConnection) DeleteByUser(ctx context.Context, username string) (*Result, error) {
+	return newAffectedResult(0, "deleted"), nil
+}
+
+func (w *DiscardConnection) AnonymizeUser(ctx context.Context, username string) (*Result, error) {
+	return newAffectedResult(0, "anonymized"), nil
+}
+
+func (w *DiscardConnection) PurgeOlderThan(ctx context.Context, cutoff time.Time) (*Result, error) {
+	return newAffectedResult(0, "purged"), nil
+}
+
+func (w *DiscardConnection) Close() error {
+	w.drain()
+	return nil
+}
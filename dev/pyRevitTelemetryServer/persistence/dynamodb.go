@@ -0,0 +1,270 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"../cli"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+	"github.com/pkg/errors"
+)
+
+// dynamodb accepts at most 25 items per BatchWriteItem call
+const dynamoBatchSize = 25
+
+// attempts at writing back unprocessed items before giving up
+const dynamoMaxAttempts = 5
+
+// items are keyed by host, sorted by timestamp#recordid
+const (
+	dynamoPartitionKey = "host"
+	dynamoSortKey      = "timestamp_id"
+)
+
+type DynamoDBConnection struct {
+	DatabaseConnection
+	client *dynamodb.Client
+}
+
+func newDynamoDBConnection(w DatabaseConnection) (*DynamoDBConnection, error) {
+	// dynamodb:us-east-1, region from the aws environment when empty
+	region := strings.Replace(w.Config.ConnString, string(DynamoDB)+":", "", 1)
+
+	awscfg, err := awsconfig.LoadDefaultConfig(
+		context.Background(),
+		awsconfig.WithRegion(region))
+	if err != nil {
+		return nil, err
+	}
+
+	client := dynamodb.NewFromConfig(awscfg, func(opts *dynamodb.Options) {
+		// custom endpoints are local or compatible stores
+		if w.Config.DynamoDBEndpoint != "" {
+			opts.BaseEndpoint = aws.String(w.Config.DynamoDBEndpoint)
+		}
+	})
+	return &DynamoDBConnection{DatabaseConnection: w, client: client}, nil
+}
+
+func (w *DynamoDBConnection) GetType() DBBackend {
+	return w.Config.Backend
+}
+
+func (w *DynamoDBConnection) GetVersion(logger *cli.Logger) string {
+	return "dynamodb"
+}
+
+func (w *DynamoDBConnection) GetStatus(logger *cli.Logger) ConnectionStatus {
+	return newConnectionStatus(w.Ping(context.Background()), w.GetVersion(logger))
+}
+
+func (w *DynamoDBConnection) Ping(ctx context.Context) error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+	defer w.end()
+
+	pingCtx, cancel := w.Config.newPingContext(ctx)
+	defer cancel()
+
+	_, err := w.client.DescribeTable(pingCtx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(w.Config.ScriptTarget),
+	})
+	return wrapContextError(pingCtx, err)
+}
+
+func (w *DynamoDBConnection) Write(ctx context.Context, logrec TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.WriteBatch(ctx, []TelemetryRecord{logrec}, logger)
+}
+
+func (w *DynamoDBConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	log := w.Config.structured(logger)
+
+	if len(logrecs) == 0 {
+		return &Result{
+			ResultCode: ResultNoData,
+			Message:    "no data to write",
+		}, nil
+	}
+
+	log.Debug("generating items")
+	requests := make([]dynamoWriteRequest, 0, len(logrecs))
+	for _, logrec := range logrecs {
+		item, iErr := generateDynamoItem(logrec)
+		if iErr != nil {
+			return nil, iErr
+		}
+		requests = append(requests, dynamoWriteRequest{
+			table: w.Config.targetFor(logrec),
+			request: types.WriteRequest{
+				PutRequest: &types.PutRequest{Item: item},
+			},
+		})
+	}
+
+	written := 0
+	for start := 0; start < len(requests); start += dynamoBatchSize {
+		end := start + dynamoBatchSize
+		if end > len(requests) {
+			end = len(requests)
+		}
+
+		log.Debug("writing items", "from", start+1, "to", end)
+		count, bErr := w.writeChunk(ctx, requests[start:end], logger)
+		written += count
+		if bErr != nil {
+			result := &Result{
+				Written: written,
+				Message: fmt.Sprintf("wrote %d of %d usage records", written, len(logrecs)),
+			}
+			if isDynamoThrottle(bErr) {
+				result.ResultCode = ResultThrottled
+				result.Message = fmt.Sprintf("throttled, %s", result.Message)
+			}
+			return result, wrapContextError(ctx, bErr)
+		}
+	}
+
+	log.Debug("preparing report")
+	return &Result{
+		Written: written,
+		Message: fmt.Sprintf("successfully wrote %d usage records", written),
+	}, nil
+}
+
+func (w *DynamoDBConnection) Close() error {
+	w.drain()
+	return nil
+}
+
+type dynamoWriteRequest struct {
+	table   string
+	request types.WriteRequest
+}
+
+// writes up to 25 items, writing back unprocessed items with backoff
+// returns the number of items written
+func (w *DynamoDBConnection) writeChunk(ctx context.Context, chunk []dynamoWriteRequest, logger *cli.Logger) (int, error) {
+	pending := make(map[string][]types.WriteRequest)
+	for _, item := range chunk {
+		pending[item.table] = append(pending[item.table], item.request)
+	}
+
+	for attempt := 0; ; attempt++ {
+		output, err := w.client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: pending,
+		})
+		if err != nil {
+			return len(chunk) - countDynamoRequests(pending), err
+		}
+
+		pending = output.UnprocessedItems
+		remaining := countDynamoRequests(pending)
+		if remaining == 0 {
+			return len(chunk), nil
+		}
+		if attempt+1 >= dynamoMaxAttempts {
+			return len(chunk) - remaining, errUnprocessedItems(remaining)
+		}
+
+		backoff := w.backoff(attempt)
+		w.Config.structured(logger).Debug("items unprocessed, retrying", "items", remaining, "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return len(chunk) - remaining, ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// exponentially growing backoff, capped at MaxBackoff
+func (w *DynamoDBConnection) backoff(attempt int) time.Duration {
+	maxBackoff := w.Config.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+	if backoff := DefaultRetryBackoff << uint(attempt); backoff > 0 && backoff < maxBackoff {
+		return backoff
+	}
+	return maxBackoff
+}
+
+// unprocessed items are what dynamodb returns when throughput is exceeded
+type errUnprocessedItems int
+
+func (e errUnprocessedItems) Error() string {
+	return fmt.Sprintf("%d items left unprocessed", int(e))
+}
+
+func isDynamoThrottle(err error) bool {
+	var unprocessed errUnprocessedItems
+	if errors.As(err, &unprocessed) {
+		return true
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "ProvisionedThroughputExceededException", "ThrottlingException", "RequestLimitExceeded":
+			return true
+		}
+	}
+	return false
+}
+
+func countDynamoRequests(requests map[string][]types.WriteRequest) int {
+	count := 0
+	for _, items := range requests {
+		count += len(items)
+	}
+	return count
+}
+
+func generateDynamoItem(logrec TelemetryRecord) (map[string]types.AttributeValue, error) {
+	item, err := attributevalue.MarshalMapWithOptions(logrec, func(opts *attributevalue.EncoderOptions) {
+		opts.TagKey = "json"
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := logrec.GetTimeStamp()
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	host := ""
+	switch rec := logrec.(type) {
+	case *ScriptTelemetryRecordV1:
+		host = rec.UserName
+	case *ScriptTelemetryRecordV2:
+		host = rec.HostUserName
+	case *EventTelemetryRecordV2:
+		host = rec.HostUserName
+	}
+	if host == "" {
+		return nil, errors.New("dynamodb backend requires records with a host user")
+	}
+
+	recordId, idErr := newRecordId(logrec)
+	if idErr != nil {
+		return nil, idErr
+	}
+	item[dynamoPartitionKey] = &types.AttributeValueMemberS{Value: host}
+	item[dynamoSortKey] = &types.AttributeValueMemberS{
+		Value: fmt.Sprintf("%s#%s", timestamp.UTC().Format(time.RFC3339Nano), recordId),
+	}
+	return item, nil
+}
@@ -0,0 +1,207 @@
+package persistence
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"../cli"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/pkg/errors"
+)
+
+type ElasticsearchConnection struct {
+	DatabaseConnection
+	client *elasticsearch.Client
+}
+
+type elasticBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+func newElasticsearchConnection(w DatabaseConnection) (*ElasticsearchConnection, error) {
+	// elasticsearch:http://host1:9200,http://host2:9200
+	addresses := strings.Split(
+		strings.Replace(w.Config.ConnString, string(Elasticsearch)+":", "", 1), ",")
+
+	client, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: addresses,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ElasticsearchConnection{w, client}, nil
+}
+
+func (w *ElasticsearchConnection) GetType() DBBackend {
+	return w.Config.Backend
+}
+
+func (w *ElasticsearchConnection) GetVersion(logger *cli.Logger) string {
+	if err := w.begin(); err != nil {
+		return ""
+	}
+	defer w.end()
+
+	w.Config.structured(logger).Debug("getting elasticsearch version")
+	res, err := w.client.Info()
+	if err != nil {
+		return ""
+	}
+	defer res.Body.Close()
+
+	var info struct {
+		Version struct {
+			Number string `json:"number"`
+		} `json:"version"`
+	}
+	if dErr := json.NewDecoder(res.Body).Decode(&info); dErr != nil {
+		return ""
+	}
+	return info.Version.Number
+}
+
+func (w *ElasticsearchConnection) GetStatus(logger *cli.Logger) ConnectionStatus {
+	if err := w.Ping(context.Background()); err != nil {
+		return newConnectionStatus(err, "")
+	}
+	return newConnectionStatus(nil, w.GetVersion(logger))
+}
+
+func (w *ElasticsearchConnection) Ping(ctx context.Context) error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+	defer w.end()
+
+	pingCtx, cancel := w.Config.newPingContext(ctx)
+	defer cancel()
+
+	res, err := w.client.Ping(w.client.Ping.WithContext(pingCtx))
+	if err != nil {
+		return wrapContextError(pingCtx, err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return errors.Errorf("elasticsearch ping failed: %s", res.Status())
+	}
+	return nil
+}
+
+func (w *ElasticsearchConnection) Write(ctx context.Context, logrec TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.WriteBatch(ctx, []TelemetryRecord{logrec}, logger)
+}
+
+func (w *ElasticsearchConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	log := w.Config.structured(logger)
+
+	if len(logrecs) == 0 {
+		return &Result{
+			ResultCode: ResultNoData,
+			Message:    "no data to write",
+		}, nil
+	}
+
+	// build ndjson bulk request body
+	log.Debug("building bulk request")
+	var body bytes.Buffer
+	for _, logrec := range logrecs {
+		action := map[string]interface{}{
+			"index": map[string]string{"_index": w.indexFor(logrec)},
+		}
+		actionLine, aErr := json.Marshal(action)
+		if aErr != nil {
+			return nil, aErr
+		}
+		docLine, dErr := json.Marshal(logrec)
+		if dErr != nil {
+			return nil, dErr
+		}
+		body.Write(actionLine)
+		body.WriteByte('\n')
+		body.Write(docLine)
+		body.WriteByte('\n')
+	}
+
+	log.Debug("running bulk request")
+	res, err := w.client.Bulk(
+		bytes.NewReader(body.Bytes()),
+		w.client.Bulk.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, wrapContextError(ctx, err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, errors.Errorf("elasticsearch bulk request failed: %s", res.Status())
+	}
+
+	log.Debug("reading bulk response")
+	var bulkRes elasticBulkResponse
+	if dErr := json.NewDecoder(res.Body).Decode(&bulkRes); dErr != nil {
+		return nil, dErr
+	}
+
+	// report per-document failures
+	written := 0
+	failures := make([]string, 0)
+	for idx, item := range bulkRes.Items {
+		for _, op := range item {
+			if op.Status >= 200 && op.Status < 300 {
+				written++
+			} else {
+				failures = append(
+					failures,
+					fmt.Sprintf("document %d: %s: %s", idx, op.Error.Type, op.Error.Reason))
+			}
+		}
+	}
+
+	log.Debug("preparing report")
+	if len(failures) > 0 {
+		return &Result{
+			Written: written,
+			Message: fmt.Sprintf(
+				"indexed %d of %d usage documents; %s",
+				written, len(logrecs), strings.Join(failures, "; ")),
+		}, errors.Errorf("%d documents failed to index", len(failures))
+	}
+
+	return &Result{
+		Written: written,
+		Message: fmt.Sprintf("successfully indexed %d usage documents", written),
+	}, nil
+}
+
+func (w *ElasticsearchConnection) Close() error {
+	w.drain()
+	return nil
+}
+
+// time-based index from target name, e.g. pyrevit-telemetry-2024.03
+func (w *ElasticsearchConnection) indexFor(logrec TelemetryRecord) string {
+	timestamp := logrec.GetTimeStamp()
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	// index names must be lowercase
+	return strings.ToLower(
+		fmt.Sprintf("%s-%s", w.Config.targetFor(logrec), timestamp.UTC().Format("2006.01")))
+}
@@ -0,0 +1,153 @@
+package persistence
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// prefix of all environment variables read by LoadConfigFromEnv
+const EnvPrefix = "PYREVIT_TELEMETRY_"
+
+// json config file the environment is layered on, optional
+const EnvConfigFile = EnvPrefix + "CONFIG"
+
+// environment variable suffixes and the config fields they set
+var envSettings = []struct {
+	name  string
+	apply func(cfg *Config, value string) error
+}{
+	{"BACKEND", func(cfg *Config, value string) error {
+		cfg.Backend = DBBackend(value)
+		return nil
+	}},
+	{"DSN", func(cfg *Config, value string) error {
+		cfg.ConnString = value
+		return nil
+	}},
+	{"READ_DSN", func(cfg *Config, value string) error {
+		cfg.ReadConnString = value
+		return nil
+	}},
+	{"TABLE", func(cfg *Config, value string) error {
+		cfg.ScriptTarget = value
+		return nil
+	}},
+	{"EVENTS_TABLE", func(cfg *Config, value string) error {
+		cfg.EventTarget = value
+		return nil
+	}},
+	{"REQUEST_TIMEOUT", envDuration(func(cfg *Config) *time.Duration { return &cfg.RequestTimeout })},
+	{"PING_TIMEOUT", envDuration(func(cfg *Config) *time.Duration { return &cfg.PingTimeout })},
+	{"WRITE_TIMEOUT", envDuration(func(cfg *Config) *time.Duration { return &cfg.WriteTimeout })},
+	{"TLS_ENABLED", func(cfg *Config, value string) error {
+		enabled, err := strconv.ParseBool(value)
+		cfg.TLSEnabled = enabled
+		return err
+	}},
+	{"TLS_CA_CERT", func(cfg *Config, value string) error {
+		cfg.CACertPath = value
+		return nil
+	}},
+	{"TLS_CLIENT_CERT", func(cfg *Config, value string) error {
+		cfg.ClientCertPath = value
+		return nil
+	}},
+	{"TLS_CLIENT_KEY", func(cfg *Config, value string) error {
+		cfg.ClientKeyPath = value
+		return nil
+	}},
+	{"SOCKET_PATH", func(cfg *Config, value string) error {
+		cfg.SocketPath = value
+		return nil
+	}},
+	{"MAX_OPEN_CONNS", envInt(func(cfg *Config) *int { return &cfg.MaxOpenConns })},
+	{"MAX_IDLE_CONNS", envInt(func(cfg *Config) *int { return &cfg.MaxIdleConns })},
+	{"CONN_MAX_LIFETIME", envDuration(func(cfg *Config) *time.Duration { return &cfg.ConnMaxLifetime })},
+	{"CONN_MAX_IDLE_TIME", envDuration(func(cfg *Config) *time.Duration { return &cfg.ConnMaxIdleTime })},
+	{"RETENTION_DAYS", envInt(func(cfg *Config) *int { return &cfg.RetentionDays })},
+	{"LOG_FORMAT", func(cfg *Config, value string) error {
+		cfg.LogFormat = value
+		return nil
+	}},
+	{"ANONYMIZATION_KEY", func(cfg *Config, value string) error {
+		cfg.AnonymizationKey = value
+		return nil
+	}},
+}
+
+// reads the config from PYREVIT_TELEMETRY_* environment variables,
+// layered on top of the json file named by PYREVIT_TELEMETRY_CONFIG.
+// durations are go duration strings e.g. 30s. the backend defaults to
+// the one named by the connection string
+func LoadConfigFromEnv() (*Config, error) {
+	cfg := &Config{}
+	if path := os.Getenv(EnvConfigFile); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "config file can not be read")
+		}
+		if uErr := json.Unmarshal(data, cfg); uErr != nil {
+			return nil, errors.Wrapf(uErr, "config file %s is invalid", path)
+		}
+	}
+
+	// a backend from the file does not apply to a connection string
+	// from the environment
+	_, envBackend := os.LookupEnv(EnvPrefix + "BACKEND")
+	if _, envConnString := os.LookupEnv(EnvPrefix + "DSN"); envConnString && !envBackend {
+		cfg.Backend = ""
+	}
+
+	for _, setting := range envSettings {
+		value, exists := os.LookupEnv(EnvPrefix + setting.name)
+		if !exists {
+			continue
+		}
+		if err := setting.apply(cfg, value); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s%s", EnvPrefix, setting.name)
+		}
+	}
+
+	if cfg.ConnString == "" {
+		return nil, errors.Errorf("connection string is required, set %sDSN", EnvPrefix)
+	}
+	backend, err := parseUri(cfg.ConnString)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %sDSN", EnvPrefix)
+	}
+	if cfg.Backend == "" {
+		cfg.Backend = backend
+	} else if cfg.Backend != backend {
+		return nil, errors.Errorf(
+			"backend %s does not match the %s connection string, check %sBACKEND",
+			cfg.Backend, backend, EnvPrefix)
+	}
+	return cfg, nil
+}
+
+func envDuration(field func(cfg *Config) *time.Duration) func(cfg *Config, value string) error {
+	return func(cfg *Config, value string) error {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*field(cfg) = duration
+		return nil
+	}
+}
+
+func envInt(field func(cfg *Config) *int) func(cfg *Config, value string) error {
+	return func(cfg *Config, value string) error {
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*field(cfg) = number
+		return nil
+	}
+}
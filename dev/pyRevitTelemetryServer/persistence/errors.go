@@ -0,0 +1,153 @@
+package persistence
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// classes of backend failures, match them with errors.Is. the driver
+// error stays reachable with errors.As
+var (
+	ErrConnection = errors.New("backend connection failed")
+	ErrConstraint = errors.New("record violates a backend constraint")
+	ErrTimeout    = errors.New("backend operation timed out")
+	ErrClosed     = errors.New("connection is closed")
+)
+
+// driver error tagged with the class it belongs to
+type classifiedError struct {
+	class error
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+func (e *classifiedError) Cause() error {
+	return e.err
+}
+
+func (e *classifiedError) Is(target error) bool {
+	return target == e.class
+}
+
+// tags the error with its class, errors of no known class are returned
+// as they are
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var classified *classifiedError
+	if errors.As(err, &classified) {
+		return err
+	}
+	if class := errorClass(err); class != nil {
+		return &classifiedError{class: class, err: err}
+	}
+	return err
+}
+
+func errorClass(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	if errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, mysql.ErrInvalidConn) {
+		return ErrConnection
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return ErrTimeout
+		}
+		return ErrConnection
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// integrity constraint violation, connection exception, query
+		// canceled by statement timeout, db restarting
+		code := string(pqErr.Code)
+		switch {
+		case strings.HasPrefix(code, "23"):
+			return ErrConstraint
+		case strings.HasPrefix(code, "08"), code == "57P01", code == "57P03":
+			return ErrConnection
+		case code == "57014":
+			return ErrTimeout
+		}
+		return nil
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		// duplicate entry, null column, foreign keys, lock wait timeout,
+		// server gone, lost connection
+		switch mysqlErr.Number {
+		case 1048, 1062, 1451, 1452:
+			return ErrConstraint
+		case 1205:
+			return ErrTimeout
+		case 2006, 2013:
+			return ErrConnection
+		}
+		return nil
+	}
+
+	var mssqlErr mssql.Error
+	if errors.As(err, &mssqlErr) {
+		// null column, foreign keys, unique key and index, timeout
+		switch mssqlErr.Number {
+		case 515, 547, 2601, 2627:
+			return ErrConstraint
+		case -2:
+			return ErrTimeout
+		}
+		return nil
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		if sqliteErr.Code == sqlite3.ErrConstraint {
+			return ErrConstraint
+		}
+		return nil
+	}
+
+	switch {
+	case mongo.IsDuplicateKeyError(err):
+		return ErrConstraint
+	case mongo.IsTimeout(err):
+		return ErrTimeout
+	case mongo.IsNetworkError(err):
+		return ErrConnection
+	}
+	return nil
+}
+
+// failures caused by the records being written, others would fail every
+// record of a batch the same way
+func isRecordError(ctx context.Context, err error) bool {
+	return ctx.Err() == nil && !errors.Is(err, ErrConnection) && !errors.Is(err, ErrTimeout) && !errors.Is(err, ErrClosed)
+}
@@ -0,0 +1,123 @@
+package persistence
+
+import (
+	"context"
+	"database/sql/driver"
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		class error
+	}{
+		{"deadline", context.DeadlineExceeded, ErrTimeout},
+		{"bad connection", driver.ErrBadConn, ErrConnection},
+		{"refused", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, ErrConnection},
+		{"network timeout", &net.DNSError{Err: "i/o timeout", IsTimeout: true}, ErrTimeout},
+		{"postgres unique", &pq.Error{Code: "23505"}, ErrConstraint},
+		{"postgres not null", &pq.Error{Code: "23502"}, ErrConstraint},
+		{"postgres connection", &pq.Error{Code: "08006"}, ErrConnection},
+		{"postgres shutdown", &pq.Error{Code: "57P01"}, ErrConnection},
+		{"postgres statement timeout", &pq.Error{Code: "57014"}, ErrTimeout},
+		{"postgres syntax", &pq.Error{Code: "42601"}, nil},
+		{"mysql duplicate", &mysql.MySQLError{Number: 1062}, ErrConstraint},
+		{"mysql lock wait", &mysql.MySQLError{Number: 1205}, ErrTimeout},
+		{"mysql server gone", &mysql.MySQLError{Number: 2006}, ErrConnection},
+		{"mysql invalid connection", mysql.ErrInvalidConn, ErrConnection},
+		{"mysql unknown table", &mysql.MySQLError{Number: 1146}, nil},
+		{"sqlserver unique", mssql.Error{Number: 2627}, ErrConstraint},
+		{"sqlserver timeout", mssql.Error{Number: -2}, ErrTimeout},
+		{"sqlserver syntax", mssql.Error{Number: 102}, nil},
+		{"sqlite constraint", sqlite3.Error{Code: sqlite3.ErrConstraint}, ErrConstraint},
+		{"sqlite busy", sqlite3.Error{Code: sqlite3.ErrBusy}, nil},
+		{"mongodb duplicate", mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 11000}}}, ErrConstraint},
+		{"wrapped", errors.Wrap(&pq.Error{Code: "23505"}, "inserting records"), ErrConstraint},
+		{"unknown", errors.New("unknown telemetry record type"), nil},
+	}
+	sentinels := []error{ErrConnection, ErrConstraint, ErrTimeout, ErrClosed}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := classifyError(test.err)
+			for _, sentinel := range sentinels {
+				if is := errors.Is(err, sentinel); is != (sentinel == test.class) {
+					t.Errorf("%v is %v: %v", err, sentinel, is)
+				}
+			}
+			// some driver errors hold slices and can not be compared
+			if !reflect.DeepEqual(errors.Cause(err), errors.Cause(test.err)) {
+				t.Errorf("driver error is not reachable from %v", err)
+			}
+			if err.Error() != test.err.Error() {
+				t.Errorf("message is %q, want %q", err.Error(), test.err.Error())
+			}
+		})
+	}
+
+	if classifyError(nil) != nil {
+		t.Error("nil error is classified")
+	}
+}
+
+// the driver error stays reachable with errors.As
+func TestClassifyErrorAs(t *testing.T) {
+	err := classifyError(errors.Wrap(&pq.Error{Code: "23505", Constraint: "scripts_pkey"}, "inserting records"))
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Constraint != "scripts_pkey" {
+		t.Errorf("postgres error is not reachable from %v", err)
+	}
+	if again := classifyError(err); again != err {
+		t.Errorf("classified error is wrapped again as %v", again)
+	}
+}
+
+func TestClassifySqliteError(t *testing.T) {
+	conn := newTestSqliteConnection(t, Config{})
+	sqlConn, _ := unwrapSQLConnection(conn)
+	logrec := newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z")
+	writeTestRecords(t, conn, logrec)
+
+	var recordId string
+	if err := sqlConn.db.QueryRow("SELECT id FROM scripts").Scan(&recordId); err != nil {
+		t.Fatalf("reading id: %v", err)
+	}
+	_, err := sqlConn.db.Exec("INSERT INTO scripts (id) VALUES (?)", recordId)
+	if !errors.Is(classifyError(err), ErrConstraint) {
+		t.Errorf("duplicate id error %v is not a constraint error", err)
+	}
+}
+
+func TestIsRecordError(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		err    error
+		record bool
+	}{
+		{"constraint", context.Background(), classifyError(&pq.Error{Code: "23505"}), true},
+		{"unclassified", context.Background(), errors.New("invalid input syntax"), true},
+		{"connection", context.Background(), classifyError(driver.ErrBadConn), false},
+		{"timeout", context.Background(), classifyError(context.DeadlineExceeded), false},
+		{"closed", context.Background(), ErrClosed, false},
+		{"canceled", canceled, errors.New("invalid input syntax"), false},
+	}
+	for _, test := range tests {
+		if record := isRecordError(test.ctx, test.err); record != test.record {
+			t.Errorf("%s error is a record error: %v, want %v", test.name, record, test.record)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package persistence
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"../cli"
+)
+
+// column holding the fields records carry beyond the known ones
+const extrasColumn = "extras"
+
+// json column type per dialect, others store extras as text
+var sqlJSONTypes = map[DBBackend]string{
+	Postgres: "JSONB",
+	MySql:    "JSON",
+}
+
+func (logrec *ScriptTelemetryRecordV2) UnmarshalJSON(data []byte) error {
+	type plainRecord ScriptTelemetryRecordV2
+	var plain plainRecord
+	if err := json.Unmarshal(data, &plain); err != nil {
+		return err
+	}
+	extras, err := collectExtras(data, reflect.TypeOf(plain), plain.Extras)
+	if err != nil {
+		return err
+	}
+	plain.Extras = extras
+	*logrec = ScriptTelemetryRecordV2(plain)
+	return nil
+}
+
+func (logrec *EventTelemetryRecordV2) UnmarshalJSON(data []byte) error {
+	type plainRecord EventTelemetryRecordV2
+	var plain plainRecord
+	if err := json.Unmarshal(data, &plain); err != nil {
+		return err
+	}
+	extras, err := collectExtras(data, reflect.TypeOf(plain), plain.Extras)
+	if err != nil {
+		return err
+	}
+	plain.Extras = extras
+	*logrec = EventTelemetryRecordV2(plain)
+	return nil
+}
+
+// merges the top level fields the record type does not declare into
+// the extras the client sent explicitly, explicit extras take precedence
+func collectExtras(data []byte, recordType reflect.Type, extras map[string]interface{}) (map[string]interface{}, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	known := taggedFieldNames(recordType, "json")
+	for name, raw := range fields {
+		if known[name] {
+			continue
+		}
+		if _, exists := extras[name]; exists {
+			continue
+		}
+		var value interface{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, err
+		}
+		if extras == nil {
+			extras = make(map[string]interface{})
+		}
+		extras[name] = value
+	}
+	return extras, nil
+}
+
+// field names under the given tag, the go name for untagged fields
+func taggedFieldNames(recordType reflect.Type, tag string) map[string]bool {
+	names := make(map[string]bool)
+	for idx := 0; idx < recordType.NumField(); idx++ {
+		field := recordType.Field(idx)
+		name := strings.Split(field.Tag.Get(tag), ",")[0]
+		if name == "" {
+			name = field.Name
+		}
+		names[name] = true
+	}
+	return names
+}
+
+// tables created before the column existed get it added
+func (w *GenericSQLConnection) ensureColumn(ctx context.Context, table string, column string, logger *cli.Logger) error {
+	log := w.Config.structured(logger)
+
+	// unquoted, sqlite reads unknown quoted columns as string literals
+	probe := fmt.Sprintf("SELECT %s FROM %s WHERE 1 = 0", column, table)
+	rows, err := w.db.QueryContext(ctx, probe)
+	if err == nil {
+		return rows.Close()
+	}
+	if ctx.Err() != nil {
+		return wrapContextError(ctx, err)
+	}
+
+	log.Debug("adding column", "column", column, "table", table)
+	definition := generateColumnDefinitions(w.Config.Backend, []string{column}, true)[0]
+	query := fmt.Sprintf("ALTER TABLE %s ADD %s", table, definition)
+	log.Trace(query)
+	if _, aErr := w.db.ExecContext(ctx, query); aErr != nil {
+		return wrapContextError(ctx, aErr)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package persistence
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestUnmarshalExtras(t *testing.T) {
+	data := []byte(`{
+		"meta": {"schema": "2.0"},
+		"timestamp": "2021-06-01T10:00:00Z",
+		"commandname": "Sync",
+		"viewtype": "FloorPlan",
+		"selection": 3,
+		"extras": {"viewtype": "Section"}
+	}`)
+	var rec ScriptTelemetryRecordV2
+	if err := json.Unmarshal(data, &rec); err != nil {
+		t.Fatalf("unmarshalling: %v", err)
+	}
+	if rec.CommandName != "Sync" || rec.RecordMeta.SchemaVersion != "2.0" {
+		t.Errorf("known fields are not decoded: %+v", rec)
+	}
+	want := map[string]interface{}{"viewtype": "Section", "selection": float64(3)}
+	if !reflect.DeepEqual(rec.Extras, want) {
+		t.Errorf("extras are %v, want %v", rec.Extras, want)
+	}
+
+	var event EventTelemetryRecordV2
+	if err := json.Unmarshal([]byte(`{"type": "doc-opened", "worksharing": true}`), &event); err != nil {
+		t.Fatalf("unmarshalling event: %v", err)
+	}
+	if !reflect.DeepEqual(event.Extras, map[string]interface{}{"worksharing": true}) {
+		t.Errorf("event extras are %v", event.Extras)
+	}
+
+	var plain ScriptTelemetryRecordV2
+	if err := json.Unmarshal([]byte(`{"commandname": "Sync"}`), &plain); err != nil {
+		t.Fatalf("unmarshalling: %v", err)
+	}
+	if plain.Extras != nil {
+		t.Errorf("record without unknown fields has extras %v", plain.Extras)
+	}
+}
+
+func TestExtrasRoundTrip(t *testing.T) {
+	testExtrasRoundTrip(t, newTestSqliteConnection)
+}
+
+func TestExtrasRoundTripServers(t *testing.T) {
+	for _, server := range testSQLServers {
+		t.Run(string(server.backend), func(t *testing.T) {
+			testExtrasRoundTrip(t, func(t *testing.T, dbcfg Config) Connection {
+				return newTestSQLServerConnection(t, server.env, dbcfg)
+			})
+		})
+	}
+}
+
+// shared by the backends, extras of script and event records are read
+// back as written. values are the types json decodes them to
+func testExtrasRoundTrip(t *testing.T, connect func(*testing.T, Config) Connection) {
+	conn := connect(t, Config{})
+	extras := map[string]interface{}{"viewtype": "FloorPlan", "selection": float64(3), "worksharing": true}
+
+	script := newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z")
+	script.Extras = extras
+	event := newTestEventRecord("jane", "jane.doe", "2021-06-01T10:00:00Z")
+	event.Extras = extras
+	plain := newTestScriptRecord("john", "john.doe", "2021-06-01T11:00:00Z")
+	writeTestRecords(t, conn, script, event, plain)
+
+	scripts := readTestRecords(t, conn, nil)
+	if len(scripts) != 2 {
+		t.Fatalf("found %d records, want 2", len(scripts))
+	}
+	if read := scripts[0].(*ScriptTelemetryRecordV2).Extras; !reflect.DeepEqual(read, extras) {
+		t.Errorf("script extras are %v, want %v", read, extras)
+	}
+	if read := scripts[1].(*ScriptTelemetryRecordV2).Extras; len(read) != 0 {
+		t.Errorf("record written without extras has %v", read)
+	}
+
+	events := readTestRecords(t, conn, &RecordFilter{RecordType: EventRecord})
+	if len(events) != 1 {
+		t.Fatalf("found %d events, want 1", len(events))
+	}
+	if read := events[0].(*EventTelemetryRecordV2).Extras; !reflect.DeepEqual(read, extras) {
+		t.Errorf("event extras are %v, want %v", read, extras)
+	}
+}
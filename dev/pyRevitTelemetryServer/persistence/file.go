@@ -0,0 +1,327 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"../cli"
+	"github.com/gofrs/flock"
+	"github.com/pkg/errors"
+)
+
+// file rotation modes
+const (
+	RotateNever = ""
+	RotateDaily = "daily"
+)
+
+// appends records as newline-delimited json into <dir>/<target>.json,
+// or <target>.json.gz when compressed
+type FileConnection struct {
+	DatabaseConnection
+	dir         string
+	compression string
+
+	// serializes appends within the process, flock guards across processes
+	mutex sync.Mutex
+}
+
+func newFileConnection(w DatabaseConnection) (*FileConnection, error) {
+	// file:/var/log/pyrevit
+	dir := strings.Replace(w.Config.ConnString, string(File)+":", "", 1)
+	if dir == "" {
+		return nil, errors.New("file backend requires a directory path")
+	}
+
+	if w.Config.FileRotation != RotateNever && w.Config.FileRotation != RotateDaily {
+		return nil, errors.Errorf("unknown file rotation %q", w.Config.FileRotation)
+	}
+
+	compression, cErr := w.Config.compressionOr(CompressionNone)
+	if cErr != nil {
+		return nil, cErr
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileConnection{DatabaseConnection: w, dir: dir, compression: compression}, nil
+}
+
+func (w *FileConnection) GetType() DBBackend {
+	return w.Config.Backend
+}
+
+func (w *FileConnection) GetVersion(logger *cli.Logger) string {
+	return "ndjson"
+}
+
+func (w *FileConnection) GetStatus(logger *cli.Logger) ConnectionStatus {
+	return newConnectionStatus(w.Ping(context.Background()), w.GetVersion(logger))
+}
+
+func (w *FileConnection) Ping(ctx context.Context) error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+	defer w.end()
+
+	info, err := os.Stat(w.dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.Errorf("%s is not a directory", w.dir)
+	}
+	return nil
+}
+
+func (w *FileConnection) Write(ctx context.Context, logrec TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.WriteBatch(ctx, []TelemetryRecord{logrec}, logger)
+}
+
+func (w *FileConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	log := w.Config.structured(logger)
+
+	if len(logrecs) == 0 {
+		return &Result{
+			ResultCode: ResultNoData,
+			Message:    "no data to write",
+		}, nil
+	}
+
+	// marshal all records first, one buffer per target file
+	log.Debug("marshalling records")
+	targets := make([]string, 0)
+	lines := make(map[string]*bytes.Buffer)
+	counts := make(map[string]int)
+	for _, logrec := range logrecs {
+		data, mErr := json.Marshal(logrec)
+		if mErr != nil {
+			return nil, mErr
+		}
+
+		target := w.Config.targetFor(logrec)
+		if _, exists := lines[target]; !exists {
+			targets = append(targets, target)
+			lines[target] = &bytes.Buffer{}
+		}
+		lines[target].Write(data)
+		lines[target].WriteByte('\n')
+		counts[target]++
+	}
+
+	written := 0
+	for _, target := range targets {
+		if ctx.Err() != nil {
+			return &Result{Written: written}, wrapContextError(ctx, ctx.Err())
+		}
+
+		data := lines[target].Bytes()
+		if w.compression == CompressionGzip {
+			// each append is a complete gzip member, nothing is left
+			// buffered on rotation or shutdown
+			compressed, gErr := gzipBytes(data)
+			if gErr != nil {
+				return &Result{Written: written}, gErr
+			}
+			data = compressed
+		}
+
+		log.Debug("appending records", "target", target)
+		if aErr := w.appendLocked(target, data); aErr != nil {
+			return &Result{
+				Written: written,
+				Message: fmt.Sprintf("appended %d of %d usage records", written, len(logrecs)),
+			}, aErr
+		}
+		written += counts[target]
+	}
+
+	log.Debug("preparing report")
+	return &Result{
+		Written: written,
+		Message: fmt.Sprintf("successfully appended %d usage records", written),
+	}, nil
+}
+
+// scans all script target files, plain or compressed, active or rotated
+func (w *FileConnection) Read(ctx context.Context, filter *RecordFilter, logger *cli.Logger) ([]TelemetryRecord, *Result, error) {
+	if err := w.begin(); err != nil {
+		return nil, nil, err
+	}
+	defer w.end()
+
+	log := w.Config.structured(logger)
+
+	recordType, tErr := filter.recordType()
+	if tErr != nil {
+		return nil, nil, tErr
+	}
+	conditions, cErr := filter.conditions()
+	if cErr != nil {
+		return nil, nil, cErr
+	}
+
+	log.Debug("listing record files")
+	// active, dated and rotated files of the target only
+	target := w.Config.targetOf(recordType)
+	paths := make([]string, 0)
+	for _, extension := range []string{".json", ".json.gz"} {
+		for _, suffix := range []string{"", ".*", "-*"} {
+			matches, gErr := filepath.Glob(filepath.Join(w.dir, target+suffix+extension))
+			if gErr != nil {
+				return nil, nil, gErr
+			}
+			paths = append(paths, matches...)
+		}
+	}
+
+	log.Debug("reading records")
+	records := make([]TelemetryRecord, 0)
+	for _, path := range paths {
+		fileRecords, rErr := readRecordFile(path, recordType, filter, conditions)
+		if rErr != nil {
+			return nil, nil, rErr
+		}
+		records = append(records, fileRecords...)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].GetTimeStamp().Equal(records[j].GetTimeStamp()) {
+			return records[i].GetRecordId() < records[j].GetRecordId()
+		}
+		return records[i].GetTimeStamp().Before(records[j].GetTimeStamp())
+	})
+
+	records, pErr := filter.paginate(records)
+	if pErr != nil {
+		return nil, nil, pErr
+	}
+
+	log.Debug("preparing report")
+	return records, newReadResult(records, filter), nil
+}
+
+func (w *FileConnection) Close() error {
+	w.drain()
+	return nil
+}
+
+func (w *FileConnection) appendLocked(target string, data []byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	path := w.pathFor(target)
+	fileLock := flock.New(path + ".lock")
+	if err := fileLock.Lock(); err != nil {
+		return err
+	}
+	defer fileLock.Unlock()
+
+	if err := w.rotateBySize(path, int64(len(data))); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, wErr := file.Write(data); wErr != nil {
+		file.Close()
+		return wErr
+	}
+	return file.Close()
+}
+
+// reads v2 script records from one file, skipping other schemas
+func readRecordFile(path string, recordType RecordType, filter *RecordFilter, conditions []fieldCondition) ([]TelemetryRecord, error) {
+	reader, err := openMaybeGzip(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	records := make([]TelemetryRecord, 0)
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var logrec TelemetryRecord
+		var meta *RecordMetaV2
+		if recordType == EventRecord {
+			rec := &EventTelemetryRecordV2{}
+			logrec, meta = rec, &rec.RecordMeta
+		} else {
+			rec := &ScriptTelemetryRecordV2{}
+			logrec, meta = rec, &rec.RecordMeta
+		}
+		if uErr := json.Unmarshal(line, logrec); uErr != nil {
+			return nil, errors.Wrapf(uErr, "invalid record in %s", path)
+		}
+		if meta.SchemaVersion != "2.0" || !filter.matches(logrec, conditions) {
+			continue
+		}
+		records = append(records, logrec)
+	}
+	return records, scanner.Err()
+}
+
+// active file path, dated when rotating daily
+func (w *FileConnection) pathFor(target string) string {
+	name := target
+	if w.Config.FileRotation == RotateDaily {
+		name = fmt.Sprintf("%s-%s", target, time.Now().UTC().Format("2006-01-02"))
+	}
+	return filepath.Join(w.dir, name+w.extension())
+}
+
+func (w *FileConnection) extension() string {
+	if w.compression == CompressionGzip {
+		return ".json.gz"
+	}
+	return ".json"
+}
+
+// moves the active file aside when the next append would exceed FileMaxSize
+func (w *FileConnection) rotateBySize(path string, incoming int64) error {
+	if w.Config.FileMaxSize <= 0 {
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if info.Size() == 0 || info.Size()+incoming <= w.Config.FileMaxSize {
+		return nil
+	}
+
+	rotated := fmt.Sprintf(
+		"%s.%s%s",
+		strings.TrimSuffix(path, w.extension()),
+		time.Now().UTC().Format("20060102T150405.000000000"),
+		w.extension())
+	return os.Rename(path, rotated)
+}
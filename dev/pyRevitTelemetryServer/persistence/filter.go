@@ -0,0 +1,175 @@
+package persistence
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// zero values are ignored when filtering, records match all predicates
+// RecordType picks the records read, script records when empty. Limit
+// caps the records read per page, PageToken is the Result.NextPage of the
+// previous page
+type RecordFilter struct {
+	RecordType   RecordType       `json:"type"`
+	From         time.Time        `json:"from"`
+	To           time.Time        `json:"to"`
+	HostUserName string           `json:"host_user"`
+	UserName     string           `json:"username"`
+	Predicates   []FieldPredicate `json:"where"`
+	Limit        int              `json:"limit"`
+	PageToken    string           `json:"page_token"`
+}
+
+// type of the records read, unknown types are errors
+func (filter *RecordFilter) recordType() (RecordType, error) {
+	if filter == nil || filter.RecordType == "" {
+		return ScriptRecord, nil
+	}
+	switch filter.RecordType {
+	case ScriptRecord, EventRecord:
+		return filter.RecordType, nil
+	}
+	return "", errors.Errorf("unknown record type %q", filter.RecordType)
+}
+
+// pages continue from the timestamp of the last record read, skipping the
+// records sharing that timestamp which were read already, so deep pages
+// cost no more than the first. ties are ordered by record id
+type pageToken struct {
+	After string `json:"after"`
+	Skip  int    `json:"skip"`
+}
+
+// position the page starts at, nil for the first page
+func (filter *RecordFilter) page() (*pageToken, error) {
+	if filter == nil {
+		return nil, nil
+	}
+	if filter.Limit < 0 {
+		return nil, errors.Errorf("invalid page limit %d", filter.Limit)
+	}
+	if filter.PageToken == "" {
+		return nil, nil
+	}
+	if filter.Limit == 0 {
+		return nil, errors.New("page token requires a page limit")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(filter.PageToken)
+	if err != nil {
+		return nil, errors.New("invalid page token")
+	}
+	page := &pageToken{}
+	if uErr := json.Unmarshal(data, page); uErr != nil || page.After == "" || page.Skip < 0 {
+		return nil, errors.New("invalid page token")
+	}
+	if _, tErr := time.Parse(time.RFC3339Nano, page.After); tErr != nil {
+		return nil, errors.New("invalid page token")
+	}
+	return page, nil
+}
+
+// timestamp of the last record read, checked to parse by page
+func (page *pageToken) after() time.Time {
+	after, _ := time.Parse(time.RFC3339Nano, page.After)
+	return after
+}
+
+// token of the page after the records, empty once the last page is read
+func (filter *RecordFilter) nextPageToken(records []TelemetryRecord) string {
+	if filter == nil || filter.Limit == 0 || len(records) < filter.Limit {
+		return ""
+	}
+
+	last := records[len(records)-1]
+	next := pageToken{After: last.GetTimeStamp().UTC().Format(time.RFC3339Nano)}
+	for idx := len(records) - 1; idx >= 0; idx-- {
+		if !records[idx].GetTimeStamp().Equal(last.GetTimeStamp()) {
+			break
+		}
+		next.Skip++
+	}
+	// the whole page shares the timestamp the previous page ended on
+	if page, _ := filter.page(); page != nil && next.Skip == len(records) && page.After == next.After {
+		next.Skip += page.Skip
+	}
+
+	data, _ := json.Marshal(next)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// for backends paging records in memory, records are in read order
+func (filter *RecordFilter) paginate(records []TelemetryRecord) ([]TelemetryRecord, error) {
+	page, err := filter.page()
+	if err != nil {
+		return nil, err
+	}
+	if page != nil {
+		after := page.after()
+		start := 0
+		for start < len(records) && records[start].GetTimeStamp().Before(after) {
+			start++
+		}
+		start += page.Skip
+		if start > len(records) {
+			start = len(records)
+		}
+		records = records[start:]
+	}
+	if filter != nil && filter.Limit > 0 && len(records) > filter.Limit {
+		records = records[:filter.Limit]
+	}
+	return records, nil
+}
+
+func formatFilterTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// for backends filtering records in memory, conditions are the checked
+// predicates of the filter
+func (filter *RecordFilter) matches(logrec TelemetryRecord, conditions []fieldCondition) bool {
+	if filter == nil {
+		return true
+	}
+	if rec, ok := logrec.(*ScriptTelemetryRecordV2); ok {
+		for _, condition := range conditions {
+			if !condition.matches(rec) {
+				return false
+			}
+		}
+	}
+
+	timestamp := logrec.GetTimeStamp()
+	if !filter.From.IsZero() && timestamp.Before(filter.From) {
+		return false
+	}
+	if !filter.To.IsZero() && timestamp.After(filter.To) {
+		return false
+	}
+	userName, hostUserName := recordUsers(logrec)
+	if filter.HostUserName != "" && hostUserName != filter.HostUserName {
+		return false
+	}
+	if filter.UserName != "" && userName != filter.UserName {
+		return false
+	}
+	return true
+}
+
+// v1 records only carry the user name
+func recordUsers(logrec TelemetryRecord) (string, string) {
+	switch rec := logrec.(type) {
+	case *ScriptTelemetryRecordV1:
+		return rec.UserName, ""
+	case *ScriptTelemetryRecordV2:
+		return rec.UserName, rec.HostUserName
+	case *EventTelemetryRecordV2:
+		return rec.UserName, rec.HostUserName
+	default:
+		return "", ""
+	}
+}
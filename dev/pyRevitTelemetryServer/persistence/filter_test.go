@@ -0,0 +1,201 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestReadPages(t *testing.T) {
+	testReadPages(t, newTestSqliteConnection)
+}
+
+func TestReadPagesServers(t *testing.T) {
+	for _, server := range testSQLServers {
+		t.Run(string(server.backend), func(t *testing.T) {
+			testReadPages(t, func(t *testing.T, dbcfg Config) Connection {
+				return newTestSQLServerConnection(t, server.env, dbcfg)
+			})
+		})
+	}
+}
+
+func TestFileReadPages(t *testing.T) {
+	testReadPages(t, func(t *testing.T, dbcfg Config) Connection {
+		dbcfg.Backend = File
+		dbcfg.ConnString = "file:" + t.TempDir()
+		return newTestConnection(t, dbcfg)
+	})
+}
+
+// shared by the backends, paging through the records reads each of them
+// once and in read order. records sharing a timestamp span the pages
+func testReadPages(t *testing.T, connect func(*testing.T, Config) Connection) {
+	conn := connect(t, Config{})
+	logrecs := make([]TelemetryRecord, 0)
+	for idx := 0; idx < 11; idx++ {
+		logrecs = append(logrecs, newTestScriptRecord("jane", "jane.doe", fmt.Sprintf("2021-06-01T10:%02d:00Z", idx)))
+	}
+	for idx := 0; idx < 7; idx++ {
+		logrecs = append(logrecs, newTestScriptRecord("jane", "jane.doe", "2021-06-01T11:00:00Z"))
+	}
+	for idx := 0; idx < 5; idx++ {
+		logrecs = append(logrecs, newTestScriptRecord("john", "john.doe", fmt.Sprintf("2021-06-02T10:%02d:00Z", idx)))
+	}
+	writeTestRecords(t, conn, logrecs...)
+	all := readTestRecords(t, conn, nil)
+	if len(all) != len(logrecs) {
+		t.Fatalf("found %d records, want %d", len(all), len(logrecs))
+	}
+
+	for _, limit := range []int{1, 3, 5, 23, 50} {
+		t.Run(fmt.Sprintf("limit %d", limit), func(t *testing.T) {
+			paged := make([]TelemetryRecord, 0)
+			seen := make(map[string]bool)
+			filter := &RecordFilter{Limit: limit}
+			for pages := 0; ; pages++ {
+				if pages > len(logrecs) {
+					t.Fatal("paging does not end")
+				}
+				records, res, err := conn.Read(context.Background(), filter, testLogger)
+				if err != nil {
+					t.Fatalf("reading page %d: %v", pages, err)
+				}
+				if len(records) > limit {
+					t.Fatalf("page %d has %d records, limit is %d", pages, len(records), limit)
+				}
+				for _, logrec := range records {
+					if seen[testSessionId(logrec)] {
+						t.Errorf("record %s is read again on page %d", testSessionId(logrec), pages)
+					}
+					seen[testSessionId(logrec)] = true
+					paged = append(paged, logrec)
+				}
+				if res.NextPage == "" {
+					break
+				}
+				filter = &RecordFilter{Limit: limit, PageToken: res.NextPage}
+			}
+
+			if len(paged) != len(all) {
+				t.Fatalf("paged %d records, want %d", len(paged), len(all))
+			}
+			for idx := range all {
+				if testSessionId(paged[idx]) != testSessionId(all[idx]) {
+					t.Errorf("paged record %d is %s, read %s", idx, testSessionId(paged[idx]), testSessionId(all[idx]))
+				}
+			}
+		})
+	}
+
+	// pages of filtered reads
+	first, res, err := conn.Read(context.Background(), &RecordFilter{UserName: "john", Limit: 3}, testLogger)
+	if err != nil || len(first) != 3 || res.NextPage == "" {
+		t.Fatalf("first page of john is %d records with %v", len(first), err)
+	}
+	second, _, sErr := conn.Read(context.Background(), &RecordFilter{UserName: "john", Limit: 3, PageToken: res.NextPage}, testLogger)
+	if sErr != nil || len(second) != 2 {
+		t.Errorf("second page of john is %d records with %v, want 2", len(second), sErr)
+	}
+}
+
+func TestReadPagesMixedTimestamps(t *testing.T) {
+	testReadPagesMixedTimestamps(t, newTestSqliteConnection)
+}
+
+func TestReadPagesMixedTimestampsServers(t *testing.T) {
+	for _, server := range testSQLServers {
+		t.Run(string(server.backend), func(t *testing.T) {
+			testReadPagesMixedTimestamps(t, func(t *testing.T, dbcfg Config) Connection {
+				return newTestSQLServerConnection(t, server.env, dbcfg)
+			})
+		})
+	}
+}
+
+// records written below the validating wrapper keep the offset and
+// precision of the client, pages follow their times all the same
+func testReadPagesMixedTimestamps(t *testing.T, connect func(*testing.T, Config) Connection) {
+	conn := connect(t, Config{})
+	sqlConn, _ := unwrapSQLConnection(conn)
+	timestamps := []string{
+		"2021-06-01T10:00:01Z",
+		"2021-06-01T12:00:00.5+02:00",
+		"2021-06-01T10:00:00Z",
+		"2021-06-01T10:00:00.500Z",
+		"2021-06-01T09:00:00.75-01:00",
+		"2021-06-01T10:00:00.25Z",
+		"2021-06-01T10:00:00.5Z",
+	}
+	logrecs := make([]TelemetryRecord, 0, len(timestamps))
+	for _, timestamp := range timestamps {
+		logrecs = append(logrecs, newTestScriptRecord("jane", "jane.doe", timestamp))
+	}
+	if _, err := sqlConn.WriteBatch(context.Background(), logrecs, testLogger); err != nil {
+		t.Fatalf("writing: %v", err)
+	}
+	sort.SliceStable(logrecs, func(i, j int) bool {
+		return logrecs[i].GetTimeStamp().Before(logrecs[j].GetTimeStamp())
+	})
+
+	for _, limit := range []int{1, 2, 3} {
+		t.Run(fmt.Sprintf("limit %d", limit), func(t *testing.T) {
+			paged := make([]TelemetryRecord, 0)
+			filter := &RecordFilter{Limit: limit}
+			for pages := 0; pages <= len(logrecs); pages++ {
+				records, res, err := conn.Read(context.Background(), filter, testLogger)
+				if err != nil {
+					t.Fatalf("reading page %d: %v", pages, err)
+				}
+				paged = append(paged, records...)
+				if res.NextPage == "" {
+					break
+				}
+				filter = &RecordFilter{Limit: limit, PageToken: res.NextPage}
+			}
+
+			if len(paged) != len(logrecs) {
+				t.Fatalf("paged %d records, want %d", len(paged), len(logrecs))
+			}
+			seen := make(map[string]bool)
+			for idx, logrec := range paged {
+				if seen[testSessionId(logrec)] {
+					t.Errorf("record %s is read again", testSessionId(logrec))
+				}
+				seen[testSessionId(logrec)] = true
+				if want := logrecs[idx].GetTimeStamp(); !logrec.GetTimeStamp().Equal(want) {
+					t.Errorf("paged record %d is at %s, want %s", idx, logrec.GetTimeStamp(), want)
+				}
+			}
+		})
+	}
+}
+
+// test records have unique sessions, the file backend stores no record ids
+func testSessionId(logrec TelemetryRecord) string {
+	return logrec.(*ScriptTelemetryRecordV2).SessionId
+}
+
+func TestReadPagesInvalid(t *testing.T) {
+	conn := newTestMemoryConnection(t, Config{})
+	writeTestRecords(t, conn, newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"))
+
+	tests := []struct {
+		name   string
+		filter *RecordFilter
+	}{
+		{"negative limit", &RecordFilter{Limit: -1}},
+		{"token without limit", &RecordFilter{PageToken: "eyJhZnRlciI6IjIwMjEtMDYtMDFUMTA6MDA6MDBaIiwic2tpcCI6MX0"}},
+		{"not base64", &RecordFilter{Limit: 5, PageToken: "page 2"}},
+		{"not json", &RecordFilter{Limit: 5, PageToken: "cGFnZQ"}},
+		{"negative skip", &RecordFilter{Limit: 5, PageToken: "eyJhZnRlciI6IjIwMjEtMDYtMDFUMTA6MDA6MDBaIiwic2tpcCI6LTF9"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, err := conn.Read(context.Background(), test.filter, testLogger); err == nil {
+				t.Error("invalid page was read")
+			}
+		})
+	}
+}
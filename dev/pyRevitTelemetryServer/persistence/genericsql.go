@@ -1,325 +1,1372 @@
 package persistence
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"log"
-	"regexp"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"../cli"
+	"github.com/pkg/errors"
 
 	_ "github.com/denisenkom/go-mssqldb"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
-
-	uuid "github.com/satori/go.uuid"
 )
 
+const DefaultSqliteBusyTimeout = 5 * time.Second
+
+// max bind parameters per statement
+var sqlMaxParams = map[DBBackend]int{
+	Postgres: 65535,
+	MySql:    65535,
+	MSSql:    2100,
+	Sqlite:   999,
+}
+
+type sqlQuery struct {
+	Query       string
+	Args        []interface{}
+	RecordCount int
+	// positions of the inserted records in the batch
+	Indexes []int
+}
+
+// safe for concurrent use, one connection is shared by all requests.
+// every call works on its own queries and transactions over the shared
+// pools, which sql.DB makes safe. the only mutable state is the schema
+// and partition bookkeeping guarded by migrateMutex, and the statement
+// cache guarding itself. it is not a sync.Once since failed migrations
+// are retried on the next call
 type GenericSQLConnection struct {
 	DatabaseConnection
+	db *sql.DB
+
+	// prepared insert statements of db
+	stmts *stmtCache
+
+	// replica pool for reads, same as db without a replica
+	readDb *sql.DB
+
+	// tables are created on first use, retried until it succeeds
+	migrateMutex sync.Mutex
+	migrated     bool
+
+	// monthly partitions known to exist, guarded by migrateMutex
+	partitions map[string]bool
 }
 
-func (w GenericSQLConnection) GetType() DBBackend {
-	return w.Config.Backend
+func newGenericSQLConnection(w DatabaseConnection) (*GenericSQLConnection, error) {
+	w.Config = w.Config.withScriptTarget(w.Config.TableName)
+	if err := w.Config.validateTargets(sqlTargetPattern); err != nil {
+		return nil, err
+	}
+	if w.Config.Partitioning && w.Config.Backend != Postgres {
+		return nil, errors.Errorf("partitioning is not supported by %s backend", w.Config.Backend)
+	}
+
+	// sql.Open only prepares the pool, connections are opened on demand
+	db, err := openConnection(w.Config)
+	if err != nil {
+		return nil, err
+	}
+	configurePool(db, w.Config)
+
+	readDb, rErr := openReadConnection(w.Config)
+	if rErr != nil {
+		db.Close()
+		return nil, rErr
+	}
+	if readDb == nil {
+		readDb = db
+	}
+	return &GenericSQLConnection{
+		DatabaseConnection: w,
+		db:                 db,
+		stmts:              newStmtCache(db),
+		readDb:             readDb,
+		partitions:         make(map[string]bool),
+	}, nil
 }
 
-func (w GenericSQLConnection) GetVersion(logger *cli.Logger) string {
-	db, err := openConnection(w.Config.Backend, w.Config.ConnString, logger)
+// opens the replica pool, nil when no replica is configured
+func openReadConnection(dbcfg *Config) (*sql.DB, error) {
+	if dbcfg.ReadConnString == "" {
+		return nil, nil
+	}
+	backend, err := parseUri(dbcfg.ReadConnString)
 	if err != nil {
-		logger.Debug("error opening connection")
+		return nil, err
+	}
+	if backend != dbcfg.Backend {
+		return nil, errors.Errorf("read replica must be a %s database", dbcfg.Backend)
+	}
+
+	// the socket is of the primary, replicas are reached by their host
+	readCfg := *dbcfg
+	readCfg.ConnString = dbcfg.ReadConnString
+	readCfg.SocketPath = ""
+	readDb, oErr := openConnection(&readCfg)
+	if oErr != nil {
+		return nil, redactError(oErr, dbcfg.ReadConnString)
+	}
+	configurePool(readDb, dbcfg)
+	return readDb, nil
+}
+
+// applies the pool settings of dbcfg to the open pools, connections in use
+// are not interrupted and above the new limits are closed once returned
+func (w *GenericSQLConnection) configurePools(dbcfg *Config) {
+	configurePool(w.db, dbcfg)
+	if w.readDb != w.db {
+		configurePool(w.readDb, dbcfg)
+	}
+}
+
+func configurePool(db *sql.DB, dbcfg *Config) {
+	maxOpenConns := dbcfg.MaxOpenConns
+	if maxOpenConns == 0 {
+		maxOpenConns = DefaultMaxOpenConns
+	}
+	db.SetMaxOpenConns(maxOpenConns)
+
+	maxIdleConns := dbcfg.MaxIdleConns
+	if maxIdleConns == 0 {
+		maxIdleConns = DefaultMaxIdleConns
+	}
+	db.SetMaxIdleConns(maxIdleConns)
+
+	connMaxLifetime := dbcfg.ConnMaxLifetime
+	if connMaxLifetime == 0 {
+		connMaxLifetime = DefaultConnMaxLifetime
+	}
+	db.SetConnMaxLifetime(connMaxLifetime)
+
+	connMaxIdleTime := dbcfg.ConnMaxIdleTime
+	if connMaxIdleTime == 0 {
+		connMaxIdleTime = DefaultConnMaxIdleTime
+	}
+	db.SetConnMaxIdleTime(connMaxIdleTime)
+}
+
+func (w *GenericSQLConnection) GetType() DBBackend {
+	return w.Config.Backend
+}
+
+func (w *GenericSQLConnection) GetVersion(logger *cli.Logger) string {
+	if err := w.begin(); err != nil {
 		return ""
 	}
-	defer db.Close()
+	defer w.end()
 
 	var version string
-	err = db.QueryRow("select version()").Scan(&version)
+	err := w.db.QueryRow(generateVersionQuery(w.Config.Backend)).Scan(&version)
 	if err != nil {
-		log.Fatal(err)
+		w.Config.structured(logger).Debug("error getting version", "error", err)
+		return ""
 	}
 	return version
 }
 
-func (w GenericSQLConnection) GetStatus(logger *cli.Logger) ConnectionStatus {
-	return ConnectionStatus{
-		Status:  "pass",
-		Version: w.GetVersion(logger),
+func generateVersionQuery(backend DBBackend) string {
+	switch backend {
+	case MSSql:
+		return "SELECT @@VERSION"
+	case Sqlite:
+		return "SELECT sqlite_version()"
+	default:
+		return "SELECT version()"
+	}
+}
+
+func (w *GenericSQLConnection) GetStatus(logger *cli.Logger) ConnectionStatus {
+	if err := w.Ping(context.Background()); err != nil {
+		return newConnectionStatus(err, "")
+	}
+	return newConnectionStatus(nil, w.GetVersion(logger))
+}
+
+func (w *GenericSQLConnection) Ping(ctx context.Context) error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+	defer w.end()
+
+	pingCtx, cancel := w.Config.newPingContext(ctx)
+	defer cancel()
+
+	return wrapContextError(pingCtx, w.db.PingContext(pingCtx))
+}
+
+func (w *GenericSQLConnection) Warmup(ctx context.Context, n int) error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+	defer w.end()
+
+	if err := warmupPool(ctx, w.db, n); err != nil {
+		return err
+	}
+	if w.readDb != w.db {
+		return errors.Wrap(warmupPool(ctx, w.readDb, n), "warming up read replica")
+	}
+	return nil
+}
+
+// holds n connections open at once so the pool has to dial each of them,
+// releasing them leaves them idle in the pool
+func warmupPool(ctx context.Context, db *sql.DB, n int) error {
+	// asking for more than the pool allows would block
+	if maxOpen := db.Stats().MaxOpenConnections; maxOpen > 0 && n > maxOpen {
+		n = maxOpen
+	}
+
+	conns := make([]*sql.Conn, 0, n)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for len(conns) < n {
+		conn, cErr := db.Conn(ctx)
+		if cErr != nil {
+			return wrapContextError(ctx, cErr)
+		}
+		conns = append(conns, conn)
+		if pErr := conn.PingContext(ctx); pErr != nil {
+			return wrapContextError(ctx, pErr)
+		}
 	}
+	return nil
+}
+
+func (w *GenericSQLConnection) Write(ctx context.Context, logrec TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.WriteBatch(ctx, []TelemetryRecord{logrec}, logger)
 }
 
-func (w GenericSQLConnection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
-	// generate generic sql insert query
-	logger.Debug("generating query")
-	query, qErr := generateScriptInsertQueryV1(w.Config.ScriptTarget, logrec, logger)
+func (w *GenericSQLConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	if len(logrecs) == 0 {
+		return &Result{
+			ResultCode: ResultNoData,
+			Message:    "no data to write",
+		}, nil
+	}
+
+	if mErr := w.EnsureSchema(ctx, logger); mErr != nil {
+		return nil, mErr
+	}
+
+	if w.Config.Partitioning {
+		if pErr := w.ensurePartitions(ctx, logrecs, logger); pErr != nil {
+			return nil, pErr
+		}
+	}
+
+	if w.useCopy(logrecs) {
+		return commitBulkCopy(ctx, w.db, w.Config, logrecs, logger)
+	}
+
+	// generate generic sql insert queries
+	w.Config.structured(logger).Debug("generating queries")
+	queries, qErr := generateInsertQueries(w.Config, logrecs, logger)
 	if qErr != nil {
 		return nil, qErr
 	}
 
-	return commitSQL(w.Config.Backend, w.Config.ConnString, query, logger)
+	return commitSQL(ctx, w.db, w.stmts, w.Config, logrecs, queries, logger)
 }
 
-func (w GenericSQLConnection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
-	// generate generic sql insert query
-	logger.Debug("generating query")
-	query, qErr := generateScriptInsertQueryV2(w.Config.ScriptTarget, logrec, logger)
+func (w *GenericSQLConnection) Read(ctx context.Context, filter *RecordFilter, logger *cli.Logger) ([]TelemetryRecord, *Result, error) {
+	if err := w.begin(); err != nil {
+		return nil, nil, err
+	}
+	defer w.end()
+
+	log := w.Config.structured(logger)
+
+	if mErr := w.ensureReadSchema(ctx, logger); mErr != nil {
+		return nil, nil, mErr
+	}
+
+	// generate parameterized sql select query
+	log.Debug("generating query")
+	query, args, gErr := generateSelectQueryV2(w.Config, filter, logger)
+	if gErr != nil {
+		return nil, nil, gErr
+	}
+
+	// run the select query
+	log.Debug("executing select query")
+	rows, qErr := w.readDb.QueryContext(ctx, query, args...)
 	if qErr != nil {
-		return nil, qErr
+		return nil, nil, wrapContextError(ctx, qErr)
+	}
+	defer rows.Close()
+
+	log.Debug("reading records")
+	records := make([]TelemetryRecord, 0)
+	for rows.Next() {
+		logrec, sErr := scanRecordV2(rows, filter)
+		if sErr != nil {
+			return nil, nil, sErr
+		}
+		records = append(records, logrec)
+	}
+	if rErr := rows.Err(); rErr != nil {
+		return nil, nil, wrapContextError(ctx, rErr)
 	}
 
-	return commitSQL(w.Config.Backend, w.Config.ConnString, query, logger)
+	log.Debug("preparing report")
+	return records, newReadResult(records, filter), nil
 }
 
-func (w GenericSQLConnection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
-	// generate generic sql insert query
-	logger.Debug("generating query")
-	query, qErr := generateEventInsertQueryV2(w.Config.EventTarget, logrec, logger)
+// replicas get their tables from the primary, reading them does not need
+// the primary to be up. reads of the primary create missing tables first
+func (w *GenericSQLConnection) ensureReadSchema(ctx context.Context, logger *cli.Logger) error {
+	if w.readDb != w.db {
+		return nil
+	}
+	return w.EnsureSchema(ctx, logger)
+}
+
+// rows are sent as the cursor advances
+func (w *GenericSQLConnection) ReadStream(ctx context.Context, filter *RecordFilter, logger *cli.Logger) (<-chan TelemetryRecord, <-chan error) {
+	log := w.Config.structured(logger)
+
+	if err := w.begin(); err != nil {
+		return failedRecordStream(err)
+	}
+
+	return newRecordStream(ctx, func(send func(TelemetryRecord) bool) error {
+		defer w.end()
+
+		if mErr := w.ensureReadSchema(ctx, logger); mErr != nil {
+			return mErr
+		}
+
+		log.Debug("generating query")
+		query, args, gErr := generateSelectQueryV2(w.Config, filter, logger)
+		if gErr != nil {
+			return gErr
+		}
+
+		log.Debug("executing select query")
+		rows, qErr := w.readDb.QueryContext(ctx, query, args...)
+		if qErr != nil {
+			return wrapContextError(ctx, qErr)
+		}
+		defer rows.Close()
+
+		log.Debug("streaming records")
+		for rows.Next() {
+			logrec, sErr := scanRecordV2(rows, filter)
+			if sErr != nil {
+				return sErr
+			}
+			if !send(logrec) {
+				return nil
+			}
+		}
+		return wrapContextError(ctx, rows.Err())
+	})
+}
+
+// counts are grouped by the database, only one row per command is read
+func (w *GenericSQLConnection) AggregateCommandCounts(ctx context.Context, from time.Time, to time.Time) (map[string]int, error) {
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	query, args := generateCommandCountsQuery(w.Config.Backend, w.Config.ScriptTarget, from, to)
+	rows, qErr := w.readDb.QueryContext(ctx, query, args...)
 	if qErr != nil {
-		return nil, qErr
+		return nil, wrapContextError(ctx, qErr)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var command sql.NullString
+		var count int
+		if sErr := rows.Scan(&command, &count); sErr != nil {
+			return nil, sErr
+		}
+		counts[command.String] += count
+	}
+	if rErr := rows.Err(); rErr != nil {
+		return nil, wrapContextError(ctx, rErr)
+	}
+	return counts, nil
+}
+
+// newest script records of the user, served by the timestamp index
+func (w *GenericSQLConnection) RecentByUser(ctx context.Context, username string, n int) ([]TelemetryRecord, error) {
+	if err := validateRecentCount(n); err != nil {
+		return nil, err
+	}
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	query, args := generateRecentByUserQuery(w.Config.Backend, w.Config.ScriptTarget, username, n)
+	rows, qErr := w.readDb.QueryContext(ctx, query, args...)
+	if qErr != nil {
+		return nil, wrapContextError(ctx, qErr)
 	}
+	defer rows.Close()
 
-	return commitSQL(w.Config.Backend, w.Config.ConnString, query, logger)
+	records := make([]TelemetryRecord, 0, n)
+	for rows.Next() {
+		logrec, sErr := scanScriptRecordV2(rows)
+		if sErr != nil {
+			return nil, sErr
+		}
+		records = append(records, logrec)
+	}
+	if rErr := rows.Err(); rErr != nil {
+		return nil, wrapContextError(ctx, rErr)
+	}
+	return records, nil
 }
 
-func commitSQL(backend DBBackend, connStr string, query string, logger *cli.Logger) (*Result, error) {
-	// open connection
-	db, err := openConnection(backend, connStr, logger)
+// deletes from the script and event tables in a single transaction
+func (w *GenericSQLConnection) DeleteByUser(ctx context.Context, username string) (*Result, error) {
+	p := func(index int) string { return sqlPlaceholder(w.Config.Backend, index) }
+	return w.execPerTable(ctx, "deleted", func(table string) (string, []interface{}) {
+		return fmt.Sprintf(
+			"DELETE FROM %s WHERE username = %s OR host_user = %s",
+			table, p(1), p(2)), []interface{}{username, username}
+	})
+}
+
+// replaces the user and host user names of the matching rows with their
+// pseudonyms, the other name on a matched row included. pseudonyms are made
+// outside the database, so the names are read first in the same transaction
+func (w *GenericSQLConnection) AnonymizeUser(ctx context.Context, username string) (*Result, error) {
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	tx, err := w.db.BeginTx(ctx, nil)
 	if err != nil {
-		logger.Debug("error opening connection")
+		return nil, wrapContextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	affected := 0
+	for _, table := range w.schemaTables() {
+		names, nErr := selectUserNames(ctx, tx, w.Config.Backend, table.name, username)
+		if nErr != nil {
+			return nil, nErr
+		}
+		if len(names) == 0 {
+			continue
+		}
+
+		query, args := generateAnonymizeQuery(w.Config.Backend, table.name, username, names, w.Config.AnonymizationKey)
+		res, eErr := tx.ExecContext(ctx, query, args...)
+		if eErr != nil {
+			return nil, wrapContextError(ctx, eErr)
+		}
+		if count, aErr := res.RowsAffected(); aErr == nil {
+			affected += int(count)
+		}
+	}
+
+	if cErr := tx.Commit(); cErr != nil {
+		return nil, wrapContextError(ctx, cErr)
+	}
+	return newAffectedResult(affected, "anonymized"), nil
+}
+
+// distinct user and host user names of the rows matching the user, sorted
+func selectUserNames(ctx context.Context, tx *sql.Tx, backend DBBackend, table string, username string) ([]string, error) {
+	rows, qErr := tx.QueryContext(ctx, fmt.Sprintf(
+		"SELECT DISTINCT username, host_user FROM %s WHERE username = %s OR host_user = %s",
+		table, sqlPlaceholder(backend, 1), sqlPlaceholder(backend, 2)), username, username)
+	if qErr != nil {
+		return nil, wrapContextError(ctx, qErr)
+	}
+	defer rows.Close()
+
+	found := make(map[string]bool)
+	for rows.Next() {
+		var userName, hostUserName sql.NullString
+		if sErr := rows.Scan(&userName, &hostUserName); sErr != nil {
+			return nil, sErr
+		}
+		for _, name := range []sql.NullString{userName, hostUserName} {
+			if name.Valid {
+				found[name.String] = true
+			}
+		}
+	}
+	if rErr := rows.Err(); rErr != nil {
+		return nil, wrapContextError(ctx, rErr)
+	}
+
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (w *GenericSQLConnection) PurgeOlderThan(ctx context.Context, cutoff time.Time) (*Result, error) {
+	return w.execPerTable(ctx, "purged", func(table string) (string, []interface{}) {
+		backend := w.Config.Backend
+		return fmt.Sprintf(
+				"DELETE FROM %s WHERE %s",
+				table, sqlTimeCondition(backend, "<", sqlPlaceholder(backend, 1))),
+			[]interface{}{sqlTimeArg(backend, cutoff)}
+	})
+}
+
+func (w *GenericSQLConnection) execPerTable(ctx context.Context, verb string, generate func(table string) (string, []interface{})) (*Result, error) {
+	if err := w.begin(); err != nil {
 		return nil, err
 	}
-	defer db.Close()
+	defer w.end()
+
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, wrapContextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	affected := 0
+	for _, table := range w.schemaTables() {
+		query, args := generate(table.name)
+		res, eErr := tx.ExecContext(ctx, query, args...)
+		if eErr != nil {
+			return nil, wrapContextError(ctx, eErr)
+		}
+		if count, aErr := res.RowsAffected(); aErr == nil {
+			affected += int(count)
+		}
+	}
+
+	if cErr := tx.Commit(); cErr != nil {
+		return nil, wrapContextError(ctx, cErr)
+	}
+	return newAffectedResult(affected, verb), nil
+}
+
+// waits for in-flight operations and closes the connection pools
+func (w *GenericSQLConnection) Close() error {
+	if !w.drain() {
+		return nil
+	}
+	w.stmts.close()
+	if w.readDb != w.db {
+		w.readDb.Close()
+	}
+	return w.db.Close()
+}
+
+// a failing query is split into one insert per record so the other
+// records still get written, Records of the result tells which failed.
+// failures not caused by the records fail all records still to be written
+func commitSQL(ctx context.Context, db *sql.DB, stmts *stmtCache, dbcfg *Config, logrecs []TelemetryRecord, queries []sqlQuery, logger *cli.Logger) (*Result, error) {
+	log := dbcfg.structured(logger)
+
+	// commit each chunk separately so the written count stays accurate
+	total := 0
+	for _, query := range queries {
+		total += query.RecordCount
+	}
+
+	written := 0
+	duplicates := 0
+	var records []RecordResult
+	var firstErr error
+	fail := func(idx int, err error) {
+		if records == nil {
+			records = newRecordResults(len(logrecs))
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		records[idx].Err = err
+	}
+
+	for qIdx, query := range queries {
+		inserted, cErr := commitSQLQuery(ctx, db, stmts, query, log)
+		if cErr == nil {
+			written += inserted
+			duplicates += query.RecordCount - inserted
+			continue
+		}
+
+		cErr = wrapContextError(ctx, cErr)
+		if !isRecordError(ctx, cErr) {
+			for _, rest := range queries[qIdx:] {
+				for _, idx := range rest.Indexes {
+					fail(idx, cErr)
+				}
+			}
+			break
+		}
+		if query.RecordCount == 1 {
+			fail(query.Indexes[0], cErr)
+			continue
+		}
+
+		log.Debug("splitting failed insert", "records", query.RecordCount)
+		for _, idx := range query.Indexes {
+			inserted, rErr := commitSQLRecord(ctx, db, stmts, dbcfg, logrecs[idx], logger)
+			if rErr != nil {
+				fail(idx, wrapContextError(ctx, rErr))
+				continue
+			}
+			written += inserted
+			duplicates += 1 - inserted
+		}
+	}
+
+	if failed := countFailedRecords(records); failed > 0 {
+		return &Result{
+			Written:    written,
+			Duplicates: duplicates,
+			Records:    records,
+			Message:    fmt.Sprintf("inserted %d of %d usage records", written, total),
+		}, errors.Wrapf(firstErr, "%d of %d usage records failed", failed, total)
+	}
+
+	log.Debug("preparing report")
+	return newWriteResult(written, duplicates, "inserted"), nil
+}
+
+func commitSQLRecord(ctx context.Context, db *sql.DB, stmts *stmtCache, dbcfg *Config, logrec TelemetryRecord, logger *cli.Logger) (int, error) {
+	queries, qErr := generateInsertQueries(dbcfg, []TelemetryRecord{logrec}, logger)
+	if qErr != nil {
+		return 0, qErr
+	}
+	return commitSQLQuery(ctx, db, stmts, queries[0], dbcfg.structured(logger))
+}
+
+// returns the number of rows actually inserted
+// runs the query as a cached prepared statement when stmts has room
+func commitSQLQuery(ctx context.Context, db *sql.DB, stmts *stmtCache, query sqlQuery, log *structuredLogger) (int, error) {
+	// prepared before the transaction takes a connection, preparing needs
+	// one of its own and a pool of one would wait on the transaction
+	stmt := stmts.get(ctx, query.Query)
 
 	// start transaction
-	logger.Debug("opening transaction")
-	tx, beginErr := db.Begin()
+	log.Debug("opening transaction")
+	tx, beginErr := db.BeginTx(ctx, nil)
 	if beginErr != nil {
-		logger.Debug("error opening transaction")
-		return nil, beginErr
+		log.Debug("error opening transaction")
+		return 0, beginErr
 	}
 	defer tx.Rollback()
 
 	// run the insert query
-	logger.Debug("executing insert query")
-	_, eErr := db.Exec(query)
+	var res sql.Result
+	var eErr error
+	if stmt != nil {
+		log.Debug("executing prepared insert query")
+		res, eErr = tx.StmtContext(ctx, stmt).ExecContext(ctx, query.Args...)
+	} else {
+		log.Debug("executing insert query")
+		res, eErr = tx.ExecContext(ctx, query.Query, query.Args...)
+	}
 	if eErr != nil {
-		return nil, eErr
+		return 0, eErr
 	}
 
-	// commit transaction
-	logger.Debug("commiting transaction")
-	txnErr := tx.Commit()
-	if txnErr != nil {
-		return nil, txnErr
+	// rows skipped as duplicates are not counted as affected
+	inserted := query.RecordCount
+	if affected, aErr := res.RowsAffected(); aErr == nil && int(affected) <= query.RecordCount {
+		inserted = int(affected)
 	}
 
-	logger.Debug("preparing report")
-	return &Result{
-		Message: "successfully inserted usage record",
-	}, nil
+	// commit transaction
+	log.Debug("commiting transaction")
+	if cErr := tx.Commit(); cErr != nil {
+		return 0, cErr
+	}
+	return inserted, nil
 }
 
-func openConnection(backend DBBackend, connStr string, logger *cli.Logger) (*sql.DB, error) {
+func openConnection(dbcfg *Config) (*sql.DB, error) {
+	backend := dbcfg.Backend
+	connStr, err := applySQLTLS(dbcfg, dbcfg.ConnString)
+	if err != nil {
+		return nil, err
+	}
+
 	// open connection
-	logger.Debug(fmt.Sprintf("opening %s connection", backend))
 	cleanConnStr := connStr
 	if backend == Sqlite || backend == MySql {
 		cleanConnStr = strings.Replace(connStr, string(backend)+":", "", 1)
 	}
+	if backend == Sqlite {
+		cleanConnStr = applySqlitePragmas(dbcfg, cleanConnStr)
+	}
+	cleanConnStr, err = applySocketPath(dbcfg, cleanConnStr)
+	if err != nil {
+		return nil, err
+	}
 	return sql.Open(string(backend), cleanConnStr)
 }
 
-func generateScriptInsertQueryV1(table string, logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (string, error) {
-	// read csv file and build sql insert query
-	var querystr strings.Builder
+// connects over the unix socket instead of the host of the connection
+// string. connStr is a mysql dsn without the backend prefix
+func applySocketPath(dbcfg *Config, connStr string) (string, error) {
+	if dbcfg.SocketPath == "" {
+		return connStr, nil
+	}
 
-	logger.Debug("generating insert query with-out headers")
-	querystr.WriteString(fmt.Sprintf("INSERT INTO %s values ", table))
+	switch dbcfg.Backend {
+	case Postgres:
+		// lib/pq takes the directory of the socket as host, the last
+		// host of keyword style connection strings wins
+		params := map[string]string{"host": dbcfg.SocketPath}
+		if !strings.Contains(connStr, "://") {
+			return setConnStringParams(connStr, params)
+		}
+		// url parameters are sorted with the url host, so the host is
+		// moved out of the url. the port names the socket file
+		connUrl, err := url.Parse(connStr)
+		if err != nil {
+			return "", err
+		}
+		if port := connUrl.Port(); port != "" {
+			params["port"] = port
+		}
+		connUrl.Host = ""
+		return setConnStringParams(connUrl.String(), params)
 
-	// build sql data info
-	logger.Debug("building insert query for data")
-	datalines := make([]string, 0)
+	case MySql:
+		mysqlCfg, err := mysql.ParseDSN(connStr)
+		if err != nil {
+			return "", err
+		}
+		mysqlCfg.Net = "unix"
+		mysqlCfg.Addr = dbcfg.SocketPath
+		return mysqlCfg.FormatDSN(), nil
 
-	cresults, merr := json.Marshal(logrec.CommandResults)
-	if merr != nil {
-		logger.Debug("error logging command results")
+	default:
+		return "", errors.Errorf("unix sockets are not supported by %s backend", dbcfg.Backend)
 	}
+}
 
-	// create record based on schema
-	var record []string
+// the driver runs these pragmas on every new pooled connection, so
+// writers wait on each other instead of failing with database is locked.
+// wal lets readers continue while a write is in progress
+func applySqlitePragmas(dbcfg *Config, connStr string) string {
+	busyTimeout := dbcfg.SqliteBusyTimeout
+	if busyTimeout <= 0 {
+		busyTimeout = DefaultSqliteBusyTimeout
+	}
+	pragmas := []struct {
+		name  string
+		value string
+	}{
+		{"_journal_mode", "WAL"},
+		{"_busy_timeout", strconv.FormatInt(busyTimeout.Nanoseconds()/int64(time.Millisecond), 10)},
+	}
 
-	// generate record id, panic if error
-	recordId := uuid.Must(uuid.NewV4())
+	// values set in the connection string win
+	for _, pragma := range pragmas {
+		if strings.Contains(connStr, pragma.name+"=") {
+			continue
+		}
+		separator := "?"
+		if strings.Contains(connStr, "?") {
+			separator = "&"
+		}
+		connStr += separator + pragma.name + "=" + pragma.value
+	}
+	return connStr
+}
 
-	re := regexp.MustCompile(`(\d+:\d+:\d+)`)
-	record = []string{
-		recordId.String(),
-		logrec.Date,
-		re.FindString(logrec.Time),
-		logrec.UserName,
-		logrec.RevitVersion,
-		logrec.RevitBuild,
-		logrec.SessionId,
-		logrec.PyRevitVersion,
-		strconv.FormatBool(logrec.IsDebugMode),
-		strconv.FormatBool(logrec.IsConfigMode),
-		logrec.CommandName,
-		logrec.BundleName,
-		logrec.ExtensionName,
-		logrec.CommandUniqueName,
-		strconv.Itoa(logrec.ResultCode),
-		string(cresults),
-		logrec.ScriptPath,
-		logrec.TraceInfo.EngineInfo.Version,
-		logrec.TraceInfo.IronPythonTraceDump,
-		logrec.TraceInfo.CLRTraceDump,
+func generateInsertQueries(dbcfg *Config, logrecs []TelemetryRecord, logger *cli.Logger) ([]sqlQuery, error) {
+	log := dbcfg.structured(logger)
+
+	// group record values by target table and record shape, keeping order
+	log.Debug("grouping records by target table")
+	type insertGroup struct {
+		table string
+		kind  string
 	}
+	groups := make([]insertGroup, 0)
+	groupColumns := make(map[insertGroup][]string)
+	groupRows := make(map[insertGroup][][]interface{})
+	groupIndexes := make(map[insertGroup][]int)
+	for idx, logrec := range logrecs {
+		columns, values, vErr := generateInsertValues(dbcfg.Backend, logrec, log)
+		if vErr != nil {
+			return nil, vErr
+		}
 
-	datalines = append(datalines, ToSql(&record, true))
+		group := insertGroup{dbcfg.targetFor(logrec), recordKind(logrec)}
+		if _, exists := groupRows[group]; !exists {
+			groups = append(groups, group)
+			groupColumns[group] = columns
+		}
+		groupRows[group] = append(groupRows[group], values)
+		groupIndexes[group] = append(groupIndexes[group], idx)
+	}
+
+	// chunk each group to stay under the backend parameter limits
+	log.Debug("building insert queries")
+	queries := make([]sqlQuery, 0)
+	for _, group := range groups {
+		rows := groupRows[group]
+		chunkSize := maxInsertRows(dbcfg.Backend, len(rows[0]))
+		for start := 0; start < len(rows); start += chunkSize {
+			end := start + chunkSize
+			if end > len(rows) {
+				end = len(rows)
+			}
+			query := generateInsertQuery(dbcfg.Backend, group.table, groupColumns[group], rows[start:end], log)
+			query.Indexes = groupIndexes[group][start:end]
+			queries = append(queries, query)
+		}
+	}
+	log.Debug("building queries completed")
+
+	return queries, nil
+}
 
-	// add csv records to query string
+// values are inserted by position when no columns are given
+func generateInsertQuery(backend DBBackend, table string, columns []string, rows [][]interface{}, log *structuredLogger) sqlQuery {
+	var querystr strings.Builder
+
+	target := table
+	if len(columns) > 0 {
+		log.Debug("generating insert query with headers")
+		quoted := make([]string, 0, len(columns))
+		for _, column := range columns {
+			quoted = append(quoted, quoteSQLColumn(backend, column))
+		}
+		target = fmt.Sprintf("%s (%s)", table, strings.Join(quoted, ", "))
+	} else {
+		log.Debug("generating insert query with-out headers")
+	}
+
+	if backend == MSSql {
+		querystr.WriteString(fmt.Sprintf("INSERT INTO %s SELECT * FROM (VALUES ", target))
+	} else {
+		querystr.WriteString(fmt.Sprintf("INSERT INTO %s values ", target))
+	}
+
+	// build parameterized sql data info
+	log.Debug("building insert query for data")
+	datalines := make([]string, 0, len(rows))
+	args := make([]interface{}, 0)
+	for _, row := range rows {
+		placeholders := make([]string, 0, len(row))
+		for _, value := range row {
+			args = append(args, value)
+			placeholders = append(placeholders, sqlPlaceholder(backend, len(args)))
+		}
+		datalines = append(datalines, fmt.Sprintf("(%s)", strings.Join(placeholders, ", ")))
+	}
+
+	// add records to query string
 	all_datalines := strings.Join(datalines, ", ")
-	logger.Trace(all_datalines)
+	log.Trace(all_datalines)
 	querystr.WriteString(all_datalines)
+
+	// records already stored under the same id are skipped
+	querystr.WriteString(sqlConflictClause(backend, table, len(rows[0])))
 	querystr.WriteString(";\n")
-	logger.Debug("building query completed")
 
-	// execute query
 	full_query := querystr.String()
-	logger.Trace(full_query)
-	return full_query, nil
+	log.Trace(full_query)
+	return sqlQuery{
+		Query:       full_query,
+		Args:        args,
+		RecordCount: len(rows),
+	}
 }
 
-func generateScriptInsertQueryV2(table string, logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (string, error) {
-	// read csv file and build sql insert query
-	var querystr strings.Builder
-
-	logger.Debug("generating insert query with-out headers")
-	querystr.WriteString(fmt.Sprintf("INSERT INTO %s values ", table))
+// the id is always the first column of the insert values
+func sqlConflictClause(backend DBBackend, table string, columns int) string {
+	switch backend {
+	case Postgres, Sqlite:
+		return " ON CONFLICT DO NOTHING"
+	case MySql:
+		// mysql has no DO NOTHING, assigning the id to itself keeps the
+		// stored row and reports it as zero rows affected. connection
+		// strings setting clientFoundRows count it as written instead
+		return " ON DUPLICATE KEY UPDATE id = id"
+	case MSSql:
+		aliases := make([]string, 0, columns)
+		for idx := 1; idx <= columns; idx++ {
+			aliases = append(aliases, fmt.Sprintf("c%d", idx))
+		}
+		return fmt.Sprintf(
+			") AS v (%s) WHERE NOT EXISTS (SELECT 1 FROM %s WHERE %s.id = v.c1)",
+			strings.Join(aliases, ", "), table, table)
+	default:
+		return ""
+	}
+}
 
-	// build sql data info
-	logger.Debug("building insert query for data")
-	datalines := make([]string, 0)
+func maxInsertRows(backend DBBackend, columns int) int {
+	maxRows := sqlMaxParams[backend] / columns
+	if backend == MSSql && maxRows > 1000 {
+		// sqlserver limits row value expressions to 1000 per insert
+		maxRows = 1000
+	}
+	if maxRows < 1 {
+		maxRows = 1
+	}
+	return maxRows
+}
 
-	// marshal json data
-	engineCfgs, merr := json.Marshal(logrec.TraceInfo.EngineInfo.Configs)
-	if merr != nil {
-		logger.Debug("error logging engine configs")
+// columns the values are for, v1 tables have no column names and are
+// inserted by position
+func generateInsertValues(backend DBBackend, logrec TelemetryRecord, log *structuredLogger) ([]string, []interface{}, error) {
+	switch rec := logrec.(type) {
+	case *ScriptTelemetryRecordV1:
+		values, vErr := generateScriptInsertValuesV1(rec, log)
+		return nil, values, vErr
+	case *ScriptTelemetryRecordV2:
+		values, vErr := generateTaggedInsertValues(backend, rec, scriptFieldsV2, log)
+		return scriptColumnsV2, values, vErr
+	case *EventTelemetryRecordV2:
+		values, vErr := generateTaggedInsertValues(backend, rec, eventFieldsV2, log)
+		return eventColumnsV2, values, vErr
+	default:
+		return nil, nil, errors.New("unknown telemetry record type")
 	}
+}
 
-	// marshal json data
+func generateScriptInsertValuesV1(logrec *ScriptTelemetryRecordV1, log *structuredLogger) ([]interface{}, error) {
 	cresults, merr := json.Marshal(logrec.CommandResults)
 	if merr != nil {
-		logger.Debug("error logging command results")
+		log.Debug("error logging command results")
 	}
 
-	// create record based on schema
-	var record []string
-
-	// generate record id, panic if error
-	recordId := uuid.Must(uuid.NewV4())
+	// client provided or generated record id
+	recordId, idErr := newRecordId(logrec)
+	if idErr != nil {
+		return nil, idErr
+	}
 
-	record = []string{
-		recordId.String(),
-		logrec.TimeStamp,
+	return ToSqlArgs(&[]string{
+		recordId,
+		logrec.Date,
+		v1TimePattern.FindString(logrec.Time),
 		logrec.UserName,
-		logrec.HostUserName,
 		logrec.RevitVersion,
 		logrec.RevitBuild,
 		logrec.SessionId,
 		logrec.PyRevitVersion,
-		logrec.Clone,
 		strconv.FormatBool(logrec.IsDebugMode),
 		strconv.FormatBool(logrec.IsConfigMode),
-		strconv.FormatBool(logrec.IsExecFromGUI),
-		logrec.ExecId,
-		logrec.ExecTimeStamp,
 		logrec.CommandName,
 		logrec.BundleName,
 		logrec.ExtensionName,
 		logrec.CommandUniqueName,
-		logrec.DocumentName,
-		logrec.DocumentPath,
 		strconv.Itoa(logrec.ResultCode),
 		string(cresults),
 		logrec.ScriptPath,
-		logrec.TraceInfo.EngineInfo.Type,
 		logrec.TraceInfo.EngineInfo.Version,
-		strings.Join(logrec.TraceInfo.EngineInfo.SysPaths, ";"),
-		string(engineCfgs),
-		logrec.TraceInfo.Message,
+		logrec.TraceInfo.IronPythonTraceDump,
+		logrec.TraceInfo.CLRTraceDump,
+	}), nil
+}
+
+// selects the records of the filtered type from its table
+func generateSelectQueryV2(dbcfg *Config, filter *RecordFilter, logger *cli.Logger) (string, []interface{}, error) {
+	log := dbcfg.structured(logger)
+
+	recordType, tErr := filter.recordType()
+	if tErr != nil {
+		return "", nil, tErr
+	}
+	page, pErr := filter.page()
+	if pErr != nil {
+		return "", nil, pErr
+	}
+	predicates, cErr := filter.conditions()
+	if cErr != nil {
+		return "", nil, cErr
 	}
-	datalines = append(datalines, ToSql(&record, true))
 
-	// add csv records to query string
-	all_datalines := strings.Join(datalines, ", ")
-	logger.Trace(all_datalines)
-	querystr.WriteString(all_datalines)
-	querystr.WriteString(";\n")
-	logger.Debug("building query completed")
+	var querystr strings.Builder
+
+	log.Debug("generating select query")
+	backend := dbcfg.Backend
+	columns := scriptColumnsV2
+	if recordType == EventRecord {
+		columns = eventColumnsV2
+	}
+	querystr.WriteString(
+		fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), dbcfg.targetOf(recordType)))
+
+	// build parameterized conditions from filter
+	log.Debug("building query conditions from filter")
+	conditions := make([]string, 0)
+	args := make([]interface{}, 0)
+	addCondition := func(column string, op string, value interface{}) {
+		args = append(args, value)
+		conditions = append(
+			conditions,
+			fmt.Sprintf("%s %s %s", column, op, sqlPlaceholder(backend, len(args))))
+	}
+	addTimeCondition := func(op string, t time.Time) {
+		args = append(args, sqlTimeArg(backend, t))
+		conditions = append(conditions, sqlTimeCondition(backend, op, sqlPlaceholder(backend, len(args))))
+	}
+
+	if filter != nil {
+		if !filter.From.IsZero() {
+			addTimeCondition(">=", filter.From)
+		}
+		if !filter.To.IsZero() {
+			addTimeCondition("<=", filter.To)
+		}
+		if filter.HostUserName != "" {
+			addCondition("host_user", "=", filter.HostUserName)
+		}
+		if filter.UserName != "" {
+			addCondition("username", "=", filter.UserName)
+		}
+	}
+	for _, predicate := range predicates {
+		column := quoteSQLColumn(backend, predicate.field)
+		if predicate.op != FilterIn {
+			addCondition(column, sqlFilterOperators[predicate.op], sqlFilterValue(predicate.values[0]))
+			continue
+		}
+		placeholders := make([]string, 0, len(predicate.values))
+		for _, value := range predicate.values {
+			args = append(args, sqlFilterValue(value))
+			placeholders = append(placeholders, sqlPlaceholder(backend, len(args)))
+		}
+		conditions = append(
+			conditions,
+			fmt.Sprintf("%s IN (%s)", column, strings.Join(placeholders, ", ")))
+	}
+	if page != nil {
+		addTimeCondition(">=", page.after())
+	}
+
+	if len(conditions) > 0 {
+		querystr.WriteString(" WHERE ")
+		querystr.WriteString(strings.Join(conditions, " AND "))
+	}
+	querystr.WriteString(" ORDER BY timestamp, id")
+	if filter != nil && filter.Limit > 0 {
+		skip := 0
+		if page != nil {
+			skip = page.Skip
+		}
+		querystr.WriteString(generateLimitClause(backend, filter.Limit, skip))
+	}
+	querystr.WriteString(";")
+	log.Debug("building query completed")
 
-	// execute query
 	full_query := querystr.String()
-	logger.Trace(full_query)
-	return full_query, nil
+	log.Trace(full_query)
+	return full_query, args, nil
+}
+
+var sqlFilterOperators = map[string]string{
+	FilterEquals:      "=",
+	FilterNotEquals:   "<>",
+	FilterGreaterThan: ">",
+	FilterLessThan:    "<",
+}
+
+// booleans are stored as text, see generateSQLValue
+func sqlFilterValue(value interface{}) interface{} {
+	if flag, ok := value.(bool); ok {
+		return strconv.FormatBool(flag)
+	}
+	return value
+}
+
+func generateLimitClause(backend DBBackend, limit int, offset int) string {
+	// sqlserver pages with the standard syntax only
+	if backend == MSSql {
+		return fmt.Sprintf(" OFFSET %d ROWS FETCH NEXT %d ROWS ONLY", offset, limit)
+	}
+	return fmt.Sprintf(" LIMIT %d OFFSET %d", limit, offset)
+}
+
+func generateRecentByUserQuery(backend DBBackend, table string, username string, n int) (string, []interface{}) {
+	return fmt.Sprintf(
+		"SELECT %s FROM %s WHERE username = %s OR host_user = %s ORDER BY timestamp DESC, id DESC%s;",
+		strings.Join(scriptColumnsV2, ", "),
+		table,
+		sqlPlaceholder(backend, 1),
+		sqlPlaceholder(backend, 2),
+		generateLimitClause(backend, n, 0)), []interface{}{username, username}
+}
+
+// names are the user names found on the matching rows, names written in
+// between are removed along with the names that have no pseudonym
+func generateAnonymizeQuery(backend DBBackend, table string, username string, names []string, key string) (string, []interface{}) {
+	args := make([]interface{}, 0, 4*len(names)+2)
+	replace := func(column string) string {
+		var casestr strings.Builder
+		casestr.WriteString("CASE " + column)
+		for _, name := range names {
+			args = append(args, name, sqlPseudonym(key, name))
+			fmt.Fprintf(&casestr, " WHEN %s THEN %s",
+				sqlPlaceholder(backend, len(args)-1), sqlPlaceholder(backend, len(args)))
+		}
+		casestr.WriteString(" ELSE NULL END")
+		return casestr.String()
+	}
+
+	userColumn, hostUserColumn := replace("username"), replace("host_user")
+	args = append(args, username, username)
+	return fmt.Sprintf(
+		"UPDATE %s SET username = %s, host_user = %s WHERE username = %s OR host_user = %s",
+		table, userColumn, hostUserColumn,
+		sqlPlaceholder(backend, len(args)-1), sqlPlaceholder(backend, len(args))), args
+}
+
+// pseudonym as stored, removed names are null and empty names stay empty
+func sqlPseudonym(key string, name string) interface{} {
+	if pseudonym := anonymizeUserName(key, name); pseudonym != "" || name == "" {
+		return pseudonym
+	}
+	return nil
 }
 
-func generateEventInsertQueryV2(table string, logrec *EventTelemetryRecordV2, logger *cli.Logger) (string, error) {
-	// read csv file and build sql insert query
+func generateCommandCountsQuery(backend DBBackend, table string, from time.Time, to time.Time) (string, []interface{}) {
+	conditions := make([]string, 0)
+	args := make([]interface{}, 0)
+	if !from.IsZero() {
+		args = append(args, sqlTimeArg(backend, from))
+		conditions = append(conditions, sqlTimeCondition(backend, ">=", sqlPlaceholder(backend, len(args))))
+	}
+	if !to.IsZero() {
+		args = append(args, sqlTimeArg(backend, to))
+		conditions = append(conditions, sqlTimeCondition(backend, "<=", sqlPlaceholder(backend, len(args))))
+	}
+
 	var querystr strings.Builder
+	querystr.WriteString(fmt.Sprintf("SELECT commandname, COUNT(*) FROM %s", table))
+	if len(conditions) > 0 {
+		querystr.WriteString(" WHERE ")
+		querystr.WriteString(strings.Join(conditions, " AND "))
+	}
+	querystr.WriteString(" GROUP BY commandname;")
+	return querystr.String(), args
+}
 
-	logger.Debug("generating insert query with-out headers")
-	querystr.WriteString(fmt.Sprintf("INSERT INTO %s values ", table))
+// layouts of the bound and scanned record timestamps. sqlite stores utc
+// text padded to nanoseconds so it sorts like the times, mysql takes
+// times without an offset and stores them in utc
+const (
+	sqliteTimeLayout = "2006-01-02T15:04:05.000000000Z07:00"
+	mysqlTimeLayout  = "2006-01-02 15:04:05.999999"
+)
 
-	// build sql data info
-	logger.Debug("building insert query for data")
-	datalines := make([]string, 0)
+// compares the bare timestamp column so its index is used, placeholder is
+// bound to sqlTimeArg
+func sqlTimeCondition(backend DBBackend, op string, placeholder string) string {
+	return fmt.Sprintf("timestamp %s %s", op, placeholder)
+}
 
-	// marshal json data
-	cresults, merr := json.Marshal(logrec.EventArgs)
-	if merr != nil {
-		logger.Debug("error logging command results")
+// the value a time is stored and compared as in the timestamp column,
+// fractions of a second are kept so pages continue right after the
+// record they ended on
+func sqlTimeArg(backend DBBackend, t time.Time) interface{} {
+	switch backend {
+	case MySql:
+		return t.UTC().Format(mysqlTimeLayout)
+	case Sqlite:
+		return t.UTC().Format(sqliteTimeLayout)
+	default:
+		return t.UTC()
+	}
+}
+
+// rfc3339 utc text of a scanned timestamp. the drivers hand typed columns
+// over as times, which scan as rfc3339 text, or as mysql datetime text.
+// text that is neither is returned as it is
+func formatSQLTimeStamp(text string) string {
+	parsed, err := time.Parse(time.RFC3339Nano, text)
+	if err != nil {
+		var mErr error
+		if parsed, mErr = time.Parse("2006-01-02 15:04:05", text); mErr != nil {
+			return text
+		}
 	}
+	return parsed.UTC().Format(time.RFC3339Nano)
+}
 
-	// create record based on schema
-	var record []string
+func sqlPlaceholder(backend DBBackend, index int) string {
+	switch backend {
+	case Postgres:
+		return "$" + strconv.Itoa(index)
+	case MSSql:
+		return "@p" + strconv.Itoa(index)
+	default:
+		return "?"
+	}
+}
 
-	// generate record id, panic if error
-	recordId := uuid.Must(uuid.NewV4())
+// scans a row of the table generateSelectQueryV2 selected from, the
+// filter is checked already
+func scanRecordV2(rows *sql.Rows, filter *RecordFilter) (TelemetryRecord, error) {
+	if recordType, _ := filter.recordType(); recordType == EventRecord {
+		return scanEventRecordV2(rows)
+	}
+	return scanScriptRecordV2(rows)
+}
 
-	record = []string{
-		recordId.String(),
-		logrec.TimeStamp,
-		logrec.HandlerId,
-		logrec.EventType,
-		string(cresults),
-		logrec.UserName,
-		logrec.HostUserName,
-		logrec.RevitVersion,
-		logrec.RevitBuild,
-		strconv.FormatBool(logrec.Cancellable),
-		strconv.FormatBool(logrec.Cancelled),
-		strconv.Itoa(logrec.DocumentId),
-		logrec.DocumentType,
-		logrec.DocumentTemplate,
-		logrec.DocumentName,
-		logrec.DocumentPath,
-		logrec.ProjectNumber,
-		logrec.ProjectName,
-	}
-	datalines = append(datalines, ToSql(&record, true))
-
-	// add csv records to query string
-	all_datalines := strings.Join(datalines, ", ")
-	logger.Trace(all_datalines)
-	querystr.WriteString(all_datalines)
-	querystr.WriteString(";\n")
-	logger.Debug("building query completed")
+func scanScriptRecordV2(rows *sql.Rows) (*ScriptTelemetryRecordV2, error) {
+	// scan all columns as nullable strings since inserts are not typed,
+	// except for the timestamp which is formatted below
+	values := make([]sql.NullString, len(scriptColumnsV2))
+	dest := make([]interface{}, len(values))
+	for idx := range values {
+		dest[idx] = &values[idx]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
 
-	// execute query
-	full_query := querystr.String()
-	logger.Trace(full_query)
-	return full_query, nil
+	row := make(map[string]string)
+	for idx, column := range scriptColumnsV2 {
+		row[column] = values[idx].String
+	}
+
+	resultCode, _ := strconv.Atoi(row["resultcode"])
+	duration, _ := strconv.Atoi(row["duration"])
+	isDebugMode, _ := strconv.ParseBool(row["debug"])
+	isConfigMode, _ := strconv.ParseBool(row["config"])
+	isExecFromGUI, _ := strconv.ParseBool(row["from_gui"])
+
+	logrec := &ScriptTelemetryRecordV2{
+		RecordId:          row["id"],
+		RecordMeta:        RecordMetaV2{SchemaVersion: "2.0"},
+		TimeStamp:         formatSQLTimeStamp(row["timestamp"]),
+		UserName:          row["username"],
+		HostUserName:      row["host_user"],
+		RevitVersion:      row["revit"],
+		RevitBuild:        row["revitbuild"],
+		SessionId:         row["sessionid"],
+		PyRevitVersion:    row["pyrevit"],
+		Clone:             row["clone"],
+		IsDebugMode:       isDebugMode,
+		IsConfigMode:      isConfigMode,
+		IsExecFromGUI:     isExecFromGUI,
+		ExecId:            row["exec_id"],
+		ExecTimeStamp:     row["exec_timestamp"],
+		CommandName:       row["commandname"],
+		BundleName:        row["commandbundle"],
+		ExtensionName:     row["commandextension"],
+		CommandUniqueName: row["commanduniquename"],
+		DocumentName:      row["docname"],
+		DocumentPath:      row["docpath"],
+		ResultCode:        resultCode,
+		Duration:          duration,
+		ScriptPath:        row["scriptpath"],
+		TraceInfo: TraceInfoV2{
+			EngineInfo: EngineInfoV2{
+				Type:    row["engine_type"],
+				Version: row["engine_version"],
+			},
+			Message: row["trace_message"],
+		},
+	}
+
+	// unmarshal json data
+	if cresults := row["commandresults"]; cresults != "" {
+		if err := json.Unmarshal([]byte(cresults), &logrec.CommandResults); err != nil {
+			return nil, err
+		}
+	}
+	if engineCfgs := row["engine_configs"]; engineCfgs != "" {
+		if err := json.Unmarshal([]byte(engineCfgs), &logrec.TraceInfo.EngineInfo.Configs); err != nil {
+			return nil, err
+		}
+	}
+	if extras := row["extras"]; extras != "" {
+		if err := json.Unmarshal([]byte(extras), &logrec.Extras); err != nil {
+			return nil, err
+		}
+	}
+	if sysPaths := row["engine_syspath"]; sysPaths != "" {
+		logrec.TraceInfo.EngineInfo.SysPaths = strings.Split(sysPaths, ";")
+	}
+
+	return logrec, nil
+}
+
+func scanEventRecordV2(rows *sql.Rows) (*EventTelemetryRecordV2, error) {
+	// scan all columns as nullable strings since inserts are not typed,
+	// except for the timestamp which is formatted below
+	values := make([]sql.NullString, len(eventColumnsV2))
+	dest := make([]interface{}, len(values))
+	for idx := range values {
+		dest[idx] = &values[idx]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	row := make(map[string]string)
+	for idx, column := range eventColumnsV2 {
+		row[column] = values[idx].String
+	}
+
+	cancellable, _ := strconv.ParseBool(row["cancellable"])
+	cancelled, _ := strconv.ParseBool(row["cancelled"])
+	documentId, _ := strconv.Atoi(row["docid"])
+
+	logrec := &EventTelemetryRecordV2{
+		RecordId:         row["id"],
+		RecordMeta:       RecordMetaV2{SchemaVersion: "2.0"},
+		TimeStamp:        formatSQLTimeStamp(row["timestamp"]),
+		HandlerId:        row["handler_id"],
+		EventType:        row["type"],
+		UserName:         row["username"],
+		HostUserName:     row["host_user"],
+		RevitVersion:     row["revit"],
+		RevitBuild:       row["revitbuild"],
+		Cancellable:      cancellable,
+		Cancelled:        cancelled,
+		DocumentId:       documentId,
+		DocumentType:     row["doctype"],
+		DocumentTemplate: row["doctemplate"],
+		DocumentName:     row["docname"],
+		DocumentPath:     row["docpath"],
+		ProjectNumber:    row["projectnum"],
+		ProjectName:      row["projectname"],
+	}
+
+	// unmarshal json data
+	if args := row["args"]; args != "" {
+		if err := json.Unmarshal([]byte(args), &logrec.EventArgs); err != nil {
+			return nil, err
+		}
+	}
+	if extras := row["extras"]; extras != "" {
+		if err := json.Unmarshal([]byte(extras), &logrec.Extras); err != nil {
+			return nil, err
+		}
+	}
+
+	return logrec, nil
 }
@@ -0,0 +1,53 @@
+package persistence
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"../cli"
+)
+
+// connections reporting the status of each of their backends
+type healthReporter interface {
+	Health(ctx context.Context) ConnectionStatus
+}
+
+// handler for /healthz, responds with 503 when the backend can not be reached.
+// fan-out connections list every backend and respond with 503 when a
+// required one is down
+func NewHealthHandler(conn Connection, logger *cli.Logger) http.HandlerFunc {
+	log := connectionLogger(conn, logger)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Debug("checking backend connectivity")
+		var status ConnectionStatus
+		if reporter, ok := unwrapHealthReporter(conn); ok {
+			status = reporter.Health(r.Context())
+		} else {
+			status = newConnectionStatus(conn.Ping(r.Context()), "")
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if status.Status != "pass" {
+			log.Debug("backend is unreachable", "error", status.Output)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// finds the fan-out connection under the wrappers, they only ping the
+// connection they wrap
+func unwrapHealthReporter(conn Connection) (healthReporter, bool) {
+	for {
+		if reporter, ok := conn.(healthReporter); ok {
+			return reporter, true
+		}
+		inner, ok := innerConnection(conn)
+		if !ok {
+			return nil, false
+		}
+		conn = inner
+	}
+}
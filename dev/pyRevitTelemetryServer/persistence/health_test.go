@@ -0,0 +1,79 @@
+package persistence
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fan-out of a healthy and an unreachable memory backend, wrapped the way
+// NewConnection and the server wrap connections
+func newTestHealthConnection(t *testing.T, downOptional bool) Connection {
+	t.Helper()
+	healthy := NewMemoryConnection(&Config{})
+	down := NewMemoryConnection(&Config{})
+	down.Close()
+
+	multi := newMultiConnection([]Connection{healthy, down}, []bool{false, downOptional}, FanOutRequireAll)
+	t.Cleanup(func() { multi.Close() })
+
+	metrics, err := NewMetricsConnection(NewValidatingConnection(NewTimeoutConnection(multi, &Config{}), &Config{}), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("wrapping: %v", err)
+	}
+	return metrics
+}
+
+func checkHealth(t *testing.T, conn Connection) (int, ConnectionStatus) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	NewHealthHandler(conn, testLogger)(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	var status ConnectionStatus
+	if err := json.NewDecoder(recorder.Body).Decode(&status); err != nil {
+		t.Fatalf("decoding status: %v", err)
+	}
+	return recorder.Code, status
+}
+
+func TestHealthRequiredBackendDown(t *testing.T) {
+	code, status := checkHealth(t, newTestHealthConnection(t, false))
+	if code != http.StatusServiceUnavailable || status.Status != "fail" {
+		t.Errorf("responded %d %q, want 503 fail", code, status.Status)
+	}
+	if len(status.Backends) != 2 {
+		t.Fatalf("listed %d backends, want 2", len(status.Backends))
+	}
+	if status.Backends[0].Status != "pass" || status.Backends[1].Status != "fail" {
+		t.Errorf("backend statuses are %q and %q, want pass and fail",
+			status.Backends[0].Status, status.Backends[1].Status)
+	}
+	if status.Backends[1].Output == "" {
+		t.Errorf("failed backend reports no output")
+	}
+}
+
+func TestHealthOptionalBackendDown(t *testing.T) {
+	code, status := checkHealth(t, newTestHealthConnection(t, true))
+	if code != http.StatusOK || status.Status != "pass" {
+		t.Errorf("responded %d %q, want 200 pass", code, status.Status)
+	}
+	if len(status.Backends) != 2 || status.Backends[1].Required || status.Backends[1].Status != "fail" {
+		t.Errorf("backends are %+v, want the optional one listed as failed", status.Backends)
+	}
+}
+
+func TestHealthSingleBackend(t *testing.T) {
+	conn := newTestMemoryConnection(t, Config{})
+	if code, status := checkHealth(t, conn); code != http.StatusOK || len(status.Backends) != 0 {
+		t.Errorf("responded %d with %d backends, want 200 without", code, len(status.Backends))
+	}
+
+	conn.Close()
+	if code, _ := checkHealth(t, conn); code != http.StatusServiceUnavailable {
+		t.Errorf("responded %d for a closed backend, want 503", code)
+	}
+}
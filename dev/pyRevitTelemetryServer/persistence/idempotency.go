@@ -0,0 +1,288 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"../cli"
+	"github.com/pkg/errors"
+)
+
+// longest idempotency key stored, keys are usually uuids
+const maxIdempotencyKeyLength = 255
+
+// side table of the sql backends keeping the results of keyed writes
+const idempotencyKeysTable = "idempotency_keys"
+
+type idempotencyKeyKey struct{}
+
+// writes with the key are done once within the idempotency ttl, the
+// http handler passes the Idempotency-Key header here
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyKey{}, key)
+}
+
+func idempotencyKeyFrom(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKeyKey{}).(string)
+	return key
+}
+
+// the part of a result kept for repeated writes
+type storedResult struct {
+	ResultCode int    `json:"resultcode"`
+	Message    string `json:"message"`
+	Written    int    `json:"written"`
+	Duplicates int    `json:"duplicates"`
+}
+
+type idempotencyStore interface {
+	get(ctx context.Context, key string, now time.Time) (*storedResult, error)
+	put(ctx context.Context, key string, result *storedResult, expires time.Time) error
+}
+
+// answers writes repeating the idempotency key of an earlier successful
+// write with the result of that write, without writing again. writes
+// without a key, failed writes and writes only queued are not remembered.
+// sql backends keep the keys in a side table shared by all servers, other
+// backends in memory of this server
+type IdempotentConnection struct {
+	Connection
+	TTL time.Duration
+
+	store idempotencyStore
+	// writes of the same key on this server wait for each other
+	locks [64]sync.Mutex
+}
+
+func NewIdempotentConnection(conn Connection, dbcfg *Config) *IdempotentConnection {
+	var store idempotencyStore = &memoryIdempotencyStore{entries: make(map[string]memoryIdempotencyEntry)}
+	if sqlConn, ok := unwrapSQLConnection(conn); ok {
+		store = &sqlIdempotencyStore{conn: sqlConn}
+	}
+	return &IdempotentConnection{
+		Connection: conn,
+		TTL:        dbcfg.IdempotencyTTL,
+		store:      store,
+	}
+}
+
+func (w *IdempotentConnection) Write(ctx context.Context, logrec TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.idempotent(ctx, logger, func() (*Result, error) {
+		return w.Connection.Write(ctx, logrec, logger)
+	})
+}
+
+func (w *IdempotentConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.idempotent(ctx, logger, func() (*Result, error) {
+		return w.Connection.WriteBatch(ctx, logrecs, logger)
+	})
+}
+
+func (w *IdempotentConnection) idempotent(ctx context.Context, logger *cli.Logger, write func() (*Result, error)) (*Result, error) {
+	log := connectionLogger(w.Connection, logger)
+
+	key := idempotencyKeyFrom(ctx)
+	if key == "" {
+		return write()
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		return nil, errors.Errorf("idempotency key is longer than %d characters", maxIdempotencyKeyLength)
+	}
+
+	lock := w.lockFor(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	stored, gErr := w.store.get(ctx, key, time.Now())
+	if gErr != nil {
+		return nil, errors.Wrap(gErr, "checking idempotency key")
+	}
+	if stored != nil {
+		log.Debug("idempotency key was already written", "key", key)
+		return &Result{
+			ResultCode: stored.ResultCode,
+			Message:    stored.Message,
+			Written:    stored.Written,
+			Duplicates: stored.Duplicates,
+		}, nil
+	}
+
+	result, err := write()
+	if err != nil || result == nil {
+		return result, err
+	}
+	// queued records may still fail to be written, a repeated write
+	// queues them again and their record ids keep them from being
+	// written twice
+	if result.Queued > 0 {
+		return result, nil
+	}
+
+	// the records are written, a key not stored only lets a retry
+	// write them again
+	stored = &storedResult{
+		ResultCode: result.ResultCode,
+		Message:    result.Message,
+		Written:    result.Written,
+		Duplicates: result.Duplicates,
+	}
+	if pErr := w.store.put(ctx, key, stored, time.Now().Add(w.TTL)); pErr != nil {
+		log.Print("error storing idempotency key", "key", key, "error", pErr)
+	}
+	return result, nil
+}
+
+func (w *IdempotentConnection) lockFor(key string) *sync.Mutex {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return &w.locks[hash.Sum32()%uint32(len(w.locks))]
+}
+
+type memoryIdempotencyEntry struct {
+	result  *storedResult
+	expires time.Time
+}
+
+type memoryIdempotencyStore struct {
+	mutex   sync.Mutex
+	entries map[string]memoryIdempotencyEntry
+}
+
+func (s *memoryIdempotencyStore) get(ctx context.Context, key string, now time.Time) (*storedResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, exists := s.entries[key]
+	if !exists || !now.Before(entry.expires) {
+		return nil, nil
+	}
+	return entry.result, nil
+}
+
+// expires is the end of the ttl, expired keys are dropped on every put
+func (s *memoryIdempotencyStore) put(ctx context.Context, key string, result *storedResult, expires time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	for stored, entry := range s.entries {
+		if !now.Before(entry.expires) {
+			delete(s.entries, stored)
+		}
+	}
+	s.entries[key] = memoryIdempotencyEntry{result: result, expires: expires}
+	return nil
+}
+
+// expiry times are rfc3339 strings in utc, which sort as the times do
+type sqlIdempotencyStore struct {
+	conn *GenericSQLConnection
+
+	// the table is created on first use, retried until it succeeds
+	mutex   sync.Mutex
+	created bool
+}
+
+func (s *sqlIdempotencyStore) ensureTable(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.created {
+		return nil
+	}
+	if _, err := s.conn.db.ExecContext(ctx, generateCreateIdempotencyTableQuery(s.conn.Config.Backend)); err != nil {
+		return wrapContextError(ctx, err)
+	}
+	s.created = true
+	return nil
+}
+
+// reads the primary, a replica may not have the key yet
+func (s *sqlIdempotencyStore) get(ctx context.Context, key string, now time.Time) (*storedResult, error) {
+	if err := s.ensureTable(ctx); err != nil {
+		return nil, err
+	}
+	backend := s.conn.Config.Backend
+	query := fmt.Sprintf(
+		"SELECT %s FROM %s WHERE %s = %s AND %s > %s",
+		quoteSQLColumn(backend, "result"),
+		idempotencyKeysTable,
+		quoteSQLColumn(backend, "key"),
+		sqlPlaceholder(backend, 1),
+		quoteSQLColumn(backend, "expires_at"),
+		sqlPlaceholder(backend, 2))
+
+	var data string
+	err := s.conn.db.QueryRowContext(ctx, query, key, formatFilterTime(now)).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, wrapContextError(ctx, err)
+	}
+
+	result := &storedResult{}
+	if uErr := json.Unmarshal([]byte(data), result); uErr != nil {
+		return nil, uErr
+	}
+	return result, nil
+}
+
+// replaces the key in case it expired, and drops the expired keys
+func (s *sqlIdempotencyStore) put(ctx context.Context, key string, result *storedResult, expires time.Time) error {
+	if err := s.ensureTable(ctx); err != nil {
+		return err
+	}
+	data, mErr := json.Marshal(result)
+	if mErr != nil {
+		return mErr
+	}
+
+	backend := s.conn.Config.Backend
+	keyColumn := quoteSQLColumn(backend, "key")
+	expiresColumn := quoteSQLColumn(backend, "expires_at")
+	deleteQuery := fmt.Sprintf(
+		"DELETE FROM %s WHERE %s = %s OR %s <= %s",
+		idempotencyKeysTable,
+		keyColumn, sqlPlaceholder(backend, 1),
+		expiresColumn, sqlPlaceholder(backend, 2))
+	insertQuery := fmt.Sprintf(
+		"INSERT INTO %s (%s, %s, %s) VALUES (%s, %s, %s)",
+		idempotencyKeysTable,
+		keyColumn, quoteSQLColumn(backend, "result"), expiresColumn,
+		sqlPlaceholder(backend, 1), sqlPlaceholder(backend, 2), sqlPlaceholder(backend, 3))
+
+	tx, beginErr := s.conn.db.BeginTx(ctx, nil)
+	if beginErr != nil {
+		return wrapContextError(ctx, beginErr)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, deleteQuery, key, formatFilterTime(time.Now())); err != nil {
+		return wrapContextError(ctx, err)
+	}
+	if _, err := tx.ExecContext(ctx, insertQuery, key, string(data), formatFilterTime(expires)); err != nil {
+		return wrapContextError(ctx, err)
+	}
+	return wrapContextError(ctx, tx.Commit())
+}
+
+func generateCreateIdempotencyTableQuery(backend DBBackend) string {
+	body := fmt.Sprintf(
+		"%s VARCHAR(%d) NOT NULL PRIMARY KEY, %s %s NOT NULL, %s VARCHAR(32) NOT NULL",
+		quoteSQLColumn(backend, "key"),
+		maxIdempotencyKeyLength,
+		quoteSQLColumn(backend, "result"),
+		sqlTextTypes[backend],
+		quoteSQLColumn(backend, "expires_at"))
+
+	// sqlserver has no IF NOT EXISTS for tables
+	if backend == MSSql {
+		return fmt.Sprintf(
+			"IF OBJECT_ID(N'%s', N'U') IS NULL CREATE TABLE %s (%s)",
+			strings.Replace(idempotencyKeysTable, "'", "''", -1), idempotencyKeysTable, body)
+	}
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", idempotencyKeysTable, body)
+}
@@ -0,0 +1,157 @@
+package persistence
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotentRetry(t *testing.T) {
+	testIdempotentRetry(t, newTestSqliteConnection)
+}
+
+func TestIdempotentRetryServers(t *testing.T) {
+	for _, server := range testSQLServers {
+		t.Run(string(server.backend), func(t *testing.T) {
+			testIdempotentRetry(t, func(t *testing.T, dbcfg Config) Connection {
+				return newTestSQLServerConnection(t, server.env, dbcfg)
+			})
+		})
+	}
+}
+
+// shared by the backends, a retry carrying the key of a write that went
+// through returns its result without writing the record again. the retry
+// is a new record so dedup by record id does not catch it
+func testIdempotentRetry(t *testing.T, connect func(*testing.T, Config) Connection) {
+	conn := connect(t, Config{IdempotencyTTL: time.Hour})
+	ctx := WithIdempotencyKey(context.Background(), "request-1")
+
+	first, err := conn.Write(ctx, newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"), testLogger)
+	if err != nil {
+		t.Fatalf("writing: %v", err)
+	}
+	retry, rErr := conn.Write(ctx, newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"), testLogger)
+	if rErr != nil {
+		t.Fatalf("retrying: %v", rErr)
+	}
+	if retry.ResultCode != first.ResultCode || retry.Written != first.Written || retry.Message != first.Message {
+		t.Errorf("retry returned %+v, want the result of the first write %+v", retry, first)
+	}
+	if records := readTestRecords(t, conn, nil); len(records) != 1 {
+		t.Fatalf("found %d records after the retry, want 1", len(records))
+	}
+
+	// other keys and writes without a key are written
+	writeTestRecords(t, conn, newTestScriptRecord("jane", "jane.doe", "2021-06-01T11:00:00Z"))
+	if _, oErr := conn.Write(WithIdempotencyKey(context.Background(), "request-2"), newTestScriptRecord("jane", "jane.doe", "2021-06-01T12:00:00Z"), testLogger); oErr != nil {
+		t.Fatalf("writing with another key: %v", oErr)
+	}
+	if records := readTestRecords(t, conn, nil); len(records) != 3 {
+		t.Errorf("found %d records, want 3", len(records))
+	}
+}
+
+// the side table is shared by the connections of all servers
+func TestIdempotentRetryOtherConnection(t *testing.T) {
+	dbcfg := Config{
+		Backend:        Sqlite,
+		ConnString:     "sqlite3:" + filepath.Join(t.TempDir(), "telemetry.db"),
+		IdempotencyTTL: time.Hour,
+	}
+	ctx := WithIdempotencyKey(context.Background(), "request-1")
+	first := newTestConnection(t, dbcfg)
+	if _, err := first.Write(ctx, newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"), testLogger); err != nil {
+		t.Fatalf("writing: %v", err)
+	}
+
+	second := newTestConnection(t, dbcfg)
+	if _, err := second.Write(ctx, newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"), testLogger); err != nil {
+		t.Fatalf("retrying on another connection: %v", err)
+	}
+	if records := readTestRecords(t, second, nil); len(records) != 1 {
+		t.Errorf("found %d records after the retry, want 1", len(records))
+	}
+}
+
+// a failed write is retried for real
+func TestIdempotentRetryAfterFailure(t *testing.T) {
+	inner := newFailingConnection(t, errTestWrite)
+	conn := NewIdempotentConnection(inner, &Config{IdempotencyTTL: time.Hour})
+	ctx := WithIdempotencyKey(context.Background(), "request-1")
+	if _, err := conn.Write(ctx, newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"), testLogger); err != errTestWrite {
+		t.Fatalf("writing returned %v, want the backend error", err)
+	}
+
+	inner.setErr(nil)
+	res, err := conn.Write(ctx, newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"), testLogger)
+	if err != nil || res.Written != 1 {
+		t.Fatalf("retrying returned %+v, %v, want the record written", res, err)
+	}
+	if records := readTestRecords(t, inner, nil); len(records) != 1 {
+		t.Errorf("found %d records, want 1", len(records))
+	}
+}
+
+// retries of a client out of tokens still get the result of their write
+func TestIdempotentRetryRateLimited(t *testing.T) {
+	conn := newTestMemoryConnection(t, Config{IdempotencyTTL: time.Hour, MaxRecordsPerMinute: 1})
+	ctx := WithIdempotencyKey(context.Background(), "request-1")
+	logrec := newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z")
+	if _, err := conn.Write(ctx, logrec, testLogger); err != nil {
+		t.Fatalf("writing: %v", err)
+	}
+	if _, err := conn.Write(context.Background(), newTestScriptRecord("jane", "jane.doe", "2021-06-01T11:00:00Z"), testLogger); err != ErrRateLimited {
+		t.Fatalf("writing over the limit returned %v, want ErrRateLimited", err)
+	}
+
+	res, err := conn.Write(ctx, logrec, testLogger)
+	if err != nil || res.Written != 1 {
+		t.Errorf("retrying returned %+v, %v, want the stored result", res, err)
+	}
+	if records := readTestRecords(t, conn, nil); len(records) != 1 {
+		t.Errorf("found %d records, want 1", len(records))
+	}
+}
+
+func TestIdempotencyKeyTooLong(t *testing.T) {
+	conn := NewIdempotentConnection(newTestMemoryConnection(t, Config{}), &Config{IdempotencyTTL: time.Hour})
+	ctx := WithIdempotencyKey(context.Background(), strings.Repeat("k", maxIdempotencyKeyLength+1))
+	if _, err := conn.Write(ctx, newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"), testLogger); err == nil {
+		t.Error("writing with a key over the length limit succeeded")
+	}
+}
+
+// keys are found until their ttl ends
+func TestIdempotencyStoreExpiry(t *testing.T) {
+	sqlConn, _ := unwrapSQLConnection(newTestSqliteConnection(t, Config{}))
+	stores := []struct {
+		name  string
+		store idempotencyStore
+	}{
+		{"memory", &memoryIdempotencyStore{entries: make(map[string]memoryIdempotencyEntry)}},
+		{"sql", &sqlIdempotencyStore{conn: sqlConn}},
+	}
+	// sql expiry times have whole seconds
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	for _, test := range stores {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			if err := test.store.put(ctx, "request-1", &storedResult{Written: 1, Message: "written"}, expires); err != nil {
+				t.Fatalf("storing key: %v", err)
+			}
+			stored, err := test.store.get(ctx, "request-1", expires.Add(-time.Second))
+			if err != nil || stored == nil || stored.Written != 1 || stored.Message != "written" {
+				t.Errorf("key before its expiry has result %+v, %v", stored, err)
+			}
+			if expired, gErr := test.store.get(ctx, "request-1", expires); gErr != nil || expired != nil {
+				t.Errorf("key at its expiry has result %+v, %v, want none", expired, gErr)
+			}
+			if missing, gErr := test.store.get(ctx, "request-2", expires.Add(-time.Second)); gErr != nil || missing != nil {
+				t.Errorf("unknown key has result %+v, %v, want none", missing, gErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"../cli"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/pkg/errors"
+)
+
+type InfluxDBConnection struct {
+	DatabaseConnection
+	client   influxdb2.Client
+	writeAPI api.WriteAPIBlocking
+}
+
+func newInfluxDBConnection(w DatabaseConnection) (*InfluxDBConnection, error) {
+	if w.Config.InfluxOrg == "" || w.Config.InfluxBucket == "" {
+		return nil, errors.New("influxdb backend requires org and bucket")
+	}
+
+	// influxdb:http://localhost:8086
+	serverUrl := strings.Replace(w.Config.ConnString, string(InfluxDB)+":", "", 1)
+	client := influxdb2.NewClient(serverUrl, w.Config.InfluxToken)
+
+	return &InfluxDBConnection{
+		DatabaseConnection: w,
+		client:             client,
+		writeAPI:           client.WriteAPIBlocking(w.Config.InfluxOrg, w.Config.InfluxBucket),
+	}, nil
+}
+
+func (w *InfluxDBConnection) GetType() DBBackend {
+	return w.Config.Backend
+}
+
+func (w *InfluxDBConnection) GetVersion(logger *cli.Logger) string {
+	if err := w.begin(); err != nil {
+		return ""
+	}
+	defer w.end()
+
+	w.Config.structured(logger).Debug("getting influxdb version")
+	health, err := w.client.Health(context.Background())
+	if err != nil || health.Version == nil {
+		return ""
+	}
+	return *health.Version
+}
+
+func (w *InfluxDBConnection) GetStatus(logger *cli.Logger) ConnectionStatus {
+	if err := w.Ping(context.Background()); err != nil {
+		return newConnectionStatus(err, "")
+	}
+	return newConnectionStatus(nil, w.GetVersion(logger))
+}
+
+func (w *InfluxDBConnection) Ping(ctx context.Context) error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+	defer w.end()
+
+	pingCtx, cancel := w.Config.newPingContext(ctx)
+	defer cancel()
+
+	ok, err := w.client.Ping(pingCtx)
+	if err != nil {
+		return wrapContextError(pingCtx, err)
+	}
+	if !ok {
+		return errors.New("influxdb is not ready")
+	}
+	return nil
+}
+
+func (w *InfluxDBConnection) Write(ctx context.Context, logrec TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.WriteBatch(ctx, []TelemetryRecord{logrec}, logger)
+}
+
+func (w *InfluxDBConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	log := w.Config.structured(logger)
+
+	if len(logrecs) == 0 {
+		return &Result{
+			ResultCode: ResultNoData,
+			Message:    "no data to write",
+		}, nil
+	}
+
+	log.Debug("building points")
+	points := make([]*write.Point, 0, len(logrecs))
+	for _, logrec := range logrecs {
+		point, pErr := w.generatePoint(logrec)
+		if pErr != nil {
+			return nil, pErr
+		}
+		points = append(points, point)
+	}
+
+	// all points are sent in a single batched request
+	log.Debug("writing points")
+	if wErr := w.writeAPI.WritePoint(ctx, points...); wErr != nil {
+		return nil, wrapContextError(ctx, wErr)
+	}
+
+	log.Debug("preparing report")
+	return &Result{
+		Written: len(points),
+		Message: fmt.Sprintf("successfully wrote %d usage points", len(points)),
+	}, nil
+}
+
+func (w *InfluxDBConnection) Close() error {
+	if !w.drain() {
+		return nil
+	}
+	w.client.Close()
+	return nil
+}
+
+// measurement is the target name, identity goes into tags and outcome into fields
+func (w *InfluxDBConnection) generatePoint(logrec TelemetryRecord) (*write.Point, error) {
+	timestamp := logrec.GetTimeStamp()
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	switch rec := logrec.(type) {
+	case *ScriptTelemetryRecordV1:
+		return influxdb2.NewPoint(
+			w.Config.targetFor(logrec),
+			map[string]string{
+				"user":    rec.UserName,
+				"command": rec.CommandName,
+				"revit":   rec.RevitVersion,
+			},
+			map[string]interface{}{
+				"success":    rec.ResultCode == 0,
+				"resultcode": rec.ResultCode,
+			},
+			timestamp,
+		), nil
+
+	case *ScriptTelemetryRecordV2:
+		return influxdb2.NewPoint(
+			w.Config.targetFor(logrec),
+			map[string]string{
+				"host":    rec.HostUserName,
+				"user":    rec.UserName,
+				"command": rec.CommandName,
+				"revit":   rec.RevitVersion,
+				"engine":  rec.TraceInfo.EngineInfo.Type,
+			},
+			map[string]interface{}{
+				"success":    rec.ResultCode == 0,
+				"resultcode": rec.ResultCode,
+				"session":    rec.SessionId,
+			},
+			timestamp,
+		), nil
+
+	case *EventTelemetryRecordV2:
+		return influxdb2.NewPoint(
+			w.Config.targetFor(logrec),
+			map[string]string{
+				"host":  rec.HostUserName,
+				"user":  rec.UserName,
+				"event": rec.EventType,
+				"revit": rec.RevitVersion,
+			},
+			map[string]interface{}{
+				"cancellable": rec.Cancellable,
+				"cancelled":   rec.Cancelled,
+				"docname":     rec.DocumentName,
+			},
+			timestamp,
+		), nil
+
+	default:
+		return nil, errors.New("unknown telemetry record type")
+	}
+}
@@ -0,0 +1,372 @@
+package persistence
+
+import (
+	"context"
+
+	"../cli"
+)
+
+// the per record type writes of the original Connection interface, kept
+// for existing callers. every connection defines them itself so wrappers
+// do not fall through to the connection they wrap. the writes run without
+// a deadline of their own, the timeout wrapper still bounds each attempt
+
+// Deprecated: use Write
+func (w *AsyncConnection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *AsyncConnection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *AsyncConnection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *BigQueryConnection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *BigQueryConnection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *BigQueryConnection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *CassandraConnection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *CassandraConnection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *CassandraConnection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *ClickHouseConnection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *ClickHouseConnection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *ClickHouseConnection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *DeadLetterConnection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *DeadLetterConnection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *DeadLetterConnection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *DiscardConnection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *DiscardConnection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *DiscardConnection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *DynamoDBConnection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *DynamoDBConnection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *DynamoDBConnection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *ElasticsearchConnection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *ElasticsearchConnection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *ElasticsearchConnection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *FileConnection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *FileConnection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *FileConnection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *GenericSQLConnection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *GenericSQLConnection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *GenericSQLConnection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *IdempotentConnection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *IdempotentConnection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *IdempotentConnection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *InfluxDBConnection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *InfluxDBConnection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *InfluxDBConnection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *MemoryConnection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *MemoryConnection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *MemoryConnection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *MetricsConnection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *MetricsConnection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *MetricsConnection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *MongoDBConnection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *MongoDBConnection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *MongoDBConnection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *MultiConnection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *MultiConnection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *MultiConnection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *RateLimitedConnection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *RateLimitedConnection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *RateLimitedConnection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *RedisConnection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *RedisConnection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *RedisConnection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *RetryConnection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *RetryConnection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *RetryConnection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *S3Connection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *S3Connection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *S3Connection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *StdoutConnection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *StdoutConnection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *StdoutConnection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *TimeoutConnection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *TimeoutConnection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *TimeoutConnection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *TracingConnection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *TracingConnection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *TracingConnection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *ValidatingConnection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *ValidatingConnection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
+
+// Deprecated: use Write
+func (w *ValidatingConnection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
+	return w.Write(context.Background(), logrec, logger)
+}
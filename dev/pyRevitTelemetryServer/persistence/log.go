@@ -0,0 +1,145 @@
+package persistence
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"../cli"
+)
+
+// Config.LogFormat values
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+func isLogFormat(format string) bool {
+	switch format {
+	case "", LogFormatText, LogFormatJSON:
+		return true
+	}
+	return false
+}
+
+// log line levels, the cli logger decides which of them are printed
+const (
+	logLevelInfo  = "info"
+	logLevelDebug = "debug"
+	logLevelTrace = "trace"
+)
+
+// log calls of the package with key/value fields, printed through the cli
+// logger. text lines are the message, the error after a colon and the
+// other fields as key=value. json lines carry time, level, message,
+// backend and error fields along with the other fields, servers logging
+// json clear the flags of the log package so lines are plain json
+type structuredLogger struct {
+	logger  *cli.Logger
+	format  string
+	backend string
+}
+
+func newStructuredLogger(logger *cli.Logger, format string, backend string) *structuredLogger {
+	return &structuredLogger{logger: logger, format: format, backend: backend}
+}
+
+// logger in the format of the config, labeled by its backend
+func (cfg *Config) structured(logger *cli.Logger) *structuredLogger {
+	if cfg == nil {
+		return newStructuredLogger(logger, LogFormatText, "")
+	}
+	return newStructuredLogger(logger, cfg.LogFormat, string(cfg.Backend))
+}
+
+// keyvals alternate keys and values, a key without a value is ignored
+func (l *structuredLogger) Print(message string, keyvals ...interface{}) {
+	l.logger.Print(l.line(logLevelInfo, message, keyvals))
+}
+
+func (l *structuredLogger) Debug(message string, keyvals ...interface{}) {
+	l.logger.Debug(l.line(logLevelDebug, message, keyvals))
+}
+
+func (l *structuredLogger) Trace(message string, keyvals ...interface{}) {
+	l.logger.Trace(l.line(logLevelTrace, message, keyvals))
+}
+
+func (l *structuredLogger) line(level string, message string, keyvals []interface{}) string {
+	if l.format == LogFormatJSON {
+		return l.jsonLine(level, message, keyvals)
+	}
+
+	var linestr strings.Builder
+	linestr.WriteString(message)
+	fields := make([]string, 0, len(keyvals)/2)
+	for idx := 0; idx+1 < len(keyvals); idx += 2 {
+		key := fmt.Sprint(keyvals[idx])
+		if key == "error" {
+			fmt.Fprintf(&linestr, ": %v", keyvals[idx+1])
+			continue
+		}
+		fields = append(fields, fmt.Sprintf("%s=%v", key, keyvals[idx+1]))
+	}
+	if len(fields) > 0 {
+		linestr.WriteString(" " + strings.Join(fields, " "))
+	}
+	return linestr.String()
+}
+
+func (l *structuredLogger) jsonLine(level string, message string, keyvals []interface{}) string {
+	entry := map[string]interface{}{
+		"time":    time.Now().UTC().Format(time.RFC3339Nano),
+		"level":   level,
+		"message": message,
+	}
+	if l.backend != "" {
+		entry["backend"] = l.backend
+	}
+	for idx := 0; idx+1 < len(keyvals); idx += 2 {
+		value := keyvals[idx+1]
+		switch field := value.(type) {
+		case error:
+			value = field.Error()
+		case fmt.Stringer:
+			value = field.String()
+		}
+		entry[fmt.Sprint(keyvals[idx])] = value
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data, _ = json.Marshal(map[string]interface{}{
+			"time":    entry["time"],
+			"level":   level,
+			"message": message,
+			"error":   fmt.Sprintf("fields can not be logged: %v", err),
+		})
+	}
+	return string(data)
+}
+
+// connections knowing the config their log lines are formatted by
+type logConfigured interface {
+	logConfig() *Config
+}
+
+func (w DatabaseConnection) logConfig() *Config {
+	return w.Config
+}
+
+// logger for code given a connection only, formatted by the config of the
+// connection under the wrappers
+func connectionLogger(conn Connection, logger *cli.Logger) *structuredLogger {
+	for {
+		if configured, ok := conn.(logConfigured); ok {
+			return configured.logConfig().structured(logger)
+		}
+		inner, ok := innerConnection(conn)
+		if !ok {
+			return (*Config)(nil).structured(logger)
+		}
+		conn = inner
+	}
+}
@@ -0,0 +1,66 @@
+package persistence
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestStructuredLoggerJSONLine(t *testing.T) {
+	log := (&Config{Backend: Postgres, LogFormat: LogFormatJSON}).structured(testLogger)
+	line := log.line(logLevelInfo, "error storing idempotency key",
+		[]interface{}{"key", "request-1", "records", 3, "error", errors.New("connection refused")})
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		t.Fatalf("line is not json: %v\n%s", err, line)
+	}
+	expected := map[string]interface{}{
+		"level":   "info",
+		"message": "error storing idempotency key",
+		"backend": "postgres",
+		"error":   "connection refused",
+		"key":     "request-1",
+		"records": float64(3),
+	}
+	for key, value := range expected {
+		if entry[key] != value {
+			t.Errorf("%s is %v, want %v", key, entry[key], value)
+		}
+	}
+	if _, err := time.Parse(time.RFC3339Nano, entry["time"].(string)); err != nil {
+		t.Errorf("time is not rfc3339: %v", entry["time"])
+	}
+	if len(entry) != len(expected)+1 {
+		t.Errorf("line has fields %v, want only the logged ones", entry)
+	}
+}
+
+func TestStructuredLoggerTextLine(t *testing.T) {
+	log := (&Config{Backend: Postgres}).structured(testLogger)
+	line := log.line(logLevelDebug, "splitting failed insert",
+		[]interface{}{"records", 3, "error", errors.New("constraint failed")})
+	if line != "splitting failed insert: constraint failed records=3" {
+		t.Errorf("text line is %q", line)
+	}
+	if plain := log.line(logLevelDebug, "preparing report", nil); plain != "preparing report" {
+		t.Errorf("text line without fields is %q", plain)
+	}
+}
+
+func TestUnknownLogFormatIsInvalid(t *testing.T) {
+	dbcfg := &Config{Backend: Memory, ConnString: "memory:", LogFormat: "xml"}
+	if err := dbcfg.Validate(); err == nil {
+		t.Errorf("log format xml passed validation")
+	}
+}
+
+func TestConnectionLoggerFindsTheBackendConfig(t *testing.T) {
+	conn := newTestMemoryConnection(t, Config{LogFormat: LogFormatJSON})
+	log := connectionLogger(conn, testLogger)
+	if log.format != LogFormatJSON || log.backend != string(Memory) {
+		t.Errorf("logger has format %q and backend %q, want the ones of the backend", log.format, log.backend)
+	}
+}
@@ -0,0 +1,371 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"../cli"
+)
+
+// keeps records in memory, for tests that need a working backend without
+// a database. every connection has its own records, they are lost on
+// Close. records are deduplicated by id and filtered, paged and deleted
+// the same as in the sql backends. connection string is memory:
+type MemoryConnection struct {
+	DatabaseConnection
+
+	mutex   sync.RWMutex
+	records map[string][]TelemetryRecord
+	ids     map[string]map[string]bool
+}
+
+// for tests using the connection directly instead of through NewConnection
+func NewMemoryConnection(dbcfg *Config) *MemoryConnection {
+	memcfg := *dbcfg
+	memcfg.Backend = Memory
+	conn, _ := newMemoryConnection(DatabaseConnection{Config: &memcfg, state: &connectionState{}})
+	return conn
+}
+
+func newMemoryConnection(w DatabaseConnection) (*MemoryConnection, error) {
+	return &MemoryConnection{
+		DatabaseConnection: w,
+		records:            make(map[string][]TelemetryRecord),
+		ids:                make(map[string]map[string]bool),
+	}, nil
+}
+
+func (w *MemoryConnection) GetType() DBBackend {
+	return w.Config.Backend
+}
+
+func (w *MemoryConnection) GetVersion(logger *cli.Logger) string {
+	return "memory"
+}
+
+func (w *MemoryConnection) GetStatus(logger *cli.Logger) ConnectionStatus {
+	return newConnectionStatus(w.Ping(context.Background()), w.GetVersion(logger))
+}
+
+func (w *MemoryConnection) Ping(ctx context.Context) error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+	w.end()
+	return nil
+}
+
+func (w *MemoryConnection) Write(ctx context.Context, logrec TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.WriteBatch(ctx, []TelemetryRecord{logrec}, logger)
+}
+
+// records are copied so callers can not change them once written
+func (w *MemoryConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	if len(logrecs) == 0 {
+		return &Result{
+			ResultCode: ResultNoData,
+			Message:    "no data to write",
+		}, nil
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	written, duplicates := 0, 0
+	for _, logrec := range logrecs {
+		target := w.Config.targetFor(logrec)
+		if w.ids[target] == nil {
+			w.ids[target] = make(map[string]bool)
+		}
+
+		stored, cErr := copyMemoryRecord(logrec)
+		if cErr != nil {
+			return &Result{
+				Written:    written,
+				Duplicates: duplicates,
+				Message:    fmt.Sprintf("stored %d of %d usage records", written, len(logrecs)),
+			}, cErr
+		}
+		if recordId := stored.GetRecordId(); recordId != "" {
+			if w.ids[target][recordId] {
+				duplicates++
+				continue
+			}
+			w.ids[target][recordId] = true
+		}
+		w.records[target] = append(w.records[target], stored)
+		written++
+	}
+
+	w.Config.structured(logger).Debug("preparing report")
+	return newWriteResult(written, duplicates, "stored"), nil
+}
+
+func (w *MemoryConnection) Read(ctx context.Context, filter *RecordFilter, logger *cli.Logger) ([]TelemetryRecord, *Result, error) {
+	if err := w.begin(); err != nil {
+		return nil, nil, err
+	}
+	defer w.end()
+
+	records, err := w.readRecords(filter)
+	if err != nil {
+		return nil, nil, err
+	}
+	return records, newReadResult(records, filter), nil
+}
+
+// matching records are collected up front, memory is used anyway
+func (w *MemoryConnection) ReadStream(ctx context.Context, filter *RecordFilter, logger *cli.Logger) (<-chan TelemetryRecord, <-chan error) {
+	if err := w.begin(); err != nil {
+		return failedRecordStream(err)
+	}
+	defer w.end()
+
+	records, err := w.readRecords(filter)
+	if err != nil {
+		return failedRecordStream(err)
+	}
+	return newRecordStream(ctx, func(send func(TelemetryRecord) bool) error {
+		for _, logrec := range records {
+			if !send(logrec) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+func (w *MemoryConnection) AggregateCommandCounts(ctx context.Context, from time.Time, to time.Time) (map[string]int, error) {
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+
+	counts := make(map[string]int)
+	for _, logrec := range w.records[w.Config.ScriptTarget] {
+		timestamp := logrec.GetTimeStamp()
+		if (!from.IsZero() && timestamp.Before(from)) || (!to.IsZero() && timestamp.After(to)) {
+			continue
+		}
+		switch rec := logrec.(type) {
+		case *ScriptTelemetryRecordV1:
+			counts[rec.CommandName]++
+		case *ScriptTelemetryRecordV2:
+			counts[rec.CommandName]++
+		}
+	}
+	return counts, nil
+}
+
+func (w *MemoryConnection) RecentByUser(ctx context.Context, username string, n int) ([]TelemetryRecord, error) {
+	if err := validateRecentCount(n); err != nil {
+		return nil, err
+	}
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	w.mutex.RLock()
+	records := make([]TelemetryRecord, 0)
+	for _, logrec := range w.records[w.Config.ScriptTarget] {
+		rec, ok := logrec.(*ScriptTelemetryRecordV2)
+		if !ok || (rec.UserName != username && rec.HostUserName != username) {
+			continue
+		}
+		found := *rec
+		records = append(records, &found)
+	}
+	w.mutex.RUnlock()
+
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].GetTimeStamp().Equal(records[j].GetTimeStamp()) {
+			return records[i].GetRecordId() > records[j].GetRecordId()
+		}
+		return records[i].GetTimeStamp().After(records[j].GetTimeStamp())
+	})
+	if len(records) > n {
+		records = records[:n]
+	}
+	return records, nil
+}
+
+func (w *MemoryConnection) DeleteByUser(ctx context.Context, username string) (*Result, error) {
+	return w.removeRecords("deleted", func(logrec TelemetryRecord) bool {
+		for _, name := range memoryRecordUsers(logrec) {
+			if *name == username {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (w *MemoryConnection) AnonymizeUser(ctx context.Context, username string) (*Result, error) {
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	affected := 0
+	for _, records := range w.records {
+		for _, logrec := range records {
+			names := memoryRecordUsers(logrec)
+			matched := false
+			for _, name := range names {
+				matched = matched || *name == username
+			}
+			if !matched {
+				continue
+			}
+			// the other name of the record goes as well
+			for _, name := range names {
+				*name = anonymizeUserName(w.Config.AnonymizationKey, *name)
+			}
+			affected++
+		}
+	}
+	return newAffectedResult(affected, "anonymized"), nil
+}
+
+func (w *MemoryConnection) PurgeOlderThan(ctx context.Context, cutoff time.Time) (*Result, error) {
+	return w.removeRecords("purged", func(logrec TelemetryRecord) bool {
+		return logrec.GetTimeStamp().Before(cutoff)
+	})
+}
+
+func (w *MemoryConnection) Close() error {
+	if !w.drain() {
+		return nil
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.records = make(map[string][]TelemetryRecord)
+	w.ids = make(map[string]map[string]bool)
+	return nil
+}
+
+// v2 records of the filtered type the way the sql backends read them,
+// ordered by timestamp and record id
+func (w *MemoryConnection) readRecords(filter *RecordFilter) ([]TelemetryRecord, error) {
+	recordType, err := filter.recordType()
+	if err != nil {
+		return nil, err
+	}
+	conditions, cErr := filter.conditions()
+	if cErr != nil {
+		return nil, cErr
+	}
+
+	w.mutex.RLock()
+	records := make([]TelemetryRecord, 0)
+	for _, logrec := range w.records[w.Config.targetOf(recordType)] {
+		if !filter.matches(logrec, conditions) {
+			continue
+		}
+		switch rec := logrec.(type) {
+		case *ScriptTelemetryRecordV2:
+			found := *rec
+			records = append(records, &found)
+		case *EventTelemetryRecordV2:
+			found := *rec
+			records = append(records, &found)
+		}
+	}
+	w.mutex.RUnlock()
+
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].GetTimeStamp().Equal(records[j].GetTimeStamp()) {
+			return records[i].GetRecordId() < records[j].GetRecordId()
+		}
+		return records[i].GetTimeStamp().Before(records[j].GetTimeStamp())
+	})
+	return filter.paginate(records)
+}
+
+// removes the matching records of all targets
+func (w *MemoryConnection) removeRecords(verb string, matches func(logrec TelemetryRecord) bool) (*Result, error) {
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	affected := 0
+	for target, records := range w.records {
+		kept := records[:0]
+		for _, logrec := range records {
+			if !matches(logrec) {
+				kept = append(kept, logrec)
+				continue
+			}
+			delete(w.ids[target], logrec.GetRecordId())
+			affected++
+		}
+		w.records[target] = kept
+	}
+	return newAffectedResult(affected, verb), nil
+}
+
+// stored copy of the record, with an id generated like the sql backends do
+func copyMemoryRecord(logrec TelemetryRecord) (TelemetryRecord, error) {
+	recordId, err := newRecordId(logrec)
+	if err != nil {
+		return nil, err
+	}
+	switch rec := logrec.(type) {
+	case *ScriptTelemetryRecordV1:
+		stored := *rec
+		stored.RecordId = recordId
+		return &stored, nil
+	case ScriptTelemetryRecordV1:
+		rec.RecordId = recordId
+		return &rec, nil
+	case *ScriptTelemetryRecordV2:
+		stored := *rec
+		stored.RecordId = recordId
+		return &stored, nil
+	case ScriptTelemetryRecordV2:
+		rec.RecordId = recordId
+		return &rec, nil
+	case *EventTelemetryRecordV2:
+		stored := *rec
+		stored.RecordId = recordId
+		return &stored, nil
+	case EventTelemetryRecordV2:
+		rec.RecordId = recordId
+		return &rec, nil
+	default:
+		return logrec, nil
+	}
+}
+
+// user name fields of a stored record, v1 records only carry the user name
+func memoryRecordUsers(logrec TelemetryRecord) []*string {
+	switch rec := logrec.(type) {
+	case *ScriptTelemetryRecordV1:
+		return []*string{&rec.UserName}
+	case *ScriptTelemetryRecordV2:
+		return []*string{&rec.UserName, &rec.HostUserName}
+	case *EventTelemetryRecordV2:
+		return []*string{&rec.UserName, &rec.HostUserName}
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,147 @@
+package persistence
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestMemoryConnection(t *testing.T, dbcfg Config) Connection {
+	t.Helper()
+	dbcfg.Backend = Memory
+	dbcfg.ConnString = "memory:"
+	return newTestConnection(t, dbcfg)
+}
+
+func TestMemoryWriteTwice(t *testing.T) {
+	testWriteTwice(t, newTestMemoryConnection)
+}
+
+func TestMemoryDeleteByUser(t *testing.T) {
+	testDeleteByUser(t, newTestMemoryConnection)
+}
+
+func TestMemoryAnonymizeUser(t *testing.T) {
+	testAnonymizeUser(t, newTestMemoryConnection)
+}
+
+func TestMemoryAnonymizeUserWithoutKey(t *testing.T) {
+	testAnonymizeUserWithoutKey(t, newTestMemoryConnection)
+}
+
+func TestMemoryReadFilter(t *testing.T) {
+	testReadFilter(t, newTestMemoryConnection)
+}
+
+func TestMemoryReadNoMatchingRecords(t *testing.T) {
+	testReadNoMatchingRecords(t, newTestMemoryConnection)
+}
+
+func TestMemoryExtrasRoundTrip(t *testing.T) {
+	testExtrasRoundTrip(t, newTestMemoryConnection)
+}
+
+func TestMemoryAggregateCommandCounts(t *testing.T) {
+	testAggregateCommandCounts(t, newTestMemoryConnection)
+}
+
+func TestMemoryPurgeOlderThan(t *testing.T) {
+	testPurgeOlderThan(t, newTestMemoryConnection)
+}
+
+func TestMemoryReadStream(t *testing.T) {
+	testReadStream(t, newTestMemoryConnection)
+}
+
+func TestMemoryReadPages(t *testing.T) {
+	testReadPages(t, newTestMemoryConnection)
+}
+
+func TestMemoryReadPredicates(t *testing.T) {
+	testReadPredicates(t, newTestMemoryConnection)
+}
+
+// the memory backend reads, pages, counts and lists the same as sqlite
+func TestMemoryMatchesSqlite(t *testing.T) {
+	sqlite := newTestSqliteConnection(t, Config{})
+	memory := newTestMemoryConnection(t, Config{})
+	logrecs := []TelemetryRecord{
+		newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"),
+		newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"),
+		newTestScriptRecord("john", "john.doe", "2021-06-02T12:00:00+02:00"),
+		newTestScriptRecord("jane", "jane.doe", "2021-06-03T10:00:00Z"),
+		newTestEventRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"),
+	}
+	logrecs[3].(*ScriptTelemetryRecordV2).CommandName = "Purge"
+	for _, conn := range []Connection{sqlite, memory} {
+		writeTestRecords(t, conn, logrecs...)
+		// replayed records are duplicates
+		writeTestRecords(t, conn, logrecs...)
+	}
+
+	filters := []*RecordFilter{
+		nil,
+		{UserName: "jane"},
+		{From: time.Date(2021, 6, 2, 0, 0, 0, 0, time.UTC)},
+		{Limit: 2},
+		{RecordType: EventRecord},
+		{Predicates: []FieldPredicate{{Field: "commandname", Op: FilterEquals, Value: "Purge"}}},
+	}
+	for idx, filter := range filters {
+		fromSqlite, fromMemory := readTestRecords(t, sqlite, filter), readTestRecords(t, memory, filter)
+		if !reflect.DeepEqual(fromMemory, fromSqlite) {
+			t.Errorf("filter %d read %v from memory, %v from sqlite", idx, fromMemory, fromSqlite)
+		}
+	}
+
+	sqliteCounts, _ := sqlite.AggregateCommandCounts(context.Background(), time.Time{}, time.Time{})
+	memoryCounts, _ := memory.AggregateCommandCounts(context.Background(), time.Time{}, time.Time{})
+	if !reflect.DeepEqual(memoryCounts, sqliteCounts) {
+		t.Errorf("memory counts are %v, sqlite %v", memoryCounts, sqliteCounts)
+	}
+
+	sqliteRecent, sErr := sqlite.RecentByUser(context.Background(), "jane.doe", 2)
+	memoryRecent, mErr := memory.RecentByUser(context.Background(), "jane.doe", 2)
+	if sErr != nil || mErr != nil || !reflect.DeepEqual(memoryRecent, sqliteRecent) {
+		t.Errorf("recent records are %v from memory, %v from sqlite", memoryRecent, sqliteRecent)
+	}
+}
+
+// records are copied in and out, callers can not change the stored ones
+func TestMemoryStoresCopies(t *testing.T) {
+	conn := NewMemoryConnection(&Config{Backend: Sqlite, ScriptTarget: "scripts", EventTarget: "events"})
+	defer conn.Close()
+	if backend := conn.GetType(); backend != Memory {
+		t.Errorf("backend is %s, want %s", backend, Memory)
+	}
+
+	logrec := newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z")
+	writeTestRecords(t, conn, logrec)
+	logrec.UserName = "john"
+
+	read := readTestRecords(t, conn, nil)
+	read[0].(*ScriptTelemetryRecordV2).UserName = "john"
+	if stored := readTestRecords(t, conn, nil)[0].(*ScriptTelemetryRecordV2); stored.UserName != "jane" {
+		t.Errorf("stored record is changed to %s", stored.UserName)
+	}
+
+	// every connection has its own records
+	other := NewMemoryConnection(&Config{ScriptTarget: "scripts", EventTarget: "events"})
+	defer other.Close()
+	if records := readTestRecords(t, other, nil); len(records) != 0 {
+		t.Errorf("other connection found %d records", len(records))
+	}
+}
+
+func TestMemoryRecordRouting(t *testing.T) {
+	testRecordRouting(t, newTestMemoryConnection)
+}
+
+func TestMemoryRecentByUser(t *testing.T) {
+	testRecentByUser(t, newTestMemoryConnection)
+}
+
+func TestMemoryIdempotentRetry(t *testing.T) {
+	testIdempotentRetry(t, newTestMemoryConnection)
+}
@@ -0,0 +1,162 @@
+package persistence
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"../cli"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "pyrevit_telemetry"
+
+// write latency operation labels, Write calls are single and WriteBatch
+// calls are batch
+const (
+	writeOperationSingle = "single"
+	writeOperationBatch  = "batch"
+)
+
+// from a millisecond for local databases up to the default write timeout
+var writeLatencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// records write throughput and latency of the wrapped connection, labeled
+// by backend. write_duration_seconds is kept for existing dashboards,
+// write_latency_seconds also tells single and batch writes apart
+type MetricsConnection struct {
+	Connection
+	writes        *prometheus.CounterVec
+	writeFailures *prometheus.CounterVec
+	writeDuration *prometheus.HistogramVec
+	writeLatency  *prometheus.HistogramVec
+	drops         *prometheus.CounterVec
+	queued        *prometheus.CounterVec
+}
+
+func NewMetricsConnection(conn Connection, registerer prometheus.Registerer) (*MetricsConnection, error) {
+	writes := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "writes_total",
+		Help:      "Number of telemetry records written.",
+	}, []string{"backend"})
+	writeFailures := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "write_failures_total",
+		Help:      "Number of failed telemetry write calls.",
+	}, []string{"backend"})
+	writeDuration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "write_duration_seconds",
+		Help:      "Duration of telemetry write calls.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend"})
+	writeLatency := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "write_latency_seconds",
+		Help:      "Latency of telemetry write calls.",
+		Buckets:   writeLatencyBuckets,
+	}, []string{"backend", "operation"})
+	drops := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dropped_records_total",
+		Help:      "Number of telemetry records dropped by a full write queue.",
+	}, []string{"backend"})
+	queued := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "queued_records_total",
+		Help:      "Number of telemetry records queued to be written later.",
+	}, []string{"backend"})
+
+	// connections sharing a registry share the collectors
+	var err error
+	if writes, err = registerCounterVec(registerer, writes); err != nil {
+		return nil, err
+	}
+	if writeFailures, err = registerCounterVec(registerer, writeFailures); err != nil {
+		return nil, err
+	}
+	if writeDuration, err = registerHistogramVec(registerer, writeDuration); err != nil {
+		return nil, err
+	}
+	if writeLatency, err = registerHistogramVec(registerer, writeLatency); err != nil {
+		return nil, err
+	}
+	if drops, err = registerCounterVec(registerer, drops); err != nil {
+		return nil, err
+	}
+	if queued, err = registerCounterVec(registerer, queued); err != nil {
+		return nil, err
+	}
+
+	return &MetricsConnection{
+		Connection:    conn,
+		writes:        writes,
+		writeFailures: writeFailures,
+		writeDuration: writeDuration,
+		writeLatency:  writeLatency,
+		drops:         drops,
+		queued:        queued,
+	}, nil
+}
+
+func (w *MetricsConnection) Write(ctx context.Context, logrec TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.observe(writeOperationSingle, func() (*Result, error) {
+		return w.Connection.Write(ctx, logrec, logger)
+	})
+}
+
+func (w *MetricsConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.observe(writeOperationBatch, func() (*Result, error) {
+		return w.Connection.WriteBatch(ctx, logrecs, logger)
+	})
+}
+
+func (w *MetricsConnection) observe(operation string, write func() (*Result, error)) (*Result, error) {
+	backend := string(w.GetType())
+	started := time.Now()
+
+	result, err := write()
+
+	elapsed := time.Since(started).Seconds()
+	w.writeDuration.WithLabelValues(backend).Observe(elapsed)
+	w.writeLatency.WithLabelValues(backend, operation).Observe(elapsed)
+	if result != nil {
+		w.writes.WithLabelValues(backend).Add(float64(result.Written))
+		w.drops.WithLabelValues(backend).Add(float64(result.Dropped))
+		w.queued.WithLabelValues(backend).Add(float64(result.Queued))
+	}
+	if err != nil {
+		w.writeFailures.WithLabelValues(backend).Inc()
+	}
+	return result, err
+}
+
+// handler for /metrics
+func NewMetricsHandler(gatherer prometheus.Gatherer) http.Handler {
+	return promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})
+}
+
+func registerHistogramVec(registerer prometheus.Registerer, histogram *prometheus.HistogramVec) (*prometheus.HistogramVec, error) {
+	if err := registerer.Register(histogram); err != nil {
+		var existing prometheus.AlreadyRegisteredError
+		if !errors.As(err, &existing) {
+			return nil, err
+		}
+		return existing.ExistingCollector.(*prometheus.HistogramVec), nil
+	}
+	return histogram, nil
+}
+
+func registerCounterVec(registerer prometheus.Registerer, counter *prometheus.CounterVec) (*prometheus.CounterVec, error) {
+	if err := registerer.Register(counter); err != nil {
+		var existing prometheus.AlreadyRegisteredError
+		if !errors.As(err, &existing) {
+			return nil, err
+		}
+		return existing.ExistingCollector.(*prometheus.CounterVec), nil
+	}
+	return counter, nil
+}
@@ -0,0 +1,132 @@
+package persistence
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// memory backend wrapped in metrics registered to a registry of the test
+func newTestMetricsConnection(t *testing.T) (*MetricsConnection, *prometheus.Registry) {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	conn := NewMemoryConnection(&Config{ScriptTarget: "scripts", EventTarget: "events"})
+	t.Cleanup(func() { conn.Close() })
+
+	metrics, err := NewMetricsConnection(conn, registry)
+	if err != nil {
+		t.Fatalf("wrapping: %v", err)
+	}
+	return metrics, registry
+}
+
+// sample lines of the /metrics response
+func scrapeTestMetrics(t *testing.T, registry *prometheus.Registry) map[string]string {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	NewMetricsHandler(registry).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := ioutil.ReadAll(recorder.Body)
+
+	samples := make(map[string]string)
+	for _, line := range strings.Split(string(body), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if sep := strings.LastIndex(line, " "); sep > 0 {
+			samples[line[:sep]] = line[sep+1:]
+		}
+	}
+	return samples
+}
+
+func checkTestMetric(t *testing.T, samples map[string]string, name string, want string) {
+	t.Helper()
+	if got, ok := samples[name]; !ok {
+		t.Errorf("%s is not exported", name)
+	} else if got != want {
+		t.Errorf("%s is %s, want %s", name, got, want)
+	}
+}
+
+func TestMetricsCountWrites(t *testing.T) {
+	conn, registry := newTestMetricsConnection(t)
+	if _, err := conn.Write(context.Background(), newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"), testLogger); err != nil {
+		t.Fatalf("writing: %v", err)
+	}
+	writeTestRecords(t, conn,
+		newTestScriptRecord("jane", "jane.doe", "2021-06-01T11:00:00Z"),
+		newTestEventRecord("jane", "jane.doe", "2021-06-01T11:00:00Z"))
+
+	samples := scrapeTestMetrics(t, registry)
+	checkTestMetric(t, samples, `pyrevit_telemetry_writes_total{backend="memory"}`, "3")
+	checkTestMetric(t, samples, `pyrevit_telemetry_write_duration_seconds_count{backend="memory"}`, "2")
+	if _, ok := samples[`pyrevit_telemetry_write_failures_total{backend="memory"}`]; ok {
+		t.Error("failures are counted without a failed write")
+	}
+}
+
+func TestMetricsCountFailures(t *testing.T) {
+	conn, registry := newTestMetricsConnection(t)
+	conn.Close()
+	if _, err := conn.Write(context.Background(), newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"), testLogger); err == nil {
+		t.Fatal("writing to a closed connection succeeded")
+	}
+
+	samples := scrapeTestMetrics(t, registry)
+	checkTestMetric(t, samples, `pyrevit_telemetry_write_failures_total{backend="memory"}`, "1")
+	checkTestMetric(t, samples, `pyrevit_telemetry_write_duration_seconds_count{backend="memory"}`, "1")
+}
+
+// connections sharing a registry add to the same counters
+func TestMetricsShareRegistry(t *testing.T) {
+	first, registry := newTestMetricsConnection(t)
+	second, err := NewMetricsConnection(NewMemoryConnection(&Config{}), registry)
+	if err != nil {
+		t.Fatalf("wrapping a second connection: %v", err)
+	}
+	writeTestRecords(t, first, newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"))
+	writeTestRecords(t, second, newTestScriptRecord("john", "john.doe", "2021-06-01T10:00:00Z"))
+
+	checkTestMetric(t, scrapeTestMetrics(t, registry), `pyrevit_telemetry_writes_total{backend="memory"}`, "2")
+}
+
+// single and batch writes land in their own latency series
+func TestMetricsWriteLatency(t *testing.T) {
+	conn, registry := newTestMetricsConnection(t)
+	for _, ts := range []string{"2021-06-01T10:00:00Z", "2021-06-01T11:00:00Z"} {
+		if _, err := conn.Write(context.Background(), newTestScriptRecord("jane", "jane.doe", ts), testLogger); err != nil {
+			t.Fatalf("writing: %v", err)
+		}
+	}
+	writeTestRecords(t, conn,
+		newTestScriptRecord("jane", "jane.doe", "2021-06-01T12:00:00Z"),
+		newTestEventRecord("jane", "jane.doe", "2021-06-01T12:00:00Z"))
+
+	samples := scrapeTestMetrics(t, registry)
+	tests := []struct {
+		operation string
+		want      string
+	}{
+		{writeOperationSingle, "2"},
+		{writeOperationBatch, "1"},
+	}
+	for _, test := range tests {
+		labels := `backend="memory",operation="` + test.operation + `"`
+		checkTestMetric(t, samples, `pyrevit_telemetry_write_latency_seconds_count{`+labels+`}`, test.want)
+		checkTestMetric(t, samples, `pyrevit_telemetry_write_latency_seconds_bucket{`+labels+`,le="+Inf"}`, test.want)
+		// memory writes are well within the largest bucket
+		checkTestMetric(t, samples, `pyrevit_telemetry_write_latency_seconds_bucket{`+labels+`,le="10"}`, test.want)
+	}
+	for _, bucket := range writeLatencyBuckets {
+		name := `pyrevit_telemetry_write_latency_seconds_bucket{backend="memory",operation="single",le="` + strconv.FormatFloat(bucket, 'g', -1, 64) + `"}`
+		if _, ok := samples[name]; !ok {
+			t.Errorf("%s is not exported", name)
+		}
+	}
+}
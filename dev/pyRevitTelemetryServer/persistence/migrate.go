@@ -0,0 +1,436 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"../cli"
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+)
+
+// table recording the schema versions applied to each set of tables
+const schemaMigrationsTable = "schema_migrations"
+
+// mysql errors for creating an index under a name already in use and
+// for dropping one that does not exist
+const (
+	mysqlDuplicateKeyName   = 1061
+	mysqlCantDropFieldOrKey = 1091
+)
+
+// a single schema change, applied once per set of script and event tables
+// steps must be safe to run again in case recording them failed
+type sqlMigration struct {
+	Version     int
+	Description string
+	Apply       func(ctx context.Context, w *GenericSQLConnection, logger *cli.Logger) error
+}
+
+// ordered schema changes, append new steps with the next version
+var sqlMigrations = []sqlMigration{
+	{1, "create script and event tables", migrateCreateTables},
+	{2, "add extras column", migrateExtrasColumn},
+	{3, "index record timestamps", migrateTimestampIndexes},
+	{4, "add script duration column", migrateDurationColumn},
+	{5, "store record timestamps as timestamps", migrateTimestampTypes},
+	{6, "index typed record timestamps", migrateTimestampIndexes},
+}
+
+// version the schema is at after applying all migrations
+func LatestSchemaVersion() int {
+	return sqlMigrations[len(sqlMigrations)-1].Version
+}
+
+// applies the migrations up to and including the target version to the
+// sql tables of the connection, skipping the ones already applied.
+// zero migrates to the latest version
+func Migrate(ctx context.Context, conn Connection, targetVersion int, logger *cli.Logger) error {
+	sqlConn, ok := unwrapSQLConnection(conn)
+	if !ok {
+		return errors.Errorf("migrations are not supported by %s backend", conn.GetType())
+	}
+	if err := sqlConn.begin(); err != nil {
+		return err
+	}
+	defer sqlConn.end()
+
+	if targetVersion == 0 {
+		targetVersion = LatestSchemaVersion()
+	}
+	if targetVersion < 0 || targetVersion > LatestSchemaVersion() {
+		return errors.Errorf("unknown schema version %d", targetVersion)
+	}
+
+	sqlConn.migrateMutex.Lock()
+	defer sqlConn.migrateMutex.Unlock()
+	return sqlConn.migrateTo(ctx, targetVersion, logger)
+}
+
+// finds the sql connection under the wrappers NewConnection adds
+func unwrapSQLConnection(conn Connection) (*GenericSQLConnection, bool) {
+	for {
+		if sqlConn, ok := conn.(*GenericSQLConnection); ok {
+			return sqlConn, true
+		}
+		inner, ok := innerConnection(conn)
+		if !ok {
+			return nil, false
+		}
+		conn = inner
+	}
+}
+
+// connection a wrapper delegates to, false for backends
+func innerConnection(conn Connection) (Connection, bool) {
+	switch wrapper := conn.(type) {
+	case *ValidatingConnection:
+		return wrapper.Connection, true
+	case *RateLimitedConnection:
+		return wrapper.Connection, true
+	case *IdempotentConnection:
+		return wrapper.Connection, true
+	case *AsyncConnection:
+		return wrapper.Connection, true
+	case *DeadLetterConnection:
+		return wrapper.Connection, true
+	case *RetryConnection:
+		return wrapper.Connection, true
+	case *TimeoutConnection:
+		return wrapper.Connection, true
+	case *MetricsConnection:
+		return wrapper.Connection, true
+	case *TracingConnection:
+		return wrapper.Connection, true
+	default:
+		return nil, false
+	}
+}
+
+// expects migrateMutex to be held
+func (w *GenericSQLConnection) migrateTo(ctx context.Context, targetVersion int, logger *cli.Logger) error {
+	log := w.Config.structured(logger)
+
+	createQuery := generateCreateMigrationsTableQuery(w.Config.Backend)
+	log.Trace(createQuery)
+	if _, err := w.db.ExecContext(ctx, createQuery); err != nil {
+		return wrapContextError(ctx, err)
+	}
+
+	applied, aErr := w.appliedMigrations(ctx)
+	if aErr != nil {
+		return wrapContextError(ctx, aErr)
+	}
+
+	for _, migration := range sqlMigrations {
+		if migration.Version > targetVersion {
+			break
+		}
+		if applied[migration.Version] {
+			continue
+		}
+
+		log.Debug("applying schema version", "version", migration.Version, "description", migration.Description)
+		if err := migration.Apply(ctx, w, logger); err != nil {
+			return errors.Wrapf(err, "applying schema version %d", migration.Version)
+		}
+
+		insert := fmt.Sprintf(
+			"INSERT INTO %s (target, version, description, applied_at) VALUES (%s, %s, %s, %s)",
+			schemaMigrationsTable,
+			sqlPlaceholder(w.Config.Backend, 1),
+			sqlPlaceholder(w.Config.Backend, 2),
+			sqlPlaceholder(w.Config.Backend, 3),
+			sqlPlaceholder(w.Config.Backend, 4))
+		_, iErr := w.db.ExecContext(
+			ctx, insert,
+			w.migrationTarget(), migration.Version, migration.Description,
+			time.Now().UTC().Format(time.RFC3339))
+		if iErr != nil {
+			return wrapContextError(ctx, iErr)
+		}
+	}
+	return nil
+}
+
+func (w *GenericSQLConnection) appliedMigrations(ctx context.Context) (map[int]bool, error) {
+	query := fmt.Sprintf(
+		"SELECT version FROM %s WHERE target = %s",
+		schemaMigrationsTable, sqlPlaceholder(w.Config.Backend, 1))
+	rows, err := w.db.QueryContext(ctx, query, w.migrationTarget())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if sErr := rows.Scan(&version); sErr != nil {
+			return nil, sErr
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// servers sharing a database with different tables migrate separately
+func (w *GenericSQLConnection) migrationTarget() string {
+	return w.Config.ScriptTarget + "," + w.Config.EventTarget
+}
+
+func generateCreateMigrationsTableQuery(backend DBBackend) string {
+	body := fmt.Sprintf(
+		"target VARCHAR(255) NOT NULL, version INTEGER NOT NULL, description %s, applied_at VARCHAR(64), PRIMARY KEY (target, version)",
+		sqlTextTypes[backend])
+
+	// sqlserver has no IF NOT EXISTS for tables
+	if backend == MSSql {
+		return fmt.Sprintf(
+			"IF OBJECT_ID(N'%s', N'U') IS NULL CREATE TABLE %s (%s)",
+			schemaMigrationsTable, schemaMigrationsTable, body)
+	}
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", schemaMigrationsTable, body)
+}
+
+func migrateCreateTables(ctx context.Context, w *GenericSQLConnection, logger *cli.Logger) error {
+	for _, table := range w.schemaTables() {
+		query := generateCreateTableQuery(w.Config.Backend, table.name, table.columns)
+		if w.Config.Partitioning {
+			query = generatePartitionedTableQuery(table.name, table.columns)
+		}
+		w.Config.structured(logger).Trace(query)
+		if _, err := w.db.ExecContext(ctx, query); err != nil {
+			return wrapContextError(ctx, err)
+		}
+	}
+	return nil
+}
+
+// tables created before extras existed get the column added
+func migrateExtrasColumn(ctx context.Context, w *GenericSQLConnection, logger *cli.Logger) error {
+	for _, table := range w.schemaTables() {
+		if err := w.ensureColumn(ctx, table.name, extrasColumn, logger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// script tables created before durations were recorded get the column, the
+// rows already stored have no duration
+func migrateDurationColumn(ctx context.Context, w *GenericSQLConnection, logger *cli.Logger) error {
+	if w.Config.ScriptTarget == "" {
+		return nil
+	}
+	return w.ensureColumn(ctx, w.Config.ScriptTarget, "duration", logger)
+}
+
+// time range reads and aggregations filter on the timestamp column. run
+// again once the column is typed, for the indexes the text column could
+// not have or that were dropped to convert it
+func migrateTimestampIndexes(ctx context.Context, w *GenericSQLConnection, logger *cli.Logger) error {
+	log := w.Config.structured(logger)
+
+	for _, table := range w.schemaTables() {
+		typed, tErr := w.timestampColumnTyped(ctx, table.name)
+		if tErr != nil {
+			return wrapContextError(ctx, tErr)
+		}
+		query := generateTimestampIndexQuery(w.Config.Backend, table.name, typed)
+		if query == "" {
+			log.Debug("skipping timestamp index", "table", table.name)
+			continue
+		}
+
+		log.Trace(query)
+		if _, err := w.db.ExecContext(ctx, query); err != nil {
+			var mysqlErr *mysql.MySQLError
+			if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateKeyName {
+				continue
+			}
+			return wrapContextError(ctx, err)
+		}
+	}
+	return nil
+}
+
+func timestampIndexName(table string) string {
+	return strings.Replace(table, ".", "_", -1) + "_timestamp_idx"
+}
+
+// creates the index unless it exists, mysql reports existing ones as
+// mysqlDuplicateKeyName. empty for sqlserver text columns, which can not
+// be indexed as NVARCHAR(MAX)
+func generateTimestampIndexQuery(backend DBBackend, table string, typed bool) string {
+	index := timestampIndexName(table)
+	switch backend {
+	case MySql:
+		// text columns are indexed by prefix, rfc3339 timestamps fit
+		if !typed {
+			return fmt.Sprintf("CREATE INDEX %s ON %s (`timestamp`(32))", index, table)
+		}
+		return fmt.Sprintf("CREATE INDEX %s ON %s (`timestamp`)", index, table)
+	case MSSql:
+		if !typed {
+			return ""
+		}
+		return fmt.Sprintf(
+			"IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = N'%s' AND object_id = OBJECT_ID(N'%s')) CREATE INDEX %s ON %s ([timestamp])",
+			index, strings.Replace(table, "'", "''", -1), index, table)
+	default:
+		return fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s ON %s ("timestamp")`, index, table)
+	}
+}
+
+// tables created before timestamps were typed hold them as rfc3339 text in
+// the offset the client sent, they are converted to the column type of
+// the dialect in utc. sqlite keeps text and has its rows rewritten to the
+// fixed layout instead. rows that do not hold rfc3339 fail the migration,
+// except on sqlite where they are left as they are
+func migrateTimestampTypes(ctx context.Context, w *GenericSQLConnection, logger *cli.Logger) error {
+	log := w.Config.structured(logger)
+
+	for _, table := range w.schemaTables() {
+		if w.Config.Backend == Sqlite {
+			if err := w.rewriteSqliteTimestamps(ctx, table.name, logger); err != nil {
+				return wrapContextError(ctx, err)
+			}
+			continue
+		}
+
+		typed, tErr := w.timestampColumnTyped(ctx, table.name)
+		if tErr != nil {
+			return wrapContextError(ctx, tErr)
+		}
+		if typed {
+			log.Debug("timestamps are typed already", "table", table.name)
+			continue
+		}
+
+		if w.Config.Backend == Postgres {
+			kind, kErr := w.tableKind(ctx, table.name)
+			if kErr != nil {
+				return wrapContextError(ctx, kErr)
+			}
+			// the partition key can not change type, the table is rebuilt
+			if kind == "p" {
+				log.Debug("rebuilding partitioned table", "table", table.name)
+				months, mErr := w.migratePartitionedTable(ctx, table.name, table.columns, logger)
+				if mErr != nil {
+					return wrapContextError(ctx, errors.Wrapf(mErr, "migrating table %s", table.name))
+				}
+				for _, month := range months {
+					w.partitions[partitionName(table.name, month)] = true
+				}
+				continue
+			}
+		}
+
+		log.Debug("converting timestamps", "table", table.name)
+		for _, query := range generateTimestampTypeQueries(w.Config.Backend, table.name) {
+			log.Trace(query)
+			if _, err := w.db.ExecContext(ctx, query); err != nil {
+				var mysqlErr *mysql.MySQLError
+				if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlCantDropFieldOrKey {
+					continue
+				}
+				return wrapContextError(ctx, err)
+			}
+		}
+	}
+	return nil
+}
+
+// mysql can not convert offsets while changing the column type, the text
+// is rewritten as utc datetimes first. rows that were rewritten already
+// have no T in them, so running the queries again is safe. mysql also can
+// not change the type of a column under a prefix index, the index is
+// created again by the next migration
+func generateTimestampTypeQueries(backend DBBackend, table string) []string {
+	switch backend {
+	case Postgres:
+		return []string{fmt.Sprintf(
+			`ALTER TABLE %s ALTER COLUMN "timestamp" TYPE TIMESTAMPTZ USING CAST("timestamp" AS TIMESTAMPTZ)`, table)}
+	case MSSql:
+		return []string{fmt.Sprintf("ALTER TABLE %s ALTER COLUMN [timestamp] DATETIMEOFFSET", table)}
+	case MySql:
+		local := "REPLACE(IF(RIGHT(`timestamp`, 1) = 'Z', LEFT(`timestamp`, LENGTH(`timestamp`) - 1), " +
+			"LEFT(`timestamp`, LENGTH(`timestamp`) - 6)), 'T', ' ')"
+		offset := "IF(RIGHT(`timestamp`, 1) = 'Z', '+00:00', RIGHT(`timestamp`, 6))"
+		return []string{
+			fmt.Sprintf("DROP INDEX %s ON %s", timestampIndexName(table), table),
+			fmt.Sprintf(
+				"UPDATE %s SET `timestamp` = DATE_FORMAT(CONVERT_TZ(CAST(%s AS DATETIME(6)), %s, '+00:00'), '%%Y-%%m-%%d %%H:%%i:%%s.%%f') WHERE `timestamp` LIKE '%%T%%'",
+				table, local, offset),
+			fmt.Sprintf("ALTER TABLE %s MODIFY `timestamp` DATETIME(6)", table),
+		}
+	default:
+		return nil
+	}
+}
+
+// false for timestamps held in a text column
+func (w *GenericSQLConnection) timestampColumnTyped(ctx context.Context, table string) (bool, error) {
+	rows, err := w.db.QueryContext(ctx, fmt.Sprintf("SELECT timestamp FROM %s WHERE 1 = 0", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	columnTypes, cErr := rows.ColumnTypes()
+	if cErr != nil {
+		return false, cErr
+	}
+	typeName := strings.ToUpper(columnTypes[0].DatabaseTypeName())
+	return !strings.Contains(typeName, "CHAR") && !strings.Contains(typeName, "TEXT"), nil
+}
+
+// rewrites the rfc3339 timestamps of a sqlite table in the layout of
+// sqliteTimeLayout, in one transaction
+func (w *GenericSQLConnection) rewriteSqliteTimestamps(ctx context.Context, table string, logger *cli.Logger) error {
+	log := w.Config.structured(logger)
+
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, qErr := tx.QueryContext(ctx, fmt.Sprintf("SELECT rowid, timestamp FROM %s", table))
+	if qErr != nil {
+		return qErr
+	}
+	rewrites := make(map[int64]string)
+	for rows.Next() {
+		var rowId int64
+		var timestamp sql.NullString
+		if sErr := rows.Scan(&rowId, &timestamp); sErr != nil {
+			rows.Close()
+			return sErr
+		}
+		parsed, pErr := time.Parse(time.RFC3339, timestamp.String)
+		if pErr != nil {
+			continue
+		}
+		if rewritten := parsed.UTC().Format(sqliteTimeLayout); rewritten != timestamp.String {
+			rewrites[rowId] = rewritten
+		}
+	}
+	rows.Close()
+	if rErr := rows.Err(); rErr != nil {
+		return rErr
+	}
+
+	log.Debug("rewriting timestamps", "table", table, "rows", len(rewrites))
+	update := fmt.Sprintf("UPDATE %s SET timestamp = ? WHERE rowid = ?", table)
+	for rowId, timestamp := range rewrites {
+		if _, uErr := tx.ExecContext(ctx, update, timestamp, rowId); uErr != nil {
+			return uErr
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,202 @@
+package persistence
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func appliedTestMigrations(t *testing.T, sqlConn *GenericSQLConnection) []int {
+	t.Helper()
+	applied, err := sqlConn.appliedMigrations(context.Background())
+	if err != nil {
+		t.Fatalf("reading applied migrations: %v", err)
+	}
+	versions := make([]int, 0, len(applied))
+	for _, migration := range sqlMigrations {
+		if applied[migration.Version] {
+			versions = append(versions, migration.Version)
+		}
+	}
+	return versions
+}
+
+func TestMigrate(t *testing.T) {
+	conn := newTestSqliteConnection(t, Config{})
+	sqlConn, _ := unwrapSQLConnection(conn)
+
+	steps := []struct {
+		target int
+		want   []int
+	}{
+		{1, []int{1}},
+		{3, []int{1, 2, 3}},
+		{2, []int{1, 2, 3}},
+		{0, []int{1, 2, 3, 4, 5, 6}},
+		{LatestSchemaVersion(), []int{1, 2, 3, 4, 5, 6}},
+	}
+	for _, step := range steps {
+		if err := Migrate(context.Background(), conn, step.target, testLogger); err != nil {
+			t.Fatalf("migrating to %d: %v", step.target, err)
+		}
+		if applied := appliedTestMigrations(t, sqlConn); !reflect.DeepEqual(applied, step.want) {
+			t.Errorf("applied %v after migrating to %d, want %v", applied, step.target, step.want)
+		}
+	}
+
+	var index string
+	if err := sqlConn.db.QueryRow("SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = 'scripts' AND name = 'scripts_timestamp_idx'").Scan(&index); err != nil {
+		t.Errorf("timestamp index is missing: %v", err)
+	}
+	writeTestRecords(t, conn, newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"))
+}
+
+// tables created before extras and durations were stored get the columns
+func TestMigrateOldTables(t *testing.T) {
+	conn := newTestSqliteConnection(t, Config{})
+	sqlConn, _ := unwrapSQLConnection(conn)
+	for _, table := range sqlConn.schemaTables() {
+		columns := make([]string, 0, len(table.columns))
+		for _, column := range table.columns {
+			if column != extrasColumn && column != "duration" {
+				columns = append(columns, column)
+			}
+		}
+		if _, err := sqlConn.db.Exec(generateCreateTableQuery(Sqlite, table.name, columns)); err != nil {
+			t.Fatalf("creating old table %s: %v", table.name, err)
+		}
+	}
+
+	if err := Migrate(context.Background(), conn, 0, testLogger); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	if columns := sqliteTestColumns(t, sqlConn, "scripts"); !columns[extrasColumn] || !columns["duration"] {
+		t.Errorf("script table has columns %v, want extras and duration added", columns)
+	}
+	if columns := sqliteTestColumns(t, sqlConn, "events"); !columns[extrasColumn] {
+		t.Errorf("event table has columns %v, want extras added", columns)
+	}
+
+	rec := newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z")
+	rec.Duration = 1200
+	rec.Extras = map[string]interface{}{"viewtype": "FloorPlan"}
+	writeTestRecords(t, conn, rec)
+	records := readTestRecords(t, conn, nil)
+	if len(records) != 1 || records[0].(*ScriptTelemetryRecordV2).Duration != 1200 {
+		t.Errorf("read %v, want the record with its duration", records)
+	}
+}
+
+// timestamps stored as client text are rewritten so they sort and filter
+// as times
+func TestMigrateTextTimestamps(t *testing.T) {
+	conn := newTestSqliteConnection(t, Config{})
+	sqlConn, _ := unwrapSQLConnection(conn)
+	if err := Migrate(context.Background(), conn, 4, testLogger); err != nil {
+		t.Fatalf("migrating to 4: %v", err)
+	}
+	for _, timestamp := range []string{"2021-06-01T12:30:00+02:00", "2021-06-01T10:00:00Z", "2021-06-01T09:45:00.5-01:00", "yesterday"} {
+		if _, err := sqlConn.db.Exec("INSERT INTO scripts (id, timestamp) VALUES (?, ?)", timestamp, timestamp); err != nil {
+			t.Fatalf("inserting old row: %v", err)
+		}
+	}
+
+	if err := Migrate(context.Background(), conn, 0, testLogger); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	records := readTestRecords(t, conn, &RecordFilter{
+		From: time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC),
+		To:   time.Date(2021, 6, 2, 0, 0, 0, 0, time.UTC),
+	})
+	timestamps := make([]string, 0, len(records))
+	for _, record := range records {
+		timestamps = append(timestamps, record.(*ScriptTelemetryRecordV2).TimeStamp)
+	}
+	if want := []string{"2021-06-01T10:00:00Z", "2021-06-01T10:30:00Z", "2021-06-01T10:45:00.5Z"}; !reflect.DeepEqual(timestamps, want) {
+		t.Errorf("read timestamps %v, want %v", timestamps, want)
+	}
+
+	var kept string
+	if err := sqlConn.db.QueryRow("SELECT timestamp FROM scripts WHERE id = 'yesterday'").Scan(&kept); err != nil || kept != "yesterday" {
+		t.Errorf("row that is not rfc3339 has timestamp %q, %v", kept, err)
+	}
+}
+
+func TestGenerateTimestampTypeQueries(t *testing.T) {
+	queries := generateTimestampTypeQueries(MySql, "telemetry.scripts")
+	if len(queries) != 3 || queries[0] != "DROP INDEX telemetry_scripts_timestamp_idx ON telemetry.scripts" {
+		t.Fatalf("generated %v", queries)
+	}
+	if !strings.Contains(queries[1], "'%Y-%m-%d %H:%i:%s.%f') WHERE `timestamp` LIKE '%T%'") {
+		t.Errorf("update query is %s", queries[1])
+	}
+	if queries[2] != "ALTER TABLE telemetry.scripts MODIFY `timestamp` DATETIME(6)" {
+		t.Errorf("alter query is %s", queries[2])
+	}
+
+	if queries := generateTimestampTypeQueries(Postgres, "scripts"); len(queries) != 1 || !strings.Contains(queries[0], "TYPE TIMESTAMPTZ USING") {
+		t.Errorf("generated %v", queries)
+	}
+}
+
+// typed columns are indexed whole on every dialect
+func TestGenerateTimestampIndexQuery(t *testing.T) {
+	tests := []struct {
+		backend DBBackend
+		typed   bool
+		want    string
+	}{
+		{Postgres, true, `CREATE INDEX IF NOT EXISTS scripts_timestamp_idx ON scripts ("timestamp")`},
+		{MySql, true, "CREATE INDEX scripts_timestamp_idx ON scripts (`timestamp`)"},
+		{MySql, false, "CREATE INDEX scripts_timestamp_idx ON scripts (`timestamp`(32))"},
+		{MSSql, true, "IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = N'scripts_timestamp_idx' AND object_id = OBJECT_ID(N'scripts')) CREATE INDEX scripts_timestamp_idx ON scripts ([timestamp])"},
+		{MSSql, false, ""},
+	}
+	for _, test := range tests {
+		if query := generateTimestampIndexQuery(test.backend, "scripts", test.typed); query != test.want {
+			t.Errorf("%s index query is %q, want %q", test.backend, query, test.want)
+		}
+	}
+}
+
+// tables of other targets in the same database migrate separately
+func TestMigrateTargets(t *testing.T) {
+	dbcfg := Config{Backend: Sqlite, ConnString: "sqlite3:" + filepath.Join(t.TempDir(), "telemetry.db")}
+	first := newTestConnection(t, dbcfg)
+	if err := Migrate(context.Background(), first, 0, testLogger); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+
+	dbcfg.ScriptTarget, dbcfg.EventTarget = "other_scripts", "other_events"
+	second := newTestConnection(t, dbcfg)
+	sqlConn, _ := unwrapSQLConnection(second)
+	if applied := appliedTestMigrations(t, sqlConn); len(applied) != 0 {
+		t.Errorf("tables of another target have %v applied", applied)
+	}
+	if err := Migrate(context.Background(), second, 0, testLogger); err != nil {
+		t.Fatalf("migrating other target: %v", err)
+	}
+	if columns := sqliteTestColumns(t, sqlConn, "other_scripts"); len(columns) == 0 {
+		t.Error("tables of the other target were not created")
+	}
+}
+
+func TestMigrateInvalid(t *testing.T) {
+	conn := newTestSqliteConnection(t, Config{})
+	for _, version := range []int{-1, LatestSchemaVersion() + 1} {
+		if err := Migrate(context.Background(), conn, version, testLogger); err == nil {
+			t.Errorf("migrated to unknown version %d", version)
+		}
+	}
+	if err := Migrate(context.Background(), newTestMemoryConnection(t, Config{}), 0, testLogger); err == nil {
+		t.Error("migrated the memory backend")
+	}
+
+	conn.Close()
+	if err := Migrate(context.Background(), conn, 0, testLogger); err != ErrClosed {
+		t.Errorf("migrating a closed connection returned %v, want ErrClosed", err)
+	}
+}
@@ -1,12 +1,76 @@
 package persistence
 
 import (
+	"encoding/json"
 	"fmt"
+	"regexp"
+	"sync"
+	"time"
 
 	"../cli"
 	"github.com/asaskevich/govalidator"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
 )
 
+// what a record describes, each type is stored in its own table or
+// collection, see Config.targetOf
+type RecordType string
+
+const (
+	ScriptRecord RecordType = "script"
+	EventRecord  RecordType = "event"
+)
+
+// empty v2 record of the type to decode into
+func newRecordV2(recordType RecordType) TelemetryRecord {
+	if recordType == EventRecord {
+		return &EventTelemetryRecordV2{}
+	}
+	return &ScriptTelemetryRecordV2{}
+}
+
+// common interface of all telemetry record types
+type TelemetryRecord interface {
+	PrintRecordInfo(*cli.Logger, string)
+	Validate() error
+	GetRecordType() RecordType
+	GetTimeStamp() time.Time
+	GetRecordId() string
+	GetExtras() map[string]interface{}
+}
+
+// namespace of the record ids derived from record contents
+var recordIdNamespace = uuid.Must(uuid.FromString("6f1c7e52-3a4d-4b8e-9c1f-2d7a5e0b8c34"))
+
+// client provided record id, or one derived from the record contents when
+// the client sent none. the same record gets the same id on every attempt
+// so retries and resent records are skipped as duplicates, records have to
+// differ in at least one field to be stored twice. records that can not
+// be marshalled get no id, a random one would store them again on retries
+func newRecordId(logrec TelemetryRecord) (string, error) {
+	if recordId := logrec.GetRecordId(); recordId != "" {
+		return recordId, nil
+	}
+	data, err := json.Marshal(logrec)
+	if err != nil {
+		return "", errors.Wrap(err, "record id can not be derived from the record")
+	}
+	return uuid.NewV5(recordIdNamespace, recordKind(logrec)+":"+string(data)).String(), nil
+}
+
+// zero time if timestamp can not be parsed
+func parseTimeStamp(timestamp string) time.Time {
+	parsed, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return time.Time{}
+	}
+	return parsed
+}
+
+// time of day in v1 time fields, which may carry more than the time
+var v1TimePattern = regexp.MustCompile(`(\d+:\d+:\d+)`)
+
 // v1.0
 type EngineInfoV1 struct {
 	Version  string   `json:"version" bson:"version" valid:"-"`
@@ -20,6 +84,7 @@ type TraceInfoV1 struct {
 }
 
 type ScriptTelemetryRecordV1 struct {
+	RecordId          string            `json:"record_id,omitempty" bson:"record_id,omitempty" valid:"uuid~Invalid record id"`
 	Date              string            `json:"date" bson:"date" valid:"-"`
 	Time              string            `json:"time" bson:"time" valid:"-"`
 	UserName          string            `json:"username" bson:"username" valid:"-"`
@@ -55,6 +120,28 @@ func (logrec ScriptTelemetryRecordV1) PrintRecordInfo(logger *cli.Logger, messag
 	))
 }
 
+func (logrec ScriptTelemetryRecordV1) GetRecordType() RecordType {
+	return ScriptRecord
+}
+
+func (logrec ScriptTelemetryRecordV1) GetTimeStamp() time.Time {
+	parsed, err := time.Parse(
+		"2006/01/02 15:04:05",
+		fmt.Sprintf("%s %s", logrec.Date, v1TimePattern.FindString(logrec.Time)))
+	if err != nil {
+		return time.Time{}
+	}
+	return parsed
+}
+
+func (logrec ScriptTelemetryRecordV1) GetRecordId() string {
+	return logrec.RecordId
+}
+
+func (logrec ScriptTelemetryRecordV1) GetExtras() map[string]interface{} {
+	return nil
+}
+
 func (logrec ScriptTelemetryRecordV1) Validate() error {
 	// govalidator.SetFieldsRequiredByDefault(true)
 
@@ -63,17 +150,48 @@ func (logrec ScriptTelemetryRecordV1) Validate() error {
 	return err
 }
 
+// custom validators are registered once, TagMap is a plain map and
+// records are validated concurrently
+var registerValidatorsOnce sync.Once
+
+func registerValidators() {
+	registerValidatorsOnce.Do(func() {
+		govalidator.TagMap["schema"] = govalidator.Validator(func(str string) bool {
+			return str == "2.0"
+		})
+
+		govalidator.TagMap["engine"] = govalidator.Validator(func(str string) bool {
+			switch str {
+			case
+				"unknown",
+				"ironpython",
+				"cpython",
+				"csharp",
+				"invoke",
+				"visualbasic",
+				"ironruby",
+				"dynamobim",
+				"grasshopper",
+				"content",
+				"hyperlink":
+				return true
+			}
+			return false
+		})
+	})
+}
+
 // v2.0
 type EngineInfoV2 struct {
-	Type     string                 `json:"type" bson:"type" valid:"engine~Invalid executor engine type"`
-	Version  string                 `json:"version" bson:"version" valid:"-"`
-	SysPaths []string               `json:"syspath" bson:"syspath" valid:"-"`
-	Configs  map[string]interface{} `json:"configs" bson:"configs" valid:"-"`
+	Type     string                 `json:"type" bson:"type" db:"engine_type" valid:"engine~Invalid executor engine type"`
+	Version  string                 `json:"version" bson:"version" db:"engine_version" valid:"-"`
+	SysPaths []string               `json:"syspath" bson:"syspath" db:"engine_syspath,joined" valid:"-"`
+	Configs  map[string]interface{} `json:"configs" bson:"configs" db:"engine_configs,json" valid:"-"`
 }
 
 type TraceInfoV2 struct {
 	EngineInfo EngineInfoV2 `json:"engine" bson:"engine"`
-	Message    string       `json:"message" bson:"message" valid:"-"`
+	Message    string       `json:"message" bson:"message" db:"trace_message" valid:"-"`
 }
 
 type RecordMetaV2 struct {
@@ -81,30 +199,35 @@ type RecordMetaV2 struct {
 }
 
 type ScriptTelemetryRecordV2 struct {
+	RecordId          string                 `json:"record_id,omitempty" bson:"record_id,omitempty" db:"id,recordid" valid:"uuid~Invalid record id"`
 	RecordMeta        RecordMetaV2           `json:"meta" bson:"meta"`
-	TimeStamp         string                 `json:"timestamp" bson:"timestamp" valid:"rfc3339~Invalid timestamp"`
-	UserName          string                 `json:"username" bson:"username" valid:"-"`
-	HostUserName      string                 `json:"host_user" bson:"host_user" valid:"-"`
-	RevitVersion      string                 `json:"revit" bson:"revit" valid:"numeric~Invalid revit version"`
-	RevitBuild        string                 `json:"revitbuild" bson:"revitbuild" valid:"matches(\\d{8}_\\d{4}\\(x\\d{2}\\))~Invalid revit build number"`
-	SessionId         string                 `json:"sessionid" bson:"sessionid" valid:"uuidv4~Invalid session id"`
-	PyRevitVersion    string                 `json:"pyrevit" bson:"pyrevit" valid:"-"`
-	Clone             string                 `json:"clone" bson:"clone" valid:"-"`
-	IsDebugMode       bool                   `json:"debug" bson:"debug"`
-	IsConfigMode      bool                   `json:"config" bson:"config"`
-	IsExecFromGUI     bool                   `json:"from_gui" bson:"from_gui"`
-	ExecId            string                 `json:"exec_id" bson:"exec_id" valid:"-"`
-	ExecTimeStamp     string                 `json:"exec_timestamp" bson:"exec_timestamp" valid:"-"`
-	CommandName       string                 `json:"commandname" bson:"commandname" valid:"-"`
-	CommandUniqueName string                 `json:"commanduniquename" bson:"commanduniquename" valid:"-"`
-	BundleName        string                 `json:"commandbundle" bson:"commandbundle" valid:"-"`
-	ExtensionName     string                 `json:"commandextension" bson:"commandextension" valid:"-"`
-	DocumentName      string                 `json:"docname" bson:"docname" valid:"-"`
-	DocumentPath      string                 `json:"docpath" bson:"docpath" valid:"-"`
-	ResultCode        int                    `json:"resultcode" bson:"resultcode" valid:"numeric~Invalid result code"`
-	CommandResults    map[string]interface{} `json:"commandresults" bson:"commandresults" valid:"-"`
-	ScriptPath        string                 `json:"scriptpath" bson:"scriptpath" valid:"-"`
+	TimeStamp         string                 `json:"timestamp" bson:"timestamp" db:"timestamp,time" valid:"rfc3339~Invalid timestamp"`
+	UserName          string                 `json:"username" bson:"username" db:"username" valid:"-"`
+	HostUserName      string                 `json:"host_user" bson:"host_user" db:"host_user" valid:"-"`
+	RevitVersion      string                 `json:"revit" bson:"revit" db:"revit" valid:"numeric~Invalid revit version"`
+	RevitBuild        string                 `json:"revitbuild" bson:"revitbuild" db:"revitbuild" valid:"matches(\\d{8}_\\d{4}\\(x\\d{2}\\))~Invalid revit build number"`
+	SessionId         string                 `json:"sessionid" bson:"sessionid" db:"sessionid" valid:"uuidv4~Invalid session id"`
+	PyRevitVersion    string                 `json:"pyrevit" bson:"pyrevit" db:"pyrevit" valid:"-"`
+	Clone             string                 `json:"clone" bson:"clone" db:"clone" valid:"-"`
+	IsDebugMode       bool                   `json:"debug" bson:"debug" db:"debug"`
+	IsConfigMode      bool                   `json:"config" bson:"config" db:"config"`
+	IsExecFromGUI     bool                   `json:"from_gui" bson:"from_gui" db:"from_gui"`
+	ExecId            string                 `json:"exec_id" bson:"exec_id" db:"exec_id" valid:"-"`
+	ExecTimeStamp     string                 `json:"exec_timestamp" bson:"exec_timestamp" db:"exec_timestamp" valid:"-"`
+	CommandName       string                 `json:"commandname" bson:"commandname" db:"commandname" valid:"-"`
+	CommandUniqueName string                 `json:"commanduniquename" bson:"commanduniquename" db:"commanduniquename" valid:"-"`
+	BundleName        string                 `json:"commandbundle" bson:"commandbundle" db:"commandbundle" valid:"-"`
+	ExtensionName     string                 `json:"commandextension" bson:"commandextension" db:"commandextension" valid:"-"`
+	DocumentName      string                 `json:"docname" bson:"docname" db:"docname" valid:"-"`
+	DocumentPath      string                 `json:"docpath" bson:"docpath" db:"docpath" valid:"-"`
+	ResultCode        int                    `json:"resultcode" bson:"resultcode" db:"resultcode" valid:"numeric~Invalid result code"`
+	Duration          int                    `json:"duration" bson:"duration" db:"duration" valid:"-"`
+	CommandResults    map[string]interface{} `json:"commandresults" bson:"commandresults" db:"commandresults,json" valid:"-"`
+	ScriptPath        string                 `json:"scriptpath" bson:"scriptpath" db:"scriptpath" valid:"-"`
 	TraceInfo         TraceInfoV2            `json:"trace" bson:"trace"`
+
+	// fields newer clients send that have no column yet
+	Extras map[string]interface{} `json:"extras,omitempty" bson:"extras,omitempty" db:"extras,json,omitempty" valid:"-"`
 }
 
 func (logrec ScriptTelemetryRecordV2) PrintRecordInfo(logger *cli.Logger, message string) {
@@ -123,32 +246,26 @@ func (logrec ScriptTelemetryRecordV2) PrintRecordInfo(logger *cli.Logger, messag
 	))
 }
 
+func (logrec ScriptTelemetryRecordV2) GetRecordType() RecordType {
+	return ScriptRecord
+}
+
+func (logrec ScriptTelemetryRecordV2) GetTimeStamp() time.Time {
+	return parseTimeStamp(logrec.TimeStamp)
+}
+
+func (logrec ScriptTelemetryRecordV2) GetRecordId() string {
+	return logrec.RecordId
+}
+
+func (logrec ScriptTelemetryRecordV2) GetExtras() map[string]interface{} {
+	return logrec.Extras
+}
+
 func (logrec ScriptTelemetryRecordV2) Validate() error {
 	// govalidator.SetFieldsRequiredByDefault(true)
 
-	// custom validators
-	govalidator.TagMap["schema"] = govalidator.Validator(func(str string) bool {
-		return str == "2.0"
-	})
-
-	govalidator.TagMap["engine"] = govalidator.Validator(func(str string) bool {
-		switch str {
-		case
-			"unknown",
-			"ironpython",
-			"cpython",
-			"csharp",
-			"invoke",
-			"visualbasic",
-			"ironruby",
-			"dynamobim",
-			"grasshopper",
-			"content",
-			"hyperlink":
-			return true
-		}
-		return false
-	})
+	registerValidators()
 
 	// validate now
 	_, err := govalidator.ValidateStruct(logrec)
@@ -157,26 +274,30 @@ func (logrec ScriptTelemetryRecordV2) Validate() error {
 
 // introduced with api v2
 type EventTelemetryRecordV2 struct {
+	RecordId     string                 `json:"record_id,omitempty" bson:"record_id,omitempty" db:"id,recordid" valid:"uuid~Invalid record id"`
 	RecordMeta   RecordMetaV2           `json:"meta" bson:"meta"`
-	TimeStamp    string                 `json:"timestamp" bson:"timestamp" valid:"rfc3339~Invalid timestamp"`
-	HandlerId    string                 `json:"handler_id" bson:"handler_id" valid:"-"`
-	EventType    string                 `json:"type" bson:"type" valid:"-"`
-	EventArgs    map[string]interface{} `json:"args" bson:"args" valid:"-"`
-	UserName     string                 `json:"username" bson:"username" valid:"-"`
-	HostUserName string                 `json:"host_user" bson:"host_user" valid:"-"`
-	RevitVersion string                 `json:"revit" bson:"revit" valid:"numeric~Invalid revit version"`
-	RevitBuild   string                 `json:"revitbuild" bson:"revitbuild" valid:"matches(\\d{8}_\\d{4}\\(x\\d{2}\\))~Invalid revit build number"`
+	TimeStamp    string                 `json:"timestamp" bson:"timestamp" db:"timestamp,time" valid:"rfc3339~Invalid timestamp"`
+	HandlerId    string                 `json:"handler_id" bson:"handler_id" db:"handler_id" valid:"-"`
+	EventType    string                 `json:"type" bson:"type" db:"type" valid:"-"`
+	EventArgs    map[string]interface{} `json:"args" bson:"args" db:"args,json" valid:"-"`
+	UserName     string                 `json:"username" bson:"username" db:"username" valid:"-"`
+	HostUserName string                 `json:"host_user" bson:"host_user" db:"host_user" valid:"-"`
+	RevitVersion string                 `json:"revit" bson:"revit" db:"revit" valid:"numeric~Invalid revit version"`
+	RevitBuild   string                 `json:"revitbuild" bson:"revitbuild" db:"revitbuild" valid:"matches(\\d{8}_\\d{4}\\(x\\d{2}\\))~Invalid revit build number"`
 
 	// general
-	Cancellable      bool   `json:"cancellable" bson:"cancellable"`
-	Cancelled        bool   `json:"cancelled" bson:"cancelled"`
-	DocumentId       int    `json:"docid" bson:"docid" valid:"-"`
-	DocumentType     string `json:"doctype" bson:"doctype" valid:"-"`
-	DocumentTemplate string `json:"doctemplate" bson:"doctemplate" valid:"-"`
-	DocumentName     string `json:"docname" bson:"docname" valid:"-"`
-	DocumentPath     string `json:"docpath" bson:"docpath" valid:"-"`
-	ProjectNumber    string `json:"projectnum" bson:"projectnum" valid:"-"`
-	ProjectName      string `json:"projectname" bson:"projectname" valid:"-"`
+	Cancellable      bool   `json:"cancellable" bson:"cancellable" db:"cancellable"`
+	Cancelled        bool   `json:"cancelled" bson:"cancelled" db:"cancelled"`
+	DocumentId       int    `json:"docid" bson:"docid" db:"docid" valid:"-"`
+	DocumentType     string `json:"doctype" bson:"doctype" db:"doctype" valid:"-"`
+	DocumentTemplate string `json:"doctemplate" bson:"doctemplate" db:"doctemplate" valid:"-"`
+	DocumentName     string `json:"docname" bson:"docname" db:"docname" valid:"-"`
+	DocumentPath     string `json:"docpath" bson:"docpath" db:"docpath" valid:"-"`
+	ProjectNumber    string `json:"projectnum" bson:"projectnum" db:"projectnum" valid:"-"`
+	ProjectName      string `json:"projectname" bson:"projectname" db:"projectname" valid:"-"`
+
+	// fields newer clients send that have no column yet
+	Extras map[string]interface{} `json:"extras,omitempty" bson:"extras,omitempty" db:"extras,json,omitempty" valid:"-"`
 }
 
 func (logrec EventTelemetryRecordV2) PrintRecordInfo(logger *cli.Logger, message string) {
@@ -194,13 +315,26 @@ func (logrec EventTelemetryRecordV2) PrintRecordInfo(logger *cli.Logger, message
 	}
 }
 
+func (logrec EventTelemetryRecordV2) GetRecordType() RecordType {
+	return EventRecord
+}
+
+func (logrec EventTelemetryRecordV2) GetTimeStamp() time.Time {
+	return parseTimeStamp(logrec.TimeStamp)
+}
+
+func (logrec EventTelemetryRecordV2) GetRecordId() string {
+	return logrec.RecordId
+}
+
+func (logrec EventTelemetryRecordV2) GetExtras() map[string]interface{} {
+	return logrec.Extras
+}
+
 func (logrec EventTelemetryRecordV2) Validate() error {
 	// govalidator.SetFieldsRequiredByDefault(true)
 
-	// custom validators
-	govalidator.TagMap["schema"] = govalidator.Validator(func(str string) bool {
-		return str == "2.0"
-	})
+	registerValidators()
 
 	_, err := govalidator.ValidateStruct(logrec)
 	return err
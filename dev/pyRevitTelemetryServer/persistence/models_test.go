@@ -0,0 +1,157 @@
+package persistence
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestGetRecordType(t *testing.T) {
+	script := newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z")
+	event := newTestEventRecord("jane", "jane.doe", "2021-06-01T10:00:00Z")
+	tests := []struct {
+		name       string
+		logrec     TelemetryRecord
+		recordType RecordType
+	}{
+		{"v1 script", &ScriptTelemetryRecordV1{}, ScriptRecord},
+		{"v1 script value", ScriptTelemetryRecordV1{}, ScriptRecord},
+		{"v2 script", script, ScriptRecord},
+		{"v2 script value", *script, ScriptRecord},
+		{"event", event, EventRecord},
+		{"event value", *event, EventRecord},
+	}
+	dbcfg := &Config{ScriptTarget: "runs", EventTarget: "ui_events"}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if recordType := test.logrec.GetRecordType(); recordType != test.recordType {
+				t.Errorf("record type is %s, want %s", recordType, test.recordType)
+			}
+			if target, want := dbcfg.targetFor(test.logrec), dbcfg.targetOf(test.recordType); target != want {
+				t.Errorf("record is routed to %s, want %s", target, want)
+			}
+		})
+	}
+}
+
+func TestNewRecordId(t *testing.T) {
+	logrec := newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z")
+	resent := *logrec
+	first, fErr := newRecordId(logrec)
+	second, sErr := newRecordId(&resent)
+	if fErr != nil || sErr != nil {
+		t.Fatalf("deriving record ids: %v, %v", fErr, sErr)
+	}
+	if first == "" || first != second {
+		t.Errorf("same records got ids %q and %q", first, second)
+	}
+
+	resent.TimeStamp = "2021-06-01T11:00:00Z"
+	other, _ := newRecordId(&resent)
+	if other == first {
+		t.Errorf("different records got the same id %q", first)
+	}
+
+	logrec.RecordId = "0d7b0bb6-0b8a-4a0c-9a8e-4e0f3f4b8e1a"
+	if recordId, _ := newRecordId(logrec); recordId != logrec.RecordId {
+		t.Errorf("record id is %q, want the client provided %q", recordId, logrec.RecordId)
+	}
+}
+
+// no random id stores the record again on every retry
+func TestNewRecordIdUnmarshallable(t *testing.T) {
+	logrec := newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z")
+	logrec.Extras = map[string]interface{}{"ratio": math.Inf(1)}
+	if recordId, err := newRecordId(logrec); err == nil {
+		t.Errorf("derived record id %q, want an error", recordId)
+	}
+
+	conn := NewMemoryConnection(&Config{ScriptTarget: "scripts"})
+	defer conn.Close()
+	if _, err := conn.Write(context.Background(), logrec, testLogger); err == nil {
+		t.Error("writing succeeded, want an error")
+	}
+	if records := readTestRecords(t, conn, &RecordFilter{}); len(records) != 0 {
+		t.Errorf("found %d records, want none", len(records))
+	}
+}
+
+func TestRecordRouting(t *testing.T) {
+	testRecordRouting(t, newTestSqliteConnection)
+}
+
+func TestRecordRoutingServers(t *testing.T) {
+	for _, server := range testSQLServers {
+		t.Run(string(server.backend), func(t *testing.T) {
+			testRecordRouting(t, func(t *testing.T, dbcfg Config) Connection {
+				return newTestSQLServerConnection(t, server.env, dbcfg)
+			})
+		})
+	}
+}
+
+func TestFileRecordRouting(t *testing.T) {
+	testRecordRouting(t, func(t *testing.T, dbcfg Config) Connection {
+		dbcfg.Backend = File
+		dbcfg.ConnString = "file:" + t.TempDir()
+		return newTestConnection(t, dbcfg)
+	})
+}
+
+// shared by the backends, one batch of both types is read back by type
+func testRecordRouting(t *testing.T, connect func(*testing.T, Config) Connection) {
+	conn := connect(t, Config{})
+	event := newTestEventRecord("john", "john.doe", "2021-06-01T11:00:00Z")
+	writeTestRecords(t, conn,
+		newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"),
+		newTestEventRecord("jane", "jane.doe", "2021-06-01T10:30:00Z"),
+		newTestScriptRecord("john", "john.doe", "2021-06-01T11:00:00Z"),
+		*event)
+
+	scripts := readTestRecords(t, conn, nil)
+	if len(scripts) != 2 {
+		t.Errorf("found %d script records, want 2", len(scripts))
+	}
+	for _, logrec := range append(scripts, readTestRecords(t, conn, &RecordFilter{RecordType: ScriptRecord})...) {
+		if _, ok := logrec.(*ScriptTelemetryRecordV2); !ok {
+			t.Errorf("script read returned %T", logrec)
+		}
+	}
+
+	events := readTestRecords(t, conn, &RecordFilter{RecordType: EventRecord})
+	if len(events) != 2 {
+		t.Fatalf("found %d events, want 2", len(events))
+	}
+	for _, logrec := range events {
+		if _, ok := logrec.(*EventTelemetryRecordV2); !ok {
+			t.Errorf("event read returned %T", logrec)
+		}
+	}
+	if johns := readTestRecords(t, conn, &RecordFilter{RecordType: EventRecord, HostUserName: "john.doe"}); len(johns) != 1 {
+		t.Errorf("found %d events of john, want 1", len(johns))
+	}
+
+	if _, _, err := conn.Read(context.Background(), &RecordFilter{RecordType: "metric"}, testLogger); err == nil {
+		t.Error("read of an unknown record type passed")
+	}
+}
+
+// each type lands in the table of its target
+func TestRecordRoutingTables(t *testing.T) {
+	conn := newTestSqliteConnection(t, Config{ScriptTarget: "runs", EventTarget: "ui_events"})
+	writeTestRecords(t, conn,
+		newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"),
+		newTestEventRecord("jane", "jane.doe", "2021-06-01T10:30:00Z"),
+		*newTestEventRecord("john", "john.doe", "2021-06-01T11:00:00Z"))
+
+	sqlConn, _ := unwrapSQLConnection(conn)
+	for table, want := range map[string]int{"runs": 1, "ui_events": 2} {
+		var rows int
+		if err := sqlConn.db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&rows); err != nil {
+			t.Fatalf("counting rows of %s: %v", table, err)
+		}
+		if rows != want {
+			t.Errorf("%s has %d rows, want %d", table, rows, want)
+		}
+	}
+}
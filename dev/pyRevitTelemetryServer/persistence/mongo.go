@@ -1,103 +1,717 @@
 package persistence
 
 import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
 	"../cli"
-	_ "github.com/lib/pq"
-	"gopkg.in/mgo.v2"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
 )
 
+// default indexes, recent-first queries and per user lookups
+var defaultMongoIndexes = [][]string{
+	{"-timestamp"},
+	{"host_user", "username"},
+}
+
 type MongoDBConnection struct {
 	DatabaseConnection
-}
+	client *mongo.Client
+	dbName string
 
-func (w MongoDBConnection) GetType() DBBackend {
-	return w.Config.Backend
+	// indexes are created on first use, retried until it succeeds
+	indexMutex sync.Mutex
+	indexed    bool
 }
 
-func (w MongoDBConnection) GetVersion(logger *cli.Logger) string {
-	// parse and grab database name from uri
-	logger.Debug("grabbing db name from connection string")
-	dialinfo, err := mgo.ParseURL(w.Config.ConnString)
+func newMongoDBConnection(w DatabaseConnection) (*MongoDBConnection, error) {
+	w.Config = w.Config.withScriptTarget(w.Config.CollectionName)
+	if err := w.Config.validateTargets(mongoTargetPattern); err != nil {
+		return nil, err
+	}
+
+	// the client connects lazily in the background
+	client, dbName, err := openMongoClient(context.Background(), w.Config)
 	if err != nil {
-		return ""
+		return nil, err
 	}
+	return &MongoDBConnection{DatabaseConnection: w, client: client, dbName: dbName}, nil
+}
 
-	logger.Debug("opening mongodb session")
-	session, cErr := mgo.DialWithInfo(dialinfo)
-	if cErr != nil {
+func (w *MongoDBConnection) GetType() DBBackend {
+	return w.Config.Backend
+}
+
+func (w *MongoDBConnection) GetVersion(logger *cli.Logger) string {
+	if err := w.begin(); err != nil {
 		return ""
 	}
-	defer session.Close()
+	defer w.end()
 
-	logger.Debug("getting mongodb version")
-	buildInfo, vErr := session.BuildInfo()
+	// the status methods take no context, the ping timeout bounds them
+	ctx, cancel := w.Config.newPingContext(context.Background())
+	defer cancel()
+
+	w.Config.structured(logger).Debug("getting mongodb version")
+	var buildInfo bson.M
+	vErr := w.client.Database(w.dbName).RunCommand(ctx, bson.D{{Key: "buildInfo", Value: 1}}).Decode(&buildInfo)
 	if vErr != nil {
 		return ""
 	}
 
-	return buildInfo.Version
+	version, _ := buildInfo["version"].(string)
+	return version
+}
+
+func (w *MongoDBConnection) GetStatus(logger *cli.Logger) ConnectionStatus {
+	if err := w.Ping(context.Background()); err != nil {
+		return newConnectionStatus(err, "")
+	}
+	return newConnectionStatus(nil, w.GetVersion(logger))
+}
+
+func (w *MongoDBConnection) Ping(ctx context.Context) error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+	defer w.end()
+
+	pingCtx, cancel := w.Config.newPingContext(ctx)
+	defer cancel()
+
+	return wrapContextError(pingCtx, w.client.Ping(pingCtx, readpref.Primary()))
+}
+
+// concurrent pings each check out a connection of their own, so the
+// driver dials up to n of them
+func (w *MongoDBConnection) Warmup(ctx context.Context, n int) error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+	defer w.end()
+
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			errs <- w.client.Ping(ctx, readpref.Primary())
+		}()
+	}
+
+	var firstErr error
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return wrapContextError(ctx, firstErr)
+}
+
+func (w *MongoDBConnection) Write(ctx context.Context, logrec TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.WriteBatch(ctx, []TelemetryRecord{logrec}, logger)
+}
+
+func (w *MongoDBConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	if len(logrecs) == 0 {
+		return &Result{
+			ResultCode: ResultNoData,
+			Message:    "no data to write",
+		}, nil
+	}
+
+	w.ensureIndexes(ctx, logger)
+
+	// group documents by target collection, keeping order
+	w.Config.structured(logger).Debug("grouping documents by target collection")
+	collections := make([]string, 0)
+	docs := make(map[string][]int)
+	for idx, logrec := range logrecs {
+		target := w.Config.targetFor(logrec)
+		if _, exists := docs[target]; !exists {
+			collections = append(collections, target)
+		}
+		docs[target] = append(docs[target], idx)
+	}
+
+	return commitMongo(ctx, w.client.Database(w.dbName), logrecs, collections, docs, w.Config.retentionByTTL(), w.Config.structured(logger))
 }
 
-func (w MongoDBConnection) GetStatus(logger *cli.Logger) ConnectionStatus {
-	return ConnectionStatus{
-		Status:  "pass",
-		Version: w.GetVersion(logger),
+func (w *MongoDBConnection) Read(ctx context.Context, filter *RecordFilter, logger *cli.Logger) ([]TelemetryRecord, *Result, error) {
+	if err := w.begin(); err != nil {
+		return nil, nil, err
+	}
+	defer w.end()
+
+	log := w.Config.structured(logger)
+
+	recordType, tErr := filter.recordType()
+	if tErr != nil {
+		return nil, nil, tErr
+	}
+
+	w.ensureIndexes(ctx, logger)
+
+	log.Debug("getting target collection")
+	c := w.client.Database(w.dbName).Collection(w.Config.targetOf(recordType))
+	log.Trace(c.Name())
+
+	log.Debug("building query from filter")
+	query, findOpts, gErr := generateMongoReadQuery(filter)
+	if gErr != nil {
+		return nil, nil, gErr
+	}
+	log.Trace("find query", "query", query)
+
+	log.Debug("reading documents")
+	cursor, fErr := c.Find(ctx, query, findOpts)
+	if fErr != nil {
+		return nil, nil, wrapContextError(ctx, fErr)
 	}
+	// ctx may be done already
+	defer cursor.Close(context.Background())
+
+	records := make([]TelemetryRecord, 0)
+	for cursor.Next(ctx) {
+		logrec := newRecordV2(recordType)
+		if dErr := cursor.Decode(logrec); dErr != nil {
+			return nil, nil, dErr
+		}
+		records = append(records, logrec)
+	}
+	if cErr := cursor.Err(); cErr != nil {
+		return nil, nil, wrapContextError(ctx, cErr)
+	}
+
+	log.Debug("preparing report")
+	return records, newReadResult(records, filter), nil
 }
 
-func (w MongoDBConnection) WriteScriptTelemetryV1(logrec *ScriptTelemetryRecordV1, logger *cli.Logger) (*Result, error) {
-	return commitMongo(w.Config.ConnString, w.Config.ScriptTarget, logrec, logger)
+// documents are decoded one at a time as the cursor advances
+func (w *MongoDBConnection) ReadStream(ctx context.Context, filter *RecordFilter, logger *cli.Logger) (<-chan TelemetryRecord, <-chan error) {
+	log := w.Config.structured(logger)
+
+	if err := w.begin(); err != nil {
+		return failedRecordStream(err)
+	}
+
+	return newRecordStream(ctx, func(send func(TelemetryRecord) bool) error {
+		defer w.end()
+
+		recordType, tErr := filter.recordType()
+		if tErr != nil {
+			return tErr
+		}
+
+		w.ensureIndexes(ctx, logger)
+
+		c := w.client.Database(w.dbName).Collection(w.Config.targetOf(recordType))
+		query, findOpts, gErr := generateMongoReadQuery(filter)
+		if gErr != nil {
+			return gErr
+		}
+		log.Trace("find query", "query", query)
+
+		log.Debug("streaming documents")
+		cursor, fErr := c.Find(ctx, query, findOpts)
+		if fErr != nil {
+			return wrapContextError(ctx, fErr)
+		}
+		// ctx may be done already
+		defer cursor.Close(context.Background())
+
+		for cursor.Next(ctx) {
+			logrec := newRecordV2(recordType)
+			if dErr := cursor.Decode(logrec); dErr != nil {
+				return dErr
+			}
+			if !send(logrec) {
+				return nil
+			}
+		}
+		return wrapContextError(ctx, cursor.Err())
+	})
 }
 
-func (w MongoDBConnection) WriteScriptTelemetryV2(logrec *ScriptTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
-	return commitMongo(w.Config.ConnString, w.Config.ScriptTarget, logrec, logger)
+// counts are grouped by an aggregation pipeline on the server
+func (w *MongoDBConnection) AggregateCommandCounts(ctx context.Context, from time.Time, to time.Time) (map[string]int, error) {
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	c := w.client.Database(w.dbName).Collection(w.Config.ScriptTarget)
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: generateMongoQuery(&RecordFilter{From: from, To: to})}},
+		{{Key: "$group", Value: bson.M{"_id": "$commandname", "count": bson.M{"$sum": 1}}}},
+	}
+	cursor, aErr := c.Aggregate(ctx, pipeline)
+	if aErr != nil {
+		return nil, wrapContextError(ctx, aErr)
+	}
+	defer cursor.Close(ctx)
+
+	var groups []struct {
+		Command string `bson:"_id"`
+		Count   int    `bson:"count"`
+	}
+	if cErr := cursor.All(ctx, &groups); cErr != nil {
+		return nil, wrapContextError(ctx, cErr)
+	}
+
+	counts := make(map[string]int, len(groups))
+	for _, group := range groups {
+		counts[group.Command] += group.Count
+	}
+	return counts, nil
 }
 
-func (w MongoDBConnection) WriteEventTelemetryV2(logrec *EventTelemetryRecordV2, logger *cli.Logger) (*Result, error) {
-	return commitMongo(w.Config.ConnString, w.Config.EventTarget, logrec, logger)
+func (w *MongoDBConnection) RecentByUser(ctx context.Context, username string, n int) ([]TelemetryRecord, error) {
+	if err := validateRecentCount(n); err != nil {
+		return nil, err
+	}
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	c := w.client.Database(w.dbName).Collection(w.Config.ScriptTarget)
+	findOpts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(int64(n))
+	cursor, fErr := c.Find(ctx, generateMongoUserQuery(username), findOpts)
+	if fErr != nil {
+		return nil, wrapContextError(ctx, fErr)
+	}
+	// ctx may be done already
+	defer cursor.Close(context.Background())
+
+	records := make([]TelemetryRecord, 0, n)
+	for cursor.Next(ctx) {
+		logrec := &ScriptTelemetryRecordV2{}
+		if dErr := cursor.Decode(logrec); dErr != nil {
+			return nil, dErr
+		}
+		records = append(records, logrec)
+	}
+	if cErr := cursor.Err(); cErr != nil {
+		return nil, wrapContextError(ctx, cErr)
+	}
+	return records, nil
 }
 
-func commitMongo(connStr string, targetCollection string, logrec interface{}, logger *cli.Logger) (*Result, error) {
+func (w *MongoDBConnection) DeleteByUser(ctx context.Context, username string) (*Result, error) {
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	affected := 0
+	db := w.client.Database(w.dbName)
+	for _, collection := range []string{w.Config.ScriptTarget, w.Config.EventTarget} {
+		if collection == "" {
+			continue
+		}
+		res, dErr := db.Collection(collection).DeleteMany(ctx, generateMongoUserQuery(username))
+		if dErr != nil {
+			return nil, wrapContextError(ctx, dErr)
+		}
+		affected += int(res.DeletedCount)
+	}
+	return newAffectedResult(affected, "deleted"), nil
+}
+
+func (w *MongoDBConnection) PurgeOlderThan(ctx context.Context, cutoff time.Time) (*Result, error) {
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	affected := 0
+	db := w.client.Database(w.dbName)
+	query := bson.M{"$expr": generateMongoTimeCondition("$lt", cutoff)}
+	for _, collection := range []string{w.Config.ScriptTarget, w.Config.EventTarget} {
+		if collection == "" {
+			continue
+		}
+		res, dErr := db.Collection(collection).DeleteMany(ctx, query)
+		if dErr != nil {
+			return nil, wrapContextError(ctx, dErr)
+		}
+		affected += int(res.DeletedCount)
+	}
+	return newAffectedResult(affected, "purged"), nil
+}
+
+// replaces the user and host user names of the matching documents with
+// their pseudonyms, the other name on a matched document included. the
+// names are read first, pseudonyms are made outside the database
+func (w *MongoDBConnection) AnonymizeUser(ctx context.Context, username string) (*Result, error) {
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	affected := 0
+	db := w.client.Database(w.dbName)
+	for _, collection := range []string{w.Config.ScriptTarget, w.Config.EventTarget} {
+		if collection == "" {
+			continue
+		}
+		names := make(map[string]bool)
+		for _, field := range []string{"username", "host_user"} {
+			values, dErr := db.Collection(collection).Distinct(ctx, field, generateMongoUserQuery(username))
+			if dErr != nil {
+				return nil, wrapContextError(ctx, dErr)
+			}
+			for _, value := range values {
+				if name, ok := value.(string); ok {
+					names[name] = true
+				}
+			}
+		}
+		if len(names) == 0 {
+			continue
+		}
+
+		update := generateMongoAnonymizeUpdate(names, w.Config.AnonymizationKey)
+		res, uErr := db.Collection(collection).UpdateMany(ctx, generateMongoUserQuery(username), update)
+		if uErr != nil {
+			return nil, wrapContextError(ctx, uErr)
+		}
+		affected += int(res.ModifiedCount)
+	}
+	return newAffectedResult(affected, "anonymized"), nil
+}
+
+// waits for in-flight operations and disconnects the client
+func (w *MongoDBConnection) Close() error {
+	if !w.drain() {
+		return nil
+	}
+	return w.client.Disconnect(context.Background())
+}
+
+// creates the configured indexes on the script and event collections
+// failures are logged and retried on the next call, writes do not need them
+func (w *MongoDBConnection) ensureIndexes(ctx context.Context, logger *cli.Logger) {
+	log := w.Config.structured(logger)
+
+	w.indexMutex.Lock()
+	defer w.indexMutex.Unlock()
+	if w.indexed {
+		return
+	}
+
+	indexes := w.Config.MongoIndexes
+	if indexes == nil {
+		indexes = defaultMongoIndexes
+	}
+	models := generateMongoIndexModels(indexes)
+	if w.Config.retentionByTTL() {
+		models = append(models, generateMongoTTLIndexModel(w.Config.RetentionDays))
+	}
+	if len(models) == 0 {
+		w.indexed = true
+		return
+	}
+
+	log.Debug("ensuring mongodb indexes exist")
+	db := w.client.Database(w.dbName)
+	for _, collection := range []string{w.Config.ScriptTarget, w.Config.EventTarget} {
+		if collection == "" {
+			continue
+		}
+		if _, err := db.Collection(collection).Indexes().CreateMany(ctx, models); err != nil {
+			log.Debug("error creating indexes", "collection", collection, "error", err)
+			return
+		}
+	}
+
+	w.indexed = true
+}
+
+// fields prefixed with - are indexed in descending order
+func generateMongoIndexModels(indexes [][]string) []mongo.IndexModel {
+	models := make([]mongo.IndexModel, 0, len(indexes))
+	for _, fields := range indexes {
+		keys := bson.D{}
+		for _, field := range fields {
+			if strings.HasPrefix(field, "-") {
+				keys = append(keys, bson.E{Key: strings.TrimPrefix(field, "-"), Value: -1})
+			} else {
+				keys = append(keys, bson.E{Key: field, Value: 1})
+			}
+		}
+		if len(keys) > 0 {
+			models = append(models, mongo.IndexModel{Keys: keys})
+		}
+	}
+	return models
+}
+
+func generateMongoQuery(filter *RecordFilter) bson.M {
+	query := bson.M{}
+	if filter == nil {
+		return query
+	}
+
+	timeRange := bson.A{}
+	if !filter.From.IsZero() {
+		timeRange = append(timeRange, generateMongoTimeCondition("$gte", filter.From))
+	}
+	if !filter.To.IsZero() {
+		timeRange = append(timeRange, generateMongoTimeCondition("$lte", filter.To))
+	}
+	if len(timeRange) > 0 {
+		query["$expr"] = bson.M{"$and": timeRange}
+	}
+	if filter.HostUserName != "" {
+		query["host_user"] = filter.HostUserName
+	}
+	if filter.UserName != "" {
+		query["username"] = filter.UserName
+	}
+	return query
+}
+
+// timestamps are stored as strings in the offset and precision the client
+// sent, so they are compared as dates. documents whose timestamp can not be
+// parsed never match
+func generateMongoTimeCondition(op string, t time.Time) bson.M {
+	stamped := bson.M{"$dateFromString": bson.M{"dateString": "$timestamp", "onError": nil}}
+	return bson.M{"$and": bson.A{
+		bson.M{"$ne": bson.A{stamped, nil}},
+		bson.M{op: bson.A{stamped, t.UTC()}},
+	}}
+}
+
+// pages the same way as the sql backends, ties are ordered by _id
+func generateMongoReadQuery(filter *RecordFilter) (bson.M, *options.FindOptions, error) {
+	page, err := filter.page()
+	if err != nil {
+		return nil, nil, err
+	}
+	conditions, cErr := filter.conditions()
+	if cErr != nil {
+		return nil, nil, cErr
+	}
+
+	query := generateMongoQuery(filter)
+	findOpts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}})
+	and := bson.A{}
+	for _, condition := range conditions {
+		value := condition.values[0]
+		if condition.op == FilterIn {
+			value = bson.A(condition.values)
+		}
+		// the operators are named after the mongo ones
+		and = append(and, bson.M{condition.field: bson.M{"$" + condition.op: value}})
+	}
+	if page != nil {
+		and = append(and, bson.M{"timestamp": bson.M{"$gte": page.After}})
+		findOpts.SetSkip(int64(page.Skip))
+	}
+	if len(and) > 0 {
+		query["$and"] = and
+	}
+	if filter != nil && filter.Limit > 0 {
+		findOpts.SetLimit(int64(filter.Limit))
+	}
+	return query, findOpts, nil
+}
+
+func generateMongoUserQuery(username string) bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{"username": username},
+		bson.M{"host_user": username},
+	}}
+}
+
+// names without a pseudonym and names written in between are removed
+func generateMongoAnonymizeUpdate(names map[string]bool, key string) mongo.Pipeline {
+	replace := func(field string) bson.M {
+		branches := bson.A{}
+		for name := range names {
+			var pseudonym interface{} = anonymizeUserName(key, name)
+			if pseudonym == "" && name != "" {
+				pseudonym = "$$REMOVE"
+			}
+			branches = append(branches, bson.M{"case": bson.M{"$eq": bson.A{"$" + field, name}}, "then": pseudonym})
+		}
+		return bson.M{"$switch": bson.M{"branches": branches, "default": "$$REMOVE"}}
+	}
+	return mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"username": replace("username"), "host_user": replace("host_user")}}},
+	}
+}
+
+// write concern of every write of the client, majority, acknowledged or
+// the number of nodes. acknowledged waits for the primary only and is the
+// fastest, majority waits for most of the replica set so writes survive
+// a failover, a number waits for that many nodes. unacknowledged writes
+// are not accepted, their results could not count the records written
+func parseMongoWriteConcern(name string) (*writeconcern.WriteConcern, error) {
+	switch name {
+	case "majority":
+		return writeconcern.New(writeconcern.WMajority()), nil
+	case "acknowledged":
+		return writeconcern.New(writeconcern.W(1)), nil
+	}
+	nodes, err := strconv.Atoi(name)
+	if err != nil || nodes < 1 {
+		return nil, errors.Errorf("unknown mongodb write concern %q", name)
+	}
+	return writeconcern.New(writeconcern.W(nodes)), nil
+}
+
+func openMongoClient(ctx context.Context, dbcfg *Config) (*mongo.Client, string, error) {
 	// parse and grab database name from uri
-	logger.Debug("grabbing db name from connection string")
-	dialinfo, err := mgo.ParseURL(connStr)
+	connInfo, err := connstring.ParseAndValidate(dbcfg.ConnString)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+
+	clientOpts, oErr := generateMongoClientOptions(dbcfg)
+	if oErr != nil {
+		return nil, "", oErr
 	}
 
-	logger.Debug("opening mongodb session")
-	session, cErr := mgo.DialWithInfo(dialinfo)
+	client, cErr := mongo.Connect(ctx, clientOpts)
 	if cErr != nil {
-		return nil, cErr
+		return nil, "", cErr
+	}
+
+	return client, connInfo.Database, nil
+}
+
+func generateMongoClientOptions(dbcfg *Config) (*options.ClientOptions, error) {
+	clientOpts := options.Client().ApplyURI(dbcfg.ConnString)
+	tlsCfg, tErr := dbcfg.newTLSConfig()
+	if tErr != nil {
+		return nil, tErr
+	}
+	if tlsCfg != nil {
+		clientOpts.SetTLSConfig(tlsCfg)
+	}
+	if dbcfg.MongoWriteConcern != "" {
+		writeConcern, wErr := parseMongoWriteConcern(dbcfg.MongoWriteConcern)
+		if wErr != nil {
+			return nil, wErr
+		}
+		clientOpts.SetWriteConcern(writeConcern)
+	}
+	// left to maxIdleTimeMS of the connection string otherwise
+	if dbcfg.ConnMaxIdleTime > 0 {
+		clientOpts.SetMaxConnIdleTime(dbcfg.ConnMaxIdleTime)
+	}
+	return clientOpts, nil
+}
+
+// records are upserted on their id so resent records are skipped. records
+// the client sent without an id get one derived by newRecordId. docs are
+// the positions of the records written to each collection.
+// writes are unordered so a failing document does not stop the others,
+// Records of the result tells which failed. failures not caused by the
+// documents fail all documents still to be written
+func commitMongo(ctx context.Context, db *mongo.Database, logrecs []TelemetryRecord, collections []string, docs map[string][]int, ttl bool, log *structuredLogger) (*Result, error) {
+	written := 0
+	duplicates := 0
+	var records []RecordResult
+	var firstErr error
+	fail := func(idx int, err error) {
+		if records == nil {
+			records = newRecordResults(len(logrecs))
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		records[idx].Err = err
 	}
-	defer session.Close()
 
-	// Optional. Switch the session to a monotonic behavior.
-	logger.Debug("setting session properties")
-	session.SetMode(mgo.Monotonic, true)
-	logger.Trace(session)
+	for cIdx, targetCollection := range collections {
+		log.Debug("getting target collection")
+		c := db.Collection(targetCollection)
+		log.Trace(c.Name())
 
-	logger.Debug("getting target collection")
-	db := session.DB(dialinfo.Database)
-	c := db.C(targetCollection)
-	logger.Trace(c)
+		log.Debug("building write models")
+		models := make([]mongo.WriteModel, 0, len(docs[targetCollection]))
+		// position in the batch of the record of each model
+		modelIndexes := make([]int, 0, len(docs[targetCollection]))
+		for _, idx := range docs[targetCollection] {
+			logrec := logrecs[idx]
+			doc, dErr := generateMongoDocument(logrec, ttl)
+			if dErr != nil {
+				fail(idx, dErr)
+				continue
+			}
+			recordId, idErr := newRecordId(logrec)
+			if idErr != nil {
+				fail(idx, idErr)
+				continue
+			}
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": recordId}).
+				SetUpdate(bson.M{"$setOnInsert": doc}).
+				SetUpsert(true))
+			modelIndexes = append(modelIndexes, idx)
+		}
+		if len(models) == 0 {
+			continue
+		}
 
-	logger.Debug("opening bulk operation")
-	bulkop := c.Bulk()
+		log.Debug("writing documents")
+		res, txnErr := c.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		if res != nil {
+			written += int(res.InsertedCount + res.UpsertedCount)
+			duplicates += int(res.MatchedCount)
+		}
+		if txnErr == nil {
+			continue
+		}
 
-	// build sql data info
-	logger.Debug("building documents")
-	bulkop.Insert(logrec)
+		var bulkErr mongo.BulkWriteException
+		if errors.As(txnErr, &bulkErr) && len(bulkErr.WriteErrors) > 0 && bulkErr.WriteConcernError == nil && ctx.Err() == nil {
+			for _, writeErr := range bulkErr.WriteErrors {
+				fail(modelIndexes[writeErr.Index], classifyError(writeErr))
+			}
+			continue
+		}
+
+		txnErr = wrapContextError(ctx, txnErr)
+		for _, idx := range modelIndexes {
+			fail(idx, txnErr)
+		}
+		for _, rest := range collections[cIdx+1:] {
+			for _, idx := range docs[rest] {
+				fail(idx, txnErr)
+			}
+		}
+		break
+	}
 
-	logger.Debug("running bulk operation")
-	_, txnErr := bulkop.Run()
-	if txnErr != nil {
-		return nil, txnErr
+	if failed := countFailedRecords(records); failed > 0 {
+		return &Result{
+			Written:    written,
+			Duplicates: duplicates,
+			Records:    records,
+			Message:    fmt.Sprintf("inserted %d of %d usage documents", written, len(logrecs)),
+		}, errors.Wrapf(firstErr, "%d of %d usage documents failed", failed, len(logrecs))
 	}
 
-	// compact collection if requested
-	logger.Debug("preparing report")
-	return &Result{
-		Message: "successfully inserted usage document",
-	}, nil
+	log.Debug("preparing report")
+	return newWriteResult(written, duplicates, "inserted"), nil
 }
@@ -0,0 +1,238 @@
+package persistence
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMongoWriteTwice(t *testing.T) {
+	testWriteTwice(t, newTestMongoConnection)
+}
+
+func TestMongoDeleteByUser(t *testing.T) {
+	testDeleteByUser(t, newTestMongoConnection)
+}
+
+func TestMongoAnonymizeUser(t *testing.T) {
+	testAnonymizeUser(t, newTestMongoConnection)
+}
+
+func TestMongoAnonymizeUserWithoutKey(t *testing.T) {
+	testAnonymizeUserWithoutKey(t, newTestMongoConnection)
+}
+
+func TestMongoReadFilter(t *testing.T) {
+	testReadFilter(t, newTestMongoConnection)
+}
+
+func TestMongoReadNoMatchingRecords(t *testing.T) {
+	testReadNoMatchingRecords(t, newTestMongoConnection)
+}
+
+func TestGenerateMongoIndexModels(t *testing.T) {
+	models := generateMongoIndexModels([][]string{{"-timestamp"}, {"host_user", "username"}, {}})
+	want := []bson.D{
+		{{Key: "timestamp", Value: -1}},
+		{{Key: "host_user", Value: 1}, {Key: "username", Value: 1}},
+	}
+	if len(models) != len(want) {
+		t.Fatalf("generated %d index models, want %d", len(models), len(want))
+	}
+	for idx, model := range models {
+		if !reflect.DeepEqual(model.Keys, want[idx]) {
+			t.Errorf("index %d has keys %v, want %v", idx, model.Keys, want[idx])
+		}
+	}
+}
+
+func TestMongoIndexes(t *testing.T) {
+	tests := []struct {
+		name    string
+		indexes [][]string
+		want    []string
+	}{
+		{"default", nil, []string{"_id_", "timestamp_-1", "host_user_1_username_1"}},
+		{"configured", [][]string{{"commandname"}}, []string{"_id_", "commandname_1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := newTestMongoConnection(t, Config{MongoIndexes: test.indexes})
+			// indexes are created on first use
+			writeTestRecords(t, conn, newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"))
+
+			mongoConn, _ := unwrapMongoConnection(conn)
+			db := mongoConn.client.Database(mongoConn.dbName)
+			for _, collection := range []string{mongoConn.Config.ScriptTarget, mongoConn.Config.EventTarget} {
+				cursor, err := db.Collection(collection).Indexes().List(context.Background())
+				if err != nil {
+					t.Fatalf("listing indexes of %s: %v", collection, err)
+				}
+				var indexes []bson.M
+				if aErr := cursor.All(context.Background(), &indexes); aErr != nil {
+					t.Fatalf("decoding indexes of %s: %v", collection, aErr)
+				}
+
+				names := make([]string, 0, len(indexes))
+				for _, index := range indexes {
+					names = append(names, index["name"].(string))
+				}
+				sort.Strings(names)
+				want := append([]string{}, test.want...)
+				sort.Strings(want)
+				if !reflect.DeepEqual(names, want) {
+					t.Errorf("%s has indexes %v, want %v", collection, names, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMongoExtrasRoundTrip(t *testing.T) {
+	testExtrasRoundTrip(t, newTestMongoConnection)
+}
+
+func TestMongoAggregateCommandCounts(t *testing.T) {
+	testAggregateCommandCounts(t, newTestMongoConnection)
+}
+
+func TestMongoPurgeOlderThan(t *testing.T) {
+	testPurgeOlderThan(t, newTestMongoConnection)
+}
+
+func TestMongoReadStream(t *testing.T) {
+	testReadStream(t, newTestMongoConnection)
+}
+
+func TestMongoReadPages(t *testing.T) {
+	testReadPages(t, newTestMongoConnection)
+}
+
+func TestMongoReadPredicates(t *testing.T) {
+	testReadPredicates(t, newTestMongoConnection)
+}
+
+func TestMongoRecordRouting(t *testing.T) {
+	testRecordRouting(t, newTestMongoConnection)
+}
+
+// the configured write concern is the one of the client databases
+func TestMongoWriteConcern(t *testing.T) {
+	tests := []struct {
+		writeConcern string
+		want         interface{}
+	}{
+		{"majority", "majority"},
+		{"acknowledged", 1},
+		{"3", 3},
+	}
+	for _, test := range tests {
+		t.Run(test.writeConcern, func(t *testing.T) {
+			// the client connects lazily, no server is needed
+			client, dbName, err := openMongoClient(context.Background(), &Config{
+				ConnString:        "mongodb://127.0.0.1:1/telemetry",
+				MongoWriteConcern: test.writeConcern,
+			})
+			if err != nil {
+				t.Fatalf("opening client: %v", err)
+			}
+			defer client.Disconnect(context.Background())
+
+			writeConcern := client.Database(dbName).WriteConcern()
+			if writeConcern == nil || writeConcern.GetW() != test.want {
+				t.Errorf("write concern is %v, want w %v", writeConcern, test.want)
+			}
+		})
+	}
+
+	for _, writeConcern := range []string{"unacknowledged", "0", "all"} {
+		if _, err := parseMongoWriteConcern(writeConcern); err == nil {
+			t.Errorf("write concern %s passed", writeConcern)
+		}
+	}
+}
+
+func TestMongoWarmup(t *testing.T) {
+	conn := newTestMongoConnection(t, Config{})
+	if err := conn.Warmup(context.Background(), 3); err != nil {
+		t.Fatalf("warming up: %v", err)
+	}
+
+	conn.Close()
+	if err := conn.Warmup(context.Background(), 3); err == nil {
+		t.Error("warming up a closed connection succeeded")
+	}
+}
+
+// unordered bulk writes report the documents the collection rejects
+func TestMongoWriteBatchPartialFailure(t *testing.T) {
+	conn := newTestMongoConnection(t, Config{})
+	writeTestRecords(t, conn, newTestScriptRecord("jane", "jane.doe", "2021-06-01T09:00:00Z"))
+
+	mongoConn, _ := unwrapMongoConnection(conn)
+	db := mongoConn.client.Database(mongoConn.dbName)
+	if err := db.RunCommand(context.Background(), bson.D{
+		{Key: "collMod", Value: mongoConn.Config.ScriptTarget},
+		{Key: "validator", Value: bson.M{"username": bson.M{"$ne": "john"}}},
+	}).Err(); err != nil {
+		t.Fatalf("adding validator: %v", err)
+	}
+
+	res, err := conn.WriteBatch(context.Background(), []TelemetryRecord{
+		newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"),
+		newTestScriptRecord("john", "john.doe", "2021-06-01T11:00:00Z"),
+		newTestScriptRecord("jane", "jane.doe", "2021-06-01T12:00:00Z"),
+	}, testLogger)
+	if err == nil {
+		t.Fatal("writing a rejected document succeeded")
+	}
+	if res.Written != 2 || len(res.Records) != 3 {
+		t.Fatalf("wrote %d records with %d outcomes, want 2 written and 3 outcomes", res.Written, len(res.Records))
+	}
+	for idx, record := range res.Records {
+		if failed := record.Err != nil; failed != (idx == 1) {
+			t.Errorf("outcome of record %d has error %v", idx, record.Err)
+		}
+	}
+}
+
+func TestGenerateMongoClientOptionsIdleTime(t *testing.T) {
+	tests := []struct {
+		name      string
+		connStr   string
+		idleTime  time.Duration
+		wantIdle  time.Duration
+		wantIsSet bool
+	}{
+		{"unset", "mongodb://db.local/telemetry", 0, 0, false},
+		{"configured", "mongodb://db.local/telemetry", 10 * time.Minute, 10 * time.Minute, true},
+		{"connection string", "mongodb://db.local/telemetry?maxIdleTimeMS=30000", 0, 30 * time.Second, true},
+		{"configured over connection string", "mongodb://db.local/telemetry?maxIdleTimeMS=30000", time.Minute, time.Minute, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts, err := generateMongoClientOptions(&Config{ConnString: test.connStr, ConnMaxIdleTime: test.idleTime})
+			if err != nil {
+				t.Fatalf("generating options: %v", err)
+			}
+			if (opts.MaxConnIdleTime != nil) != test.wantIsSet {
+				t.Fatalf("max idle time is %v, want set %v", opts.MaxConnIdleTime, test.wantIsSet)
+			}
+			if test.wantIsSet && *opts.MaxConnIdleTime != test.wantIdle {
+				t.Errorf("max idle time is %s, want %s", *opts.MaxConnIdleTime, test.wantIdle)
+			}
+		})
+	}
+}
+
+func TestMongoRecentByUser(t *testing.T) {
+	testRecentByUser(t, newTestMongoConnection)
+}
+
+func TestMongoIdempotentRetry(t *testing.T) {
+	testIdempotentRetry(t, newTestMongoConnection)
+}
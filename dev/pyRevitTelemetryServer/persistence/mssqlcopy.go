@@ -0,0 +1,31 @@
+package persistence
+
+import (
+	"strconv"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+)
+
+// columns are matched to the table by name, so the order of the insert
+// values does not need to follow the table definition. nulls are kept
+// instead of taking column defaults, the same as inserts
+func generateMSSqlCopyQuery(group *copyGroup) string {
+	return mssql.CopyIn(group.table, mssql.BulkOptions{KeepNulls: true}, group.columns...)
+}
+
+// bulk copy sends typed values and rejects strings for integer columns,
+// inserts pass every value as a string and let the server convert it
+func generateMSSqlCopyValues(columns []string, row []interface{}) []interface{} {
+	values := make([]interface{}, len(row))
+	for idx, value := range row {
+		values[idx] = value
+		text, isText := value.(string)
+		if !isText || !sqlIntColumns[columns[idx]] {
+			continue
+		}
+		if number, err := strconv.ParseInt(text, 10, 64); err == nil {
+			values[idx] = number
+		}
+	}
+	return values
+}
@@ -0,0 +1,40 @@
+package persistence
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGenerateMSSqlCopyQuery(t *testing.T) {
+	query := generateMSSqlCopyQuery(&copyGroup{table: "scripts", columns: []string{"id", "username", "resultcode"}})
+	if !strings.HasPrefix(query, "INSERTBULK ") {
+		t.Fatalf("query %s is not a bulk copy", query)
+	}
+	for _, part := range []string{`"scripts"`, `"id"`, `"username"`, `"resultcode"`, `"KeepNulls":true`} {
+		if !strings.Contains(query, part) {
+			t.Errorf("query %s does not contain %s", query, part)
+		}
+	}
+}
+
+// integer columns are sent as numbers, the other values as they are
+func TestGenerateMSSqlCopyValues(t *testing.T) {
+	columns := []string{"id", "username", "resultcode", "duration", "docid"}
+	row := []interface{}{"0d7b0bb6", "jane", "0", "1500", nil}
+
+	values := generateMSSqlCopyValues(columns, row)
+	want := []interface{}{"0d7b0bb6", "jane", int64(0), int64(1500), nil}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("values are %#v, want %#v", values, want)
+	}
+	if row[2] != "0" {
+		t.Errorf("row is changed to %#v", row)
+	}
+}
+
+// compares bulk copy with multi-row inserts on the server of
+// envTestMSSql, an op is a batch of 1000 records
+func BenchmarkMSSqlWriteBatch(b *testing.B) {
+	benchmarkWriteBatch(b, envTestMSSql)
+}
@@ -0,0 +1,379 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"../cli"
+	"github.com/pkg/errors"
+)
+
+// backend type reported by connections fanning out to several backends
+const Multi DBBackend = "multi"
+
+// fan-out failure policies
+// FanOutRequireAll fails the write when any backend fails
+// FanOutRequireAny succeeds as long as one backend stores the records
+const (
+	FanOutRequireAll = "all"
+	FanOutRequireAny = "any"
+)
+
+// writes every record to all child connections concurrently
+type MultiConnection struct {
+	children  []Connection
+	labels    []string
+	optional  []bool
+	policy    string
+	logFormat string
+}
+
+// outcome of a single child operation
+type childOutcome struct {
+	label  string
+	result *Result
+	err    error
+}
+
+// opens a connection per config, closing the opened ones on failure
+func NewMultiConnection(configs []*Config, policy string) (*MultiConnection, error) {
+	if len(configs) == 0 {
+		return nil, errors.New("fan-out requires at least one backend")
+	}
+	if policy == "" {
+		policy = FanOutRequireAll
+	}
+	if policy != FanOutRequireAll && policy != FanOutRequireAny {
+		return nil, errors.Errorf("unknown fan-out policy %q", policy)
+	}
+
+	children := make([]Connection, 0, len(configs))
+	optional := make([]bool, 0, len(configs))
+	for _, dbcfg := range configs {
+		conn, err := NewConnection(dbcfg)
+		if err != nil {
+			for _, child := range children {
+				child.Close()
+			}
+			return nil, errors.Wrapf(err, "opening %s backend", dbcfg.Backend)
+		}
+		children = append(children, conn)
+		optional = append(optional, dbcfg.Optional)
+	}
+	multi := newMultiConnection(children, optional, policy)
+	multi.logFormat = configs[0].LogFormat
+	return multi, nil
+}
+
+// fan-out log lines name the backend they are about in their fields
+func (w *MultiConnection) logConfig() *Config {
+	return &Config{LogFormat: w.logFormat}
+}
+
+func newMultiConnection(children []Connection, optional []bool, policy string) *MultiConnection {
+	// backends used more than once are told apart by position
+	counts := make(map[DBBackend]int)
+	for _, child := range children {
+		counts[child.GetType()]++
+	}
+	labels := make([]string, 0, len(children))
+	for idx, child := range children {
+		label := string(child.GetType())
+		if counts[child.GetType()] > 1 {
+			label = fmt.Sprintf("%s[%d]", label, idx)
+		}
+		labels = append(labels, label)
+	}
+	return &MultiConnection{children: children, labels: labels, optional: optional, policy: policy}
+}
+
+func (w *MultiConnection) GetType() DBBackend {
+	return Multi
+}
+
+func (w *MultiConnection) GetVersion(logger *cli.Logger) string {
+	versions := make([]string, 0, len(w.children))
+	for idx, child := range w.children {
+		versions = append(versions, fmt.Sprintf("%s %s", w.labels[idx], child.GetVersion(logger)))
+	}
+	return strings.Join(versions, ", ")
+}
+
+func (w *MultiConnection) GetStatus(logger *cli.Logger) ConnectionStatus {
+	status := w.Health(context.Background())
+	if status.Status == "pass" {
+		status.Version = w.GetVersion(logger)
+	}
+	return status
+}
+
+// fails when a required backend is down, or when all of them are
+func (w *MultiConnection) Ping(ctx context.Context) error {
+	_, err := w.health(ctx)
+	return err
+}
+
+// outcome of Ping with the status of every backend
+func (w *MultiConnection) Health(ctx context.Context) ConnectionStatus {
+	backends, err := w.health(ctx)
+	status := newConnectionStatus(err, "")
+	status.Backends = backends
+	return status
+}
+
+func (w *MultiConnection) health(ctx context.Context) ([]BackendStatus, error) {
+	outcomes := w.fanOut(func(child Connection) (*Result, error) {
+		return nil, child.Ping(ctx)
+	})
+
+	backends := make([]BackendStatus, 0, len(outcomes))
+	failures := make([]string, 0)
+	requiredDown := false
+	for idx, outcome := range outcomes {
+		backend := BackendStatus{
+			Backend:  outcome.label,
+			Required: !w.optional[idx],
+			Status:   "pass",
+		}
+		if outcome.err != nil {
+			backend.Status = "fail"
+			backend.Output = outcome.err.Error()
+			failures = append(failures, fmt.Sprintf("%s: %v", outcome.label, outcome.err))
+			requiredDown = requiredDown || backend.Required
+		}
+		backends = append(backends, backend)
+	}
+
+	if requiredDown || len(failures) == len(outcomes) {
+		return backends, errors.Errorf(
+			"%d of %d backends failed: %s",
+			len(failures), len(outcomes), strings.Join(failures, "; "))
+	}
+	return backends, nil
+}
+
+func (w *MultiConnection) Warmup(ctx context.Context, n int) error {
+	outcomes := w.fanOut(func(child Connection) (*Result, error) {
+		return nil, child.Warmup(ctx, n)
+	})
+	_, err := w.applyPolicy(outcomes)
+	return err
+}
+
+func (w *MultiConnection) Write(ctx context.Context, logrec TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.WriteBatch(ctx, []TelemetryRecord{logrec}, logger)
+}
+
+// Written, Duplicates and Dropped are the most records any backend wrote,
+// skipped or dropped, the message lists the outcome of every backend
+func (w *MultiConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	w.logConfig().structured(logger).Debug("writing to backends", "backends", len(w.children))
+	outcomes := w.fanOut(func(child Connection) (*Result, error) {
+		return child.WriteBatch(ctx, logrecs, logger)
+	})
+
+	result := &Result{}
+	messages := make([]string, 0, len(outcomes))
+	for _, outcome := range outcomes {
+		message := "no result"
+		if outcome.err != nil {
+			message = fmt.Sprintf("failed: %v", outcome.err)
+		} else if outcome.result != nil {
+			message = outcome.result.Message
+		}
+		messages = append(messages, fmt.Sprintf("%s: %s", outcome.label, message))
+
+		if outcome.result != nil {
+			if outcome.result.Written > result.Written {
+				result.Written = outcome.result.Written
+			}
+			if outcome.result.Duplicates > result.Duplicates {
+				result.Duplicates = outcome.result.Duplicates
+			}
+			if outcome.result.Dropped > result.Dropped {
+				result.Dropped = outcome.result.Dropped
+			}
+			if outcome.result.Queued > result.Queued {
+				result.Queued = outcome.result.Queued
+			}
+		}
+	}
+	result.Message = strings.Join(messages, "; ")
+
+	code, err := w.applyPolicy(outcomes)
+	result.ResultCode = code
+	return result, err
+}
+
+// reads from the first backend able to read records back
+func (w *MultiConnection) Read(ctx context.Context, filter *RecordFilter, logger *cli.Logger) ([]TelemetryRecord, *Result, error) {
+	var lastErr error
+	for idx, child := range w.children {
+		records, result, err := child.Read(ctx, filter, logger)
+		if err == nil {
+			return records, result, nil
+		}
+		w.logConfig().structured(logger).Debug("reading failed", "backend", w.labels[idx], "error", err)
+		lastErr = err
+	}
+	return nil, nil, lastErr
+}
+
+// streams from the first backend able to stream records, the next one
+// is tried only while nothing has been streamed yet
+func (w *MultiConnection) ReadStream(ctx context.Context, filter *RecordFilter, logger *cli.Logger) (<-chan TelemetryRecord, <-chan error) {
+	return newRecordStream(ctx, func(send func(TelemetryRecord) bool) error {
+		var lastErr error
+		for idx, child := range w.children {
+			records, errs := child.ReadStream(ctx, filter, logger)
+			streamed := false
+			for logrec := range records {
+				streamed = true
+				if !send(logrec) {
+					return nil
+				}
+			}
+			err := <-errs
+			if err == nil || streamed {
+				return err
+			}
+			w.logConfig().structured(logger).Debug("streaming failed", "backend", w.labels[idx], "error", err)
+			lastErr = err
+		}
+		return lastErr
+	})
+}
+
+// aggregates on the first backend able to aggregate records
+func (w *MultiConnection) AggregateCommandCounts(ctx context.Context, from time.Time, to time.Time) (map[string]int, error) {
+	var lastErr error
+	for _, child := range w.children {
+		counts, err := child.AggregateCommandCounts(ctx, from, to)
+		if err == nil {
+			return counts, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// reads from the first backend able to read recent records
+func (w *MultiConnection) RecentByUser(ctx context.Context, username string, n int) ([]TelemetryRecord, error) {
+	var lastErr error
+	for _, child := range w.children {
+		records, err := child.RecentByUser(ctx, username, n)
+		if err == nil {
+			return records, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// user data and old records are removed from every backend regardless
+// of the policy
+func (w *MultiConnection) DeleteByUser(ctx context.Context, username string) (*Result, error) {
+	return w.fanOutAffected(func(child Connection) (*Result, error) {
+		return child.DeleteByUser(ctx, username)
+	})
+}
+
+func (w *MultiConnection) AnonymizeUser(ctx context.Context, username string) (*Result, error) {
+	return w.fanOutAffected(func(child Connection) (*Result, error) {
+		return child.AnonymizeUser(ctx, username)
+	})
+}
+
+func (w *MultiConnection) PurgeOlderThan(ctx context.Context, cutoff time.Time) (*Result, error) {
+	return w.fanOutAffected(func(child Connection) (*Result, error) {
+		return child.PurgeOlderThan(ctx, cutoff)
+	})
+}
+
+func (w *MultiConnection) fanOutAffected(op func(child Connection) (*Result, error)) (*Result, error) {
+	outcomes := w.fanOut(op)
+
+	result := &Result{}
+	messages := make([]string, 0, len(outcomes))
+	failures := make([]string, 0)
+	for _, outcome := range outcomes {
+		if outcome.err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", outcome.label, outcome.err))
+			messages = append(messages, fmt.Sprintf("%s: failed: %v", outcome.label, outcome.err))
+			continue
+		}
+		if outcome.result != nil {
+			result.Affected += outcome.result.Affected
+			messages = append(messages, fmt.Sprintf("%s: %s", outcome.label, outcome.result.Message))
+		}
+	}
+	result.Message = strings.Join(messages, "; ")
+
+	if len(failures) > 0 {
+		return result, errors.Errorf(
+			"%d of %d backends failed: %s",
+			len(failures), len(outcomes), strings.Join(failures, "; "))
+	}
+	return result, nil
+}
+
+func (w *MultiConnection) Close() error {
+	var firstErr error
+	for idx, child := range w.children {
+		if err := child.Close(); err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "closing %s", w.labels[idx])
+		}
+	}
+	return firstErr
+}
+
+// runs the operation on every child concurrently, outcomes keep the
+// order of the children
+func (w *MultiConnection) fanOut(op func(child Connection) (*Result, error)) []childOutcome {
+	outcomes := make([]childOutcome, len(w.children))
+	var wg sync.WaitGroup
+	for idx, child := range w.children {
+		wg.Add(1)
+		go func(idx int, child Connection) {
+			defer wg.Done()
+			result, err := op(child)
+			outcomes[idx] = childOutcome{label: w.labels[idx], result: result, err: err}
+		}(idx, child)
+	}
+	wg.Wait()
+	return outcomes
+}
+
+// result code and error of the combined outcomes under the policy.
+// the code is the one all succeeding backends agree on, otherwise ResultOK
+func (w *MultiConnection) applyPolicy(outcomes []childOutcome) (int, error) {
+	failures := make([]string, 0)
+	codes := make(map[int]bool)
+	for _, outcome := range outcomes {
+		if outcome.err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", outcome.label, outcome.err))
+		} else if outcome.result != nil {
+			codes[outcome.result.ResultCode] = true
+		}
+	}
+
+	failed := len(failures) > 0
+	if w.policy == FanOutRequireAny {
+		failed = len(failures) == len(outcomes)
+	}
+	if failed {
+		return ResultOK, errors.Errorf(
+			"%d of %d backends failed: %s",
+			len(failures), len(outcomes), strings.Join(failures, "; "))
+	}
+
+	if len(codes) == 1 {
+		for code := range codes {
+			return code, nil
+		}
+	}
+	return ResultOK, nil
+}
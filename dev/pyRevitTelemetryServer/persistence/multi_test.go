@@ -0,0 +1,122 @@
+package persistence
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// fan-out to a healthy memory backend and a failing one
+func newTestMultiConnection(t *testing.T, policy string) (*MultiConnection, *MemoryConnection, *failingConnection) {
+	t.Helper()
+	healthy := NewMemoryConnection(&Config{ScriptTarget: "scripts", EventTarget: "events"})
+	failing := newFailingConnection(t, errTestWrite)
+	multi := newMultiConnection([]Connection{healthy, failing}, []bool{false, false}, policy)
+	t.Cleanup(func() { multi.Close() })
+	return multi, healthy, failing
+}
+
+func TestMultiWrite(t *testing.T) {
+	for _, policy := range []string{FanOutRequireAll, FanOutRequireAny} {
+		t.Run(policy, func(t *testing.T) {
+			multi, healthy, failing := newTestMultiConnection(t, policy)
+			failing.setErr(nil)
+
+			res, err := multi.Write(context.Background(), newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"), testLogger)
+			if err != nil {
+				t.Fatalf("writing: %v", err)
+			}
+			if res.Written != 1 || res.ResultCode != ResultOK {
+				t.Errorf("result is %+v, want one record written", res)
+			}
+			for _, conn := range []Connection{healthy, failing} {
+				if records := readTestRecords(t, conn, nil); len(records) != 1 {
+					t.Errorf("backend has %d records, want 1", len(records))
+				}
+			}
+			if !strings.Contains(res.Message, "memory[0]: ") || !strings.Contains(res.Message, "memory[1]: ") {
+				t.Errorf("message %q does not report every backend", res.Message)
+			}
+		})
+	}
+}
+
+func TestMultiRequireAll(t *testing.T) {
+	multi, healthy, _ := newTestMultiConnection(t, FanOutRequireAll)
+	res, err := multi.Write(context.Background(), newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"), testLogger)
+	if err == nil {
+		t.Fatal("write failing on one backend succeeded")
+	}
+	if !strings.Contains(err.Error(), "1 of 2 backends failed: memory[1]: backend is down") {
+		t.Errorf("error %q does not name the failed backend", err)
+	}
+	if !strings.Contains(res.Message, "memory[1]: failed: backend is down") {
+		t.Errorf("message %q does not report the failure", res.Message)
+	}
+	// the healthy backend keeps the record
+	if records := readTestRecords(t, healthy, nil); len(records) != 1 {
+		t.Errorf("healthy backend has %d records, want 1", len(records))
+	}
+}
+
+func TestMultiRequireAny(t *testing.T) {
+	multi, _, _ := newTestMultiConnection(t, FanOutRequireAny)
+	res, err := multi.Write(context.Background(), newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"), testLogger)
+	if err != nil {
+		t.Fatalf("write stored by one backend failed: %v", err)
+	}
+	if res.Written != 1 || !strings.Contains(res.Message, "memory[1]: failed: backend is down") {
+		t.Errorf("result is %+v, want one record written and the failure reported", res)
+	}
+
+	failing := newFailingConnection(t, errTestWrite)
+	other := newFailingConnection(t, errTestWrite)
+	down := newMultiConnection([]Connection{failing, other}, []bool{false, false}, FanOutRequireAny)
+	if _, dErr := down.Write(context.Background(), newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"), testLogger); dErr == nil || !strings.Contains(dErr.Error(), "2 of 2 backends failed") {
+		t.Errorf("write failing on every backend returned %v", dErr)
+	}
+}
+
+func TestNewMultiConnection(t *testing.T) {
+	memory := func() *Config {
+		return &Config{Backend: Memory, ConnString: "memory:", ScriptTarget: "scripts"}
+	}
+	if _, err := NewMultiConnection(nil, FanOutRequireAll); err == nil {
+		t.Error("fan-out without backends was created")
+	}
+	if _, err := NewMultiConnection([]*Config{memory()}, "most"); err == nil {
+		t.Error("unknown policy was accepted")
+	}
+	if _, err := NewMultiConnection([]*Config{memory(), {Backend: "oracle"}}, FanOutRequireAll); err == nil {
+		t.Error("fan-out with an invalid backend was created")
+	}
+
+	multi, err := NewMultiConnection([]*Config{memory(), memory()}, "")
+	if err != nil {
+		t.Fatalf("creating: %v", err)
+	}
+	defer multi.Close()
+	if multi.policy != FanOutRequireAll {
+		t.Errorf("policy is %q, want %q by default", multi.policy, FanOutRequireAll)
+	}
+	if multi.GetType() != Multi || strings.Join(multi.labels, ",") != "memory[0],memory[1]" {
+		t.Errorf("fan-out is %s with labels %v", multi.GetType(), multi.labels)
+	}
+}
+
+// reads fall back to the next backend, deletes go to all of them
+func TestMultiReadAndDelete(t *testing.T) {
+	multi, healthy, failing := newTestMultiConnection(t, FanOutRequireAny)
+	failing.setErr(nil)
+	writeTestRecords(t, multi, newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"))
+
+	healthy.Close()
+	if records := readTestRecords(t, multi, nil); len(records) != 1 {
+		t.Errorf("read %d records from the open backend, want 1", len(records))
+	}
+
+	res, err := multi.DeleteByUser(context.Background(), "jane")
+	if err == nil || res.Affected != 1 {
+		t.Errorf("deleting across an open and a closed backend returned %+v, %v", res, err)
+	}
+}
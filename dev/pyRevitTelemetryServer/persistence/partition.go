@@ -0,0 +1,287 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"../cli"
+	"github.com/pkg/errors"
+)
+
+// partition months are the utc months of the record timestamps
+const partitionMonthLayout = "2006-01"
+
+// postgres partitioned table over the timestamp column
+func generatePartitionedTableQuery(table string, columns []string) string {
+	definitions := generateColumnDefinitions(Postgres, columns, false)
+	definitions = append(definitions, `PRIMARY KEY ("id", "timestamp")`)
+	return fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s (%s) PARTITION BY RANGE ("timestamp")`,
+		table, strings.Join(definitions, ", "))
+}
+
+// table_2006_01 holding the records of the given utc month
+func generateCreatePartitionQuery(table string, parent string, month time.Time) string {
+	return fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')",
+		partitionName(table, month),
+		parent,
+		month.Format(time.RFC3339),
+		month.AddDate(0, 1, 0).Format(time.RFC3339))
+}
+
+func partitionName(table string, month time.Time) string {
+	return fmt.Sprintf("%s_%s", table, month.Format("2006_01"))
+}
+
+// current and next month, so writes never wait on a partition at month end
+func upcomingPartitionMonths() []time.Time {
+	now := time.Now().UTC()
+	current := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return []time.Time{current, current.AddDate(0, 1, 0)}
+}
+
+// utc month of the stored timestamp, false for records without one
+func recordPartitionMonth(logrec TelemetryRecord) (time.Time, bool) {
+	timestamp := ""
+	switch rec := logrec.(type) {
+	case *ScriptTelemetryRecordV2:
+		timestamp = rec.TimeStamp
+	case *EventTelemetryRecordV2:
+		timestamp = rec.TimeStamp
+	}
+	parsed, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return time.Time{}, false
+	}
+	parsed = parsed.UTC()
+	return time.Date(parsed.Year(), parsed.Month(), 1, 0, 0, 0, 0, time.UTC), true
+}
+
+// month of yyyy-mm text
+func parsePartitionMonth(timestamp string) (time.Time, bool) {
+	if len(timestamp) < len(partitionMonthLayout) {
+		return time.Time{}, false
+	}
+	month, err := time.Parse(partitionMonthLayout, timestamp[:len(partitionMonthLayout)])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return month, true
+}
+
+// creates the partitions of the upcoming months and of the months the
+// records fall in, partitions created earlier are remembered
+func (w *GenericSQLConnection) ensurePartitions(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) error {
+	log := w.Config.structured(logger)
+
+	months := upcomingPartitionMonths()
+	for _, logrec := range logrecs {
+		if month, ok := recordPartitionMonth(logrec); ok {
+			months = append(months, month)
+		}
+	}
+
+	w.migrateMutex.Lock()
+	defer w.migrateMutex.Unlock()
+
+	for _, table := range w.schemaTables() {
+		for _, month := range months {
+			name := partitionName(table.name, month)
+			if w.partitions[name] {
+				continue
+			}
+
+			log.Debug("ensuring partition exists", "partition", name)
+			query := generateCreatePartitionQuery(table.name, table.name, month)
+			log.Trace(query)
+			if _, err := w.db.ExecContext(ctx, query); err != nil {
+				return wrapContextError(ctx, err)
+			}
+			w.partitions[name] = true
+		}
+	}
+	return nil
+}
+
+// existing plain tables are not converted implicitly since that copies
+// every row, operators run MigrateToPartitioned instead
+func (w *GenericSQLConnection) checkPartitioned(ctx context.Context, table string) error {
+	kind, err := w.tableKind(ctx, table)
+	if err != nil {
+		return wrapContextError(ctx, err)
+	}
+	if kind != "p" {
+		return errors.Errorf(
+			"table %s is not partitioned, migrate it with MigrateToPartitioned", table)
+	}
+	return nil
+}
+
+// converts existing plain script and event tables to monthly partitioned
+// tables, copying their rows. each table is converted in a transaction
+// and tables that are missing or already partitioned are skipped
+func (w *GenericSQLConnection) MigrateToPartitioned(ctx context.Context, logger *cli.Logger) error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+	defer w.end()
+
+	log := w.Config.structured(logger)
+
+	if !w.Config.Partitioning {
+		return errors.New("partitioning is not enabled")
+	}
+
+	w.migrateMutex.Lock()
+	defer w.migrateMutex.Unlock()
+
+	for _, table := range w.schemaTables() {
+		kind, kErr := w.tableKind(ctx, table.name)
+		if kErr != nil {
+			return wrapContextError(ctx, kErr)
+		}
+		if kind != "r" {
+			log.Debug("table does not need migration", "table", table.name)
+			continue
+		}
+
+		// the copy selects every column, columns added by migrations may
+		// be missing on old tables
+		for _, column := range table.columns {
+			if column != extrasColumn && column != "duration" {
+				continue
+			}
+			if eErr := w.ensureColumn(ctx, table.name, column, logger); eErr != nil {
+				return eErr
+			}
+		}
+
+		log.Debug("migrating table to partitions", "table", table.name)
+		months, mErr := w.migratePartitionedTable(ctx, table.name, table.columns, logger)
+		if mErr != nil {
+			return wrapContextError(ctx, errors.Wrapf(mErr, "migrating table %s", table.name))
+		}
+		for _, month := range months {
+			w.partitions[partitionName(table.name, month)] = true
+		}
+	}
+	return nil
+}
+
+// builds the partitioned table next to the existing one, copies the rows
+// and swaps the tables. returns the months partitions were created for.
+// the existing table may be partitioned already, its timestamps may still
+// be text and are cast. the new partitions are named after the staging
+// table until the old ones are dropped with their table
+func (w *GenericSQLConnection) migratePartitionedTable(ctx context.Context, table string, columns []string, logger *cli.Logger) ([]time.Time, error) {
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	staging := table + "_partitioned"
+	queries := []string{generatePartitionedTableQuery(staging, columns)}
+
+	months, mErr := existingPartitionMonths(ctx, tx, table)
+	if mErr != nil {
+		return nil, mErr
+	}
+	for _, month := range months {
+		queries = append(queries, generateCreatePartitionQuery(staging, staging, month))
+	}
+
+	quoted := make([]string, 0, len(columns))
+	selected := make([]string, 0, len(columns))
+	for _, column := range columns {
+		quoted = append(quoted, quoteSQLColumn(Postgres, column))
+		if column == "timestamp" {
+			selected = append(selected, `CAST("timestamp" AS TIMESTAMPTZ)`)
+			continue
+		}
+		selected = append(selected, quoteSQLColumn(Postgres, column))
+	}
+
+	// rename takes the bare table name, the schema stays the same
+	bareName := func(name string) string { return name[strings.LastIndex(name, ".")+1:] }
+	queries = append(queries,
+		fmt.Sprintf(
+			"INSERT INTO %s (%s) SELECT %s FROM %s",
+			staging, strings.Join(quoted, ", "), strings.Join(selected, ", "), table),
+		fmt.Sprintf("DROP TABLE %s", table),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", staging, bareName(table)),
+	)
+	for _, month := range months {
+		queries = append(queries, fmt.Sprintf(
+			"ALTER TABLE %s RENAME TO %s",
+			partitionName(staging, month), bareName(partitionName(table, month))))
+	}
+	// the index went with the dropped table, partitions inherit the new one
+	queries = append(queries, generateTimestampIndexQuery(Postgres, table, true))
+
+	for _, query := range queries {
+		w.Config.structured(logger).Trace(query)
+		if _, qErr := tx.ExecContext(ctx, query); qErr != nil {
+			return nil, qErr
+		}
+	}
+
+	if cErr := tx.Commit(); cErr != nil {
+		return nil, cErr
+	}
+	return months, nil
+}
+
+// utc months of the rows in a table, plus the upcoming ones
+func existingPartitionMonths(ctx context.Context, tx *sql.Tx, table string) ([]time.Time, error) {
+	query := fmt.Sprintf(
+		`SELECT DISTINCT to_char(CAST("timestamp" AS TIMESTAMPTZ) AT TIME ZONE 'UTC', 'YYYY-MM') FROM %s`, table)
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := make(map[time.Time]bool)
+	for _, month := range upcomingPartitionMonths() {
+		seen[month] = true
+	}
+	for rows.Next() {
+		var prefix sql.NullString
+		if sErr := rows.Scan(&prefix); sErr != nil {
+			return nil, sErr
+		}
+		month, ok := parsePartitionMonth(prefix.String)
+		if !ok {
+			return nil, errors.Errorf("rows with invalid timestamp %q can not be partitioned", prefix.String)
+		}
+		seen[month] = true
+	}
+	if rErr := rows.Err(); rErr != nil {
+		return nil, rErr
+	}
+
+	months := make([]time.Time, 0, len(seen))
+	for month := range seen {
+		months = append(months, month)
+	}
+	sort.Slice(months, func(i, j int) bool { return months[i].Before(months[j]) })
+	return months, nil
+}
+
+// relkind of the table, r for plain and p for partitioned tables
+// empty when the table does not exist
+func (w *GenericSQLConnection) tableKind(ctx context.Context, table string) (string, error) {
+	var kind string
+	err := w.db.QueryRowContext(
+		ctx, "SELECT relkind FROM pg_class WHERE oid = to_regclass($1)", table).Scan(&kind)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return kind, err
+}
@@ -0,0 +1,143 @@
+package persistence
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateCreatePartitionQuery(t *testing.T) {
+	tests := []struct {
+		month time.Time
+		want  string
+	}{
+		{time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC), "CREATE TABLE IF NOT EXISTS scripts_2021_06 PARTITION OF scripts FOR VALUES FROM ('2021-06-01T00:00:00Z') TO ('2021-07-01T00:00:00Z')"},
+		{time.Date(2021, 12, 1, 0, 0, 0, 0, time.UTC), "CREATE TABLE IF NOT EXISTS scripts_2021_12 PARTITION OF scripts FOR VALUES FROM ('2021-12-01T00:00:00Z') TO ('2022-01-01T00:00:00Z')"},
+	}
+	for _, test := range tests {
+		if query := generateCreatePartitionQuery("scripts", "scripts", test.month); query != test.want {
+			t.Errorf("generated %s, want %s", query, test.want)
+		}
+	}
+
+	query := generatePartitionedTableQuery("scripts", scriptColumnsV2)
+	for _, want := range []string{`PRIMARY KEY ("id", "timestamp")`, `PARTITION BY RANGE ("timestamp")`, `"timestamp" TIMESTAMPTZ,`, `"id" VARCHAR(36) NOT NULL,`} {
+		if !strings.Contains(query, want) {
+			t.Errorf("%s does not contain %s", query, want)
+		}
+	}
+}
+
+func TestParsePartitionMonth(t *testing.T) {
+	tests := []struct {
+		timestamp string
+		want      time.Time
+		ok        bool
+	}{
+		{"2021-06-01T10:00:00Z", time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC), true},
+		{"2021-06-30T23:59:59.999Z", time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC), true},
+		{"2021", time.Time{}, false},
+		{"", time.Time{}, false},
+		{"yesterday", time.Time{}, false},
+	}
+	for _, test := range tests {
+		month, ok := parsePartitionMonth(test.timestamp)
+		if ok != test.ok || !month.Equal(test.want) {
+			t.Errorf("month of %q is %v %v, want %v %v", test.timestamp, month, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestUpcomingPartitionMonths(t *testing.T) {
+	now := time.Now().UTC()
+	months := upcomingPartitionMonths()
+	if len(months) != 2 {
+		t.Fatalf("got %d months, want the current and the next", len(months))
+	}
+	if months[0].Year() != now.Year() || months[0].Month() != now.Month() || months[0].Day() != 1 {
+		t.Errorf("first month is %v, want the start of the current month", months[0])
+	}
+	if !months[1].Equal(months[0].AddDate(0, 1, 0)) {
+		t.Errorf("second month is %v, want the one after %v", months[1], months[0])
+	}
+}
+
+func TestPartitioningRequiresPostgres(t *testing.T) {
+	dbcfg := &Config{Backend: Sqlite, ConnString: "sqlite3::memory:", ScriptTarget: "scripts", Partitioning: true}
+	if conn, err := NewConnection(dbcfg); err == nil {
+		conn.Close()
+		t.Error("partitioning was accepted for sqlite")
+	}
+}
+
+func TestPartitioning(t *testing.T) {
+	conn := newTestSQLServerConnection(t, envTestPostgres, Config{Partitioning: true})
+	writeTestRecords(t, conn,
+		newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"),
+		newTestScriptRecord("jane", "jane.doe", "2021-07-01T10:00:00Z"),
+		newTestEventRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"))
+
+	sqlConn, _ := unwrapSQLConnection(conn)
+	checkTestPartitions(t, sqlConn, sqlConn.Config.ScriptTarget, "2021-06", "2021-07")
+	checkTestPartitions(t, sqlConn, sqlConn.Config.EventTarget, "2021-06")
+	if records := readTestRecords(t, conn, nil); len(records) != 2 {
+		t.Errorf("found %d records, want 2", len(records))
+	}
+}
+
+// plain tables are kept until they are migrated, the rows are copied
+func TestMigrateToPartitioned(t *testing.T) {
+	plain := newTestSQLServerConnection(t, envTestPostgres, Config{})
+	writeTestRecords(t, plain,
+		newTestScriptRecord("jane", "jane.doe", "2021-05-01T10:00:00Z"),
+		newTestEventRecord("jane", "jane.doe", "2021-05-01T10:00:00Z"))
+	plainConn, _ := unwrapSQLConnection(plain)
+
+	conn := newTestSQLServerConnection(t, envTestPostgres, Config{
+		Partitioning: true,
+		ScriptTarget: plainConn.Config.ScriptTarget,
+		EventTarget:  plainConn.Config.EventTarget,
+	})
+	sqlConn, _ := unwrapSQLConnection(conn)
+	if err := sqlConn.EnsureSchema(context.Background(), testLogger); err == nil {
+		t.Fatal("plain tables were used as partitioned")
+	}
+
+	if err := sqlConn.MigrateToPartitioned(context.Background(), testLogger); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	if err := sqlConn.MigrateToPartitioned(context.Background(), testLogger); err != nil {
+		t.Fatalf("migrating again: %v", err)
+	}
+	checkTestPartitions(t, sqlConn, sqlConn.Config.ScriptTarget, "2021-05")
+	checkTestPartitions(t, sqlConn, sqlConn.Config.EventTarget, "2021-05")
+	if kind, err := sqlConn.tableKind(context.Background(), timestampIndexName(sqlConn.Config.ScriptTarget)); err != nil || kind != "I" {
+		t.Errorf("timestamp index has kind %q: %v, want a partitioned index", kind, err)
+	}
+
+	writeTestRecords(t, conn, newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"))
+	if records := readTestRecords(t, conn, nil); len(records) != 2 {
+		t.Errorf("found %d records, want the copied and the new one", len(records))
+	}
+}
+
+// table is partitioned and has a partition for every month, yyyy-mm
+func checkTestPartitions(t *testing.T, sqlConn *GenericSQLConnection, table string, months ...string) {
+	t.Helper()
+	kind, err := sqlConn.tableKind(context.Background(), table)
+	if err != nil {
+		t.Fatalf("checking %s: %v", table, err)
+	}
+	if kind != "p" {
+		t.Errorf("table %s has kind %q, want partitioned", table, kind)
+	}
+
+	for _, value := range months {
+		month, _ := time.Parse(partitionMonthLayout, value)
+		partition := partitionName(table, month)
+		if partKind, pErr := sqlConn.tableKind(context.Background(), partition); pErr != nil || partKind != "r" {
+			t.Errorf("partition %s has kind %q: %v", partition, partKind, pErr)
+		}
+	}
+}
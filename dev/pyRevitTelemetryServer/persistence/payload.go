@@ -0,0 +1,62 @@
+package persistence
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// checks raw payloads against the json schema at Config.RecordSchemaPath
+// before they are unmarshaled into records, so payloads of newer or older
+// clients that lost their shape are rejected at the edge
+type PayloadValidator struct {
+	schema *gojsonschema.Schema
+}
+
+// nil validator when no schema is configured, it accepts every payload
+func NewPayloadValidator(dbcfg *Config) (*PayloadValidator, error) {
+	if dbcfg.RecordSchemaPath == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(dbcfg.RecordSchemaPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "record schema can not be read")
+	}
+	schema, sErr := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(data))
+	if sErr != nil {
+		return nil, errors.Wrapf(sErr, "record schema %s is invalid", dbcfg.RecordSchemaPath)
+	}
+	return &PayloadValidator{schema: schema}, nil
+}
+
+// rejected payloads get a validation failed result listing every problem
+func (v *PayloadValidator) Validate(payload []byte) (*Result, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	validation, err := v.schema.Validate(gojsonschema.NewBytesLoader(payload))
+	if err != nil {
+		return &Result{
+			ResultCode: ResultValidationFailed,
+			Message:    fmt.Sprintf("payload is not valid json: %v", err),
+		}, err
+	}
+	if validation.Valid() {
+		return nil, nil
+	}
+
+	problems := make([]string, 0, len(validation.Errors()))
+	for _, problem := range validation.Errors() {
+		problems = append(problems, problem.String())
+	}
+	err = errors.Errorf("payload does not match the record schema: %s", strings.Join(problems, "; "))
+	return &Result{
+		ResultCode: ResultValidationFailed,
+		Message:    err.Error(),
+	}, err
+}
@@ -0,0 +1,98 @@
+package persistence
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sample schema of v2 script payloads
+const testRecordSchema = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"type": "object",
+	"required": ["meta", "timestamp", "username", "commandname"],
+	"properties": {
+		"meta": {
+			"type": "object",
+			"required": ["schema"],
+			"properties": {"schema": {"const": "2.0"}}
+		},
+		"timestamp": {"type": "string", "format": "date-time"},
+		"username": {"type": "string", "minLength": 1},
+		"commandname": {"type": "string"},
+		"resultcode": {"type": "integer"}
+	}
+}`
+
+func newTestPayloadValidator(t *testing.T, schema string) *PayloadValidator {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "record.schema.json")
+	if err := ioutil.WriteFile(path, []byte(schema), 0644); err != nil {
+		t.Fatalf("writing schema: %v", err)
+	}
+	validator, err := NewPayloadValidator(&Config{RecordSchemaPath: path})
+	if err != nil {
+		t.Fatalf("loading schema: %v", err)
+	}
+	return validator
+}
+
+func TestPayloadValidator(t *testing.T) {
+	validator := newTestPayloadValidator(t, testRecordSchema)
+
+	valid := `{"meta": {"schema": "2.0"}, "timestamp": "2021-06-01T10:00:00Z", "username": "jane", "commandname": "Sync", "resultcode": 0}`
+	if res, err := validator.Validate([]byte(valid)); err != nil || res != nil {
+		t.Errorf("valid payload is rejected with %+v: %v", res, err)
+	}
+
+	tests := []struct {
+		name     string
+		payload  string
+		problems []string
+	}{
+		{"missing fields", `{"meta": {"schema": "2.0"}, "timestamp": "2021-06-01T10:00:00Z"}`, []string{"username", "commandname"}},
+		{"wrong schema", `{"meta": {"schema": "1.0"}, "timestamp": "2021-06-01T10:00:00Z", "username": "jane", "commandname": "Sync"}`, []string{"meta.schema"}},
+		{"wrong type", `{"meta": {"schema": "2.0"}, "timestamp": "2021-06-01T10:00:00Z", "username": "jane", "commandname": "Sync", "resultcode": "ok"}`, []string{"resultcode"}},
+		{"not json", `{"meta": `, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := validator.Validate([]byte(test.payload))
+			if err == nil {
+				t.Fatal("invalid payload passed")
+			}
+			if res == nil || res.ResultCode != ResultValidationFailed {
+				t.Errorf("result is %+v, want validation failed", res)
+			}
+			for _, problem := range test.problems {
+				if !strings.Contains(err.Error(), problem) {
+					t.Errorf("error %v does not name %s", err, problem)
+				}
+			}
+		})
+	}
+}
+
+// without a schema every payload passes
+func TestPayloadValidatorWithoutSchema(t *testing.T) {
+	validator, err := NewPayloadValidator(&Config{})
+	if err != nil || validator != nil {
+		t.Fatalf("validator without schema is %v with %v", validator, err)
+	}
+	if res, vErr := validator.Validate([]byte(`not json`)); res != nil || vErr != nil {
+		t.Errorf("payload is rejected with %+v: %v", res, vErr)
+	}
+}
+
+func TestPayloadValidatorInvalidSchema(t *testing.T) {
+	if _, err := NewPayloadValidator(&Config{RecordSchemaPath: filepath.Join(t.TempDir(), "missing.json")}); err == nil {
+		t.Error("missing schema file was loaded")
+	}
+
+	path := filepath.Join(t.TempDir(), "record.schema.json")
+	ioutil.WriteFile(path, []byte(`{"type": 5}`), 0644)
+	if _, err := NewPayloadValidator(&Config{RecordSchemaPath: path}); err == nil || !strings.Contains(err.Error(), "is invalid") {
+		t.Errorf("invalid schema is loaded with %v", err)
+	}
+}
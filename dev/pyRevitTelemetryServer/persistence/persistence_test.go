@@ -0,0 +1,251 @@
+package persistence
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"../cli"
+	uuid "github.com/satori/go.uuid"
+)
+
+// servers the tests run against when set, e.g. mongodb://localhost:27017/telemetry
+const (
+	envTestMongo    = "PYREVIT_TELEMETRY_TEST_MONGODB"
+	envTestPostgres = "PYREVIT_TELEMETRY_TEST_POSTGRES"
+	envTestMySql    = "PYREVIT_TELEMETRY_TEST_MYSQL"
+	envTestMSSql    = "PYREVIT_TELEMETRY_TEST_MSSQL"
+)
+
+// sql servers of the dialects the sql tests run against
+var testSQLServers = []struct {
+	backend DBBackend
+	env     string
+}{
+	{Postgres, envTestPostgres},
+	{MySql, envTestMySql},
+	{MSSql, envTestMSSql},
+}
+
+var testLogger = &cli.Logger{}
+
+// connection through NewConnection with the script and event targets set,
+// closed when the test ends
+func newTestConnection(t testing.TB, dbcfg Config) Connection {
+	t.Helper()
+	if dbcfg.ScriptTarget == "" {
+		dbcfg.ScriptTarget = "scripts"
+	}
+	if dbcfg.EventTarget == "" {
+		dbcfg.EventTarget = "events"
+	}
+	conn, err := NewConnection(&dbcfg)
+	if err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// sqlite database in the temp dir of the test
+func newTestSqliteConnection(t *testing.T, dbcfg Config) Connection {
+	t.Helper()
+	dbcfg.Backend = Sqlite
+	dbcfg.ConnString = "sqlite3:" + filepath.Join(t.TempDir(), "telemetry.db")
+	return newTestConnection(t, dbcfg)
+}
+
+// sqlite database in memory, shared by the connections of the pool as
+// long as one of them is open
+func newTestSqliteMemoryConnection(t *testing.T, dbcfg Config) Connection {
+	t.Helper()
+	dbcfg.Backend = Sqlite
+	dbcfg.ConnString = "sqlite3:file:" + uuid.Must(uuid.NewV4()).String() + "?mode=memory&cache=shared"
+	return newTestConnection(t, dbcfg)
+}
+
+// sql server named by env, the test is skipped without one. tables are
+// named randomly unless the script target is set, they are dropped when
+// the test ends
+func newTestSQLServerConnection(t testing.TB, env string, dbcfg Config) Connection {
+	t.Helper()
+	connString := os.Getenv(env)
+	if connString == "" {
+		t.Skipf("%s is not set", env)
+	}
+	backend, err := parseUri(connString)
+	if err != nil {
+		t.Fatalf("parsing %s: %v", env, err)
+	}
+	dbcfg.Backend = backend
+	dbcfg.ConnString = connString
+	if dbcfg.ScriptTarget == "" {
+		dbcfg.ScriptTarget = "scripts_" + uuid.Must(uuid.NewV4()).String()[:8]
+		dbcfg.EventTarget = "events_" + uuid.Must(uuid.NewV4()).String()[:8]
+	}
+	conn := newTestConnection(t, dbcfg)
+	t.Cleanup(func() {
+		if sqlConn, ok := unwrapSQLConnection(conn); ok {
+			for _, table := range []string{dbcfg.ScriptTarget, dbcfg.EventTarget} {
+				sqlConn.db.Exec("DROP TABLE " + table)
+			}
+			sqlConn.db.Exec("DELETE FROM "+schemaMigrationsTable+" WHERE target = "+sqlPlaceholder(backend, 1), sqlConn.migrationTarget())
+		}
+	})
+	return conn
+}
+
+// mongodb server named by envTestMongo, the test is skipped without one.
+// the collections are dropped when the test ends
+func newTestMongoConnection(t *testing.T, dbcfg Config) Connection {
+	t.Helper()
+	connString := os.Getenv(envTestMongo)
+	if connString == "" {
+		t.Skipf("%s is not set", envTestMongo)
+	}
+	dbcfg.Backend = MongoDB
+	dbcfg.ConnString = connString
+	dbcfg.ScriptTarget = "scripts_" + uuid.Must(uuid.NewV4()).String()[:8]
+	dbcfg.EventTarget = "events_" + uuid.Must(uuid.NewV4()).String()[:8]
+	conn := newTestConnection(t, dbcfg)
+	t.Cleanup(func() {
+		if mongoConn, ok := unwrapMongoConnection(conn); ok {
+			db := mongoConn.client.Database(mongoConn.dbName)
+			db.Collection(dbcfg.ScriptTarget).Drop(context.Background())
+			db.Collection(dbcfg.EventTarget).Drop(context.Background())
+		}
+	})
+	return conn
+}
+
+// innermost mongodb connection below the wrappers
+func unwrapMongoConnection(conn Connection) (*MongoDBConnection, bool) {
+	for {
+		if mongoConn, ok := conn.(*MongoDBConnection); ok {
+			return mongoConn, true
+		}
+		inner, ok := innerConnection(conn)
+		if !ok {
+			return nil, false
+		}
+		conn = inner
+	}
+}
+
+// memory backend failing writes with err while it is set. with fails set
+// only the matching records fail and the outcome of every record is
+// reported, the others are written
+type failingConnection struct {
+	*MemoryConnection
+
+	mutex  sync.Mutex
+	err    error
+	fails  func(TelemetryRecord) bool
+	writes int
+}
+
+func newFailingConnection(t *testing.T, err error) *failingConnection {
+	memory := NewMemoryConnection(&Config{ScriptTarget: "scripts", EventTarget: "events"})
+	t.Cleanup(func() { memory.Close() })
+	return &failingConnection{MemoryConnection: memory, err: err}
+}
+
+func (w *failingConnection) setErr(err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.err = err
+}
+
+// write calls so far, failed ones included
+func (w *failingConnection) writeCount() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.writes
+}
+
+func (w *failingConnection) Write(ctx context.Context, logrec TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.WriteBatch(ctx, []TelemetryRecord{logrec}, logger)
+}
+
+func (w *failingConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	w.mutex.Lock()
+	w.writes++
+	err, fails := w.err, w.fails
+	w.mutex.Unlock()
+
+	if err == nil {
+		return w.MemoryConnection.WriteBatch(ctx, logrecs, logger)
+	}
+	if fails == nil {
+		return nil, err
+	}
+
+	result := &Result{Records: newRecordResults(len(logrecs))}
+	for idx, logrec := range logrecs {
+		if fails(logrec) {
+			result.Records[idx].Err = err
+			continue
+		}
+		written, wErr := w.MemoryConnection.Write(ctx, logrec, logger)
+		if wErr != nil {
+			result.Records[idx].Err = wErr
+			continue
+		}
+		result.Written += written.Written
+	}
+	if countFailedRecords(result.Records) == 0 {
+		return result, nil
+	}
+	return result, err
+}
+
+// valid v2 script record of the user, timestamp is rfc3339
+func newTestScriptRecord(username string, hostUserName string, timestamp string) *ScriptTelemetryRecordV2 {
+	return &ScriptTelemetryRecordV2{
+		RecordMeta:     RecordMetaV2{SchemaVersion: "2.0"},
+		TimeStamp:      timestamp,
+		UserName:       username,
+		HostUserName:   hostUserName,
+		RevitVersion:   "2023",
+		RevitBuild:     "20220401_1500(x64)",
+		SessionId:      uuid.Must(uuid.NewV4()).String(),
+		CommandName:    "Sync",
+		ExtensionName:  "pyRevitTools",
+		CommandResults: map[string]interface{}{},
+		TraceInfo: TraceInfoV2{
+			EngineInfo: EngineInfoV2{Type: "ironpython", Version: "2.7.12"},
+		},
+	}
+}
+
+// valid v2 event record of the user, timestamp is rfc3339
+func newTestEventRecord(username string, hostUserName string, timestamp string) *EventTelemetryRecordV2 {
+	return &EventTelemetryRecordV2{
+		RecordMeta:   RecordMetaV2{SchemaVersion: "2.0"},
+		TimeStamp:    timestamp,
+		EventType:    "doc-opened",
+		EventArgs:    map[string]interface{}{},
+		UserName:     username,
+		HostUserName: hostUserName,
+		RevitVersion: "2023",
+		RevitBuild:   "20220401_1500(x64)",
+	}
+}
+
+func writeTestRecords(t testing.TB, conn Connection, logrecs ...TelemetryRecord) {
+	t.Helper()
+	if _, err := conn.WriteBatch(context.Background(), logrecs, testLogger); err != nil {
+		t.Fatalf("writing records: %v", err)
+	}
+}
+
+func readTestRecords(t *testing.T, conn Connection, filter *RecordFilter) []TelemetryRecord {
+	t.Helper()
+	records, _, err := conn.Read(context.Background(), filter, testLogger)
+	if err != nil {
+		t.Fatalf("reading records: %v", err)
+	}
+	return records
+}
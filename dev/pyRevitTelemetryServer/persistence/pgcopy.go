@@ -0,0 +1,217 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"../cli"
+	"github.com/lib/pq"
+)
+
+// batches of at least this many records are loaded with COPY on postgres
+// and bulk copy on sqlserver
+const DefaultCopyThreshold = 500
+
+type copyGroup struct {
+	table   string
+	columns []string
+	rows    [][]interface{}
+}
+
+func (w *GenericSQLConnection) useCopy(logrecs []TelemetryRecord) bool {
+	if (w.Config.Backend != Postgres && w.Config.Backend != MSSql) || w.Config.CopyThreshold < 0 {
+		return false
+	}
+	threshold := w.Config.CopyThreshold
+	if threshold == 0 {
+		threshold = DefaultCopyThreshold
+	}
+	return len(logrecs) >= threshold
+}
+
+// streams v2 records with the COPY protocol or sqlserver bulk copy, one
+// transaction per table. copy can not skip existing records, so rows are
+// copied into a temporary staging table and inserted from there skipping
+// the ids already stored, the same as inserts. v1 records have no named
+// columns and go through regular inserts
+func commitBulkCopy(ctx context.Context, db *sql.DB, dbcfg *Config, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	log := dbcfg.structured(logger)
+
+	log.Debug("grouping records for copy")
+	groups := make([]*copyGroup, 0)
+	index := make(map[string]*copyGroup)
+	others := make([]TelemetryRecord, 0)
+	for _, logrec := range logrecs {
+		columns, values, vErr := generateInsertValues(dbcfg.Backend, logrec, log)
+		if vErr != nil {
+			return nil, vErr
+		}
+		if columns == nil {
+			others = append(others, logrec)
+			continue
+		}
+
+		table := dbcfg.targetFor(logrec)
+		group, exists := index[table]
+		if !exists {
+			group = &copyGroup{table: table, columns: columns}
+			index[table] = group
+			groups = append(groups, group)
+		}
+		group.rows = append(group.rows, values)
+	}
+
+	written, duplicates := 0, 0
+	for _, group := range groups {
+		log.Debug("copying records", "records", len(group.rows), "table", group.table)
+		inserted, cErr := commitCopyGroup(ctx, db, dbcfg.Backend, group)
+		if cErr != nil {
+			return &Result{
+				Written:    written,
+				Duplicates: duplicates,
+				Message:    fmt.Sprintf("inserted %d of %d usage records", written, len(logrecs)),
+			}, wrapContextError(ctx, cErr)
+		}
+		written += inserted
+		duplicates += len(group.rows) - inserted
+	}
+
+	if len(others) > 0 {
+		queries, qErr := generateInsertQueries(dbcfg, others, logger)
+		if qErr != nil {
+			return &Result{Written: written}, qErr
+		}
+		result, iErr := commitSQL(ctx, db, nil, dbcfg, others, queries, logger)
+		if result != nil {
+			written += result.Written
+			duplicates += result.Duplicates
+		}
+		if iErr != nil {
+			return &Result{
+				Written:    written,
+				Duplicates: duplicates,
+				Message:    fmt.Sprintf("inserted %d of %d usage records", written, len(logrecs)),
+			}, iErr
+		}
+		return newWriteResult(written, duplicates, "inserted"), nil
+	}
+
+	log.Debug("preparing report")
+	return newWriteResult(written, duplicates, "inserted"), nil
+}
+
+// returns the number of rows inserted, rows with ids already stored or
+// repeated within the group are skipped
+func commitCopyGroup(ctx context.Context, db *sql.DB, backend DBBackend, group *copyGroup) (int, error) {
+	tx, beginErr := db.BeginTx(ctx, nil)
+	if beginErr != nil {
+		return 0, beginErr
+	}
+	defer tx.Rollback()
+
+	staging := generateCopyStagingQueries(backend, group)
+	if _, cErr := tx.ExecContext(ctx, staging.create); cErr != nil {
+		return 0, cErr
+	}
+
+	staged := *group
+	staged.table = staging.table
+	copyQuery := generatePostgresCopyQuery(&staged)
+	if backend == MSSql {
+		copyQuery = generateMSSqlCopyQuery(&staged)
+	}
+
+	stmt, pErr := tx.PrepareContext(ctx, copyQuery)
+	if pErr != nil {
+		return 0, pErr
+	}
+	for _, row := range group.rows {
+		if backend == MSSql {
+			row = generateMSSqlCopyValues(group.columns, row)
+		}
+		if _, eErr := stmt.ExecContext(ctx, row...); eErr != nil {
+			stmt.Close()
+			return 0, eErr
+		}
+	}
+
+	// flushes the buffered rows
+	if _, eErr := stmt.ExecContext(ctx); eErr != nil {
+		stmt.Close()
+		return 0, eErr
+	}
+	if cErr := stmt.Close(); cErr != nil {
+		return 0, cErr
+	}
+
+	res, iErr := tx.ExecContext(ctx, staging.insert)
+	if iErr != nil {
+		return 0, iErr
+	}
+	inserted := len(group.rows)
+	if affected, aErr := res.RowsAffected(); aErr == nil && int(affected) <= len(group.rows) {
+		inserted = int(affected)
+	}
+
+	if staging.drop != "" {
+		if _, dErr := tx.ExecContext(ctx, staging.drop); dErr != nil {
+			return 0, dErr
+		}
+	}
+	return inserted, tx.Commit()
+}
+
+// staging table of a copy group and the queries creating it, moving its
+// rows to the target table and dropping it
+type copyStaging struct {
+	table  string
+	create string
+	insert string
+	drop   string
+}
+
+// postgres drops the staging table on commit. sqlserver temporary tables
+// live as long as the pooled connection and are dropped by the
+// transaction, on rollback their creation is undone
+func generateCopyStagingQueries(backend DBBackend, group *copyGroup) copyStaging {
+	// unquoted names are folded to lower case by postgres, copy quotes them
+	name := strings.ToLower(group.table[strings.LastIndex(group.table, ".")+1:]) + "_copy"
+	columns := make([]string, 0, len(group.columns))
+	for _, column := range group.columns {
+		columns = append(columns, quoteSQLColumn(backend, column))
+	}
+	columnList := strings.Join(columns, ", ")
+
+	if backend == MSSql {
+		// no constraints are copied, the first row of each id is inserted
+		staging := "#" + name
+		return copyStaging{
+			table:  staging,
+			create: fmt.Sprintf("SELECT TOP 0 %s INTO %s FROM %s", columnList, staging, group.table),
+			insert: fmt.Sprintf(
+				"INSERT INTO %s (%s) SELECT %s FROM (SELECT *, ROW_NUMBER() OVER (PARTITION BY id ORDER BY (SELECT NULL)) AS copy_row FROM %s) AS v WHERE copy_row = 1 AND NOT EXISTS (SELECT 1 FROM %s WHERE %s.id = v.id)",
+				group.table, columnList, columnList, staging, group.table, group.table),
+			drop: fmt.Sprintf("DROP TABLE %s", staging),
+		}
+	}
+
+	// LIKE copies no primary key, repeated ids reach the insert and are
+	// skipped by it
+	return copyStaging{
+		table:  name,
+		create: fmt.Sprintf("CREATE TEMPORARY TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP", name, group.table),
+		insert: fmt.Sprintf(
+			"INSERT INTO %s (%s) SELECT %s FROM %s ON CONFLICT DO NOTHING",
+			group.table, columnList, columnList, name),
+	}
+}
+
+// schema qualified targets are split for CopyInSchema
+func generatePostgresCopyQuery(group *copyGroup) string {
+	if parts := strings.SplitN(group.table, ".", 2); len(parts) == 2 {
+		return pq.CopyInSchema(parts[0], parts[1], group.columns...)
+	}
+	return pq.CopyIn(group.table, group.columns...)
+}
@@ -0,0 +1,157 @@
+package persistence
+
+import (
+	"context"
+	"testing"
+)
+
+func TestUseCopy(t *testing.T) {
+	withId := newTestCopyBatch(DefaultCopyThreshold)
+	withId[0].(*ScriptTelemetryRecordV2).RecordId = "0d7b0bb6-0b8a-4a0c-9a8e-4e0f3f4b8e1a"
+
+	tests := []struct {
+		name      string
+		backend   DBBackend
+		threshold int
+		logrecs   []TelemetryRecord
+		want      bool
+	}{
+		{"postgres below default", Postgres, 0, newTestCopyBatch(DefaultCopyThreshold - 1), false},
+		{"postgres at default", Postgres, 0, newTestCopyBatch(DefaultCopyThreshold), true},
+		{"postgres at configured", Postgres, 10, newTestCopyBatch(10), true},
+		{"postgres disabled", Postgres, -1, newTestCopyBatch(DefaultCopyThreshold), false},
+		{"postgres with record ids", Postgres, 0, withId, true},
+		{"sqlserver at default", MSSql, 0, newTestCopyBatch(DefaultCopyThreshold), true},
+		{"mysql", MySql, 0, newTestCopyBatch(DefaultCopyThreshold), false},
+		{"sqlite", Sqlite, 0, newTestCopyBatch(DefaultCopyThreshold), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := &GenericSQLConnection{DatabaseConnection: DatabaseConnection{
+				Config: &Config{Backend: test.backend, CopyThreshold: test.threshold},
+			}}
+			if got := w.useCopy(test.logrecs); got != test.want {
+				t.Errorf("use copy is %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBulkCopy(t *testing.T) {
+	for _, server := range testSQLServers {
+		if server.backend == MySql {
+			continue
+		}
+		t.Run(string(server.backend), func(t *testing.T) {
+			conn := newTestSQLServerConnection(t, server.env, Config{CopyThreshold: 10})
+			res, err := conn.WriteBatch(context.Background(), newTestCopyBatch(25), testLogger)
+			if err != nil {
+				t.Fatalf("writing: %v", err)
+			}
+			if res.Written != 25 {
+				t.Errorf("wrote %d records, want 25", res.Written)
+			}
+			if records := readTestRecords(t, conn, nil); len(records) != 25 {
+				t.Errorf("found %d records, want 25", len(records))
+			}
+		})
+	}
+}
+
+// copied batches skip stored records and records repeated in the batch,
+// records without a client id get the same id on every attempt
+func TestBulkCopyDuplicates(t *testing.T) {
+	for _, server := range testSQLServers {
+		if server.backend == MySql {
+			continue
+		}
+		t.Run(string(server.backend), func(t *testing.T) {
+			conn := newTestSQLServerConnection(t, server.env, Config{})
+			logrecs := newTestCopyBatch(DefaultCopyThreshold)
+			logrecs[len(logrecs)-1] = logrecs[0]
+
+			first, err := conn.WriteBatch(context.Background(), logrecs, testLogger)
+			if err != nil {
+				t.Fatalf("writing: %v", err)
+			}
+			if first.Written != DefaultCopyThreshold-1 || first.Duplicates != 1 {
+				t.Errorf("first write is %d written and %d duplicates, want %d and 1", first.Written, first.Duplicates, DefaultCopyThreshold-1)
+			}
+
+			second, sErr := conn.WriteBatch(context.Background(), logrecs, testLogger)
+			if sErr != nil {
+				t.Fatalf("writing again: %v", sErr)
+			}
+			if second.Written != 0 || second.Duplicates != DefaultCopyThreshold || second.ResultCode != ResultAllDuplicates {
+				t.Errorf("second write is %+v, want all duplicates", second)
+			}
+			if records := readTestRecords(t, conn, nil); len(records) != DefaultCopyThreshold-1 {
+				t.Errorf("found %d records, want %d", len(records), DefaultCopyThreshold-1)
+			}
+		})
+	}
+}
+
+func TestGenerateCopyStagingQueries(t *testing.T) {
+	group := &copyGroup{table: "telemetry.Scripts", columns: []string{"id", "timestamp"}}
+	tests := []struct {
+		backend DBBackend
+		want    copyStaging
+	}{
+		{Postgres, copyStaging{
+			table:  "scripts_copy",
+			create: `CREATE TEMPORARY TABLE scripts_copy (LIKE telemetry.Scripts INCLUDING DEFAULTS) ON COMMIT DROP`,
+			insert: `INSERT INTO telemetry.Scripts ("id", "timestamp") SELECT "id", "timestamp" FROM scripts_copy ON CONFLICT DO NOTHING`,
+		}},
+		{MSSql, copyStaging{
+			table:  "#scripts_copy",
+			create: `SELECT TOP 0 [id], [timestamp] INTO #scripts_copy FROM telemetry.Scripts`,
+			insert: `INSERT INTO telemetry.Scripts ([id], [timestamp]) SELECT [id], [timestamp] FROM (SELECT *, ROW_NUMBER() OVER (PARTITION BY id ORDER BY (SELECT NULL)) AS copy_row FROM #scripts_copy) AS v WHERE copy_row = 1 AND NOT EXISTS (SELECT 1 FROM telemetry.Scripts WHERE telemetry.Scripts.id = v.id)`,
+			drop:   `DROP TABLE #scripts_copy`,
+		}},
+	}
+	for _, test := range tests {
+		t.Run(string(test.backend), func(t *testing.T) {
+			if staging := generateCopyStagingQueries(test.backend, group); staging != test.want {
+				t.Errorf("staging queries are\n%+v\nwant\n%+v", staging, test.want)
+			}
+		})
+	}
+}
+
+// compares COPY with multi-row inserts on the server of envTestPostgres,
+// an op is a batch of 1000 records
+func BenchmarkPostgresWriteBatch(b *testing.B) {
+	benchmarkWriteBatch(b, envTestPostgres)
+}
+
+// bulk copy or inserts of the threshold on the server named by env
+func benchmarkWriteBatch(b *testing.B, env string) {
+	for _, bench := range []struct {
+		name      string
+		threshold int
+	}{
+		{"copy", 1},
+		{"insert", -1},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			conn := newTestSQLServerConnection(b, env, Config{CopyThreshold: bench.threshold})
+			logrecs := newTestCopyBatch(1000)
+
+			b.ResetTimer()
+			for idx := 0; idx < b.N; idx++ {
+				if _, err := conn.WriteBatch(context.Background(), logrecs, testLogger); err != nil {
+					b.Fatalf("writing: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func newTestCopyBatch(n int) []TelemetryRecord {
+	logrecs := make([]TelemetryRecord, 0, n)
+	for idx := 0; idx < n; idx++ {
+		logrecs = append(logrecs, newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"))
+	}
+	return logrecs
+}
@@ -0,0 +1,172 @@
+package persistence
+
+import (
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// predicate operators
+const (
+	FilterEquals      = "eq"
+	FilterNotEquals   = "ne"
+	FilterIn          = "in"
+	FilterGreaterThan = "gt"
+	FilterLessThan    = "lt"
+)
+
+// condition on a record field named by its json name. eq, ne, gt and lt
+// compare against Value, in matches any of Values. gt and lt are for the
+// integer fields, resultcode and duration, the run time in milliseconds.
+// the success field is shorthand for the result code being zero
+type FieldPredicate struct {
+	Field  string        `json:"field"`
+	Op     string        `json:"op"`
+	Value  interface{}   `json:"value,omitempty"`
+	Values []interface{} `json:"values,omitempty"`
+}
+
+type filterKind string
+
+const (
+	filterText filterKind = "text"
+	filterInt  filterKind = "integer"
+	filterBool filterKind = "boolean"
+)
+
+// script record fields predicates can filter on, the names are the same
+// for json, sql columns and mongo documents
+var filterFields = map[string]struct {
+	kind filterKind
+	get  func(logrec *ScriptTelemetryRecordV2) interface{}
+}{
+	"username":          {filterText, func(r *ScriptTelemetryRecordV2) interface{} { return r.UserName }},
+	"host_user":         {filterText, func(r *ScriptTelemetryRecordV2) interface{} { return r.HostUserName }},
+	"revit":             {filterText, func(r *ScriptTelemetryRecordV2) interface{} { return r.RevitVersion }},
+	"revitbuild":        {filterText, func(r *ScriptTelemetryRecordV2) interface{} { return r.RevitBuild }},
+	"sessionid":         {filterText, func(r *ScriptTelemetryRecordV2) interface{} { return r.SessionId }},
+	"pyrevit":           {filterText, func(r *ScriptTelemetryRecordV2) interface{} { return r.PyRevitVersion }},
+	"clone":             {filterText, func(r *ScriptTelemetryRecordV2) interface{} { return r.Clone }},
+	"debug":             {filterBool, func(r *ScriptTelemetryRecordV2) interface{} { return r.IsDebugMode }},
+	"config":            {filterBool, func(r *ScriptTelemetryRecordV2) interface{} { return r.IsConfigMode }},
+	"from_gui":          {filterBool, func(r *ScriptTelemetryRecordV2) interface{} { return r.IsExecFromGUI }},
+	"exec_id":           {filterText, func(r *ScriptTelemetryRecordV2) interface{} { return r.ExecId }},
+	"commandname":       {filterText, func(r *ScriptTelemetryRecordV2) interface{} { return r.CommandName }},
+	"commanduniquename": {filterText, func(r *ScriptTelemetryRecordV2) interface{} { return r.CommandUniqueName }},
+	"commandbundle":     {filterText, func(r *ScriptTelemetryRecordV2) interface{} { return r.BundleName }},
+	"commandextension":  {filterText, func(r *ScriptTelemetryRecordV2) interface{} { return r.ExtensionName }},
+	"docname":           {filterText, func(r *ScriptTelemetryRecordV2) interface{} { return r.DocumentName }},
+	"docpath":           {filterText, func(r *ScriptTelemetryRecordV2) interface{} { return r.DocumentPath }},
+	"resultcode":        {filterInt, func(r *ScriptTelemetryRecordV2) interface{} { return int64(r.ResultCode) }},
+	"duration":          {filterInt, func(r *ScriptTelemetryRecordV2) interface{} { return int64(r.Duration) }},
+	"scriptpath":        {filterText, func(r *ScriptTelemetryRecordV2) interface{} { return r.ScriptPath }},
+}
+
+// predicate checked against its field, values are string, int64 or bool
+type fieldCondition struct {
+	field  string
+	op     string
+	values []interface{}
+}
+
+// checks the predicates, unknown fields and operators are errors
+func (filter *RecordFilter) conditions() ([]fieldCondition, error) {
+	if filter == nil {
+		return nil, nil
+	}
+	if filter.RecordType == EventRecord && len(filter.Predicates) > 0 {
+		return nil, errors.New("filter predicates are only supported on script records")
+	}
+
+	conditions := make([]fieldCondition, 0, len(filter.Predicates))
+	for _, predicate := range filter.Predicates {
+		if predicate.Field == "success" {
+			succeeded, ok := predicate.Value.(bool)
+			if predicate.Op != FilterEquals || !ok {
+				return nil, errors.New("filter on success expects eq with a boolean value")
+			}
+			op := FilterEquals
+			if !succeeded {
+				op = FilterNotEquals
+			}
+			conditions = append(conditions, fieldCondition{"resultcode", op, []interface{}{int64(0)}})
+			continue
+		}
+
+		field, exists := filterFields[predicate.Field]
+		if !exists {
+			return nil, errors.Errorf("unsupported filter field %q", predicate.Field)
+		}
+
+		values := []interface{}{predicate.Value}
+		switch predicate.Op {
+		case FilterEquals, FilterNotEquals:
+		case FilterGreaterThan, FilterLessThan:
+			if field.kind != filterInt {
+				return nil, errors.Errorf("filter on %s does not support %s", predicate.Field, predicate.Op)
+			}
+		case FilterIn:
+			if len(predicate.Values) == 0 {
+				return nil, errors.Errorf("filter on %s lists no values", predicate.Field)
+			}
+			values = predicate.Values
+		default:
+			return nil, errors.Errorf("unsupported filter operator %q", predicate.Op)
+		}
+
+		condition := fieldCondition{field: predicate.Field, op: predicate.Op}
+		for _, value := range values {
+			typed, ok := filterValue(field.kind, value)
+			if !ok {
+				return nil, errors.Errorf(
+					"filter on %s expects %s values, got %v", predicate.Field, field.kind, value)
+			}
+			condition.values = append(condition.values, typed)
+		}
+		conditions = append(conditions, condition)
+	}
+	return conditions, nil
+}
+
+// numbers decoded from json are floats
+func filterValue(kind filterKind, value interface{}) (interface{}, bool) {
+	switch kind {
+	case filterText:
+		text, ok := value.(string)
+		return text, ok
+	case filterBool:
+		flag, ok := value.(bool)
+		return flag, ok
+	}
+	switch number := value.(type) {
+	case int:
+		return int64(number), true
+	case int64:
+		return number, true
+	case float64:
+		if number != math.Trunc(number) {
+			return nil, false
+		}
+		return int64(number), true
+	}
+	return nil, false
+}
+
+// for backends filtering records in memory
+func (condition fieldCondition) matches(logrec *ScriptTelemetryRecordV2) bool {
+	actual := filterFields[condition.field].get(logrec)
+	switch condition.op {
+	case FilterNotEquals:
+		return actual != condition.values[0]
+	case FilterGreaterThan:
+		return actual.(int64) > condition.values[0].(int64)
+	case FilterLessThan:
+		return actual.(int64) < condition.values[0].(int64)
+	}
+	for _, value := range condition.values {
+		if actual == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package persistence
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestReadPredicates(t *testing.T) {
+	testReadPredicates(t, newTestSqliteConnection)
+}
+
+func TestReadPredicatesServers(t *testing.T) {
+	for _, server := range testSQLServers {
+		t.Run(string(server.backend), func(t *testing.T) {
+			testReadPredicates(t, func(t *testing.T, dbcfg Config) Connection {
+				return newTestSQLServerConnection(t, server.env, dbcfg)
+			})
+		})
+	}
+}
+
+func TestFileReadPredicates(t *testing.T) {
+	testReadPredicates(t, func(t *testing.T, dbcfg Config) Connection {
+		dbcfg.Backend = File
+		dbcfg.ConnString = "file:" + t.TempDir()
+		return newTestConnection(t, dbcfg)
+	})
+}
+
+// shared by the backends, records are named by their document
+func testReadPredicates(t *testing.T, connect func(*testing.T, Config) Connection) {
+	conn := connect(t, Config{})
+	record := func(docname string, command string, resultcode int, duration int, debug bool, timestamp string) TelemetryRecord {
+		logrec := newTestScriptRecord("jane", "jane.doe", timestamp)
+		logrec.DocumentName = docname
+		logrec.CommandName = command
+		logrec.ResultCode = resultcode
+		logrec.Duration = duration
+		logrec.IsDebugMode = debug
+		return logrec
+	}
+	writeTestRecords(t, conn,
+		record("a", "Sync", 0, 1200, false, "2021-06-01T10:00:00Z"),
+		record("b", "Sync", 1, 30000, false, "2021-06-01T11:00:00Z"),
+		record("c", "Purge", 0, 500, true, "2021-06-02T10:00:00Z"),
+		record("d", "Purge", 2, 45000, false, "2021-06-02T11:00:00Z"),
+		record("e", "Export", 0, 8000, false, "2021-06-03T10:00:00Z"))
+
+	where := func(predicates ...FieldPredicate) *RecordFilter {
+		return &RecordFilter{Predicates: predicates}
+	}
+	day := time.Date(2021, 6, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		filter *RecordFilter
+		want   []string
+	}{
+		{"equals", where(FieldPredicate{Field: "commandname", Op: FilterEquals, Value: "Sync"}), []string{"a", "b"}},
+		{"not equals", where(FieldPredicate{Field: "commandname", Op: FilterNotEquals, Value: "Sync"}), []string{"c", "d", "e"}},
+		{"in", where(FieldPredicate{Field: "commandname", Op: FilterIn, Values: []interface{}{"Purge", "Export"}}), []string{"c", "d", "e"}},
+		{"succeeded", where(FieldPredicate{Field: "success", Op: FilterEquals, Value: true}), []string{"a", "c", "e"}},
+		{"failed", where(FieldPredicate{Field: "success", Op: FilterEquals, Value: false}), []string{"b", "d"}},
+		{"longer than", where(FieldPredicate{Field: "duration", Op: FilterGreaterThan, Value: 10000}), []string{"b", "d"}},
+		{"shorter than", where(FieldPredicate{Field: "duration", Op: FilterLessThan, Value: float64(1200)}), []string{"c"}},
+		{"result code in", where(FieldPredicate{Field: "resultcode", Op: FilterIn, Values: []interface{}{1, 2}}), []string{"b", "d"}},
+		{"boolean", where(FieldPredicate{Field: "debug", Op: FilterEquals, Value: true}), []string{"c"}},
+		{"command and success", where(
+			FieldPredicate{Field: "commandname", Op: FilterEquals, Value: "Purge"},
+			FieldPredicate{Field: "success", Op: FilterEquals, Value: false},
+		), []string{"d"}},
+		{"in and duration", where(
+			FieldPredicate{Field: "commandname", Op: FilterIn, Values: []interface{}{"Sync", "Purge"}},
+			FieldPredicate{Field: "duration", Op: FilterGreaterThan, Value: 1000},
+			FieldPredicate{Field: "duration", Op: FilterLessThan, Value: 40000},
+		), []string{"a", "b"}},
+		{"time range and predicate", &RecordFilter{
+			From:       day,
+			Predicates: []FieldPredicate{{Field: "duration", Op: FilterGreaterThan, Value: 1000}},
+		}, []string{"d", "e"}},
+		{"no match", where(FieldPredicate{Field: "commandname", Op: FilterEquals, Value: "Sync'; --"}), []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			records, _, err := conn.Read(context.Background(), test.filter, testLogger)
+			if err != nil {
+				t.Fatalf("reading: %v", err)
+			}
+			found := make([]string, 0, len(records))
+			for _, logrec := range records {
+				found = append(found, logrec.(*ScriptTelemetryRecordV2).DocumentName)
+			}
+			sort.Strings(found)
+			if !reflect.DeepEqual(found, test.want) {
+				t.Errorf("found %v, want %v", found, test.want)
+			}
+		})
+	}
+}
+
+// predicates that can not be checked fail the read instead of matching all
+func TestFilterConditionsInvalid(t *testing.T) {
+	tests := []struct {
+		name      string
+		filter    *RecordFilter
+		predicate FieldPredicate
+		message   string
+	}{
+		{"unknown field", nil, FieldPredicate{Field: "color", Op: FilterEquals, Value: "red"}, `unsupported filter field "color"`},
+		{"unknown operator", nil, FieldPredicate{Field: "commandname", Op: "like", Value: "Sy%"}, `unsupported filter operator "like"`},
+		{"greater than on text", nil, FieldPredicate{Field: "commandname", Op: FilterGreaterThan, Value: "Sync"}, "filter on commandname does not support gt"},
+		{"in without values", nil, FieldPredicate{Field: "commandname", Op: FilterIn}, "filter on commandname lists no values"},
+		{"text for integer", nil, FieldPredicate{Field: "duration", Op: FilterGreaterThan, Value: "1s"}, "filter on duration expects integer values"},
+		{"fractional integer", nil, FieldPredicate{Field: "resultcode", Op: FilterEquals, Value: 1.5}, "filter on resultcode expects integer values"},
+		{"integer for boolean", nil, FieldPredicate{Field: "debug", Op: FilterEquals, Value: 1}, "filter on debug expects boolean values"},
+		{"success without boolean", nil, FieldPredicate{Field: "success", Op: FilterEquals, Value: "yes"}, "filter on success expects eq with a boolean value"},
+		{"events", &RecordFilter{RecordType: EventRecord}, FieldPredicate{Field: "commandname", Op: FilterEquals, Value: "Sync"}, "filter predicates are only supported on script records"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter := test.filter
+			if filter == nil {
+				filter = &RecordFilter{}
+			}
+			filter.Predicates = []FieldPredicate{test.predicate}
+
+			if _, err := filter.conditions(); err == nil || !strings.Contains(err.Error(), test.message) {
+				t.Errorf("conditions fail with %v, want %s", err, test.message)
+			}
+			conn := newTestMemoryConnection(t, Config{})
+			if _, _, err := conn.Read(context.Background(), filter, testLogger); err == nil {
+				t.Error("read with the predicate passed")
+			}
+		})
+	}
+}
+
+func TestGenerateSelectQueryPredicates(t *testing.T) {
+	filter := &RecordFilter{
+		UserName: "jane",
+		Predicates: []FieldPredicate{
+			{Field: "commandname", Op: FilterIn, Values: []interface{}{"Sync", "Purge"}},
+			{Field: "duration", Op: FilterGreaterThan, Value: float64(1000)},
+			{Field: "debug", Op: FilterEquals, Value: false},
+		},
+	}
+	query, args, err := generateSelectQueryV2(&Config{Backend: Postgres, ScriptTarget: "scripts"}, filter, testLogger)
+	if err != nil {
+		t.Fatalf("generating: %v", err)
+	}
+	where := `WHERE username = $1 AND "commandname" IN ($2, $3) AND "duration" > $4 AND "debug" = $5 ORDER BY`
+	if !strings.Contains(query, where) {
+		t.Errorf("query %s does not contain %s", query, where)
+	}
+	if want := []interface{}{"jane", "Sync", "Purge", int64(1000), "false"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("args are %#v, want %#v", args, want)
+	}
+}
+
+func TestGenerateMongoReadQueryPredicates(t *testing.T) {
+	filter := &RecordFilter{
+		Predicates: []FieldPredicate{
+			{Field: "commandname", Op: FilterIn, Values: []interface{}{"Sync", "Purge"}},
+			{Field: "success", Op: FilterEquals, Value: false},
+			{Field: "duration", Op: FilterLessThan, Value: 500},
+		},
+	}
+	query, _, err := generateMongoReadQuery(filter)
+	if err != nil {
+		t.Fatalf("generating: %v", err)
+	}
+	want := bson.A{
+		bson.M{"commandname": bson.M{"$in": bson.A{"Sync", "Purge"}}},
+		bson.M{"resultcode": bson.M{"$ne": int64(0)}},
+		bson.M{"duration": bson.M{"$lt": int64(500)}},
+	}
+	if !reflect.DeepEqual(query["$and"], want) {
+		t.Errorf("query is %v, want %v", query["$and"], want)
+	}
+}
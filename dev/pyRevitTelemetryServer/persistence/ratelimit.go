@@ -0,0 +1,175 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"../cli"
+	"github.com/pkg/errors"
+)
+
+// clients tracked at once before the least recently seen are evicted
+const DefaultRateLimitMaxClients = 10000
+
+var ErrRateLimited = errors.New("client exceeded its rate limit")
+
+// token bucket of a single client, refilled continuously
+type rateBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// limits the records each client can write per minute
+type RateLimitedConnection struct {
+	Connection
+	MaxRecordsPerMinute int
+	MaxClients          int
+
+	mutex     sync.Mutex
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+}
+
+func NewRateLimitedConnection(conn Connection, dbcfg *Config) *RateLimitedConnection {
+	maxClients := dbcfg.RateLimitMaxClients
+	if maxClients <= 0 {
+		maxClients = DefaultRateLimitMaxClients
+	}
+	return &RateLimitedConnection{
+		Connection:          conn,
+		MaxRecordsPerMinute: dbcfg.MaxRecordsPerMinute,
+		MaxClients:          maxClients,
+		buckets:             make(map[string]*rateBucket),
+		lastSweep:           time.Now(),
+	}
+}
+
+func (w *RateLimitedConnection) Write(ctx context.Context, logrec TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.WriteBatch(ctx, []TelemetryRecord{logrec}, logger)
+}
+
+// a batch is written only when every client in it is within its limit,
+// rejected batches do not use up any of the clients' tokens. a client
+// can not send more records in one batch than its per minute limit
+func (w *RateLimitedConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	counts := make(map[string]int)
+	for _, logrec := range logrecs {
+		counts[rateLimitKey(logrec)]++
+	}
+
+	if client, limit, limited := w.take(counts, time.Now()); limited {
+		connectionLogger(w.Connection, logger).Debug("client is rate limited", "client", client)
+		return &Result{
+			ResultCode: ResultRateLimited,
+			Message: fmt.Sprintf(
+				"client %q exceeded %d usage records per minute", client, limit),
+		}, ErrRateLimited
+	}
+	return w.Connection.WriteBatch(ctx, logrecs, logger)
+}
+
+// takes tokens for all clients, or none when one of them runs short
+// returns the first client without enough tokens and the limit it ran into
+func (w *RateLimitedConnection) take(counts map[string]int, now time.Time) (string, int, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.sweep(now)
+
+	limit := float64(w.MaxRecordsPerMinute)
+	buckets := make(map[string]*rateBucket, len(counts))
+	for client, count := range counts {
+		bucket := w.bucket(client, now)
+		buckets[client] = bucket
+		elapsed := now.Sub(bucket.lastSeen)
+		bucket.tokens += limit * elapsed.Minutes()
+		if bucket.tokens > limit {
+			bucket.tokens = limit
+		}
+		bucket.lastSeen = now
+		if bucket.tokens < float64(count) {
+			return client, w.MaxRecordsPerMinute, true
+		}
+	}
+
+	for client, count := range counts {
+		buckets[client].tokens -= float64(count)
+	}
+	return "", w.MaxRecordsPerMinute, false
+}
+
+// changes the limits of a running connection, buckets holding more tokens
+// than the new limit are capped on their next write
+func (w *RateLimitedConnection) setLimits(maxRecordsPerMinute int, maxClients int) {
+	if maxClients <= 0 {
+		maxClients = DefaultRateLimitMaxClients
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.MaxRecordsPerMinute = maxRecordsPerMinute
+	w.MaxClients = maxClients
+	for len(w.buckets) > w.MaxClients {
+		w.evictOldest()
+	}
+}
+
+func (w *RateLimitedConnection) bucket(client string, now time.Time) *rateBucket {
+	bucket, exists := w.buckets[client]
+	if !exists {
+		// make room by dropping the least recently seen client
+		if len(w.buckets) >= w.MaxClients {
+			w.evictOldest()
+		}
+		bucket = &rateBucket{tokens: float64(w.MaxRecordsPerMinute), lastSeen: now}
+		w.buckets[client] = bucket
+	}
+	return bucket
+}
+
+// buckets idle for a minute are full again, the same as a new bucket,
+// so dropping them keeps memory bounded without changing the limits
+func (w *RateLimitedConnection) sweep(now time.Time) {
+	if now.Sub(w.lastSweep) < time.Minute {
+		return
+	}
+	for client, bucket := range w.buckets {
+		if now.Sub(bucket.lastSeen) >= time.Minute {
+			delete(w.buckets, client)
+		}
+	}
+	w.lastSweep = now
+}
+
+func (w *RateLimitedConnection) evictOldest() {
+	oldest := ""
+	var oldestSeen time.Time
+	for client, bucket := range w.buckets {
+		if oldest == "" || bucket.lastSeen.Before(oldestSeen) {
+			oldest, oldestSeen = client, bucket.lastSeen
+		}
+	}
+	delete(w.buckets, oldest)
+}
+
+// clients are told apart by host user, v1 records only carry the user name
+func rateLimitKey(logrec TelemetryRecord) string {
+	switch rec := logrec.(type) {
+	case *ScriptTelemetryRecordV1:
+		return rec.UserName
+	case *ScriptTelemetryRecordV2:
+		if rec.HostUserName != "" {
+			return rec.HostUserName
+		}
+		return rec.UserName
+	case *EventTelemetryRecordV2:
+		if rec.HostUserName != "" {
+			return rec.HostUserName
+		}
+		return rec.UserName
+	default:
+		return ""
+	}
+}
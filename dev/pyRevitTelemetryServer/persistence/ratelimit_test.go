@@ -0,0 +1,154 @@
+package persistence
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func newTestRateLimitedConnection(t *testing.T, dbcfg Config) (*RateLimitedConnection, *MemoryConnection) {
+	t.Helper()
+	memory := NewMemoryConnection(&Config{ScriptTarget: "scripts", EventTarget: "events"})
+	t.Cleanup(func() { memory.Close() })
+	return NewRateLimitedConnection(memory, &dbcfg), memory
+}
+
+// n distinct records of the client in one batch
+func writeTestClientRecords(conn Connection, hostUserName string, n int) (*Result, error) {
+	logrecs := make([]TelemetryRecord, 0, n)
+	for idx := 0; idx < n; idx++ {
+		rec := newTestScriptRecord("jane", hostUserName, "2021-06-01T10:00:00Z")
+		rec.ExecId = hostUserName + string(rune('a'+idx))
+		logrecs = append(logrecs, rec)
+	}
+	return conn.WriteBatch(context.Background(), logrecs, testLogger)
+}
+
+func TestRateLimit(t *testing.T) {
+	conn, memory := newTestRateLimitedConnection(t, Config{MaxRecordsPerMinute: 3})
+	if _, err := writeTestClientRecords(conn, "jane.doe", 3); err != nil {
+		t.Fatalf("writing within the limit: %v", err)
+	}
+
+	res, err := writeTestClientRecords(conn, "jane.doe", 1)
+	if err != ErrRateLimited {
+		t.Errorf("writing over the limit returned %v, want ErrRateLimited", err)
+	}
+	if res == nil || res.ResultCode != ResultRateLimited {
+		t.Errorf("result is %+v, want rate limited", res)
+	}
+
+	// other clients have their own buckets
+	if _, oErr := writeTestClientRecords(conn, "john.doe", 3); oErr != nil {
+		t.Errorf("writing for another client: %v", oErr)
+	}
+	if records := readTestRecords(t, memory, nil); len(records) != 6 {
+		t.Errorf("backend has %d records, want 6", len(records))
+	}
+}
+
+// rejected batches take no tokens of the clients within their limits
+func TestRateLimitBatch(t *testing.T) {
+	conn, _ := newTestRateLimitedConnection(t, Config{MaxRecordsPerMinute: 3})
+	writeTestClientRecords(conn, "jane.doe", 2)
+
+	rejected := []TelemetryRecord{
+		newTestScriptRecord("jane", "jane.doe", "2021-06-01T11:00:00Z"),
+		newTestScriptRecord("jane", "jane.doe", "2021-06-01T11:01:00Z"),
+		newTestScriptRecord("john", "john.doe", "2021-06-01T11:00:00Z"),
+	}
+	if _, err := conn.WriteBatch(context.Background(), rejected, testLogger); err != ErrRateLimited {
+		t.Fatalf("batch over the limit of one client returned %v", err)
+	}
+	if _, err := writeTestClientRecords(conn, "john.doe", 3); err != nil {
+		t.Errorf("tokens of john.doe were taken by the rejected batch: %v", err)
+	}
+	if _, err := writeTestClientRecords(conn, "jane.doe", 1); err != nil {
+		t.Errorf("tokens of jane.doe were taken by the rejected batch: %v", err)
+	}
+	if _, err := writeTestClientRecords(conn, "nobody", 4); err != ErrRateLimited {
+		t.Errorf("batch larger than the limit returned %v", err)
+	}
+}
+
+func TestRateLimitRefill(t *testing.T) {
+	conn, _ := newTestRateLimitedConnection(t, Config{MaxRecordsPerMinute: 60})
+	now := time.Now()
+	if _, _, limited := conn.take(map[string]int{"jane.doe": 60}, now); limited {
+		t.Fatal("full bucket was limited")
+	}
+	if _, _, limited := conn.take(map[string]int{"jane.doe": 1}, now); !limited {
+		t.Fatal("empty bucket was not limited")
+	}
+
+	// a token per second
+	later := now.Add(10 * time.Second)
+	if _, _, limited := conn.take(map[string]int{"jane.doe": 10}, later); limited {
+		t.Error("bucket was not refilled")
+	}
+	if _, _, limited := conn.take(map[string]int{"jane.doe": 1}, later); !limited {
+		t.Error("bucket was refilled beyond the elapsed time")
+	}
+
+	// refills are capped at the limit
+	if _, _, limited := conn.take(map[string]int{"jane.doe": 61}, later.Add(time.Hour)); !limited {
+		t.Error("bucket was refilled beyond the limit")
+	}
+}
+
+func TestRateLimitEviction(t *testing.T) {
+	conn, _ := newTestRateLimitedConnection(t, Config{MaxRecordsPerMinute: 5, RateLimitMaxClients: 2})
+	now := time.Now()
+	for idx, client := range []string{"jane.doe", "john.doe", "joe.doe"} {
+		conn.take(map[string]int{client: 5}, now.Add(time.Duration(idx)*time.Second))
+	}
+	if len(conn.buckets) != 2 {
+		t.Fatalf("tracking %d clients, want 2", len(conn.buckets))
+	}
+	if _, exists := conn.buckets["jane.doe"]; exists {
+		t.Error("least recently seen client was not evicted")
+	}
+
+	// evicted clients start over with a full bucket
+	if _, _, limited := conn.take(map[string]int{"jane.doe": 5}, now.Add(3*time.Second)); limited {
+		t.Error("evicted client was limited")
+	}
+
+	conn.setLimits(5, 1)
+	if len(conn.buckets) != 1 {
+		t.Errorf("tracking %d clients after lowering the limit, want 1", len(conn.buckets))
+	}
+}
+
+// clients idle for a minute are dropped
+func TestRateLimitSweep(t *testing.T) {
+	conn, _ := newTestRateLimitedConnection(t, Config{MaxRecordsPerMinute: 5})
+	now := time.Now()
+	conn.take(map[string]int{"jane.doe": 1}, now)
+	conn.take(map[string]int{"john.doe": 1}, now.Add(30*time.Second))
+
+	conn.take(map[string]int{"joe.doe": 1}, now.Add(70*time.Second))
+	if _, exists := conn.buckets["jane.doe"]; exists {
+		t.Error("idle client was not swept")
+	}
+	if _, exists := conn.buckets["john.doe"]; !exists {
+		t.Error("client seen within the minute was swept")
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	tests := []struct {
+		logrec TelemetryRecord
+		want   string
+	}{
+		{newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"), "jane.doe"},
+		{newTestScriptRecord("jane", "", "2021-06-01T10:00:00Z"), "jane"},
+		{newTestEventRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"), "jane.doe"},
+		{&ScriptTelemetryRecordV1{UserName: "jane"}, "jane"},
+	}
+	for _, test := range tests {
+		if key := rateLimitKey(test.logrec); key != test.want {
+			t.Errorf("key of %T is %q, want %q", test.logrec, key, test.want)
+		}
+	}
+}
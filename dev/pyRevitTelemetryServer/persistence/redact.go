@@ -0,0 +1,81 @@
+package persistence
+
+import (
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const redactedSecret = "*****"
+
+var (
+	// user:password@ in urls, also matches multi-host mongodb uris
+	// and mysql dsns that url.Parse rejects
+	urlPasswordPattern = regexp.MustCompile(`^((?:[a-z0-9+.\-]+:(?://)?)?[^:/@\s]*:)([^@\s]*)(@)`)
+
+	// password=... pairs in keyword style and ado style dsns
+	keywordSecretPattern = regexp.MustCompile(`(?i)\b(password|pwd|token|secret)(\s*=\s*)('(?:[^'\\]|\\.)*'|[^\s;&]*)`)
+)
+
+// query parameters holding secrets
+var secretQueryParams = map[string]bool{
+	"password":     true,
+	"pwd":          true,
+	"token":        true,
+	"access_token": true,
+	"secret":       true,
+	"apikey":       true,
+	"api_key":      true,
+}
+
+// replaces passwords and tokens in connection strings with asterisks
+func RedactConnString(connStr string) string {
+	if parsed, err := url.Parse(connStr); err == nil && parsed.Host != "" {
+		if _, exists := parsed.User.Password(); exists {
+			parsed.User = url.UserPassword(parsed.User.Username(), redactedSecret)
+		}
+		query := parsed.Query()
+		for key := range query {
+			if secretQueryParams[strings.ToLower(key)] {
+				query.Set(key, redactedSecret)
+			}
+		}
+		parsed.RawQuery = query.Encode()
+		// keep the asterisks readable instead of percent encoded
+		return strings.Replace(parsed.String(), url.QueryEscape(redactedSecret), redactedSecret, -1)
+	}
+
+	redacted := urlPasswordPattern.ReplaceAllString(connStr, "${1}"+redactedSecret+"${3}")
+	return keywordSecretPattern.ReplaceAllString(redacted, "${1}${2}"+redactedSecret)
+}
+
+// drivers tend to echo the connection string in their errors
+func redactError(err error, connStr string) error {
+	if err == nil || connStr == "" {
+		return err
+	}
+	message := err.Error()
+	redacted := strings.Replace(message, connStr, RedactConnString(connStr), -1)
+	if redacted == message {
+		return err
+	}
+	return errors.New(redacted)
+}
+
+// configs are included in json status output, keep secrets out of it
+func (cfg Config) MarshalJSON() ([]byte, error) {
+	type plainConfig Config
+	redacted := plainConfig(cfg)
+	redacted.ConnString = RedactConnString(cfg.ConnString)
+	redacted.ReadConnString = RedactConnString(cfg.ReadConnString)
+	if redacted.InfluxToken != "" {
+		redacted.InfluxToken = redactedSecret
+	}
+	if redacted.AnonymizationKey != "" {
+		redacted.AnonymizationKey = redactedSecret
+	}
+	return json.Marshal(redacted)
+}
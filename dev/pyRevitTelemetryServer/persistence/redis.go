@@ -0,0 +1,139 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"../cli"
+	"github.com/redis/go-redis/v9"
+)
+
+type RedisConnection struct {
+	DatabaseConnection
+	client *redis.Client
+}
+
+func newRedisConnection(w DatabaseConnection) (*RedisConnection, error) {
+	opts, err := redis.ParseURL(w.Config.ConnString)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisConnection{w, redis.NewClient(opts)}, nil
+}
+
+func (w *RedisConnection) GetType() DBBackend {
+	return w.Config.Backend
+}
+
+func (w *RedisConnection) GetVersion(logger *cli.Logger) string {
+	if err := w.begin(); err != nil {
+		return ""
+	}
+	defer w.end()
+
+	w.Config.structured(logger).Debug("getting redis version")
+	info, err := w.client.Info(context.Background(), "server").Result()
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(info, "\n") {
+		if strings.HasPrefix(line, "redis_version:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "redis_version:"))
+		}
+	}
+	return ""
+}
+
+func (w *RedisConnection) GetStatus(logger *cli.Logger) ConnectionStatus {
+	if err := w.Ping(context.Background()); err != nil {
+		return newConnectionStatus(err, "")
+	}
+	return newConnectionStatus(nil, w.GetVersion(logger))
+}
+
+func (w *RedisConnection) Ping(ctx context.Context) error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+	defer w.end()
+
+	pingCtx, cancel := w.Config.newPingContext(ctx)
+	defer cancel()
+
+	return wrapContextError(pingCtx, w.client.Ping(pingCtx).Err())
+}
+
+func (w *RedisConnection) Write(ctx context.Context, logrec TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.WriteBatch(ctx, []TelemetryRecord{logrec}, logger)
+}
+
+func (w *RedisConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	log := w.Config.structured(logger)
+
+	if len(logrecs) == 0 {
+		return &Result{
+			ResultCode: ResultNoData,
+			Message:    "no data to write",
+		}, nil
+	}
+
+	// pipeline all stream appends in a single round trip
+	log.Debug("building stream entries")
+	pipe := w.client.Pipeline()
+	for _, logrec := range logrecs {
+		values, fErr := flattenRecord(logrec)
+		if fErr != nil {
+			return nil, fErr
+		}
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: w.streamFor(logrec),
+			MaxLen: w.Config.RedisMaxLen,
+			Approx: true,
+			Values: values,
+		})
+	}
+
+	log.Debug("running pipeline")
+	cmds, pErr := pipe.Exec(ctx)
+
+	written := 0
+	for _, cmd := range cmds {
+		if cmd.Err() == nil {
+			written++
+		}
+	}
+
+	if pErr != nil {
+		return &Result{
+			Written: written,
+			Message: fmt.Sprintf("appended %d of %d usage records", written, len(logrecs)),
+		}, wrapContextError(ctx, pErr)
+	}
+
+	log.Debug("preparing report")
+	return &Result{
+		Written: written,
+		Message: fmt.Sprintf("successfully appended %d usage records", written),
+	}, nil
+}
+
+func (w *RedisConnection) Close() error {
+	if !w.drain() {
+		return nil
+	}
+	return w.client.Close()
+}
+
+// configured stream key, or the record target when not set
+func (w *RedisConnection) streamFor(logrec TelemetryRecord) string {
+	if w.Config.RedisStream != "" {
+		return w.Config.RedisStream
+	}
+	return w.Config.targetFor(logrec)
+}
@@ -0,0 +1,259 @@
+package persistence
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+
+	"../cli"
+	"github.com/pkg/errors"
+)
+
+// settings a running connection picks up on reload, by config key
+var (
+	poolSettings      = []string{"max_open_conns", "max_idle_conns", "conn_max_lifetime", "conn_max_idle_time"}
+	retentionSettings = []string{"retention_days", "retention_interval"}
+	rateLimitSettings = []string{"max_records_per_minute", "rate_limit_max_clients"}
+)
+
+// reloads the config on SIGHUP and applies the settings that can change
+// without reopening the connection, changes to any other setting are
+// logged as requiring a restart. the connection stays open so in-flight
+// writes are not interrupted. windows never sends SIGHUP, Reload can be
+// called directly there
+type ConfigReloader struct {
+	conn   Connection
+	load   func() (*Config, error)
+	logger *cli.Logger
+
+	// settings in effect, guarded by mutex
+	mutex     sync.Mutex
+	current   *Config
+	retention *RetentionJob
+
+	signals chan os.Signal
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// starts the retention job of dbcfg and reloads the config with load,
+// e.g. LoadConfigFromEnv, on every SIGHUP until stopped
+func NewConfigReloader(conn Connection, dbcfg *Config, load func() (*Config, error), logger *cli.Logger) *ConfigReloader {
+	current := *dbcfg
+	inferBackend(&current)
+	w := &ConfigReloader{
+		conn:      conn,
+		load:      load,
+		logger:    logger,
+		current:   &current,
+		retention: NewRetentionJob(conn, &current, logger),
+		signals:   make(chan os.Signal, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	signal.Notify(w.signals, syscall.SIGHUP)
+	go w.reloadLoop()
+	return w
+}
+
+// copy of the settings in effect
+func (w *ConfigReloader) Config() *Config {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	current := *w.current
+	return &current
+}
+
+// stops listening for SIGHUP and stops the retention job
+func (w *ConfigReloader) Stop() {
+	w.once.Do(func() {
+		signal.Stop(w.signals)
+		close(w.stop)
+	})
+	<-w.done
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.retention.Stop()
+}
+
+func (w *ConfigReloader) reloadLoop() {
+	defer close(w.done)
+	for {
+		select {
+		case <-w.signals:
+			if err := w.Reload(); err != nil {
+				w.Config().structured(w.logger).Print("error reloading config", "error", err)
+			}
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// loads the config and applies the changed settings, an invalid config
+// is rejected as a whole and the settings in effect are kept
+func (w *ConfigReloader) Reload() error {
+	dbcfg, err := w.load()
+	if err != nil {
+		return errors.Wrap(err, "config can not be loaded")
+	}
+	inferBackend(dbcfg)
+	if vErr := dbcfg.Validate(); vErr != nil {
+		return vErr
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	changed := changedSettings(w.current, dbcfg)
+	if len(changed) == 0 {
+		w.log().Debug("config is unchanged")
+		return nil
+	}
+	for _, name := range changed {
+		live := anySetting([]string{name}, poolSettings) ||
+			anySetting([]string{name}, retentionSettings) ||
+			anySetting([]string{name}, rateLimitSettings)
+		if !live {
+			w.log().Print("changing setting requires a restart", "setting", name)
+		}
+	}
+
+	running := *w.current
+	if w.applyPool(&running, dbcfg, changed) {
+		w.log().Print("applied settings", "settings", strings.Join(poolSettings, ", "))
+	}
+	if w.applyRateLimit(&running, dbcfg, changed) {
+		w.log().Print("applied settings", "settings", strings.Join(rateLimitSettings, ", "))
+	}
+	if w.applyRetention(&running, dbcfg, changed) {
+		w.log().Print("applied settings", "settings", strings.Join(retentionSettings, ", "))
+	}
+	w.current = &running
+	return nil
+}
+
+// sql pools are resized in place, other backends size their pools on open
+func (w *ConfigReloader) applyPool(running *Config, dbcfg *Config, changed []string) bool {
+	if !anySetting(changed, poolSettings) {
+		return false
+	}
+	sqlConn, ok := unwrapSQLConnection(w.conn)
+	if !ok {
+		w.logRestart(poolSettings, running.Backend)
+		return false
+	}
+	copySettings(running, dbcfg, poolSettings)
+	sqlConn.configurePools(running)
+	return true
+}
+
+// limits can change but turning rate limiting on or off needs a restart
+func (w *ConfigReloader) applyRateLimit(running *Config, dbcfg *Config, changed []string) bool {
+	if !anySetting(changed, rateLimitSettings) {
+		return false
+	}
+	limiter, ok := unwrapRateLimitedConnection(w.conn)
+	if !ok || dbcfg.MaxRecordsPerMinute <= 0 {
+		w.logRestart(rateLimitSettings, running.Backend)
+		return false
+	}
+	copySettings(running, dbcfg, rateLimitSettings)
+	limiter.setLimits(running.MaxRecordsPerMinute, running.RateLimitMaxClients)
+	return true
+}
+
+// the retention job is restarted, mongodb ttl indexes are created on open
+func (w *ConfigReloader) applyRetention(running *Config, dbcfg *Config, changed []string) bool {
+	if !anySetting(changed, retentionSettings) {
+		return false
+	}
+	updated := *running
+	copySettings(&updated, dbcfg, retentionSettings)
+	if running.retentionByTTL() || updated.retentionByTTL() {
+		w.logRestart(retentionSettings, running.Backend)
+		return false
+	}
+	// waits for a running purge to finish
+	w.retention.Stop()
+	*running = updated
+	w.retention = NewRetentionJob(w.conn, &updated, w.logger)
+	return true
+}
+
+func (w *ConfigReloader) logRestart(names []string, backend DBBackend) {
+	w.log().Print(
+		"changing settings requires a restart", "settings", strings.Join(names, ", "), "backend", backend)
+}
+
+// in the format of the settings in effect, expects mutex to be held
+func (w *ConfigReloader) log() *structuredLogger {
+	return w.current.structured(w.logger)
+}
+
+// finds the rate limiter under the wrappers NewConnection adds
+func unwrapRateLimitedConnection(conn Connection) (*RateLimitedConnection, bool) {
+	for {
+		if limiter, ok := conn.(*RateLimitedConnection); ok {
+			return limiter, true
+		}
+		inner, ok := innerConnection(conn)
+		if !ok {
+			return nil, false
+		}
+		conn = inner
+	}
+}
+
+// the same backend NewConnection infers, so configs leaving it to the
+// connection string compare equal to ones naming it
+func inferBackend(dbcfg *Config) {
+	if dbcfg.Backend == "" {
+		if backend, err := parseUri(dbcfg.ConnString); err == nil {
+			dbcfg.Backend = backend
+		}
+	}
+}
+
+// config keys of the settings that differ, in field order
+func changedSettings(current *Config, loaded *Config) []string {
+	currentValue := reflect.ValueOf(current).Elem()
+	loadedValue := reflect.ValueOf(loaded).Elem()
+	changed := make([]string, 0)
+	for idx := 0; idx < currentValue.NumField(); idx++ {
+		if !reflect.DeepEqual(currentValue.Field(idx).Interface(), loadedValue.Field(idx).Interface()) {
+			changed = append(changed, settingName(currentValue.Type().Field(idx)))
+		}
+	}
+	return changed
+}
+
+func copySettings(dst *Config, src *Config, names []string) {
+	dstValue := reflect.ValueOf(dst).Elem()
+	srcValue := reflect.ValueOf(src).Elem()
+	for idx := 0; idx < dstValue.NumField(); idx++ {
+		if anySetting(names, []string{settingName(dstValue.Type().Field(idx))}) {
+			dstValue.Field(idx).Set(srcValue.Field(idx))
+		}
+	}
+}
+
+func settingName(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("json"), ",")[0]
+}
+
+func anySetting(names []string, settings []string) bool {
+	for _, name := range names {
+		for _, setting := range settings {
+			if name == setting {
+				return true
+			}
+		}
+	}
+	return false
+}
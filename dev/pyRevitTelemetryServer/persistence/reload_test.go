@@ -0,0 +1,290 @@
+package persistence
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// config source of a reloader, changed by the test between reloads
+type testConfigSource struct {
+	mutex  sync.Mutex
+	config Config
+	err    error
+}
+
+func (s *testConfigSource) set(dbcfg Config) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.config = dbcfg
+}
+
+func (s *testConfigSource) fail(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.err = err
+}
+
+func (s *testConfigSource) load() (*Config, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	loaded := s.config
+	return &loaded, nil
+}
+
+func newTestConfigReloader(t *testing.T, conn Connection, dbcfg Config) (*ConfigReloader, *testConfigSource) {
+	t.Helper()
+	source := &testConfigSource{config: dbcfg}
+	reloader := NewConfigReloader(conn, &dbcfg, source.load, testLogger)
+	t.Cleanup(reloader.Stop)
+	return reloader, source
+}
+
+// config of a sqlite connection of the test, as it would be loaded
+func newTestReloadSqliteConfig(t *testing.T) Config {
+	return Config{
+		ConnString:   "sqlite3:" + filepath.Join(t.TempDir(), "telemetry.db"),
+		ScriptTarget: "scripts",
+		EventTarget:  "events",
+		MaxOpenConns: 4,
+		MaxIdleConns: 2,
+	}
+}
+
+// reloads with the log lines written meanwhile
+func reloadTestConfig(t *testing.T, reloader *ConfigReloader) (string, error) {
+	t.Helper()
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+	err := reloader.Reload()
+	return output.String(), err
+}
+
+func TestReloadPoolLimits(t *testing.T) {
+	dbcfg := newTestReloadSqliteConfig(t)
+	conn := newTestConnection(t, dbcfg)
+	reloader, source := newTestConfigReloader(t, conn, dbcfg)
+
+	reloaded := dbcfg
+	reloaded.MaxOpenConns = 2
+	reloaded.MaxIdleConns = 1
+	source.set(reloaded)
+	output, err := reloadTestConfig(t, reloader)
+	if err != nil {
+		t.Fatalf("reloading: %v", err)
+	}
+	if !strings.Contains(output, "applied settings") || strings.Contains(output, "requires a restart") {
+		t.Errorf("reload logged %q", output)
+	}
+
+	sqlConn, _ := unwrapSQLConnection(conn)
+	if open := sqlConn.db.Stats().MaxOpenConnections; open != 2 {
+		t.Errorf("max open connections is %d after reloading, want 2", open)
+	}
+	// the idle limit closes the connections beyond it once released
+	if err := conn.Warmup(context.Background(), 2); err != nil {
+		t.Fatalf("warming up: %v", err)
+	}
+	if idle := sqlConn.db.Stats().Idle; idle != 1 {
+		t.Errorf("%d idle connections after reloading, want 1", idle)
+	}
+	if current := reloader.Config(); current.MaxOpenConns != 2 || current.MaxIdleConns != 1 {
+		t.Errorf("settings in effect are %d open and %d idle connections", current.MaxOpenConns, current.MaxIdleConns)
+	}
+}
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	dbcfg := newTestReloadSqliteConfig(t)
+	conn := newTestConnection(t, dbcfg)
+	_, source := newTestConfigReloader(t, conn, dbcfg)
+
+	reloaded := dbcfg
+	reloaded.MaxOpenConns = 3
+	source.set(reloaded)
+	process, _ := os.FindProcess(os.Getpid())
+	if err := process.Signal(syscall.SIGHUP); err != nil {
+		t.Skipf("sending SIGHUP: %v", err)
+	}
+
+	sqlConn, _ := unwrapSQLConnection(conn)
+	deadline := time.Now().Add(5 * time.Second)
+	for sqlConn.db.Stats().MaxOpenConnections != 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("pool was not resized on SIGHUP")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// settings needing a new connection are logged and left as they are
+func TestReloadRestartSettings(t *testing.T) {
+	dbcfg := newTestReloadSqliteConfig(t)
+	conn := newTestConnection(t, dbcfg)
+	reloader, source := newTestConfigReloader(t, conn, dbcfg)
+
+	reloaded := dbcfg
+	reloaded.ConnString = "sqlite3:" + filepath.Join(t.TempDir(), "other.db")
+	reloaded.MaxOpenConns = 2
+	source.set(reloaded)
+	output, err := reloadTestConfig(t, reloader)
+	if err != nil {
+		t.Fatalf("reloading: %v", err)
+	}
+	if !strings.Contains(output, "changing setting requires a restart setting=connection_string") {
+		t.Errorf("reload logged %q, want the connection string to require a restart", output)
+	}
+	current := reloader.Config()
+	if current.ConnString != dbcfg.ConnString || current.MaxOpenConns != 2 {
+		t.Errorf("settings in effect are %s with %d open connections", current.ConnString, current.MaxOpenConns)
+	}
+
+	// rate limits of a connection not limiting rates need a restart as well
+	reloaded.MaxRecordsPerMinute = 100
+	source.set(reloaded)
+	if output, _ = reloadTestConfig(t, reloader); !strings.Contains(output, "changing settings requires a restart settings=max_records_per_minute") {
+		t.Errorf("reload logged %q, want the rate limits to require a restart", output)
+	}
+	if current := reloader.Config(); current.MaxRecordsPerMinute != 0 {
+		t.Errorf("rate limit in effect is %d, want none", current.MaxRecordsPerMinute)
+	}
+}
+
+func TestReloadRateLimit(t *testing.T) {
+	dbcfg := newTestReloadSqliteConfig(t)
+	dbcfg.MaxRecordsPerMinute = 100
+	conn := newTestConnection(t, dbcfg)
+	reloader, source := newTestConfigReloader(t, conn, dbcfg)
+
+	reloaded := dbcfg
+	reloaded.MaxRecordsPerMinute = 10
+	reloaded.RateLimitMaxClients = 5
+	source.set(reloaded)
+	if _, err := reloadTestConfig(t, reloader); err != nil {
+		t.Fatalf("reloading: %v", err)
+	}
+	limiter, _ := unwrapRateLimitedConnection(conn)
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	if limiter.MaxRecordsPerMinute != 10 || limiter.MaxClients != 5 {
+		t.Errorf("limits are %d records of %d clients, want 10 of 5", limiter.MaxRecordsPerMinute, limiter.MaxClients)
+	}
+}
+
+func TestReloadRetention(t *testing.T) {
+	dbcfg := Config{ConnString: "memory:", ScriptTarget: "scripts", EventTarget: "events"}
+	conn := newTestConnection(t, dbcfg)
+	writeTestRecords(t, conn, newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"))
+	reloader, source := newTestConfigReloader(t, conn, dbcfg)
+
+	// the restarted retention job purges right away
+	reloaded := dbcfg
+	reloaded.RetentionDays = 5
+	source.set(reloaded)
+	if _, err := reloadTestConfig(t, reloader); err != nil {
+		t.Fatalf("reloading: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(readTestRecords(t, conn, nil)) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("old records were not purged after reloading")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// invalid configs are rejected and the settings in effect are kept
+func TestReloadInvalid(t *testing.T) {
+	dbcfg := newTestReloadSqliteConfig(t)
+	conn := newTestConnection(t, dbcfg)
+	reloader, source := newTestConfigReloader(t, conn, dbcfg)
+
+	reloaded := dbcfg
+	reloaded.MaxOpenConns = 2
+	reloaded.CassandraConsistency = "most"
+	source.set(reloaded)
+	if err := reloader.Reload(); err == nil {
+		t.Error("invalid config was reloaded")
+	}
+
+	source.fail(errors.New("file is missing"))
+	if err := reloader.Reload(); err == nil || !strings.Contains(err.Error(), "file is missing") {
+		t.Errorf("reloading a missing config returned %v", err)
+	}
+
+	sqlConn, _ := unwrapSQLConnection(conn)
+	if open := sqlConn.db.Stats().MaxOpenConnections; open != 4 {
+		t.Errorf("max open connections is %d, want 4 kept", open)
+	}
+	if current := reloader.Config(); current.MaxOpenConns != 4 {
+		t.Errorf("max open connections in effect is %d, want 4 kept", current.MaxOpenConns)
+	}
+}
+
+// writes going on while reloading are not interrupted
+func TestReloadDuringWrites(t *testing.T) {
+	dbcfg := newTestReloadSqliteConfig(t)
+	conn := newTestConnection(t, dbcfg)
+	reloader, source := newTestConfigReloader(t, conn, dbcfg)
+
+	const writers, writes = 4, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*writes)
+	for writer := 0; writer < writers; writer++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for write := 0; write < writes; write++ {
+				if _, err := conn.Write(context.Background(), newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"), testLogger); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	for maxOpen := 1; maxOpen <= 4; maxOpen++ {
+		reloaded := dbcfg
+		reloaded.MaxOpenConns = maxOpen
+		source.set(reloaded)
+		if err := reloader.Reload(); err != nil {
+			t.Errorf("reloading: %v", err)
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("write failed while reloading: %v", err)
+	}
+	if records := readTestRecords(t, conn, nil); len(records) != writers*writes {
+		t.Errorf("found %d records, want %d", len(records), writers*writes)
+	}
+}
+
+func TestChangedSettings(t *testing.T) {
+	current := &Config{Backend: Sqlite, ConnString: "sqlite3:telemetry.db", MaxOpenConns: 4, RetentionDays: 30}
+	loaded := *current
+	if changed := changedSettings(current, &loaded); len(changed) != 0 {
+		t.Errorf("equal configs changed %v", changed)
+	}
+
+	loaded.MaxOpenConns = 2
+	loaded.RetentionDays = 7
+	loaded.ConnString = "sqlite3:other.db"
+	want := []string{"connection_string", "max_open_conns", "retention_days"}
+	changed := changedSettings(current, &loaded)
+	if strings.Join(changed, ",") != strings.Join(want, ",") {
+		t.Errorf("changed %v, want %v", changed, want)
+	}
+}
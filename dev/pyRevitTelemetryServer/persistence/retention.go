@@ -0,0 +1,119 @@
+package persistence
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"../cli"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// how often the retention job purges old records
+const DefaultRetentionInterval = time.Hour
+
+// date field mongodb ttl indexes expire documents on, the record
+// timestamps are stored as strings which ttl indexes ignore
+const mongoTTLField = "expire_from"
+
+// purges records older than Config.RetentionDays in the background
+type RetentionJob struct {
+	conn     Connection
+	days     int
+	interval time.Duration
+	log      *structuredLogger
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// starts purging right away and then every RetentionInterval. nothing
+// runs when retention is disabled or left to a mongodb ttl index
+func NewRetentionJob(conn Connection, dbcfg *Config, logger *cli.Logger) *RetentionJob {
+	interval := dbcfg.RetentionInterval
+	if interval <= 0 {
+		interval = DefaultRetentionInterval
+	}
+
+	w := &RetentionJob{
+		conn:     conn,
+		days:     dbcfg.RetentionDays,
+		interval: interval,
+		log:      dbcfg.structured(logger),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if dbcfg.RetentionDays <= 0 || dbcfg.retentionByTTL() {
+		close(w.done)
+		return w
+	}
+	go w.purgeLoop()
+	return w
+}
+
+// stops the job, waiting for a running purge to finish
+func (w *RetentionJob) Stop() {
+	w.once.Do(func() { close(w.stop) })
+	<-w.done
+}
+
+func (w *RetentionJob) purgeLoop() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		w.purge()
+		select {
+		case <-ticker.C:
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+func (w *RetentionJob) purge() {
+	cutoff := time.Now().AddDate(0, 0, -w.days)
+	w.log.Debug("purging records", "older_than", formatFilterTime(cutoff))
+	result, err := w.conn.PurgeOlderThan(context.Background(), cutoff)
+	if err != nil {
+		w.log.Debug("error purging records", "error", err)
+		return
+	}
+	w.log.Debug(result.Message, "affected", result.Affected)
+}
+
+// mongodb expires documents itself when asked to
+func (cfg *Config) retentionByTTL() bool {
+	return cfg.Backend == MongoDB && cfg.MongoTTLIndex && cfg.RetentionDays > 0
+}
+
+// ttl index expiring documents RetentionDays after the record timestamp.
+// documents written before the index was enabled carry no date field and
+// are left to PurgeOlderThan. changing RetentionDays requires dropping
+// the existing index first
+func generateMongoTTLIndexModel(days int) mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys:    bson.D{{Key: mongoTTLField, Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(days * 24 * 60 * 60)),
+	}
+}
+
+// record as written to mongodb, with the date field for the ttl index
+func generateMongoDocument(logrec TelemetryRecord, ttl bool) (interface{}, error) {
+	if !ttl {
+		return logrec, nil
+	}
+	data, err := bson.Marshal(logrec)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.D
+	if uErr := bson.Unmarshal(data, &doc); uErr != nil {
+		return nil, uErr
+	}
+	return append(doc, bson.E{Key: mongoTTLField, Value: logrec.GetTimeStamp()}), nil
+}
@@ -0,0 +1,120 @@
+package persistence
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestPurgeOlderThan(t *testing.T) {
+	testPurgeOlderThan(t, newTestSqliteConnection)
+}
+
+// shared by the backends, records stamped before the cutoff are removed
+// from the script and event targets, the ones at the cutoff are kept
+func testPurgeOlderThan(t *testing.T, connect func(*testing.T, Config) Connection) {
+	conn := connect(t, Config{})
+	writeTestRecords(t, conn,
+		newTestScriptRecord("jane", "jane.doe", "2021-05-01T10:00:00Z"),
+		newTestScriptRecord("jane", "jane.doe", "2021-06-01T01:00:00+02:00"),
+		newTestScriptRecord("jane", "jane.doe", "2021-06-01T00:00:00Z"),
+		newTestScriptRecord("jane", "jane.doe", "2021-06-02T10:00:00Z"),
+		newTestEventRecord("jane", "jane.doe", "2021-05-31T23:59:59Z"),
+		newTestEventRecord("jane", "jane.doe", "2021-06-02T10:00:00Z"))
+
+	cutoff := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	res, err := conn.PurgeOlderThan(context.Background(), cutoff)
+	if err != nil {
+		t.Fatalf("purging: %v", err)
+	}
+	if res.Affected != 3 {
+		t.Errorf("purged %d records, want 3", res.Affected)
+	}
+
+	for _, logrec := range readTestRecords(t, conn, nil) {
+		if logrec.GetTimeStamp().Before(cutoff) {
+			t.Errorf("record of %v is kept", logrec.GetTimeStamp())
+		}
+	}
+	if scripts := readTestRecords(t, conn, nil); len(scripts) != 2 {
+		t.Errorf("kept %d script records, want 2", len(scripts))
+	}
+	if events := readTestRecords(t, conn, &RecordFilter{RecordType: EventRecord}); len(events) != 1 {
+		t.Errorf("kept %d events, want 1", len(events))
+	}
+
+	again, aErr := conn.PurgeOlderThan(context.Background(), cutoff)
+	if aErr != nil {
+		t.Fatalf("purging again: %v", aErr)
+	}
+	if again.Affected != 0 {
+		t.Errorf("purging again removed %d records", again.Affected)
+	}
+}
+
+func TestRetentionJob(t *testing.T) {
+	conn := newTestMemoryConnection(t, Config{})
+	now := time.Now().UTC()
+	writeTestRecords(t, conn,
+		newTestScriptRecord("jane", "jane.doe", now.AddDate(0, 0, -10).Format(time.RFC3339)),
+		newTestScriptRecord("jane", "jane.doe", now.AddDate(0, 0, -1).Format(time.RFC3339)))
+
+	job := NewRetentionJob(conn, &Config{Backend: Memory, RetentionDays: 5}, testLogger)
+	defer job.Stop()
+
+	// the first purge runs right away
+	deadline := time.Now().Add(5 * time.Second)
+	for len(readTestRecords(t, conn, nil)) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("records past the retention were not purged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	job.Stop()
+	job.Stop()
+}
+
+// retention is disabled or left to the mongodb ttl index
+func TestRetentionJobDisabled(t *testing.T) {
+	conn := newTestMemoryConnection(t, Config{})
+	writeTestRecords(t, conn, newTestScriptRecord("jane", "jane.doe", "2001-06-01T10:00:00Z"))
+
+	for _, dbcfg := range []*Config{
+		{Backend: Memory},
+		{Backend: MongoDB, RetentionDays: 5, MongoTTLIndex: true},
+	} {
+		job := NewRetentionJob(conn, dbcfg, testLogger)
+		select {
+		case <-job.done:
+		default:
+			t.Errorf("job of %s with %d retention days is running", dbcfg.Backend, dbcfg.RetentionDays)
+		}
+		job.Stop()
+	}
+	if records := readTestRecords(t, conn, nil); len(records) != 1 {
+		t.Errorf("disabled retention purged records, %d left", len(records))
+	}
+}
+
+func TestGenerateMongoTTLIndex(t *testing.T) {
+	model := generateMongoTTLIndexModel(30)
+	if expire := model.Options.ExpireAfterSeconds; expire == nil || *expire != 30*24*60*60 {
+		t.Errorf("index expires after %v seconds, want 30 days", expire)
+	}
+
+	logrec := newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z")
+	if doc, _ := generateMongoDocument(logrec, false); doc != logrec {
+		t.Error("record is changed without a ttl index")
+	}
+	doc, err := generateMongoDocument(logrec, true)
+	if err != nil {
+		t.Fatalf("generating document: %v", err)
+	}
+	fields := doc.(bson.D)
+	last := fields[len(fields)-1]
+	if last.Key != mongoTTLField || !last.Value.(time.Time).Equal(logrec.GetTimeStamp()) {
+		t.Errorf("document ends with %v, want the record timestamp as %s", last, mongoTTLField)
+	}
+}
@@ -0,0 +1,110 @@
+package persistence
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"../cli"
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+// retries writes on transient failures with exponential backoff and jitter
+type RetryConnection struct {
+	Connection
+	MaxRetries  int
+	MaxBackoff  time.Duration
+	IsTransient func(error) bool
+}
+
+func NewRetryConnection(conn Connection, dbcfg *Config) *RetryConnection {
+	maxBackoff := dbcfg.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+	return &RetryConnection{
+		Connection:  conn,
+		MaxRetries:  dbcfg.MaxRetries,
+		MaxBackoff:  maxBackoff,
+		IsTransient: isTransientError,
+	}
+}
+
+func (w *RetryConnection) Write(ctx context.Context, logrec TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.WriteBatch(ctx, []TelemetryRecord{logrec}, logger)
+}
+
+// partially written batches are not retried to avoid duplicate records
+func (w *RetryConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	for attempt := 0; ; attempt++ {
+		result, err := w.Connection.WriteBatch(ctx, logrecs, logger)
+		if err == nil || attempt >= w.MaxRetries || !w.IsTransient(err) {
+			return result, err
+		}
+		if result != nil && result.Written > 0 {
+			return result, err
+		}
+
+		backoff := w.backoff(attempt)
+		connectionLogger(w.Connection, logger).Debug(
+			"transient write error, retrying",
+			"backoff", backoff, "attempt", attempt+1, "retries", w.MaxRetries, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return result, wrapContextError(ctx, err)
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// full jitter over exponentially growing backoff, capped at MaxBackoff
+func (w *RetryConnection) backoff(attempt int) time.Duration {
+	backoff := w.MaxBackoff
+	if attempt < 32 {
+		if exp := DefaultRetryBackoff << uint(attempt); exp > 0 && exp < backoff {
+			backoff = exp
+		}
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// connection losses, deadlocks and timeouts are worth retrying
+// constraint violations, bad queries and cancellations are not
+func isTransientError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if class := errorClass(err); class != nil {
+		return class == ErrConnection || class == ErrTimeout
+	}
+
+	// conflicts between concurrent transactions clear up on their own
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// serialization failure, deadlock
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		// deadlock
+		return mysqlErr.Number == 1213
+	}
+
+	var mssqlErr mssql.Error
+	if errors.As(err, &mssqlErr) {
+		// deadlock victim
+		return mssqlErr.Number == 1205
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
@@ -0,0 +1,200 @@
+package persistence
+
+import (
+	"context"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"../cli"
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+var errTestTransient = errors.New("database is restarting")
+
+// memory backend failing its first writes with err, each with result
+type flakyConnection struct {
+	*MemoryConnection
+
+	mutex  sync.Mutex
+	fails  int
+	err    error
+	result *Result
+	writes int
+}
+
+func newFlakyConnection(t *testing.T, fails int, err error) *flakyConnection {
+	memory := NewMemoryConnection(&Config{ScriptTarget: "scripts"})
+	t.Cleanup(func() { memory.Close() })
+	return &flakyConnection{MemoryConnection: memory, fails: fails, err: err}
+}
+
+func (w *flakyConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	w.mutex.Lock()
+	w.writes++
+	failing := w.writes <= w.fails
+	w.mutex.Unlock()
+	if failing {
+		return w.result, w.err
+	}
+	return w.MemoryConnection.WriteBatch(ctx, logrecs, logger)
+}
+
+func (w *flakyConnection) writeCount() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.writes
+}
+
+// retries with the transient errors of the test and little backoff
+func newTestRetryConnection(inner Connection, maxRetries int) *RetryConnection {
+	conn := NewRetryConnection(inner, &Config{MaxRetries: maxRetries, MaxBackoff: time.Millisecond})
+	conn.IsTransient = func(err error) bool { return err == errTestTransient }
+	return conn
+}
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{"nil", nil, false},
+		{"canceled", context.Canceled, false},
+		{"deadline", context.DeadlineExceeded, true},
+		{"wrapped deadline", errors.Wrap(context.DeadlineExceeded, "inserting"), true},
+		{"connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, true},
+		{"connection reset", errors.Wrap(syscall.ECONNRESET, "reading"), true},
+		{"mysql invalid connection", mysql.ErrInvalidConn, true},
+		{"postgres connection", &pq.Error{Code: "08006"}, true},
+		{"postgres serialization", &pq.Error{Code: "40001"}, true},
+		{"postgres deadlock", &pq.Error{Code: "40P01"}, true},
+		{"postgres unique", &pq.Error{Code: "23505"}, false},
+		{"postgres syntax", &pq.Error{Code: "42601"}, false},
+		{"mysql deadlock", &mysql.MySQLError{Number: 1213}, true},
+		{"mysql duplicate", &mysql.MySQLError{Number: 1062}, false},
+		{"mssql deadlock", mssql.Error{Number: 1205}, true},
+		{"mssql duplicate", mssql.Error{Number: 2627}, false},
+		{"sqlite busy", sqlite3.Error{Code: sqlite3.ErrBusy}, true},
+		{"sqlite locked", sqlite3.Error{Code: sqlite3.ErrLocked}, true},
+		{"sqlite constraint", sqlite3.Error{Code: sqlite3.ErrConstraint}, false},
+		{"other", errors.New("unknown telemetry record type"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if transient := isTransientError(test.err); transient != test.transient {
+				t.Errorf("%v is transient %v, want %v", test.err, transient, test.transient)
+			}
+		})
+	}
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		fails      int
+		err        error
+		maxRetries int
+		wantWrites int
+		wantErr    bool
+	}{
+		{"succeeds", 0, nil, 3, 1, false},
+		{"recovers", 2, errTestTransient, 3, 3, false},
+		{"gives up", 10, errTestTransient, 3, 4, true},
+		{"no retries", 10, errTestTransient, 0, 1, true},
+		{"not transient", 10, errTestWrite, 3, 1, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inner := newFlakyConnection(t, test.fails, test.err)
+			conn := newTestRetryConnection(inner, test.maxRetries)
+			_, err := conn.Write(context.Background(), newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"), testLogger)
+			if (err != nil) != test.wantErr {
+				t.Errorf("writing returned %v, want error %v", err, test.wantErr)
+			}
+			if writes := inner.writeCount(); writes != test.wantWrites {
+				t.Errorf("made %d write attempts, want %d", writes, test.wantWrites)
+			}
+		})
+	}
+}
+
+// a batch written in part could be written twice by a retry
+func TestRetryPartialWrites(t *testing.T) {
+	inner := newFlakyConnection(t, 10, errTestTransient)
+	inner.result = &Result{Written: 1}
+	conn := newTestRetryConnection(inner, 3)
+	res, err := conn.WriteBatch(context.Background(), []TelemetryRecord{
+		newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"),
+		newTestScriptRecord("jane", "jane.doe", "2021-06-01T11:00:00Z"),
+	}, testLogger)
+	if err != errTestTransient || res.Written != 1 {
+		t.Errorf("writing returned %+v, %v, want the partial result", res, err)
+	}
+	if writes := inner.writeCount(); writes != 1 {
+		t.Errorf("made %d write attempts, want 1", writes)
+	}
+}
+
+// the context bounds the retries, backoff included
+func TestRetryStopsWithContext(t *testing.T) {
+	inner := newFlakyConnection(t, 1000, errTestTransient)
+	conn := NewRetryConnection(inner, &Config{MaxRetries: 1000, MaxBackoff: 20 * time.Millisecond})
+	conn.IsTransient = func(err error) bool { return err == errTestTransient }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	_, err := conn.Write(ctx, newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"), testLogger)
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("writing returned %v, want a timeout", err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("retrying took %s after the context was done", elapsed)
+	}
+	if writes := inner.writeCount(); writes >= 1000 {
+		t.Errorf("made all %d write attempts", writes)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	conn := NewRetryConnection(NewMemoryConnection(&Config{}), &Config{MaxRetries: 5, MaxBackoff: time.Second})
+	for attempt := 0; attempt < 64; attempt++ {
+		limit := time.Second
+		if attempt < 4 {
+			limit = DefaultRetryBackoff << uint(attempt)
+		}
+		for sample := 0; sample < 20; sample++ {
+			if backoff := conn.backoff(attempt); backoff < 0 || backoff > limit {
+				t.Fatalf("backoff of attempt %d is %s, want up to %s", attempt, backoff, limit)
+			}
+		}
+	}
+
+	if defaulted := NewRetryConnection(NewMemoryConnection(&Config{}), &Config{}); defaulted.MaxBackoff != DefaultMaxBackoff {
+		t.Errorf("max backoff is %s, want %s", defaulted.MaxBackoff, DefaultMaxBackoff)
+	}
+}
+
+func TestNewConnectionRetries(t *testing.T) {
+	conn := newTestConnection(t, Config{ConnString: "memory:", MaxRetries: 2})
+	for {
+		if retry, ok := conn.(*RetryConnection); ok {
+			if retry.MaxRetries != 2 {
+				t.Errorf("max retries is %d, want 2", retry.MaxRetries)
+			}
+			return
+		}
+		inner, ok := innerConnection(conn)
+		if !ok {
+			t.Fatal("connection does not retry writes")
+		}
+		conn = inner
+	}
+}
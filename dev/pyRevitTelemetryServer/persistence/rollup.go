@@ -0,0 +1,197 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"../cli"
+	"github.com/pkg/errors"
+)
+
+// rollup days are the utc dates of the record timestamps
+const rollupDayLayout = "2006-01-02"
+
+// script runs of a command on a day, Day is yyyy-mm-dd in utc
+type DailyCommandCount struct {
+	Day         string `json:"day"`
+	CommandName string `json:"commandname"`
+	Count       int    `json:"count"`
+}
+
+// summary table next to the script table of the connection
+func rollupTable(scriptTarget string) string {
+	return scriptTarget + "_daily_command_counts"
+}
+
+// recomputes the daily command counts of the days from since on, zero
+// since recomputes every day. the days are replaced in one transaction
+// so running it again gives the same counts, and readers never see a
+// day half refreshed. meant to run on a schedule, days of purged
+// records keep their counts
+func RefreshRollups(ctx context.Context, conn Connection, since time.Time, logger *cli.Logger) error {
+	log := connectionLogger(conn, logger)
+
+	sqlConn, ok := unwrapSQLConnection(conn)
+	if !ok {
+		return errors.Errorf("rollups are not supported by %s backend", conn.GetType())
+	}
+	if err := sqlConn.begin(); err != nil {
+		return err
+	}
+	defer sqlConn.end()
+
+	if err := sqlConn.EnsureSchema(ctx, logger); err != nil {
+		return err
+	}
+
+	backend := sqlConn.Config.Backend
+	table := rollupTable(sqlConn.Config.ScriptTarget)
+	createQuery := generateCreateRollupTableQuery(backend, table)
+	log.Trace(createQuery)
+	if _, err := sqlConn.db.ExecContext(ctx, createQuery); err != nil {
+		return wrapContextError(ctx, err)
+	}
+
+	deleteQuery, deleteArgs := generateDeleteRollupsQuery(backend, table, since)
+	insertQuery, insertArgs := generateInsertRollupsQuery(backend, table, sqlConn.Config.ScriptTarget, since)
+
+	log.Debug("refreshing rollups", "table", table)
+	tx, beginErr := sqlConn.db.BeginTx(ctx, nil)
+	if beginErr != nil {
+		return wrapContextError(ctx, beginErr)
+	}
+	defer tx.Rollback()
+
+	log.Trace(deleteQuery)
+	if _, err := tx.ExecContext(ctx, deleteQuery, deleteArgs...); err != nil {
+		return wrapContextError(ctx, err)
+	}
+	log.Trace(insertQuery)
+	if _, err := tx.ExecContext(ctx, insertQuery, insertArgs...); err != nil {
+		return wrapContextError(ctx, err)
+	}
+	return wrapContextError(ctx, tx.Commit())
+}
+
+// daily command counts of the days between from and to, as of the last
+// RefreshRollups. zero times leave the range open
+func ReadDailyCommandCounts(ctx context.Context, conn Connection, from time.Time, to time.Time, logger *cli.Logger) ([]DailyCommandCount, error) {
+	sqlConn, ok := unwrapSQLConnection(conn)
+	if !ok {
+		return nil, errors.Errorf("rollups are not supported by %s backend", conn.GetType())
+	}
+	if err := sqlConn.begin(); err != nil {
+		return nil, err
+	}
+	defer sqlConn.end()
+
+	query, args := generateSelectRollupsQuery(
+		sqlConn.Config.Backend, rollupTable(sqlConn.Config.ScriptTarget), from, to)
+	connectionLogger(conn, logger).Trace(query)
+	rows, qErr := sqlConn.readDb.QueryContext(ctx, query, args...)
+	if qErr != nil {
+		return nil, wrapContextError(ctx, qErr)
+	}
+	defer rows.Close()
+
+	counts := make([]DailyCommandCount, 0)
+	for rows.Next() {
+		var count DailyCommandCount
+		if sErr := rows.Scan(&count.Day, &count.CommandName, &count.Count); sErr != nil {
+			return nil, sErr
+		}
+		counts = append(counts, count)
+	}
+	if rErr := rows.Err(); rErr != nil {
+		return nil, wrapContextError(ctx, rErr)
+	}
+	return counts, nil
+}
+
+func generateCreateRollupTableQuery(backend DBBackend, table string) string {
+	body := fmt.Sprintf(
+		"%s VARCHAR(10) NOT NULL, %s %s NOT NULL, %s BIGINT NOT NULL",
+		quoteSQLColumn(backend, "day"),
+		quoteSQLColumn(backend, "commandname"),
+		sqlTextTypes[backend],
+		quoteSQLColumn(backend, "runs"))
+
+	// sqlserver has no IF NOT EXISTS for tables
+	if backend == MSSql {
+		return fmt.Sprintf(
+			"IF OBJECT_ID(N'%s', N'U') IS NULL CREATE TABLE %s (%s)",
+			strings.Replace(table, "'", "''", -1), table, body)
+	}
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", table, body)
+}
+
+func generateDeleteRollupsQuery(backend DBBackend, table string, since time.Time) (string, []interface{}) {
+	if since.IsZero() {
+		return fmt.Sprintf("DELETE FROM %s", table), nil
+	}
+	return fmt.Sprintf(
+			"DELETE FROM %s WHERE %s >= %s",
+			table, quoteSQLColumn(backend, "day"), sqlPlaceholder(backend, 1)),
+		[]interface{}{since.UTC().Format(rollupDayLayout)}
+}
+
+// whole days are recomputed, the day of since included
+func generateInsertRollupsQuery(backend DBBackend, table string, scriptTable string, since time.Time) (string, []interface{}) {
+	day := sqlDayExpression(backend)
+	command := "COALESCE(commandname, '')"
+
+	where := ""
+	args := make([]interface{}, 0)
+	if !since.IsZero() {
+		since = since.UTC()
+		args = append(args, sqlTimeArg(backend, time.Date(since.Year(), since.Month(), since.Day(), 0, 0, 0, 0, time.UTC)))
+		where = " WHERE " + sqlTimeCondition(backend, ">=", sqlPlaceholder(backend, 1))
+	}
+	return fmt.Sprintf(
+		"INSERT INTO %s (%s, %s, %s) SELECT %s, %s, COUNT(*) FROM %s%s GROUP BY %s, %s",
+		table,
+		quoteSQLColumn(backend, "day"),
+		quoteSQLColumn(backend, "commandname"),
+		quoteSQLColumn(backend, "runs"),
+		day, command, scriptTable, where, day, command), args
+}
+
+// yyyy-mm-dd utc date of the timestamp column, mysql and sqlite store
+// utc times already
+func sqlDayExpression(backend DBBackend) string {
+	column := quoteSQLColumn(backend, "timestamp")
+	switch backend {
+	case Postgres:
+		return fmt.Sprintf("to_char(%s AT TIME ZONE 'UTC', 'YYYY-MM-DD')", column)
+	case MSSql:
+		return fmt.Sprintf("CONVERT(VARCHAR(10), CAST(SWITCHOFFSET(%s, '+00:00') AS DATE), 23)", column)
+	case MySql:
+		return fmt.Sprintf("DATE_FORMAT(%s, '%%Y-%%m-%%d')", column)
+	default:
+		return fmt.Sprintf("SUBSTR(%s, 1, 10)", column)
+	}
+}
+
+func generateSelectRollupsQuery(backend DBBackend, table string, from time.Time, to time.Time) (string, []interface{}) {
+	dayColumn := quoteSQLColumn(backend, "day")
+	conditions := make([]string, 0)
+	args := make([]interface{}, 0)
+	if !from.IsZero() {
+		args = append(args, from.UTC().Format(rollupDayLayout))
+		conditions = append(conditions, dayColumn+" >= "+sqlPlaceholder(backend, len(args)))
+	}
+	if !to.IsZero() {
+		args = append(args, to.UTC().Format(rollupDayLayout))
+		conditions = append(conditions, dayColumn+" <= "+sqlPlaceholder(backend, len(args)))
+	}
+
+	query := fmt.Sprintf(
+		"SELECT %s, %s, %s FROM %s",
+		dayColumn, quoteSQLColumn(backend, "commandname"), quoteSQLColumn(backend, "runs"), table)
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	return query + fmt.Sprintf(" ORDER BY %s, %s", dayColumn, quoteSQLColumn(backend, "commandname")), args
+}
@@ -0,0 +1,122 @@
+package persistence
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRefreshRollups(t *testing.T) {
+	testRefreshRollups(t, newTestSqliteConnection)
+}
+
+func TestRefreshRollupsServers(t *testing.T) {
+	for _, server := range testSQLServers {
+		t.Run(string(server.backend), func(t *testing.T) {
+			testRefreshRollups(t, func(t *testing.T, dbcfg Config) Connection {
+				return newTestSQLServerConnection(t, server.env, dbcfg)
+			})
+		})
+	}
+}
+
+func newTestCommandRecord(command string, timestamp string) *ScriptTelemetryRecordV2 {
+	logrec := newTestScriptRecord("jane", "jane.doe", timestamp)
+	logrec.CommandName = command
+	return logrec
+}
+
+func refreshTestRollups(t *testing.T, conn Connection, since time.Time) []DailyCommandCount {
+	t.Helper()
+	if err := RefreshRollups(context.Background(), conn, since, testLogger); err != nil {
+		t.Fatalf("refreshing rollups: %v", err)
+	}
+	counts, err := ReadDailyCommandCounts(context.Background(), conn, time.Time{}, time.Time{}, testLogger)
+	if err != nil {
+		t.Fatalf("reading rollups: %v", err)
+	}
+	return counts
+}
+
+// shared by the sql backends, refreshing again gives the same counts
+func testRefreshRollups(t *testing.T, connect func(*testing.T, Config) Connection) {
+	conn := connect(t, Config{})
+	writeTestRecords(t, conn,
+		newTestCommandRecord("Sync", "2021-06-01T10:00:00Z"),
+		newTestCommandRecord("Sync", "2021-06-01T11:00:00Z"),
+		newTestCommandRecord("Purge", "2021-06-01T12:00:00Z"),
+		newTestCommandRecord("Sync", "2021-06-02T10:00:00Z"))
+
+	want := []DailyCommandCount{
+		{Day: "2021-06-01", CommandName: "Purge", Count: 1},
+		{Day: "2021-06-01", CommandName: "Sync", Count: 2},
+		{Day: "2021-06-02", CommandName: "Sync", Count: 1},
+	}
+	for run := 0; run < 2; run++ {
+		if counts := refreshTestRollups(t, conn, time.Time{}); !reflect.DeepEqual(counts, want) {
+			t.Errorf("run %d counted %v, want %v", run, counts, want)
+		}
+	}
+
+	// refreshing from a day recomputes the days from it on, the days of
+	// purged records keep their counts
+	writeTestRecords(t, conn, newTestCommandRecord("Sync", "2021-06-02T11:00:00Z"))
+	if _, err := conn.PurgeOlderThan(context.Background(), time.Date(2021, 6, 2, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("purging: %v", err)
+	}
+	want[2].Count = 2
+	since := time.Date(2021, 6, 2, 8, 0, 0, 0, time.UTC)
+	for run := 0; run < 2; run++ {
+		if counts := refreshTestRollups(t, conn, since); !reflect.DeepEqual(counts, want) {
+			t.Errorf("run %d from %s counted %v, want %v", run, since.Format(rollupDayLayout), counts, want)
+		}
+	}
+
+	// reads are limited to the days of the range
+	day := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	counts, err := ReadDailyCommandCounts(context.Background(), conn, day, day, testLogger)
+	if err != nil {
+		t.Fatalf("reading rollups of a day: %v", err)
+	}
+	if !reflect.DeepEqual(counts, want[:2]) {
+		t.Errorf("counted %v on %s, want %v", counts, day.Format(rollupDayLayout), want[:2])
+	}
+}
+
+func TestRefreshRollupsUnsupported(t *testing.T) {
+	conn := newTestMemoryConnection(t, Config{})
+	if err := RefreshRollups(context.Background(), conn, time.Time{}, testLogger); err == nil || !strings.Contains(err.Error(), "not supported by memory backend") {
+		t.Errorf("refreshing rollups of memory backend returned %v", err)
+	}
+	if _, err := ReadDailyCommandCounts(context.Background(), conn, time.Time{}, time.Time{}, testLogger); err == nil {
+		t.Error("reading rollups of memory backend succeeded")
+	}
+}
+
+func TestGenerateRollupQueries(t *testing.T) {
+	since := time.Date(2021, 6, 2, 8, 0, 0, 0, time.FixedZone("", -5*3600))
+	deleteQuery, deleteArgs := generateDeleteRollupsQuery(Postgres, "scripts_daily_command_counts", since)
+	if deleteQuery != `DELETE FROM scripts_daily_command_counts WHERE "day" >= $1` {
+		t.Errorf("delete query is %s", deleteQuery)
+	}
+	// the day of since is taken in utc
+	if !reflect.DeepEqual(deleteArgs, []interface{}{"2021-06-02"}) {
+		t.Errorf("delete args are %v", deleteArgs)
+	}
+
+	insertQuery, _ := generateInsertRollupsQuery(MSSql, "scripts_daily_command_counts", "scripts", time.Time{})
+	if !strings.Contains(insertQuery, "SWITCHOFFSET([timestamp], '+00:00')") || strings.Contains(insertQuery, "WHERE") {
+		t.Errorf("insert query is %s", insertQuery)
+	}
+
+	// days start at utc midnight, compared with the typed column
+	insertQuery, insertArgs := generateInsertRollupsQuery(Postgres, "scripts_daily_command_counts", "scripts", since)
+	if !strings.Contains(insertQuery, "WHERE timestamp >= $1") {
+		t.Errorf("insert query is %s", insertQuery)
+	}
+	if !reflect.DeepEqual(insertArgs, []interface{}{time.Date(2021, 6, 2, 0, 0, 0, 0, time.UTC)}) {
+		t.Errorf("insert args are %v", insertArgs)
+	}
+}
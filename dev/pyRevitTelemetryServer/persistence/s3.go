@@ -0,0 +1,308 @@
+package persistence
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"../cli"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	DefaultS3FlushSize     = 5 * 1024 * 1024
+	DefaultS3FlushInterval = time.Minute
+)
+
+// buffers records and archives them as ndjson objects, gzipped by default, under
+// <prefix>/<target>/year=YYYY/month=MM/day=DD/
+type S3Connection struct {
+	DatabaseConnection
+	client      *s3.Client
+	bucket      string
+	prefix      string
+	compression string
+
+	mutex   sync.Mutex
+	buffers map[string]*bytes.Buffer
+	counts  map[string]int
+	parts   int
+
+	stopFlush chan struct{}
+	flushDone chan struct{}
+}
+
+func newS3Connection(w DatabaseConnection) (*S3Connection, error) {
+	// s3://bucket/prefix
+	s3url, err := url.Parse(w.Config.ConnString)
+	if err != nil {
+		return nil, err
+	}
+	if s3url.Host == "" {
+		return nil, errors.New("s3 backend requires a bucket name")
+	}
+
+	compression, mErr := w.Config.compressionOr(CompressionGzip)
+	if mErr != nil {
+		return nil, mErr
+	}
+
+	awscfg, cErr := awsconfig.LoadDefaultConfig(
+		context.Background(),
+		awsconfig.WithRegion(w.Config.S3Region))
+	if cErr != nil {
+		return nil, cErr
+	}
+
+	client := s3.NewFromConfig(awscfg, func(opts *s3.Options) {
+		// custom endpoints are s3-compatible stores such as minio
+		if w.Config.S3Endpoint != "" {
+			opts.BaseEndpoint = aws.String(w.Config.S3Endpoint)
+			opts.UsePathStyle = true
+		}
+	})
+
+	conn := &S3Connection{
+		DatabaseConnection: w,
+		client:             client,
+		bucket:             s3url.Host,
+		prefix:             strings.Trim(s3url.Path, "/"),
+		compression:        compression,
+		buffers:            make(map[string]*bytes.Buffer),
+		counts:             make(map[string]int),
+		stopFlush:          make(chan struct{}),
+		flushDone:          make(chan struct{}),
+	}
+	go conn.flushLoop()
+	return conn, nil
+}
+
+func (w *S3Connection) GetType() DBBackend {
+	return w.Config.Backend
+}
+
+func (w *S3Connection) GetVersion(logger *cli.Logger) string {
+	return "s3"
+}
+
+func (w *S3Connection) GetStatus(logger *cli.Logger) ConnectionStatus {
+	return newConnectionStatus(w.Ping(context.Background()), w.GetVersion(logger))
+}
+
+func (w *S3Connection) Ping(ctx context.Context) error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+	defer w.end()
+
+	pingCtx, cancel := w.Config.newPingContext(ctx)
+	defer cancel()
+
+	_, err := w.client.HeadBucket(pingCtx, &s3.HeadBucketInput{
+		Bucket: aws.String(w.bucket),
+	})
+	return wrapContextError(pingCtx, err)
+}
+
+func (w *S3Connection) Write(ctx context.Context, logrec TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.WriteBatch(ctx, []TelemetryRecord{logrec}, logger)
+}
+
+// records are accepted into the buffer and persisted on the next flush
+func (w *S3Connection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	log := w.Config.structured(logger)
+
+	if len(logrecs) == 0 {
+		return &Result{
+			ResultCode: ResultNoData,
+			Message:    "no data to write",
+		}, nil
+	}
+
+	log.Debug("buffering records")
+	w.mutex.Lock()
+	full := make([]string, 0)
+	for _, logrec := range logrecs {
+		data, mErr := json.Marshal(logrec)
+		if mErr != nil {
+			w.mutex.Unlock()
+			return nil, mErr
+		}
+
+		target := w.Config.targetFor(logrec)
+		buffer, exists := w.buffers[target]
+		if !exists {
+			buffer = &bytes.Buffer{}
+			w.buffers[target] = buffer
+		}
+		buffer.Write(data)
+		buffer.WriteByte('\n')
+		w.counts[target]++
+
+		if buffer.Len() >= w.flushSize() && !containsString(full, target) {
+			full = append(full, target)
+		}
+	}
+	w.mutex.Unlock()
+
+	// flush buffers that reached the size threshold
+	keys := make([]string, 0)
+	for _, target := range full {
+		log.Debug("flushing buffer", "target", target)
+		key, fErr := w.flush(ctx, target)
+		if fErr != nil {
+			return &Result{Written: len(logrecs)}, fErr
+		}
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	log.Debug("preparing report")
+	message := fmt.Sprintf("buffered %d usage records", len(logrecs))
+	if len(keys) > 0 {
+		message = fmt.Sprintf("%s; flushed %s", message, strings.Join(keys, ", "))
+	}
+	return &Result{
+		Written: len(logrecs),
+		Message: message,
+	}, nil
+}
+
+// stops the flush loop and uploads whatever is still buffered
+func (w *S3Connection) Close() error {
+	if !w.drain() {
+		return nil
+	}
+	close(w.stopFlush)
+	<-w.flushDone
+	return w.flushAll(context.Background())
+}
+
+func (w *S3Connection) flushSize() int {
+	if w.Config.S3FlushSize > 0 {
+		return w.Config.S3FlushSize
+	}
+	return DefaultS3FlushSize
+}
+
+func (w *S3Connection) flushLoop() {
+	defer close(w.flushDone)
+
+	interval := w.Config.S3FlushInterval
+	if interval <= 0 {
+		interval = DefaultS3FlushInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stopFlush:
+			return
+		case <-ticker.C:
+			w.flushAll(context.Background())
+		}
+	}
+}
+
+func (w *S3Connection) flushAll(ctx context.Context) error {
+	w.mutex.Lock()
+	targets := make([]string, 0, len(w.buffers))
+	for target := range w.buffers {
+		targets = append(targets, target)
+	}
+	w.mutex.Unlock()
+
+	var lastErr error
+	for _, target := range targets {
+		if _, err := w.flush(ctx, target); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// uploads the target buffer as a new object and returns its key
+// on failure the data is put back in front of the buffer
+func (w *S3Connection) flush(ctx context.Context, target string) (string, error) {
+	w.mutex.Lock()
+	buffer, exists := w.buffers[target]
+	if !exists || buffer.Len() == 0 {
+		w.mutex.Unlock()
+		return "", nil
+	}
+	data := buffer.Bytes()
+	count := w.counts[target]
+	delete(w.buffers, target)
+	delete(w.counts, target)
+	w.parts++
+	part := w.parts
+	w.mutex.Unlock()
+
+	body, extension, contentEncoding := data, ".json", ""
+	if w.compression == CompressionGzip {
+		compressed, gErr := gzipBytes(data)
+		if gErr != nil {
+			w.restore(target, data, count)
+			return "", gErr
+		}
+		body, extension, contentEncoding = compressed, ".json.gz", "gzip"
+	}
+
+	// part numbers restart with the process, the id keeps keys unique
+	now := time.Now().UTC()
+	key := path.Join(
+		w.prefix,
+		target,
+		fmt.Sprintf("year=%04d", now.Year()),
+		fmt.Sprintf("month=%02d", now.Month()),
+		fmt.Sprintf("day=%02d", now.Day()),
+		fmt.Sprintf("part-%04d-%s%s", part, uuid.Must(uuid.NewV4()).String()[:8], extension),
+	)
+
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(w.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/x-ndjson"),
+	}
+	if contentEncoding != "" {
+		input.ContentEncoding = aws.String(contentEncoding)
+	}
+
+	_, err := w.client.PutObject(ctx, input)
+	if err != nil {
+		w.restore(target, data, count)
+		return "", wrapContextError(ctx, err)
+	}
+
+	return fmt.Sprintf("s3://%s/%s", w.bucket, key), nil
+}
+
+func (w *S3Connection) restore(target string, data []byte, count int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	restored := bytes.NewBuffer(data)
+	if pending, exists := w.buffers[target]; exists {
+		restored.Write(pending.Bytes())
+	}
+	w.buffers[target] = restored
+	w.counts[target] += count
+}
@@ -0,0 +1,150 @@
+package persistence
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// a record field stored in a sql column, from its db struct tag
+// options after the column name:
+// recordid -> client provided or generated record id
+// json -> json encoded
+// omitempty -> NULL instead of empty json
+// joined -> string lists joined by ;
+// time -> rfc3339 text stored as a time of the dialect
+type sqlField struct {
+	column    string
+	index     []int
+	recordId  bool
+	json      bool
+	omitEmpty bool
+	joined    bool
+	time      bool
+}
+
+// v2 record fields, in insert order
+var (
+	scriptFieldsV2 = sqlFields(reflect.TypeOf(ScriptTelemetryRecordV2{}), nil)
+	eventFieldsV2  = sqlFields(reflect.TypeOf(EventTelemetryRecordV2{}), nil)
+)
+
+// v2 table columns, in insert order
+var (
+	scriptColumnsV2 = sqlFieldColumns(scriptFieldsV2)
+	eventColumnsV2  = sqlFieldColumns(eventFieldsV2)
+)
+
+// fields with a db tag in declaration order, untagged struct fields
+// are flattened into their parent
+func sqlFields(recordType reflect.Type, parent []int) []sqlField {
+	fields := make([]sqlField, 0)
+	for idx := 0; idx < recordType.NumField(); idx++ {
+		structField := recordType.Field(idx)
+		index := append(append([]int{}, parent...), idx)
+
+		tag, tagged := structField.Tag.Lookup("db")
+		if !tagged {
+			if structField.Type.Kind() == reflect.Struct {
+				fields = append(fields, sqlFields(structField.Type, index)...)
+			}
+			continue
+		}
+		if tag == "-" {
+			continue
+		}
+
+		options := strings.Split(tag, ",")
+		field := sqlField{column: options[0], index: index}
+		for _, option := range options[1:] {
+			switch option {
+			case "recordid":
+				field.recordId = true
+			case "json":
+				field.json = true
+			case "omitempty":
+				field.omitEmpty = true
+			case "joined":
+				field.joined = true
+			case "time":
+				field.time = true
+			}
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+func sqlFieldColumns(fields []sqlField) []string {
+	columns := make([]string, 0, len(fields))
+	for _, field := range fields {
+		columns = append(columns, field.column)
+	}
+	return columns
+}
+
+// values are passed as strings and empty ones as NULL, the same as
+// ToSqlArgs, the database converts them to the column types. times are
+// converted here, the dialects do not all parse rfc3339 offsets
+func generateTaggedInsertValues(backend DBBackend, logrec TelemetryRecord, fields []sqlField, log *structuredLogger) ([]interface{}, error) {
+	record := reflect.Indirect(reflect.ValueOf(logrec))
+	values := make([]interface{}, 0, len(fields))
+	for _, field := range fields {
+		value, err := generateSQLValue(backend, logrec, record.FieldByIndex(field.index), field, log)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func generateSQLValue(backend DBBackend, logrec TelemetryRecord, value reflect.Value, field sqlField, log *structuredLogger) (interface{}, error) {
+	var text string
+	switch {
+	case field.time:
+		if value.String() == "" {
+			return nil, nil
+		}
+		parsed, err := time.Parse(time.RFC3339, value.String())
+		if err != nil {
+			return nil, errors.Errorf("invalid %s %q", field.column, value.String())
+		}
+		return sqlTimeArg(backend, parsed), nil
+	case field.recordId:
+		recordId, err := newRecordId(logrec)
+		if err != nil {
+			return nil, err
+		}
+		text = recordId
+	case field.json:
+		if field.omitEmpty && value.Len() == 0 {
+			return nil, nil
+		}
+		data, err := json.Marshal(value.Interface())
+		if err != nil {
+			log.Debug("error logging column", "column", field.column, "error", err)
+		}
+		text = string(data)
+	case field.joined:
+		text = strings.Join(value.Interface().([]string), ";")
+	default:
+		switch value.Kind() {
+		case reflect.Bool:
+			text = strconv.FormatBool(value.Bool())
+		case reflect.Int:
+			text = strconv.Itoa(int(value.Int()))
+		default:
+			text = value.String()
+		}
+	}
+
+	if text == "" {
+		return nil, nil
+	}
+	return text, nil
+}
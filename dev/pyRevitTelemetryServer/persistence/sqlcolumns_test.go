@@ -0,0 +1,117 @@
+package persistence
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// columns in the declaration order of the tagged fields
+func TestSqlColumnsV2(t *testing.T) {
+	tests := []struct {
+		name    string
+		columns []string
+		want    []string
+	}{
+		{"scripts", scriptColumnsV2, []string{
+			"id", "timestamp", "username", "host_user", "revit", "revitbuild",
+			"sessionid", "pyrevit", "clone", "debug", "config", "from_gui",
+			"exec_id", "exec_timestamp", "commandname", "commanduniquename",
+			"commandbundle", "commandextension", "docname", "docpath",
+			"resultcode", "duration", "commandresults", "scriptpath", "engine_type",
+			"engine_version", "engine_syspath", "engine_configs",
+			"trace_message", "extras",
+		}},
+		{"events", eventColumnsV2, []string{
+			"id", "timestamp", "handler_id", "type", "args", "username",
+			"host_user", "revit", "revitbuild", "cancellable", "cancelled",
+			"docid", "doctype", "doctemplate", "docname", "docpath",
+			"projectnum", "projectname", "extras",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if !reflect.DeepEqual(test.columns, test.want) {
+				t.Errorf("columns are %v, want %v", test.columns, test.want)
+			}
+		})
+	}
+}
+
+// every field is read from the struct field its tag is on
+func TestSqlFieldsMatchTags(t *testing.T) {
+	for _, recordType := range []reflect.Type{
+		reflect.TypeOf(ScriptTelemetryRecordV2{}),
+		reflect.TypeOf(EventTelemetryRecordV2{}),
+	} {
+		for _, field := range sqlFields(recordType, nil) {
+			tag := recordType.FieldByIndex(field.index).Tag.Get("db")
+			if column := strings.Split(tag, ",")[0]; column != field.column {
+				t.Errorf("%s field of %s is tagged %s", field.column, recordType.Name(), tag)
+			}
+		}
+	}
+}
+
+func TestGenerateTaggedInsertValues(t *testing.T) {
+	logrec := newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z")
+	logrec.RecordId = "0d7b0bb6-0b8a-4a0c-9a8e-4e0f3f4b8e1a"
+	logrec.IsDebugMode = true
+	logrec.ResultCode = 2
+	logrec.TraceInfo.EngineInfo.SysPaths = []string{`C:\lib`, `C:\site`}
+	logrec.TraceInfo.EngineInfo.Configs = map[string]interface{}{"clean": true}
+
+	values, err := generateTaggedInsertValues(Postgres, logrec, scriptFieldsV2, (*Config)(nil).structured(testLogger))
+	if err != nil {
+		t.Fatalf("generating values: %v", err)
+	}
+	if len(values) != len(scriptColumnsV2) {
+		t.Fatalf("generated %d values for %d columns", len(values), len(scriptColumnsV2))
+	}
+	byColumn := make(map[string]interface{})
+	for idx, column := range scriptColumnsV2 {
+		byColumn[column] = values[idx]
+	}
+
+	tests := []struct {
+		column string
+		want   interface{}
+	}{
+		{"id", logrec.RecordId},
+		{"username", "jane"},
+		{"debug", "true"},
+		{"config", "false"},
+		{"resultcode", "2"},
+		{"commandresults", "{}"},
+		{"engine_type", "ironpython"},
+		{"engine_syspath", `C:\lib;C:\site`},
+		{"engine_configs", `{"clean":true}`},
+		{"docname", nil},
+		{"extras", nil},
+	}
+	for _, test := range tests {
+		if value := byColumn[test.column]; value != test.want {
+			t.Errorf("%s value is %#v, want %#v", test.column, value, test.want)
+		}
+	}
+}
+
+func TestGenerateInsertQueryColumns(t *testing.T) {
+	rows := [][]interface{}{{"a", "jane"}}
+	log := (*Config)(nil).structured(testLogger)
+	tests := []struct {
+		backend DBBackend
+		columns []string
+		prefix  string
+	}{
+		{Postgres, []string{"id", "username"}, `INSERT INTO scripts ("id", "username") values ($1, $2)`},
+		{MySql, []string{"id", "username"}, "INSERT INTO scripts (`id`, `username`) values (?, ?)"},
+		{MSSql, []string{"id", "username"}, "INSERT INTO scripts ([id], [username]) SELECT * FROM (VALUES (@p1, @p2)"},
+		{Sqlite, nil, "INSERT INTO scripts values (?, ?)"},
+	}
+	for _, test := range tests {
+		if query := generateInsertQuery(test.backend, "scripts", test.columns, rows, log).Query; !strings.HasPrefix(query, test.prefix) {
+			t.Errorf("%s query is %s, want it to start with %s", test.backend, query, test.prefix)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"../cli"
+)
+
+// integer columns, everything else but the timestamp is stored as text
+// since inserts pass the record values as strings
+var sqlIntColumns = map[string]bool{
+	"resultcode": true,
+	"duration":   true,
+	"docid":      true,
+}
+
+// text column type per dialect
+var sqlTextTypes = map[DBBackend]string{
+	Postgres: "TEXT",
+	MySql:    "TEXT",
+	MSSql:    "NVARCHAR(MAX)",
+	Sqlite:   "TEXT",
+}
+
+// record timestamp column type per dialect, so reads sort and filter on
+// the bare column and its index. sqlite has no time type and stores utc
+// text of a fixed width instead, which sorts like the times, see sqlTimeArg
+var sqlTimeTypes = map[DBBackend]string{
+	Postgres: "TIMESTAMPTZ",
+	MySql:    "DATETIME(6)",
+	MSSql:    "DATETIMEOFFSET",
+	Sqlite:   "TEXT",
+}
+
+// a script or event table and its columns, in insert order
+type sqlTable struct {
+	name    string
+	columns []string
+}
+
+// the v2 script and event tables of the connection that are configured
+func (w *GenericSQLConnection) schemaTables() []sqlTable {
+	tables := make([]sqlTable, 0, 2)
+	if w.Config.ScriptTarget != "" {
+		tables = append(tables, sqlTable{w.Config.ScriptTarget, scriptColumnsV2})
+	}
+	if w.Config.EventTarget != "" {
+		tables = append(tables, sqlTable{w.Config.EventTarget, eventColumnsV2})
+	}
+	return tables
+}
+
+// brings the v2 script and event tables to the latest schema version
+// safe to call repeatedly, applied migrations are skipped
+func (w *GenericSQLConnection) EnsureSchema(ctx context.Context, logger *cli.Logger) error {
+	w.migrateMutex.Lock()
+	defer w.migrateMutex.Unlock()
+	if w.migrated {
+		return nil
+	}
+
+	w.Config.structured(logger).Debug("ensuring sql schema is up to date")
+	if err := w.migrateTo(ctx, LatestSchemaVersion(), logger); err != nil {
+		return err
+	}
+	if w.Config.Partitioning {
+		for _, table := range w.schemaTables() {
+			if pErr := w.checkPartitioned(ctx, table.name); pErr != nil {
+				return pErr
+			}
+		}
+	}
+
+	w.migrated = true
+	return nil
+}
+
+func generateCreateTableQuery(backend DBBackend, table string, columns []string) string {
+	body := strings.Join(generateColumnDefinitions(backend, columns, true), ", ")
+
+	// sqlserver has no IF NOT EXISTS for tables
+	if backend == MSSql {
+		return fmt.Sprintf(
+			"IF OBJECT_ID(N'%s', N'U') IS NULL CREATE TABLE %s (%s)",
+			strings.Replace(table, "'", "''", -1), table, body)
+	}
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", table, body)
+}
+
+// optionally declares id as the primary key, partitioned tables
+// need the partition column in the key and declare it separately
+func generateColumnDefinitions(backend DBBackend, columns []string, idPrimaryKey bool) []string {
+	definitions := make([]string, 0, len(columns))
+	for _, column := range columns {
+		columnType := sqlTextTypes[backend]
+		if column == "id" {
+			columnType = "VARCHAR(36) NOT NULL"
+			if idPrimaryKey {
+				columnType += " PRIMARY KEY"
+			}
+		} else if column == "timestamp" {
+			columnType = sqlTimeTypes[backend]
+		} else if sqlIntColumns[column] {
+			columnType = "INTEGER"
+		} else if jsonType, exists := sqlJSONTypes[backend]; exists && column == extrasColumn {
+			columnType = jsonType
+		}
+		definitions = append(definitions, fmt.Sprintf("%s %s", quoteSQLColumn(backend, column), columnType))
+	}
+	return definitions
+}
+
+// some column names are reserved words in a few dialects
+func quoteSQLColumn(backend DBBackend, column string) string {
+	switch backend {
+	case MySql:
+		return "`" + column + "`"
+	case MSSql:
+		return "[" + column + "]"
+	default:
+		return `"` + column + `"`
+	}
+}
@@ -0,0 +1,101 @@
+package persistence
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerateCreateTableQuery(t *testing.T) {
+	tests := []struct {
+		backend DBBackend
+		want    []string
+	}{
+		{Postgres, []string{"CREATE TABLE IF NOT EXISTS scripts (", `"id" VARCHAR(36) NOT NULL PRIMARY KEY`, `"username" TEXT`, `"resultcode" INTEGER`}},
+		{MySql, []string{"CREATE TABLE IF NOT EXISTS scripts (", "`id` VARCHAR(36) NOT NULL PRIMARY KEY", "`username` TEXT", "`resultcode` INTEGER"}},
+		{MSSql, []string{"IF OBJECT_ID(N'scripts', N'U') IS NULL CREATE TABLE scripts (", "[id] VARCHAR(36) NOT NULL PRIMARY KEY", "[username] NVARCHAR(MAX)", "[resultcode] INTEGER"}},
+		{Sqlite, []string{"CREATE TABLE IF NOT EXISTS scripts (", `"id" VARCHAR(36) NOT NULL PRIMARY KEY`, `"username" TEXT`, `"resultcode" INTEGER`}},
+	}
+	for _, test := range tests {
+		t.Run(string(test.backend), func(t *testing.T) {
+			query := generateCreateTableQuery(test.backend, "scripts", scriptColumnsV2)
+			for _, want := range test.want {
+				if !strings.Contains(query, want) {
+					t.Errorf("%s does not contain %s", query, want)
+				}
+			}
+		})
+	}
+}
+
+// a second connection to the migrated database finds the schema in place
+func TestEnsureSchema(t *testing.T) {
+	dbcfg := Config{Backend: Sqlite, ConnString: "sqlite3:" + filepath.Join(t.TempDir(), "telemetry.db")}
+	for idx := 0; idx < 2; idx++ {
+		conn := newTestConnection(t, dbcfg)
+		sqlConn, _ := unwrapSQLConnection(conn)
+		if err := sqlConn.EnsureSchema(context.Background(), testLogger); err != nil {
+			t.Fatalf("ensuring schema on connection %d: %v", idx+1, err)
+		}
+		if err := sqlConn.EnsureSchema(context.Background(), testLogger); err != nil {
+			t.Fatalf("ensuring schema again on connection %d: %v", idx+1, err)
+		}
+
+		for _, table := range sqlConn.schemaTables() {
+			columns := sqliteTestColumns(t, sqlConn, table.name)
+			for _, column := range table.columns {
+				if !columns[column] {
+					t.Errorf("table %s has no column %s", table.name, column)
+				}
+			}
+		}
+		writeTestRecords(t, conn, newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"))
+	}
+
+	if records := readTestRecords(t, newTestConnection(t, dbcfg), nil); len(records) != 2 {
+		t.Errorf("found %d records, want one per connection", len(records))
+	}
+}
+
+func TestEnsureSchemaServers(t *testing.T) {
+	for _, server := range testSQLServers {
+		t.Run(string(server.backend), func(t *testing.T) {
+			conn := newTestSQLServerConnection(t, server.env, Config{})
+			sqlConn, _ := unwrapSQLConnection(conn)
+			for idx := 0; idx < 2; idx++ {
+				if err := sqlConn.EnsureSchema(context.Background(), testLogger); err != nil {
+					t.Fatalf("ensuring schema %d: %v", idx+1, err)
+				}
+				// a restarted server migrates again
+				sqlConn.migrated = false
+			}
+
+			writeTestRecords(t, conn,
+				newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"),
+				newTestEventRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"))
+			if records := readTestRecords(t, conn, nil); len(records) != 1 {
+				t.Errorf("found %d records, want 1", len(records))
+			}
+		})
+	}
+}
+
+func sqliteTestColumns(t *testing.T, sqlConn *GenericSQLConnection, table string) map[string]bool {
+	t.Helper()
+	rows, err := sqlConn.db.Query("SELECT name FROM pragma_table_info('" + table + "')")
+	if err != nil {
+		t.Fatalf("listing columns of %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if sErr := rows.Scan(&name); sErr != nil {
+			t.Fatalf("scanning column: %v", sErr)
+		}
+		columns[name] = true
+	}
+	return columns
+}
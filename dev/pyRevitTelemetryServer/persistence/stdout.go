@@ -0,0 +1,101 @@
+package persistence
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"../cli"
+	"github.com/pkg/errors"
+)
+
+// prints every record as json instead of storing it, for seeing what
+// clients send while debugging. records are indented unless StdoutCompact
+// is set, compact records are one per line. connection string is stdout:
+type StdoutConnection struct {
+	DatabaseConnection
+
+	// guards the writer so records of concurrent writes do not interleave
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+// for printing records somewhere other than stdout
+func NewStdoutConnection(dbcfg *Config, out io.Writer) *StdoutConnection {
+	stdoutcfg := *dbcfg
+	stdoutcfg.Backend = Stdout
+	return &StdoutConnection{
+		DatabaseConnection: DatabaseConnection{Config: &stdoutcfg, state: &connectionState{}},
+		out:                out,
+	}
+}
+
+func newStdoutConnection(w DatabaseConnection) (*StdoutConnection, error) {
+	return &StdoutConnection{DatabaseConnection: w, out: os.Stdout}, nil
+}
+
+func (w *StdoutConnection) GetType() DBBackend {
+	return w.Config.Backend
+}
+
+func (w *StdoutConnection) GetVersion(logger *cli.Logger) string {
+	return "stdout"
+}
+
+func (w *StdoutConnection) GetStatus(logger *cli.Logger) ConnectionStatus {
+	return newConnectionStatus(w.Ping(context.Background()), w.GetVersion(logger))
+}
+
+func (w *StdoutConnection) Ping(ctx context.Context) error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+	w.end()
+	return nil
+}
+
+func (w *StdoutConnection) Write(ctx context.Context, logrec TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.WriteBatch(ctx, []TelemetryRecord{logrec}, logger)
+}
+
+func (w *StdoutConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	defer w.end()
+
+	if len(logrecs) == 0 {
+		return &Result{
+			ResultCode: ResultNoData,
+			Message:    "no data to write",
+		}, nil
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	encoder := json.NewEncoder(w.out)
+	if !w.Config.StdoutCompact {
+		encoder.SetIndent("", "  ")
+	}
+	for idx, logrec := range logrecs {
+		if err := encoder.Encode(logrec); err != nil {
+			return &Result{Written: idx}, errors.Wrap(err, "printing usage record")
+		}
+	}
+
+	w.Config.structured(logger).Debug("printed records", "records", len(logrecs))
+	return &Result{
+		ResultCode: ResultOK,
+		Written:    len(logrecs),
+		Message:    fmt.Sprintf("successfully printed %d usage records", len(logrecs)),
+	}, nil
+}
+
+func (w *StdoutConnection) Close() error {
+	w.drain()
+	return nil
+}
@@ -0,0 +1,101 @@
+package persistence
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestStdoutPrintsRecords(t *testing.T) {
+	tests := []struct {
+		name      string
+		compact   bool
+		wantLines int
+	}{
+		{"pretty", false, 0},
+		// compact records are one per line
+		{"compact", true, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			conn := NewStdoutConnection(&Config{StdoutCompact: test.compact}, &out)
+			defer conn.Close()
+
+			logrecs := []TelemetryRecord{
+				newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"),
+				newTestEventRecord("john", "john.doe", "2021-06-01T11:00:00Z"),
+			}
+			res, err := conn.WriteBatch(context.Background(), logrecs, testLogger)
+			if err != nil {
+				t.Fatalf("writing: %v", err)
+			}
+			if res.ResultCode != ResultOK || res.Written != 2 {
+				t.Errorf("result is code %d with %d written, want ok with 2", res.ResultCode, res.Written)
+			}
+
+			lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+			if test.wantLines > 0 && len(lines) != test.wantLines {
+				t.Errorf("printed %d lines, want %d", len(lines), test.wantLines)
+			}
+			if !test.compact && !strings.HasPrefix(out.String(), "{\n  \"") {
+				t.Errorf("records are not indented: %s", out.String())
+			}
+
+			// the printed records are the records written
+			decoder := json.NewDecoder(&out)
+			for _, logrec := range logrecs {
+				var printed map[string]interface{}
+				if dErr := decoder.Decode(&printed); dErr != nil {
+					t.Fatalf("decoding printed record: %v", dErr)
+				}
+				want := map[string]interface{}{}
+				data, _ := json.Marshal(logrec)
+				json.Unmarshal(data, &want)
+				if printed["sessionid"] != want["sessionid"] || printed["username"] != want["username"] {
+					t.Errorf("printed %v, want %v", printed, want)
+				}
+			}
+		})
+	}
+}
+
+func TestStdoutWriteFails(t *testing.T) {
+	conn := NewStdoutConnection(&Config{}, failingWriter{})
+	res, err := conn.Write(context.Background(), newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"), testLogger)
+	if err == nil || res.Written != 0 {
+		t.Errorf("writing to a failing writer returned %v", err)
+	}
+
+	conn.Close()
+	if _, cErr := conn.Write(context.Background(), newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"), testLogger); cErr != ErrClosed {
+		t.Errorf("writing after closing returned %v, want ErrClosed", cErr)
+	}
+}
+
+func TestNewConnectionStdout(t *testing.T) {
+	conn := newTestConnection(t, Config{ConnString: "stdout:"})
+	if conn.GetType() != Stdout {
+		t.Errorf("backend is %s, want stdout", conn.GetType())
+	}
+	for {
+		if _, ok := conn.(*StdoutConnection); ok {
+			return
+		}
+		inner, ok := innerConnection(conn)
+		if !ok {
+			t.Fatalf("connection is not a stdout connection")
+		}
+		conn = inner
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(data []byte) (int, error) {
+	return 0, errors.New("writer is closed")
+}
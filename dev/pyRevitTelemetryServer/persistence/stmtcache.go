@@ -0,0 +1,73 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// statements kept prepared per connection, queries beyond it run unprepared
+const maxCachedStatements = 32
+
+// prepared insert statements by query text. database/sql prepares a
+// statement again on every pooled connection it runs on, including ones
+// replacing broken connections, so statements stay valid for the life of
+// the pool. statements are only closed by close, so one handed out is
+// never closed under a running write
+type stmtCache struct {
+	mutex sync.Mutex
+	db    *sql.DB
+	stmts map[string]*sql.Stmt
+}
+
+func newStmtCache(db *sql.DB) *stmtCache {
+	return &stmtCache{db: db, stmts: make(map[string]*sql.Stmt)}
+}
+
+// returns nil when the query should run unprepared, a nil cache
+// prepares nothing
+func (c *stmtCache) get(ctx context.Context, query string) *sql.Stmt {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	stmt, exists := c.stmts[query]
+	full := c.stmts == nil || len(c.stmts) >= maxCachedStatements
+	c.mutex.Unlock()
+	if exists {
+		return stmt
+	}
+	if full {
+		return nil
+	}
+
+	// prepared without holding the lock, failures are reported when the
+	// query runs unprepared
+	stmt, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if cached, exists := c.stmts[query]; exists {
+		stmt.Close()
+		return cached
+	}
+	if c.stmts == nil || len(c.stmts) >= maxCachedStatements {
+		stmt.Close()
+		return nil
+	}
+	c.stmts[query] = stmt
+	return stmt
+}
+
+// closes all statements, later calls to get prepare nothing
+func (c *stmtCache) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, stmt := range c.stmts {
+		stmt.Close()
+	}
+	c.stmts = nil
+}
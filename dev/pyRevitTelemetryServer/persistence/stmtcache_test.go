@@ -0,0 +1,165 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func cachedTestStatements(c *stmtCache) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.stmts)
+}
+
+// writes of the same shape share one prepared insert
+func TestStmtCacheReuses(t *testing.T) {
+	conn := newTestSqliteConnection(t, Config{})
+	sqlConn, _ := unwrapSQLConnection(conn)
+	writeTestRecords(t, conn, newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"))
+	cached := cachedTestStatements(sqlConn.stmts)
+	if cached == 0 {
+		t.Fatal("no statement was prepared")
+	}
+
+	writeTestRecords(t, conn, newTestScriptRecord("john", "john.doe", "2021-06-01T11:00:00Z"))
+	if again := cachedTestStatements(sqlConn.stmts); again != cached {
+		t.Errorf("%d statements are cached after the second write, want %d", again, cached)
+	}
+	if records := readTestRecords(t, conn, nil); len(records) != 2 {
+		t.Errorf("found %d records, want 2", len(records))
+	}
+}
+
+// statements prepared on connections the pool closed are prepared again
+func TestStmtCacheReplacedConnections(t *testing.T) {
+	conn := newTestSqliteConnection(t, Config{})
+	sqlConn, _ := unwrapSQLConnection(conn)
+	writeTestRecords(t, conn, newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"))
+
+	sqlConn.db.SetMaxIdleConns(0)
+	sqlConn.db.SetMaxIdleConns(DefaultMaxIdleConns)
+	writeTestRecords(t, conn, newTestScriptRecord("john", "john.doe", "2021-06-01T11:00:00Z"))
+	if records := readTestRecords(t, conn, nil); len(records) != 2 {
+		t.Errorf("found %d records, want 2", len(records))
+	}
+}
+
+// preparing does not wait on the transaction holding the only connection
+func TestStmtCacheSingleConnection(t *testing.T) {
+	conn := newTestSqliteConnection(t, Config{MaxOpenConns: 1, RequestTimeout: 5 * time.Second})
+	sqlConn, _ := unwrapSQLConnection(conn)
+	writeTestRecords(t, conn, newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"))
+	if cached := cachedTestStatements(sqlConn.stmts); cached == 0 {
+		t.Error("no statement was prepared")
+	}
+	if records := readTestRecords(t, conn, nil); len(records) != 1 {
+		t.Errorf("found %d records, want 1", len(records))
+	}
+}
+
+func TestStmtCacheLimit(t *testing.T) {
+	conn := newTestSqliteConnection(t, Config{})
+	sqlConn, _ := unwrapSQLConnection(conn)
+	cache := newStmtCache(sqlConn.db)
+	defer cache.close()
+
+	for idx := 0; idx < maxCachedStatements; idx++ {
+		if stmt := cache.get(context.Background(), fmt.Sprintf("SELECT %d", idx)); stmt == nil {
+			t.Fatalf("statement %d was not prepared", idx)
+		}
+	}
+	if stmt := cache.get(context.Background(), "SELECT -1"); stmt != nil {
+		t.Error("statement beyond the limit was prepared")
+	}
+	// cached statements are still handed out
+	if stmt := cache.get(context.Background(), "SELECT 0"); stmt == nil {
+		t.Error("cached statement was not handed out")
+	}
+	if cached := cachedTestStatements(cache); cached != maxCachedStatements {
+		t.Errorf("%d statements are cached, want %d", cached, maxCachedStatements)
+	}
+}
+
+func TestStmtCacheClose(t *testing.T) {
+	conn := newTestSqliteConnection(t, Config{})
+	sqlConn, _ := unwrapSQLConnection(conn)
+	cache := newStmtCache(sqlConn.db)
+	stmt := cache.get(context.Background(), "SELECT 1")
+	if stmt == nil {
+		t.Fatal("statement was not prepared")
+	}
+
+	cache.close()
+	if _, err := stmt.Exec(); err == nil {
+		t.Error("cached statement is still open after closing")
+	}
+	if again := cache.get(context.Background(), "SELECT 1"); again != nil {
+		t.Error("statement was prepared after closing")
+	}
+	if stmt := (*stmtCache)(nil).get(context.Background(), "SELECT 1"); stmt != nil {
+		t.Error("nil cache prepared a statement")
+	}
+}
+
+// closing the connection closes its statements
+func TestStmtCacheClosedWithConnection(t *testing.T) {
+	conn := newTestSqliteConnection(t, Config{})
+	sqlConn, _ := unwrapSQLConnection(conn)
+	writeTestRecords(t, conn, newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"))
+
+	conn.Close()
+	if cached := cachedTestStatements(sqlConn.stmts); cached != 0 {
+		t.Errorf("%d statements are cached after closing, want none", cached)
+	}
+}
+
+// compares cached prepared inserts with ad-hoc ones, an op is a write of
+// one record. the servers of testSQLServers are benchmarked when set
+func BenchmarkStmtCache(b *testing.B) {
+	b.Run("sqlite", func(b *testing.B) {
+		benchmarkStmtCache(b, func(b *testing.B) Connection {
+			return newTestConnection(b, Config{
+				Backend:    Sqlite,
+				ConnString: "sqlite3:" + filepath.Join(b.TempDir(), "telemetry.db"),
+			})
+		})
+	})
+	for _, server := range testSQLServers {
+		b.Run(string(server.backend), func(b *testing.B) {
+			benchmarkStmtCache(b, func(b *testing.B) Connection {
+				return newTestSQLServerConnection(b, server.env, Config{})
+			})
+		})
+	}
+}
+
+func benchmarkStmtCache(b *testing.B, connect func(*testing.B) Connection) {
+	for _, bench := range []struct {
+		name     string
+		prepared bool
+	}{
+		{"prepared", true},
+		{"adhoc", false},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			conn := connect(b)
+			sqlConn, _ := unwrapSQLConnection(conn)
+			// a closed cache prepares nothing
+			if !bench.prepared {
+				sqlConn.stmts.close()
+			}
+			writeTestRecords(b, conn, newTestScriptRecord("jane", "jane.doe", "2021-06-01T09:00:00Z"))
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				logrec := newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z")
+				if _, err := conn.Write(context.Background(), logrec, testLogger); err != nil {
+					b.Fatalf("writing: %v", err)
+				}
+			}
+		})
+	}
+}
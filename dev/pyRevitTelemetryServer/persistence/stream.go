@@ -0,0 +1,44 @@
+package persistence
+
+import (
+	"context"
+)
+
+// streams are read until the records channel is closed, the error channel
+// then holds the error that ended the stream, if any. records are produced
+// one at a time as they are read from the backend. callers must read the
+// stream to the end or cancel ctx, the connection can not close before
+func newRecordStream(ctx context.Context, produce func(send func(TelemetryRecord) bool) error) (<-chan TelemetryRecord, <-chan error) {
+	records := make(chan TelemetryRecord)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(records)
+
+		// fails once ctx is done so producers stop reading
+		send := func(logrec TelemetryRecord) bool {
+			select {
+			case records <- logrec:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		if err := produce(send); err != nil {
+			errs <- err
+		} else if ctxErr := ctx.Err(); ctxErr != nil {
+			errs <- ctxErr
+		}
+	}()
+	return records, errs
+}
+
+// stream ending right away with the error
+func failedRecordStream(err error) (<-chan TelemetryRecord, <-chan error) {
+	records := make(chan TelemetryRecord)
+	errs := make(chan error, 1)
+	errs <- err
+	close(records)
+	close(errs)
+	return records, errs
+}
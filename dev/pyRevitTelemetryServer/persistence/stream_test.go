@@ -0,0 +1,116 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestReadStream(t *testing.T) {
+	testReadStream(t, newTestSqliteConnection)
+}
+
+func TestReadStreamServers(t *testing.T) {
+	for _, server := range testSQLServers {
+		t.Run(string(server.backend), func(t *testing.T) {
+			testReadStream(t, func(t *testing.T, dbcfg Config) Connection {
+				return newTestSQLServerConnection(t, server.env, dbcfg)
+			})
+		})
+	}
+}
+
+// records of the stream, and the error it ended with
+func readTestStream(conn Connection, filter *RecordFilter) ([]TelemetryRecord, error) {
+	stream, errs := conn.ReadStream(context.Background(), filter, testLogger)
+	records := make([]TelemetryRecord, 0)
+	for logrec := range stream {
+		records = append(records, logrec)
+	}
+	return records, <-errs
+}
+
+// shared by the backends, streams hold the records a read returns
+func testReadStream(t *testing.T, connect func(*testing.T, Config) Connection) {
+	conn := connect(t, Config{})
+	const scripts = 300
+	logrecs := make([]TelemetryRecord, 0, scripts+1)
+	for idx := 0; idx < scripts; idx++ {
+		user := fmt.Sprintf("user%d", idx%3)
+		logrecs = append(logrecs, newTestScriptRecord(user, user, fmt.Sprintf("2021-06-01T%02d:%02d:00Z", idx/60, idx%60)))
+	}
+	logrecs = append(logrecs, newTestEventRecord("user0", "user0", "2021-06-01T10:00:00Z"))
+	writeTestRecords(t, conn, logrecs...)
+
+	records, err := readTestStream(conn, nil)
+	if err != nil {
+		t.Fatalf("streaming: %v", err)
+	}
+	if len(records) != scripts {
+		t.Errorf("streamed %d records, want %d", len(records), scripts)
+	}
+	for idx, logrec := range readTestRecords(t, conn, nil) {
+		if idx < len(records) && records[idx].GetRecordId() != logrec.GetRecordId() {
+			t.Fatalf("streamed record %d is %s, read %s", idx, records[idx].GetRecordId(), logrec.GetRecordId())
+		}
+	}
+
+	filtered, fErr := readTestStream(conn, &RecordFilter{UserName: "user1"})
+	if fErr != nil {
+		t.Fatalf("streaming filtered: %v", fErr)
+	}
+	if len(filtered) != scripts/3 {
+		t.Errorf("streamed %d records of user1, want %d", len(filtered), scripts/3)
+	}
+	events, eErr := readTestStream(conn, &RecordFilter{RecordType: EventRecord})
+	if eErr != nil || len(events) != 1 {
+		t.Errorf("streamed %d events with %v, want 1", len(events), eErr)
+	}
+}
+
+// the stream closes once ctx is canceled and ends with its error
+func TestReadStreamCancel(t *testing.T) {
+	for name, connect := range map[string]func(*testing.T, Config) Connection{
+		"sqlite": newTestSqliteConnection,
+		"memory": newTestMemoryConnection,
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn := connect(t, Config{})
+			logrecs := make([]TelemetryRecord, 0, 50)
+			for idx := 0; idx < 50; idx++ {
+				logrecs = append(logrecs, newTestScriptRecord("jane", "jane.doe", fmt.Sprintf("2021-06-01T10:%02d:00Z", idx)))
+			}
+			writeTestRecords(t, conn, logrecs...)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			stream, errs := conn.ReadStream(ctx, nil, testLogger)
+			<-stream
+			cancel()
+			streamed := 1
+			for range stream {
+				streamed++
+			}
+			if err := <-errs; !errors.Is(err, context.Canceled) {
+				t.Errorf("canceled stream ended with %v", err)
+			}
+			if streamed == len(logrecs) {
+				t.Error("canceled stream sent every record")
+			}
+
+			// the stream is done, the connection can close
+			if err := conn.Close(); err != nil {
+				t.Errorf("closing: %v", err)
+			}
+		})
+	}
+}
+
+func TestReadStreamAfterClose(t *testing.T) {
+	conn := newTestSqliteConnection(t, Config{})
+	conn.Close()
+	if records, err := readTestStream(conn, nil); !errors.Is(err, ErrClosed) || len(records) != 0 {
+		t.Errorf("stream after closing sent %d records and ended with %v", len(records), err)
+	}
+}
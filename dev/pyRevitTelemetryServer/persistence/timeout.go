@@ -0,0 +1,48 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+
+	"../cli"
+	"github.com/pkg/errors"
+)
+
+// bounds every backend write by Config.WriteTimeout
+type TimeoutConnection struct {
+	Connection
+	config *Config
+}
+
+func NewTimeoutConnection(conn Connection, dbcfg *Config) *TimeoutConnection {
+	return &TimeoutConnection{Connection: conn, config: dbcfg}
+}
+
+func (w *TimeoutConnection) Write(ctx context.Context, logrec TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.WriteBatch(ctx, []TelemetryRecord{logrec}, logger)
+}
+
+func (w *TimeoutConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	writeCtx, cancel := w.config.newWriteContext(ctx)
+	defer cancel()
+
+	result, err := w.Connection.WriteBatch(writeCtx, logrecs, logger)
+	if err == nil {
+		return result, nil
+	}
+	err = wrapContextError(writeCtx, err)
+	if !errors.Is(err, ErrTimeout) {
+		return result, err
+	}
+
+	// keep what the backend reports of the partial write, the dead-letter
+	// wrapper needs the outcome of each record to keep the stored ones out
+	timedOut := &Result{}
+	if result != nil {
+		copied := *result
+		timedOut = &copied
+	}
+	timedOut.ResultCode = ResultTimeout
+	timedOut.Message = fmt.Sprintf("write timed out, %d of %d usage records written", timedOut.Written, len(logrecs))
+	return timedOut, err
+}
@@ -0,0 +1,115 @@
+package persistence
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+)
+
+// name the tls config is registered under with the mysql driver
+const mysqlTLSConfigName = "pyrevit"
+
+// builds the tls config from the configured certificates
+// returns nil when tls is not enabled
+func (cfg *Config) newTLSConfig() (*tls.Config, error) {
+	if !cfg.TLSEnabled {
+		return nil, nil
+	}
+
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if cfg.CACertPath != "" {
+		caCert, err := ioutil.ReadFile(cfg.CACertPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "tls is enabled but ca certificate can not be read")
+		}
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caCert) {
+			return nil, errors.Errorf("tls is enabled but %s has no valid certificates", cfg.CACertPath)
+		}
+		tlsCfg.RootCAs = caPool
+	}
+
+	if cfg.ClientCertPath != "" || cfg.ClientKeyPath != "" {
+		clientCert, err := tls.LoadX509KeyPair(cfg.ClientCertPath, cfg.ClientKeyPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "tls is enabled but client certificate can not be loaded")
+		}
+		tlsCfg.Certificates = []tls.Certificate{clientCert}
+	}
+
+	return tlsCfg, nil
+}
+
+// adds the tls settings to sql connection strings in each driver's dialect
+func applySQLTLS(dbcfg *Config, connStr string) (string, error) {
+	tlsCfg, err := dbcfg.newTLSConfig()
+	if err != nil || tlsCfg == nil {
+		return connStr, err
+	}
+
+	switch dbcfg.Backend {
+	case Postgres:
+		// lib/pq loads the certificates itself from these paths
+		params := map[string]string{"sslmode": "require"}
+		if dbcfg.CACertPath != "" {
+			params["sslmode"] = "verify-full"
+			params["sslrootcert"] = dbcfg.CACertPath
+		}
+		if dbcfg.ClientCertPath != "" {
+			params["sslcert"] = dbcfg.ClientCertPath
+			params["sslkey"] = dbcfg.ClientKeyPath
+		}
+		return setConnStringParams(connStr, params)
+
+	case MySql:
+		if rErr := mysql.RegisterTLSConfig(mysqlTLSConfigName, tlsCfg); rErr != nil {
+			return "", rErr
+		}
+		return setConnStringParams(connStr, map[string]string{"tls": mysqlTLSConfigName})
+
+	case MSSql:
+		if dbcfg.ClientCertPath != "" {
+			return "", errors.New("client certificates are not supported by sqlserver backend")
+		}
+		params := map[string]string{"encrypt": "true"}
+		if dbcfg.CACertPath != "" {
+			params["certificate"] = dbcfg.CACertPath
+		}
+		return setConnStringParams(connStr, params)
+
+	default:
+		return "", errors.Errorf("tls is not supported by %s backend", dbcfg.Backend)
+	}
+}
+
+// sets query parameters on url style connection strings, or appends
+// key=value pairs to postgres keyword style ones
+func setConnStringParams(connStr string, params map[string]string) (string, error) {
+	if !strings.Contains(connStr, "://") && !strings.HasPrefix(connStr, string(MySql)+":") {
+		pairs := make([]string, 0, len(params))
+		for key, value := range params {
+			pairs = append(pairs, key+"='"+strings.Replace(value, "'", "\\'", -1)+"'")
+		}
+		return connStr + " " + strings.Join(pairs, " "), nil
+	}
+
+	// mysql dsn is not a url but keeps its parameters after ?
+	base, rawQuery := connStr, ""
+	if idx := strings.Index(connStr, "?"); idx >= 0 {
+		base, rawQuery = connStr[:idx], connStr[idx+1:]
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", err
+	}
+	for key, value := range params {
+		query.Set(key, value)
+	}
+	return base + "?" + query.Encode(), nil
+}
@@ -0,0 +1,61 @@
+package persistence
+
+import (
+	"context"
+
+	"../cli"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const writeSpanName = "telemetry.write"
+
+// starts a span around every write of the wrapped connection, so writes
+// show up in the traces of the requests sending the records
+type TracingConnection struct {
+	Connection
+	tracer trace.Tracer
+}
+
+// writes are not traced when tracer is nil
+func NewTracingConnection(conn Connection, tracer trace.Tracer) *TracingConnection {
+	if tracer == nil {
+		tracer = noop.NewTracerProvider().Tracer("")
+	}
+	return &TracingConnection{Connection: conn, tracer: tracer}
+}
+
+func (w *TracingConnection) Write(ctx context.Context, logrec TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.trace(ctx, 1, func(ctx context.Context) (*Result, error) {
+		return w.Connection.Write(ctx, logrec, logger)
+	})
+}
+
+func (w *TracingConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.trace(ctx, len(logrecs), func(ctx context.Context) (*Result, error) {
+		return w.Connection.WriteBatch(ctx, logrecs, logger)
+	})
+}
+
+// the write gets the span context so backends can start child spans
+func (w *TracingConnection) trace(ctx context.Context, count int, write func(context.Context) (*Result, error)) (*Result, error) {
+	ctx, span := w.tracer.Start(ctx, writeSpanName, trace.WithAttributes(
+		attribute.String("telemetry.backend", string(w.GetType())),
+		attribute.Int("telemetry.record_count", count),
+	))
+	defer span.End()
+
+	result, err := write(ctx)
+	if result != nil {
+		span.SetAttributes(
+			attribute.Int("telemetry.written", result.Written),
+			attribute.Int("telemetry.queued", result.Queued))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return result, err
+}
@@ -0,0 +1,122 @@
+package persistence
+
+import (
+	"context"
+	"testing"
+
+	"../cli"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// connection traced by a tracer recording its spans in memory
+func newTestTracingConnection(t *testing.T, conn Connection) (*TracingConnection, *tracetest.SpanRecorder) {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+	return NewTracingConnection(conn, provider.Tracer("persistence")), recorder
+}
+
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, attr := range span.Attributes() {
+		attrs[attr.Key] = attr.Value
+	}
+	return attrs
+}
+
+func TestTracingSpansWrites(t *testing.T) {
+	memory := NewMemoryConnection(&Config{ScriptTarget: "scripts", EventTarget: "events"})
+	defer memory.Close()
+	conn, recorder := newTestTracingConnection(t, memory)
+
+	if _, err := conn.Write(context.Background(), newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"), testLogger); err != nil {
+		t.Fatalf("writing: %v", err)
+	}
+	writeTestRecords(t, conn,
+		newTestScriptRecord("jane", "jane.doe", "2021-06-01T11:00:00Z"),
+		newTestEventRecord("jane", "jane.doe", "2021-06-01T11:00:00Z"))
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("recorded %d spans, want 2", len(spans))
+	}
+	for idx, wantCount := range []int64{1, 2} {
+		span := spans[idx]
+		if span.Name() != writeSpanName {
+			t.Errorf("span %d is named %s, want %s", idx, span.Name(), writeSpanName)
+		}
+		attrs := spanAttributes(span)
+		if backend := attrs["telemetry.backend"].AsString(); backend != "memory" {
+			t.Errorf("span %d has backend %q, want memory", idx, backend)
+		}
+		if count := attrs["telemetry.record_count"].AsInt64(); count != wantCount {
+			t.Errorf("span %d has record count %d, want %d", idx, count, wantCount)
+		}
+		if written := attrs["telemetry.written"].AsInt64(); written != wantCount {
+			t.Errorf("span %d has %d written, want %d", idx, written, wantCount)
+		}
+		if span.Status().Code == codes.Error {
+			t.Errorf("span %d has error status: %s", idx, span.Status().Description)
+		}
+	}
+}
+
+func TestTracingRecordsErrors(t *testing.T) {
+	memory := NewMemoryConnection(&Config{})
+	memory.Close()
+	conn, recorder := newTestTracingConnection(t, memory)
+
+	if _, err := conn.Write(context.Background(), newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"), testLogger); err == nil {
+		t.Fatal("writing to a closed connection succeeded")
+	}
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("recorded %d spans, want 1", len(spans))
+	}
+	if status := spans[0].Status(); status.Code != codes.Error || status.Description != ErrClosed.Error() {
+		t.Errorf("span status is %v, want the error of the write", status)
+	}
+	if events := spans[0].Events(); len(events) != 1 || events[0].Name != "exception" {
+		t.Errorf("span events are %v, want the recorded error", events)
+	}
+}
+
+// memory backend keeping the span context of its last write
+type spanContextConnection struct {
+	*MemoryConnection
+	spanContext trace.SpanContext
+}
+
+func (w *spanContextConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	w.spanContext = trace.SpanContextFromContext(ctx)
+	return w.MemoryConnection.WriteBatch(ctx, logrecs, logger)
+}
+
+// the backend is given the context of the write span
+func TestTracingPassesSpanContext(t *testing.T) {
+	memory := NewMemoryConnection(&Config{ScriptTarget: "scripts"})
+	defer memory.Close()
+	inner := &spanContextConnection{MemoryConnection: memory}
+	conn, recorder := newTestTracingConnection(t, inner)
+	writeTestRecords(t, conn, newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"))
+
+	spans := recorder.Ended()
+	if len(spans) != 1 || !inner.spanContext.Equal(spans[0].SpanContext()) {
+		t.Errorf("write context has span %v, want the write span", inner.spanContext)
+	}
+}
+
+func TestTracingWithoutTracer(t *testing.T) {
+	memory := NewMemoryConnection(&Config{ScriptTarget: "scripts"})
+	defer memory.Close()
+	conn := NewTracingConnection(memory, nil)
+	writeTestRecords(t, conn, newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"))
+	if records := readTestRecords(t, memory, nil); len(records) != 1 {
+		t.Errorf("wrote %d records, want 1", len(records))
+	}
+}
@@ -1,6 +1,10 @@
 package persistence
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"strings"
 )
@@ -30,6 +34,77 @@ func ToSql(values *[]string, wrap bool) string {
 	return fmt.Sprintf("(%s)", strings.Join(cleanedValues, ", "))
 }
 
+// same as ToSql but returns bind arguments, empty values are NULL
+func ToSqlArgs(values *[]string) []interface{} {
+	args := make([]interface{}, 0, len(*values))
+	for _, value := range *values {
+		if value != "" {
+			args = append(args, value)
+		} else {
+			args = append(args, nil)
+		}
+	}
+	return args
+}
+
+func containsString(values []string, value string) bool {
+	for _, item := range values {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// stable pseudonym of a user name, records of the same user still group
+// together after anonymization. keyed so names can not be recovered by
+// hashing likely ones, empty without a key and the name is removed
+func anonymizeUserName(key string, username string) string {
+	if key == "" || username == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(username))
+	return "anon-" + hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
 func ToMap(fields, values *[]string) map[string]string {
 	return make(map[string]string)
 }
+
+// flattens a record into a single level map with dotted keys,
+// lists are kept as json strings
+func flattenRecord(logrec TelemetryRecord) (map[string]interface{}, error) {
+	data, err := json.Marshal(logrec)
+	if err != nil {
+		return nil, err
+	}
+
+	var nested map[string]interface{}
+	if uErr := json.Unmarshal(data, &nested); uErr != nil {
+		return nil, uErr
+	}
+
+	flat := make(map[string]interface{})
+	flattenInto(flat, "", nested)
+	return flat, nil
+}
+
+func flattenInto(flat map[string]interface{}, prefix string, nested map[string]interface{}) {
+	for key, value := range nested {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		switch typed := value.(type) {
+		case map[string]interface{}:
+			flattenInto(flat, key, typed)
+		case []interface{}:
+			encoded, _ := json.Marshal(typed)
+			flat[key] = string(encoded)
+		case nil:
+			flat[key] = ""
+		default:
+			flat[key] = fmt.Sprint(typed)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"../cli"
+	"github.com/pkg/errors"
+)
+
+// records stamped further ahead than this are rejected
+const MaxClockSkew = 24 * time.Hour
+
+// records stamped before this are rejected
+var minRecordTime = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// extras key flagging v2 records the server stamped for lack of a timestamp
+const timestampAssignedExtra = "timestamp_assigned"
+
+// required fields by json name, dotted for nested fields
+var defaultRequiredFields = map[string][]string{
+	"script_v1": {"date", "time", "username", "commandname"},
+	"script_v2": {"timestamp", "host_user", "commandname"},
+	"event_v2":  {"timestamp", "host_user", "type"},
+}
+
+// rejects invalid records before they reach the wrapped connection
+type ValidatingConnection struct {
+	Connection
+	RequiredFields []string
+}
+
+func NewValidatingConnection(conn Connection, dbcfg *Config) *ValidatingConnection {
+	return &ValidatingConnection{
+		Connection:     conn,
+		RequiredFields: dbcfg.RequiredFields,
+	}
+}
+
+func (w *ValidatingConnection) Write(ctx context.Context, logrec TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	return w.WriteBatch(ctx, []TelemetryRecord{logrec}, logger)
+}
+
+// a single invalid record rejects the whole batch. v2 timestamps are
+// stored in utc, whatever offset the client sent them with. the records
+// of the caller are left as they are, normalized copies are written and
+// are only read from below this point, fan-out writes share them
+func (w *ValidatingConnection) WriteBatch(ctx context.Context, logrecs []TelemetryRecord, logger *cli.Logger) (*Result, error) {
+	connectionLogger(w.Connection, logger).Debug("validating records")
+	normalized := make([]TelemetryRecord, 0, len(logrecs))
+	for idx, logrec := range logrecs {
+		logrec = normalizeTimeStamp(logrec)
+		if err := validateRecord(logrec, w.RequiredFields); err != nil {
+			return &Result{
+				ResultCode: ResultValidationFailed,
+				Message:    fmt.Sprintf("record %d is invalid: %v", idx, err),
+			}, err
+		}
+		normalized = append(normalized, logrec)
+	}
+	return w.Connection.WriteBatch(ctx, normalized, logger)
+}
+
+// checks field formats, required fields and timestamp sanity
+// nil required fields use the defaults of the record type
+func validateRecord(logrec TelemetryRecord, requiredFields []string) error {
+	if logrec == nil {
+		return errors.New("record is empty")
+	}
+	if err := logrec.Validate(); err != nil {
+		return err
+	}
+
+	if requiredFields == nil {
+		requiredFields = defaultRequiredFields[recordKind(logrec)]
+	}
+	if len(requiredFields) > 0 {
+		fields, err := flattenRecord(logrec)
+		if err != nil {
+			return err
+		}
+		missing := make([]string, 0)
+		for _, field := range requiredFields {
+			if value, exists := fields[field]; !exists || strings.TrimSpace(fmt.Sprint(value)) == "" {
+				missing = append(missing, field)
+			}
+		}
+		if len(missing) > 0 {
+			return errors.Errorf("missing required fields %s", strings.Join(missing, ", "))
+		}
+	}
+
+	timestamp := logrec.GetTimeStamp()
+	if timestamp.IsZero() {
+		return errors.New("timestamp can not be parsed")
+	}
+	if timestamp.Before(minRecordTime) {
+		return errors.Errorf("timestamp %s is too far in the past", timestamp.Format(time.RFC3339))
+	}
+	if timestamp.After(time.Now().Add(MaxClockSkew)) {
+		return errors.Errorf("timestamp %s is in the future", timestamp.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func recordKind(logrec TelemetryRecord) string {
+	switch logrec.(type) {
+	case *ScriptTelemetryRecordV1, ScriptTelemetryRecordV1:
+		return "script_v1"
+	case *ScriptTelemetryRecordV2, ScriptTelemetryRecordV2:
+		return "script_v2"
+	case *EventTelemetryRecordV2, EventTelemetryRecordV2:
+		return "event_v2"
+	default:
+		return ""
+	}
+}
+
+// copy of the record with its v2 timestamp converted to utc, keeping the
+// precision the client sent. records without one are stamped with the
+// current time and flagged in their extras. timestamps that can not be
+// parsed are left for validation. records passed by value are returned
+// as pointers, the backends below only handle those
+func normalizeTimeStamp(logrec TelemetryRecord) TelemetryRecord {
+	switch rec := logrec.(type) {
+	case *ScriptTelemetryRecordV2:
+		normalized := *rec
+		normalized.TimeStamp, normalized.Extras = normalizeTimeStampText(rec.TimeStamp, rec.Extras)
+		return &normalized
+	case ScriptTelemetryRecordV2:
+		return normalizeTimeStamp(&rec)
+	case *EventTelemetryRecordV2:
+		normalized := *rec
+		normalized.TimeStamp, normalized.Extras = normalizeTimeStampText(rec.TimeStamp, rec.Extras)
+		return &normalized
+	case EventTelemetryRecordV2:
+		return normalizeTimeStamp(&rec)
+	case ScriptTelemetryRecordV1:
+		return &rec
+	default:
+		return logrec
+	}
+}
+
+// extras are copied before the flag is added, the map is the caller's
+func normalizeTimeStampText(timestamp string, extras map[string]interface{}) (string, map[string]interface{}) {
+	if strings.TrimSpace(timestamp) == "" {
+		flagged := make(map[string]interface{}, len(extras)+1)
+		for key, value := range extras {
+			flagged[key] = value
+		}
+		flagged[timestampAssignedExtra] = true
+		return time.Now().UTC().Format(time.RFC3339), flagged
+	}
+
+	parsed, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return timestamp, extras
+	}
+	layout := "2006-01-02T15:04:05"
+	if dot := strings.Index(timestamp, "."); dot >= 0 {
+		digits := 0
+		for _, char := range timestamp[dot+1:] {
+			if char < '0' || char > '9' {
+				break
+			}
+			digits++
+		}
+		layout += "." + strings.Repeat("0", digits)
+	}
+	return parsed.UTC().Format(layout + "Z07:00"), extras
+}
@@ -0,0 +1,206 @@
+package persistence
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memory backend behind the validation of dbcfg
+func newTestValidatingConnection(t *testing.T, dbcfg Config) (*ValidatingConnection, *MemoryConnection) {
+	t.Helper()
+	dbcfg.ScriptTarget, dbcfg.EventTarget = "scripts", "events"
+	memory := NewMemoryConnection(&dbcfg)
+	t.Cleanup(func() { memory.Close() })
+	return NewValidatingConnection(memory, &dbcfg), memory
+}
+
+func TestValidateRecord(t *testing.T) {
+	script := func(change func(*ScriptTelemetryRecordV2)) TelemetryRecord {
+		rec := newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z")
+		change(rec)
+		return rec
+	}
+	event := func(change func(*EventTelemetryRecordV2)) TelemetryRecord {
+		rec := newTestEventRecord("jane", "jane.doe", "2021-06-01T10:00:00Z")
+		change(rec)
+		return rec
+	}
+	future := time.Now().Add(2 * MaxClockSkew).UTC().Format(time.RFC3339)
+
+	tests := []struct {
+		name   string
+		logrec TelemetryRecord
+	}{
+		{"empty record", nil},
+		{"empty host user", script(func(rec *ScriptTelemetryRecordV2) { rec.HostUserName = "" })},
+		{"blank host user", script(func(rec *ScriptTelemetryRecordV2) { rec.HostUserName = "  " })},
+		{"empty command name", script(func(rec *ScriptTelemetryRecordV2) { rec.CommandName = "" })},
+		{"unparsable timestamp", script(func(rec *ScriptTelemetryRecordV2) { rec.TimeStamp = "yesterday" })},
+		{"timestamp too far in the past", script(func(rec *ScriptTelemetryRecordV2) { rec.TimeStamp = "1999-12-31T23:59:59Z" })},
+		{"timestamp in the future", script(func(rec *ScriptTelemetryRecordV2) { rec.TimeStamp = future })},
+		{"invalid session id", script(func(rec *ScriptTelemetryRecordV2) { rec.SessionId = "session" })},
+		{"invalid revit build", script(func(rec *ScriptTelemetryRecordV2) { rec.RevitBuild = "2022" })},
+		{"invalid schema", script(func(rec *ScriptTelemetryRecordV2) { rec.RecordMeta.SchemaVersion = "3.0" })},
+		{"event without host user", event(func(rec *EventTelemetryRecordV2) { rec.HostUserName = "" })},
+		{"event without type", event(func(rec *EventTelemetryRecordV2) { rec.EventType = "" })},
+		{"event in the future", event(func(rec *EventTelemetryRecordV2) { rec.TimeStamp = future })},
+		{"v1 without command name", &ScriptTelemetryRecordV1{Date: "2021-06-01", Time: "10:00:00", UserName: "jane", RevitVersion: "2023", RevitBuild: "20220401_1500(x64)"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, memory := newTestValidatingConnection(t, Config{})
+			res, err := conn.Write(context.Background(), test.logrec, testLogger)
+			if err == nil {
+				t.Fatal("invalid record was written")
+			}
+			if res == nil || res.ResultCode != ResultValidationFailed {
+				t.Errorf("result is %+v, want validation failed", res)
+			}
+			if records, _, _ := memory.Read(context.Background(), nil, testLogger); len(records) != 0 {
+				t.Errorf("%d records reached the backend", len(records))
+			}
+		})
+	}
+}
+
+// one invalid record rejects the batch
+func TestValidateBatch(t *testing.T) {
+	conn, memory := newTestValidatingConnection(t, Config{})
+	invalid := newTestScriptRecord("jane", "", "2021-06-01T11:00:00Z")
+	res, err := conn.WriteBatch(context.Background(), []TelemetryRecord{
+		newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"),
+		invalid,
+	}, testLogger)
+	if err == nil || res.ResultCode != ResultValidationFailed {
+		t.Fatalf("batch with an invalid record returned %+v, %v", res, err)
+	}
+	if records, _, _ := memory.Read(context.Background(), nil, testLogger); len(records) != 0 {
+		t.Errorf("%d records of the batch were written", len(records))
+	}
+
+	if _, vErr := conn.Write(context.Background(), newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z"), testLogger); vErr != nil {
+		t.Errorf("valid record was rejected: %v", vErr)
+	}
+}
+
+func TestValidateRequiredFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		required []string
+		change   func(*ScriptTelemetryRecordV2)
+		valid    bool
+	}{
+		{"defaults", nil, func(rec *ScriptTelemetryRecordV2) {}, true},
+		{"configured present", []string{"docname"}, func(rec *ScriptTelemetryRecordV2) { rec.DocumentName = "model.rvt" }, true},
+		{"configured missing", []string{"docname"}, func(rec *ScriptTelemetryRecordV2) {}, false},
+		{"configured nested", []string{"trace.engine.type"}, func(rec *ScriptTelemetryRecordV2) { rec.TraceInfo.EngineInfo.Type = "" }, false},
+		{"configured replace defaults", []string{"docname"}, func(rec *ScriptTelemetryRecordV2) {
+			rec.DocumentName = "model.rvt"
+			rec.HostUserName = ""
+		}, true},
+		{"none required", []string{}, func(rec *ScriptTelemetryRecordV2) { rec.HostUserName = "" }, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, _ := newTestValidatingConnection(t, Config{RequiredFields: test.required})
+			rec := newTestScriptRecord("jane", "jane.doe", "2021-06-01T10:00:00Z")
+			test.change(rec)
+
+			res, err := conn.Write(context.Background(), rec, testLogger)
+			if test.valid && err != nil {
+				t.Errorf("valid record was rejected: %v", err)
+			}
+			if !test.valid && (err == nil || res.ResultCode != ResultValidationFailed) {
+				t.Errorf("record missing a required field returned %+v, %v", res, err)
+			}
+		})
+	}
+}
+
+func TestNormalizeTimeStamp(t *testing.T) {
+	tests := []struct {
+		name      string
+		timestamp string
+		stored    string
+	}{
+		{"utc", "2021-06-01T10:00:00Z", "2021-06-01T10:00:00Z"},
+		{"zero offset", "2021-06-01T10:00:00+00:00", "2021-06-01T10:00:00Z"},
+		{"pacific", "2021-06-01T03:00:00-07:00", "2021-06-01T10:00:00Z"},
+		{"central europe", "2021-06-01T12:00:00+02:00", "2021-06-01T10:00:00Z"},
+		{"india", "2021-06-01T15:30:00+05:30", "2021-06-01T10:00:00Z"},
+		{"previous day", "2021-06-01T01:00:00+10:00", "2021-05-31T15:00:00Z"},
+		{"fractional seconds", "2021-06-01T12:00:00.250+02:00", "2021-06-01T10:00:00.250Z"},
+		{"unparsable", "yesterday", "yesterday"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			script := newTestScriptRecord("jane", "jane.doe", test.timestamp)
+			event := newTestEventRecord("jane", "jane.doe", test.timestamp)
+			if stored := normalizeTimeStamp(script).(*ScriptTelemetryRecordV2).TimeStamp; stored != test.stored {
+				t.Errorf("script timestamp is %s, want %s", stored, test.stored)
+			}
+			if stored := normalizeTimeStamp(event).(*EventTelemetryRecordV2).TimeStamp; stored != test.stored {
+				t.Errorf("event timestamp is %s, want %s", stored, test.stored)
+			}
+			if script.TimeStamp != test.timestamp {
+				t.Errorf("record of the caller is changed to %s", script.TimeStamp)
+			}
+		})
+	}
+
+	v1 := &ScriptTelemetryRecordV1{Date: "2021-06-01", Time: "10:00:00"}
+	if normalizeTimeStamp(v1) != TelemetryRecord(v1) {
+		t.Error("v1 record is changed")
+	}
+}
+
+// records of several zones are stored in utc
+func TestWriteStoresUTC(t *testing.T) {
+	conn := newTestSqliteConnection(t, Config{})
+	writeTestRecords(t, conn,
+		newTestScriptRecord("jane", "jane.doe", "2021-06-01T03:00:00-07:00"),
+		newTestScriptRecord("jane", "jane.doe", "2021-06-01T17:00:00+05:30"),
+		newTestEventRecord("jane", "jane.doe", "2021-06-01T12:00:00+02:00"))
+
+	records := readTestRecords(t, conn, nil)
+	events := readTestRecords(t, conn, &RecordFilter{RecordType: EventRecord})
+	stored := []string{
+		records[0].(*ScriptTelemetryRecordV2).TimeStamp,
+		records[1].(*ScriptTelemetryRecordV2).TimeStamp,
+		events[0].(*EventTelemetryRecordV2).TimeStamp,
+	}
+	want := []string{"2021-06-01T10:00:00Z", "2021-06-01T11:30:00Z", "2021-06-01T10:00:00Z"}
+	for idx := range want {
+		if stored[idx] != want[idx] {
+			t.Errorf("stored timestamp %d is %s, want %s", idx, stored[idx], want[idx])
+		}
+	}
+}
+
+// missing timestamps are stamped with the write time and flagged
+func TestWriteWithoutTimeStamp(t *testing.T) {
+	conn, memory := newTestValidatingConnection(t, Config{})
+	logrec := newTestScriptRecord("jane", "jane.doe", "")
+	logrec.Extras = map[string]interface{}{"build": "nightly"}
+
+	before := time.Now().UTC().Truncate(time.Second)
+	if _, err := conn.Write(context.Background(), logrec, testLogger); err != nil {
+		t.Fatalf("writing: %v", err)
+	}
+	records, _, _ := memory.Read(context.Background(), nil, testLogger)
+	if len(records) != 1 {
+		t.Fatalf("found %d records, want 1", len(records))
+	}
+	stored := records[0].(*ScriptTelemetryRecordV2)
+	if timestamp := stored.GetTimeStamp(); timestamp.Before(before) || timestamp.After(time.Now()) || !strings.HasSuffix(stored.TimeStamp, "Z") {
+		t.Errorf("record is stamped %s, want the write time in utc", stored.TimeStamp)
+	}
+	if stored.Extras[timestampAssignedExtra] != true || stored.Extras["build"] != "nightly" {
+		t.Errorf("extras are %v, want the record flagged", stored.Extras)
+	}
+	if _, flagged := logrec.Extras[timestampAssignedExtra]; flagged || logrec.TimeStamp != "" {
+		t.Errorf("record of the caller is changed to %+v", logrec)
+	}
+}
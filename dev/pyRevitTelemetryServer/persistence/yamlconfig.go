@@ -0,0 +1,60 @@
+package persistence
+
+import (
+	"io/ioutil"
+	"reflect"
+	"sort"
+
+	"../cli"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// reads the config from a yaml file with the same keys as the json
+// config. durations are go duration strings e.g. 30s. unknown keys are
+// logged and skipped, the backend defaults to the one named by the
+// connection string
+func LoadConfigFromYAML(path string, logger *cli.Logger) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "config file can not be read")
+	}
+
+	var keys map[string]interface{}
+	if uErr := yaml.Unmarshal(data, &keys); uErr != nil {
+		return nil, errors.Wrapf(uErr, "config file %s is invalid", path)
+	}
+	known := taggedFieldNames(reflect.TypeOf(Config{}), "yaml")
+	unknown := make([]string, 0)
+	for key := range keys {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+
+	cfg := &Config{}
+	if uErr := yaml.Unmarshal(data, cfg); uErr != nil {
+		return nil, errors.Wrapf(uErr, "config file %s is invalid", path)
+	}
+	// logged in the format the file asks for
+	for _, key := range unknown {
+		cfg.structured(logger).Print("skipping unknown config key", "key", key, "path", path)
+	}
+
+	if cfg.ConnString == "" {
+		return nil, errors.Errorf("config file %s is missing connection_string", path)
+	}
+	backend, pErr := parseUri(cfg.ConnString)
+	if pErr != nil {
+		return nil, errors.Wrapf(pErr, "config file %s has an invalid connection_string", path)
+	}
+	if cfg.Backend == "" {
+		cfg.Backend = backend
+	} else if cfg.Backend != backend {
+		return nil, errors.Errorf(
+			"config file %s sets backend %s but the connection string is for %s",
+			path, cfg.Backend, backend)
+	}
+	return cfg, nil
+}
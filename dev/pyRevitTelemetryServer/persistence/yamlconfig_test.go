@@ -0,0 +1,132 @@
+package persistence
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// representative config of a server, keys of the json config
+const testYAMLConfig = `
+connection_string: postgres://telemetry@db.local:5432/telemetry?sslmode=verify-full
+script_target: scripts
+event_target: events
+request_timeout: 30s
+read_connection_string: postgres://telemetry@replica.local:5432/telemetry
+
+max_open_conns: 20
+max_idle_conns: 10
+conn_max_lifetime: 1h
+conn_max_idle_time: 10m
+
+tls_enabled: true
+ca_cert_path: /etc/pyrevit/ca.pem
+client_cert_path: /etc/pyrevit/client.pem
+client_key_path: /etc/pyrevit/client.key
+
+retention_days: 90
+retention_interval: 6h
+
+required_fields:
+  - username
+  - meta.schema
+`
+
+func writeTestYAMLConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "telemetry.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("writing config: %v", err)
+	}
+	return path
+}
+
+// log lines printed by the cli logger while loading
+func loadTestYAMLConfig(t *testing.T, content string) (*Config, string, error) {
+	t.Helper()
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+
+	cfg, err := LoadConfigFromYAML(writeTestYAMLConfig(t, content), testLogger)
+	return cfg, output.String(), err
+}
+
+func TestLoadConfigFromYAML(t *testing.T) {
+	cfg, output, err := loadTestYAMLConfig(t, testYAMLConfig)
+	if err != nil {
+		t.Fatalf("loading: %v", err)
+	}
+	expected := &Config{
+		Backend:           Postgres,
+		ConnString:        "postgres://telemetry@db.local:5432/telemetry?sslmode=verify-full",
+		ScriptTarget:      "scripts",
+		EventTarget:       "events",
+		RequestTimeout:    30 * time.Second,
+		ReadConnString:    "postgres://telemetry@replica.local:5432/telemetry",
+		MaxOpenConns:      20,
+		MaxIdleConns:      10,
+		ConnMaxLifetime:   time.Hour,
+		ConnMaxIdleTime:   10 * time.Minute,
+		TLSEnabled:        true,
+		CACertPath:        "/etc/pyrevit/ca.pem",
+		ClientCertPath:    "/etc/pyrevit/client.pem",
+		ClientKeyPath:     "/etc/pyrevit/client.key",
+		RetentionDays:     90,
+		RetentionInterval: 6 * time.Hour,
+		RequiredFields:    []string{"username", "meta.schema"},
+	}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("config is %+v, want %+v", cfg, expected)
+	}
+	if output != "" {
+		t.Errorf("loading a valid config logged %q", output)
+	}
+}
+
+func TestLoadConfigFromYAMLUnknownKeys(t *testing.T) {
+	cfg, output, err := loadTestYAMLConfig(t, "connection_string: \"memory:\"\nretention: 90\npool_size: 5\n")
+	if err != nil {
+		t.Fatalf("loading: %v", err)
+	}
+	if cfg.Backend != Memory {
+		t.Errorf("backend is %s, want %s", cfg.Backend, Memory)
+	}
+	for _, key := range []string{"key=pool_size", "key=retention"} {
+		if !strings.Contains(output, "skipping unknown config key") || !strings.Contains(output, key) {
+			t.Errorf("unknown %s is not logged in %q", key, output)
+		}
+	}
+}
+
+func TestLoadConfigFromYAMLInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		message string
+	}{
+		{"missing connection string", "backend: postgres\n", "is missing connection_string"},
+		{"unknown scheme", "connection_string: oracle://db.local\n", `unsupported connection string scheme "oracle"`},
+		{"backend of other scheme", "backend: mysql\nconnection_string: postgres://db.local\n", "sets backend mysql but the connection string is for postgres"},
+		{"invalid duration", "connection_string: \"memory:\"\nrequest_timeout: soon\n", "is invalid"},
+		{"not yaml", "connection_string: [unclosed\n", "is invalid"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := loadTestYAMLConfig(t, test.content)
+			if err == nil || !strings.Contains(err.Error(), test.message) {
+				t.Errorf("loading fails with %v, want %s", err, test.message)
+			}
+		})
+	}
+
+	if _, err := LoadConfigFromYAML(filepath.Join(t.TempDir(), "missing.yaml"), testLogger); err == nil {
+		t.Error("loading a missing file passed")
+	}
+}